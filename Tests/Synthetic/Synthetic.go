@@ -0,0 +1,637 @@
+// Synthetic runs the whole gonetmon pipeline on fabricated HTTP/1, HTTP/2, WebSocket, DNS, TLS, Redis, memcached and
+// plain TCP traffic, without network devices nor root, exports flow records to a local collector, and records the
+// analysed packets to pcapng files.
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/bytemare/gonetmon"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/http2/hpack"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	local    = "192.168.1.10"
+	remote   = "93.184.216.34"
+	resolver = "192.168.1.1"
+	api      = "10.0.0.20"
+	nbHits   = 50
+	duration = 15 * time.Second
+)
+
+// agents are the User-Agent and Referer headers sent by the remote clients of the local web server
+var agents = []string{
+	"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:68.0) Gecko/20100101 Firefox/68.0\r\nReferer: https://www.search.test/results?q=local\r\n",
+	"User-Agent: Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)\r\n",
+	"User-Agent: curl/7.64.0\r\n",
+	"User-Agent: Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/76.0.3809.100 Safari/537.36\r\n",
+}
+
+// pages are the paths requested by the remote clients of the local web server
+var pages = []string{"/index.html", "/index.html", "/index.html", "/missing", "/api/orders/7"}
+
+// responses are the responses of the web servers, per requested path. Other paths get an empty response.
+var responses = map[string]string{
+	"/section0/page": "HTTP/1.1 200 OK\r\nContent-Type: text/html; charset=utf-8\r\nContent-Length: 20000\r\nCache-Control: no-store\r\n\r\n",
+	"/section1/page": "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Encoding: gzip\r\nContent-Length: 800\r\nCache-Control: public, max-age=60\r\nAge: 12\r\nX-Cache: HIT\r\n\r\n",
+	"/missing":       "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\n\r\n",
+	"/api/orders/7":  "HTTP/1.1 503 Service Unavailable\r\nContent-Length: 0\r\n\r\n",
+	"/section2/page": "HTTP/1.1 304 Not Modified\r\nETag: \"v1\"\r\nCache-Control: max-age=3600\r\nX-Cache: MISS\r\n\r\n",
+}
+
+// exchange fabricates a HTTP request from client to server, with the additional headers, and its response
+func exchange(client, server, host, uri, headers string, port uint16, now time.Time) ([]gopacket.Packet, error) {
+	request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n%s\r\n", uri, host, headers)
+	response, ok := responses[uri]
+	if !ok {
+		response = "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"
+	}
+
+	req, err := gonetmon.NewSyntheticPacket(client, server, port, 80, []byte(request), now)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := gonetmon.NewSyntheticPacket(server, client, 80, port, []byte(response), now)
+	if err != nil {
+		return nil, err
+	}
+
+	return []gopacket.Packet{req, resp}, nil
+}
+
+// u16 appends v to b in big endian
+func u16(b []byte, v int) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// handshake fabricates a TLS 1.2 ClientHello for name from local to the server, and the server's ServerHello
+func handshake(server, name string, port uint16, now time.Time) ([]gopacket.Packet, error) {
+	// Server Name Indication and ALPN extensions
+	sni := u16(u16(u16(nil, 0), len(name)+5), len(name)+3)
+	sni = u16(append(sni, 0), len(name))
+	sni = append(sni, name...)
+	alpn := u16(u16(u16(nil, 16), 5), 3)
+	alpn = append(alpn, 2, 'h', '2')
+
+	hello := func(kind byte, suites []byte, extensions []byte) []byte {
+		body := u16(nil, 0x0303)
+		body = append(body, make([]byte, 32)...) // Random
+		body = append(body, 0)                   // Session ID
+		body = append(body, suites...)
+		body = append(u16(body, len(extensions)), extensions...)
+
+		msg := append([]byte{kind, 0}, u16(nil, len(body))...)
+		record := append([]byte{22, 3, 1}, u16(nil, len(msg)+len(body))...)
+		return append(append(record, msg...), body...)
+	}
+
+	clientHello := hello(1, []byte{0, 4, 0xc0, 0x2f, 0x13, 0x01, 1, 0}, append(sni, alpn...))
+	serverHello := hello(2, []byte{0xc0, 0x2f, 0}, alpn)
+
+	ch, err := gonetmon.NewSyntheticPacket(local, server, port, 443, clientHello, now)
+	if err != nil {
+		return nil, err
+	}
+
+	sh, err := gonetmon.NewSyntheticPacket(server, local, 443, port, serverHello, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return []gopacket.Packet{ch, sh}, nil
+}
+
+// frame returns a HTTP/2 frame
+func frame(typ, flags byte, stream uint32, payload []byte) []byte {
+	f := []byte{byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)), typ, flags}
+	f = append(f, byte(stream>>24), byte(stream>>16), byte(stream>>8), byte(stream))
+	return append(f, payload...)
+}
+
+// h2c fabricates a cleartext HTTP/2 connection with prior knowledge from local to the server, with a request for each
+// path, and the server's responses. Headers are compressed with a single state per direction, as on a real connection.
+// With gRPC, paths are method names, and calls end with a status in trailers : OK, and NOT_FOUND for every other one.
+func h2c(server, authority string, paths []string, grpc bool, port uint16, now time.Time) ([]gopacket.Packet, error) {
+	var reqBuf, resBuf bytes.Buffer
+	reqEncoder, resEncoder := hpack.NewEncoder(&reqBuf), hpack.NewEncoder(&resBuf)
+
+	// The preface and settings, then the requests in another segment
+	preface := append([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), frame(0x4, 0, 0, nil)...)
+	var requests, responses []byte
+	responses = frame(0x4, 0, 0, nil)
+
+	for i, path := range paths {
+		stream := uint32(2*i + 1)
+
+		reqFields := []hpack.HeaderField{{Name: ":method", Value: "GET"}, {Name: ":scheme", Value: "http"},
+			{Name: ":authority", Value: authority}, {Name: ":path", Value: path}}
+		resFields := []hpack.HeaderField{{Name: ":status", Value: "200"}}
+		if grpc {
+			reqFields[0].Value = "POST"
+			reqFields = append(reqFields, hpack.HeaderField{Name: "content-type", Value: "application/grpc"})
+			resFields = append(resFields, hpack.HeaderField{Name: "content-type", Value: "application/grpc"})
+		}
+
+		reqBuf.Reset()
+		for _, f := range reqFields {
+			if err := reqEncoder.WriteField(f); err != nil {
+				return nil, err
+			}
+		}
+		requests = append(requests, frame(0x1, 0x4|0x1, stream, reqBuf.Bytes())...)
+
+		resBuf.Reset()
+		for _, f := range resFields {
+			if err := resEncoder.WriteField(f); err != nil {
+				return nil, err
+			}
+		}
+		responses = append(responses, frame(0x1, 0x4, stream, resBuf.Bytes())...)
+
+		if !grpc {
+			responses = append(responses, frame(0x0, 0x1, stream, []byte("{}"))...)
+			continue
+		}
+
+		status := "0"
+		if i%2 == 1 {
+			status = "5"
+		}
+		resBuf.Reset()
+		if err := resEncoder.WriteField(hpack.HeaderField{Name: "grpc-status", Value: status}); err != nil {
+			return nil, err
+		}
+		responses = append(responses, frame(0x0, 0, stream, []byte{0, 0, 0, 0, 0})...)
+		responses = append(responses, frame(0x1, 0x4|0x1, stream, resBuf.Bytes())...)
+	}
+
+	var packets []gopacket.Packet
+	for _, s := range []struct {
+		src, dst string
+		sp, dp   uint16
+		seq      uint32
+		payload  []byte
+		delay    time.Duration
+	}{
+		{local, server, port, 8080, 1000, preface, 0},
+		{local, server, port, 8080, 1000 + uint32(len(preface)), requests, 0},
+		{server, local, 8080, port, 5000, responses, 15 * time.Millisecond},
+	} {
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(s.sp), DstPort: layers.TCPPort(s.dp), Seq: s.seq, Ack: 1, PSH: true, ACK: true, Window: 65535}
+		p, err := gonetmon.NewSyntheticTCPPacket(s.src, s.dst, tcp, s.payload, now.Add(s.delay))
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p)
+	}
+
+	return packets, nil
+}
+
+// wsFrame returns a WebSocket frame, masked if sent by the client
+func wsFrame(opcode byte, payload []byte, masked bool) []byte {
+	f := []byte{0x80 | opcode, byte(len(payload))}
+	if !masked {
+		return append(f, payload...)
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	f[1] |= 0x80
+	f = append(f, mask...)
+	for i, b := range payload {
+		f = append(f, b^mask[i%4])
+	}
+	return f
+}
+
+// websocket fabricates a WebSocket connection from local to the server, exchanging messages and closing normally
+func websocket(server, host string, port uint16, messages int, now time.Time) ([]gopacket.Packet, error) {
+	request := fmt.Sprintf("GET /chat HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", host)
+	response := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"
+
+	// Segments of each direction, in order
+	fromClient := [][]byte{[]byte(request)}
+	fromServer := [][]byte{[]byte(response)}
+	for i := 0; i < messages; i++ {
+		fromClient = append(fromClient, wsFrame(0x1, []byte("hello"), true))
+		fromServer = append(fromServer, wsFrame(0x1, []byte("welcome"), false))
+	}
+	fromClient = append(fromClient, wsFrame(0x8, []byte{0x03, 0xe8}, true))
+	fromServer = append(fromServer, wsFrame(0x8, []byte{0x03, 0xe8}, false))
+
+	var packets []gopacket.Packet
+	clientSeq, serverSeq := uint32(1), uint32(1)
+	for i := range fromClient {
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(port), DstPort: 80, Seq: clientSeq, Ack: serverSeq, PSH: true, ACK: true, Window: 65535}
+		p, err := gonetmon.NewSyntheticTCPPacket(local, server, tcp, fromClient[i], now)
+		if err != nil {
+			return nil, err
+		}
+		clientSeq += uint32(len(fromClient[i]))
+
+		tcp = &layers.TCP{SrcPort: 80, DstPort: layers.TCPPort(port), Seq: serverSeq, Ack: clientSeq, PSH: true, ACK: true, Window: 65535}
+		q, err := gonetmon.NewSyntheticTCPPacket(server, local, tcp, fromServer[i], now)
+		if err != nil {
+			return nil, err
+		}
+		serverSeq += uint32(len(fromServer[i]))
+
+		packets = append(packets, p, q)
+	}
+
+	return packets, nil
+}
+
+// resp encodes a Redis command as an array of bulk strings
+func resp(args ...string) string {
+	command := fmt.Sprintf("*%d\r\n", len(args))
+	for _, a := range args {
+		command += fmt.Sprintf("$%d\r\n%s\r\n", len(a), a)
+	}
+	return command
+}
+
+// store fabricates a connection from local to a key-value store, each command being replied to 2ms later
+func store(server string, serverPort, port uint16, commands, replies []string, now time.Time) ([]gopacket.Packet, error) {
+	var packets []gopacket.Packet
+	clientSeq, serverSeq := uint32(1), uint32(1)
+	for i := range commands {
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(port), DstPort: layers.TCPPort(serverPort), Seq: clientSeq, Ack: serverSeq, PSH: true, ACK: true, Window: 65535}
+		p, err := gonetmon.NewSyntheticTCPPacket(local, server, tcp, []byte(commands[i]), now)
+		if err != nil {
+			return nil, err
+		}
+		clientSeq += uint32(len(commands[i]))
+
+		tcp = &layers.TCP{SrcPort: layers.TCPPort(serverPort), DstPort: layers.TCPPort(port), Seq: serverSeq, Ack: clientSeq, PSH: true, ACK: true, Window: 65535}
+		q, err := gonetmon.NewSyntheticTCPPacket(server, local, tcp, []byte(replies[i]), now.Add(2*time.Millisecond))
+		if err != nil {
+			return nil, err
+		}
+		serverSeq += uint32(len(replies[i]))
+
+		packets = append(packets, p, q)
+	}
+
+	return packets, nil
+}
+
+// segment is a TCP segment of a fabricated connection
+type segment struct {
+	fromClient bool
+	tcp        *layers.TCP
+	payload    []byte
+	t          time.Time
+}
+
+// connection fabricates a TCP connection from local to the server, with a 30ms handshake round-trip, a segment
+// arriving out of order, a retransmission and a zero window, closed normally or reset by the server
+func connection(server string, port uint16, reset bool, now time.Time) ([]gopacket.Packet, error) {
+	ms := func(n int) time.Time { return now.Add(time.Duration(n) * time.Millisecond) }
+	data := []byte("0123456789")
+
+	segments := []segment{
+		{true, &layers.TCP{SYN: true, Seq: 100, Window: 65535}, nil, ms(0)},
+		{false, &layers.TCP{SYN: true, ACK: true, Seq: 500, Ack: 101, Window: 65535}, nil, ms(30)},
+		{true, &layers.TCP{ACK: true, Seq: 101, Ack: 501, Window: 65535}, nil, ms(30)},
+		{true, &layers.TCP{PSH: true, ACK: true, Seq: 101, Ack: 501, Window: 65535}, data, ms(31)},
+		{true, &layers.TCP{PSH: true, ACK: true, Seq: 121, Ack: 501, Window: 65535}, data, ms(32)},
+		{true, &layers.TCP{PSH: true, ACK: true, Seq: 111, Ack: 501, Window: 65535}, data, ms(33)},
+		{true, &layers.TCP{PSH: true, ACK: true, Seq: 121, Ack: 501, Window: 65535}, data, ms(300)},
+		{false, &layers.TCP{ACK: true, Seq: 501, Ack: 131, Window: 0}, nil, ms(301)},
+		{false, &layers.TCP{PSH: true, ACK: true, Seq: 501, Ack: 131, Window: 65535}, data, ms(340)},
+	}
+	if reset {
+		segments = append(segments, segment{false, &layers.TCP{RST: true, Seq: 511, Window: 0}, nil, ms(400)})
+	} else {
+		segments = append(segments, []segment{
+			{true, &layers.TCP{FIN: true, ACK: true, Seq: 131, Ack: 511, Window: 65535}, nil, ms(400)},
+			{false, &layers.TCP{FIN: true, ACK: true, Seq: 511, Ack: 132, Window: 65535}, nil, ms(430)},
+			{true, &layers.TCP{ACK: true, Seq: 132, Ack: 512, Window: 65535}, nil, ms(460)},
+		}...)
+	}
+
+	var packets []gopacket.Packet
+	for _, s := range segments {
+		src, dst := local, server
+		s.tcp.SrcPort, s.tcp.DstPort = layers.TCPPort(port), 9000
+		if !s.fromClient {
+			src, dst = server, local
+			s.tcp.SrcPort, s.tcp.DstPort = 9000, layers.TCPPort(port)
+		}
+
+		p, err := gonetmon.NewSyntheticTCPPacket(src, dst, s.tcp, s.payload, s.t)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p)
+	}
+
+	return packets, nil
+}
+
+// proxy fabricates requests from local through a forward proxy on port 8080 : an absolute-form GET, and a CONNECT
+// tunnel to name established, carrying data and closed by the client
+func proxy(server, name string, port uint16, now time.Time) ([]gopacket.Packet, error) {
+	ms := func(n int) time.Time { return now.Add(time.Duration(n) * time.Millisecond) }
+	get := []byte("GET http://Example.COM:80/a/b?q=1 HTTP/1.1\r\nHost: Example.COM\r\n\r\n")
+	ok := []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	connect := []byte(fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", name, name))
+	established := []byte("HTTP/1.1 200 Connection established\r\n\r\n")
+	data := make([]byte, 100)
+
+	var packets []gopacket.Packet
+	for i, c := range [][]segment{
+		{
+			{true, &layers.TCP{PSH: true, ACK: true, Seq: 1, Ack: 1, Window: 65535}, get, ms(0)},
+			{false, &layers.TCP{PSH: true, ACK: true, Seq: 1, Ack: 1, Window: 65535}, ok, ms(5)},
+		},
+		{
+			{true, &layers.TCP{PSH: true, ACK: true, Seq: 1, Ack: 1, Window: 65535}, connect, ms(0)},
+			{false, &layers.TCP{PSH: true, ACK: true, Seq: 1, Ack: 1, Window: 65535}, established, ms(5)},
+			{true, &layers.TCP{PSH: true, ACK: true, Seq: 1 + uint32(len(connect)), Ack: 1 + uint32(len(established)), Window: 65535}, data, ms(6)},
+			{false, &layers.TCP{PSH: true, ACK: true, Seq: 1 + uint32(len(established)), Ack: 1 + uint32(len(connect)+len(data)), Window: 65535}, data, ms(20)},
+			{true, &layers.TCP{FIN: true, ACK: true, Seq: 1 + uint32(len(connect)+len(data)), Ack: 1 + uint32(len(established)+len(data)), Window: 65535}, nil, ms(505)},
+		},
+	} {
+		clientPort := port + uint16(i)
+		for _, s := range c {
+			src, dst := local, server
+			s.tcp.SrcPort, s.tcp.DstPort = layers.TCPPort(clientPort), 8080
+			if !s.fromClient {
+				src, dst = server, local
+				s.tcp.SrcPort, s.tcp.DstPort = 8080, layers.TCPPort(clientPort)
+			}
+
+			p, err := gonetmon.NewSyntheticTCPPacket(src, dst, s.tcp, s.payload, s.t)
+			if err != nil {
+				return nil, err
+			}
+			packets = append(packets, p)
+		}
+	}
+
+	return packets, nil
+}
+
+// resolve fabricates a DNS query from local to the resolver, and its answer resolving name to ip
+func resolve(id uint16, name string, ip string, now time.Time) ([]gopacket.Packet, error) {
+	question := layers.DNSQuestion{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN}
+
+	query := &layers.DNS{ID: id, RD: true, Questions: []layers.DNSQuestion{question}}
+	answer := &layers.DNS{ID: id, QR: true, RD: true, RA: true, Questions: []layers.DNSQuestion{question},
+		Answers: []layers.DNSResourceRecord{{Name: []byte(name), Type: layers.DNSTypeA, Class: layers.DNSClassIN, TTL: 300, IP: net.ParseIP(ip)}},
+	}
+
+	var packets []gopacket.Packet
+	for _, m := range []struct {
+		dns      *layers.DNS
+		src, dst string
+		sp, dp   uint16
+		delay    time.Duration
+	}{
+		{query, local, resolver, 53000, 53, 0},
+		{answer, resolver, local, 53, 53000, 20 * time.Millisecond},
+	} {
+		buf := gopacket.NewSerializeBuffer()
+		if err := m.dns.SerializeTo(buf, gopacket.SerializeOptions{FixLengths: true}); err != nil {
+			return nil, err
+		}
+
+		p, err := gonetmon.NewSyntheticUDPPacket(m.src, m.dst, m.sp, m.dp, buf.Bytes(), now.Add(m.delay))
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p)
+	}
+
+	return packets, nil
+}
+
+// fabricate returns a series of HTTP requests and responses between a local client and a remote web server,
+// and between remote clients and a local web server, as well as TLS handshakes, HTTP/2, WebSocket, Redis, memcached
+// and proxied connections from the local client
+func fabricate() ([]gopacket.Packet, error) {
+	now := time.Now()
+
+	// Resolve the remote web server's name
+	packets, err := resolve(1, "example.com", remote, now)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < nbHits; i++ {
+		// We are the client
+		p, err := exchange(local, remote, "example.com", fmt.Sprintf("/section%d/page", i%3), "User-Agent: Go-http-client/1.1\r\n", 50000, now)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p...)
+
+		// We are the server
+		client := fmt.Sprintf("203.0.113.%d", 1+i%4)
+		p, err = exchange(client, local, "www.local.test", pages[i%len(pages)], agents[i%len(agents)], uint16(40000+i), now)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p...)
+
+		// Encrypted traffic from the client
+		p, err = handshake(remote, "secure.example.com", uint16(45000+i), now)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p...)
+
+		// Cleartext HTTP/2 traffic from the client
+		p, err = h2c(api, "api.internal", []string{"/v1/items", fmt.Sprintf("/v1/users/%d", i)}, false, uint16(46000+i), now)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p...)
+
+		// WebSocket connections from the client
+		p, err = websocket(remote, "example.com", uint16(48000+i), 3, now)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p...)
+
+		// gRPC calls from the client
+		p, err = h2c(api, "grpc.internal", []string{"/shop.Catalog/GetItem", "/shop.Catalog/ListItems", "/shop.Cart/Add"}, true, uint16(47000+i), now)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p...)
+
+		// Redis and memcached commands from the client
+		p, err = store(api, 6379, uint16(49000+i),
+			[]string{resp("GET", fmt.Sprintf("user:%d", i)), resp("SET", "session:abc", "payload"), resp("INCR", "session:abc") + "PING\r\n"},
+			[]string{"$5\r\nalice\r\n", "+OK\r\n", "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n+PONG\r\n"}, now)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p...)
+
+		p, err = store(api, 11211, uint16(50000+i),
+			[]string{"set page/home 0 60 5\r\nhello\r\n", "get page/home page/about\r\n"},
+			[]string{"STORED\r\n", "VALUE page/home 0 5\r\nhello\r\nEND\r\n"}, now)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p...)
+
+		// Requests from the client through a forward proxy
+		p, err = proxy(resolver, "secure.example.com:443", uint16(52000+2*i), now)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p...)
+
+		// Plain TCP connections from the client, some of them reset
+		p, err = connection(remote, uint16(51000+i), i%5 == 0, now)
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, p...)
+	}
+
+	return packets, nil
+}
+
+// collect counts the data records of the IPFIX messages received, until reading fails
+func collect(conn net.PacketConn, received chan<- int) {
+	records := 0
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			received <- records
+			return
+		}
+
+		// Walk the sets of the message, data sets have identifiers from 256
+		for offset := 16; offset+4 <= n; {
+			id := binary.BigEndian.Uint16(buf[offset:])
+			length := int(binary.BigEndian.Uint16(buf[offset+2:]))
+			if length < 4 {
+				break
+			}
+			if id >= 256 {
+				size := 47
+				if id == 257 {
+					size = 71
+				}
+				records += (length - 4) / size
+			}
+			offset += length
+		}
+	}
+}
+
+// countRecorded returns the number of packets in the pcapng files of the directory
+func countRecorded(dir string) (int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.pcapng"))
+	if err != nil {
+		return 0, err
+	}
+
+	var packets int
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return packets, err
+		}
+		r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			_ = f.Close()
+			return packets, err
+		}
+		for {
+			if _, _, err = r.ReadPacketData(); err != nil {
+				break
+			}
+			packets++
+		}
+		_ = f.Close()
+		if err != io.EOF {
+			return packets, err
+		}
+	}
+	return packets, nil
+}
+
+func main() {
+	if err := gonetmon.EnableDissectors([]string{"http", "http2", "websocket", "dns", "tls", "redis", "memcached", "tcp"}); err != nil {
+		fmt.Println("Could not enable dissectors :", err)
+		os.Exit(1)
+	}
+
+	// Flow records of the traffic are exported to a local collector
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println("Could not listen for flow records :", err)
+		os.Exit(1)
+	}
+	defer collector.Close()
+	if err := gonetmon.SetFlowExport(collector.LocalAddr().String(), "ipfix", "", 15*time.Second, 60*time.Second); err != nil {
+		fmt.Println("Could not set flow export :", err)
+		os.Exit(1)
+	}
+	received := make(chan int)
+	go collect(collector, received)
+
+	// Remote clients of the local web server are few, and a lot of their requests fail
+	if err := gonetmon.SetClientAlert(200, 40, 30); err != nil {
+		fmt.Println("Could not set client alerts :", err)
+		os.Exit(1)
+	}
+
+	// Analysed packets are recorded to a temporary directory
+	recordings, err := ioutil.TempDir("", "gonetmon-recordings")
+	if err != nil {
+		fmt.Println("Could not create recording directory :", err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(recordings)
+	if err := gonetmon.SetRecording(recordings, "pcapng", 1024*1024, time.Hour, 10*1024*1024); err != nil {
+		fmt.Println("Could not set recording :", err)
+		os.Exit(1)
+	}
+
+	packets, err := fabricate()
+	if err != nil {
+		fmt.Println("Could not fabricate packets :", err)
+		os.Exit(1)
+	}
+
+	source, err := gonetmon.NewSyntheticSource("synthetic", []string{local}, packets)
+	if err != nil {
+		fmt.Println("Could not create source :", err)
+		os.Exit(1)
+	}
+
+	if err := gonetmon.SourcesTest([]gonetmon.CaptureSource{source}, duration); err != nil {
+		os.Exit(1)
+	}
+
+	_ = collector.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	fmt.Println("Flow records received by the collector :", <-received)
+
+	recorded, err := countRecorded(recordings)
+	if err != nil {
+		fmt.Println("Could not read recordings :", err)
+	}
+	fmt.Println("Packets recorded :", recorded)
+}
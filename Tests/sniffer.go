@@ -1,20 +1,207 @@
 // gonetmon is a network monitoring tool.
 // It captures packets on the wire from devices based on given criteria, and displays statistics about traffic.
+//
+// Subcommands :
+//   - interfaces : list candidate interfaces and whether they would be captured on with the given flags
+//   - query : answer a question from the reports and alerts of the store, e.g.
+//     gonetmon -store ./store query -from "2026-10-18 14:00" -to "2026-10-18 15:00" top-hosts
+//     gonetmon -store ./store query -last 6h -host www.example.com status
 package main
 
 import (
 	"flag"
+	"fmt"
 	"github.com/bytemare/gonetmon"
 	log "github.com/sirupsen/logrus"
 	"os"
+	"strings"
 	"time"
 )
 
+// query answers the question of the query subcommand from the store, over its time range
+func query(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	from := fs.String("from", "", "start of the time range, as \"2006-01-02 15:04\" in local time")
+	to := fs.String("to", "", "end of the time range, as \"2006-01-02 15:04\" in local time. Defaults to now")
+	last := fs.Duration("last", time.Hour, "length of the time range ending now, if -from is not given")
+	host := fs.String("host", "", "host to answer for, all hosts if empty")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected one question : top-hosts, status, traffic or alerts")
+	}
+
+	end := time.Now()
+	if *to != "" {
+		t, err := time.ParseInLocation(queryLayout, *to, time.Local)
+		if err != nil {
+			return err
+		}
+		end = t
+	}
+	start := end.Add(-*last)
+	if *from != "" {
+		t, err := time.ParseInLocation(queryLayout, *from, time.Local)
+		if err != nil {
+			return err
+		}
+		start = t
+	}
+
+	return gonetmon.Query(os.Stdout, fs.Arg(0), *host, start, end)
+}
+
+// queryLayout is the layout of times given to the query subcommand
+const queryLayout = "2006-01-02 15:04"
+
+// split returns the comma separated elements of s, or nil if s is empty
+func split(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 func main() {
 	var err error
 	timeout := flag.Int("timeout", 0, "monitoring time in seconds. 0 or none is infinite")
+	source := flag.String("source", "pcap", "where to capture packets from : pcap or afpacket on interfaces, or file to read a pcap file")
+	file := flag.String("file", "", "pcap file to read packets from, with -source=file")
+	interfaces := flag.String("interfaces", "", "comma separated interface name patterns to capture on, '!' prefix excludes, e.g. \"eth*,!docker*\"")
+	networks := flag.String("networks", "", "comma separated networks in CIDR notation, only capture on interfaces carrying an address in them")
+	any := flag.Bool("any", false, "capture on the 'any' pseudo-device instead of individual interfaces")
+	role := flag.String("role", "auto", "role of this host in HTTP exchanges : client, server, or auto to detect it")
+	ports := flag.String("ports", "80,3000,8000,8080", "comma separated TCP ports to capture HTTP traffic on, or 'any' to detect HTTP on any port")
+	protocols := flag.String("protocols", "http", "comma separated protocols to analyse : http, http2, websocket, dns, tls, redis, memcached, tcp")
+	tlsPorts := flag.String("tls-ports", "443", "comma separated TCP ports to capture TLS traffic on, or 'any' to detect TLS on any port")
+	pathDepth := flag.Int("path-depth", 3, "number of URL path segments kept to display the top endpoints of hosts")
+	collector := flag.String("export-collector", "", "address:port of a collector to export flow records of all captured traffic to, over UDP")
+	exportFormat := flag.String("export-format", "ipfix", "format of flow records sent to the collector : ipfix or netflow9")
+	exportJSON := flag.String("export-json", "", "file to append flow records of all captured traffic to, as JSON lines")
+	flowIdle := flag.Int("flow-idle", 15, "seconds without packets after which a flow is exported")
+	flowActive := flag.Int("flow-active", 60, "seconds after which a long lasting flow is exported")
+	clientThreshold := flag.Int("client-threshold", 600, "requests of a single client address over the alert time frame that raise an alert")
+	prefixThreshold := flag.Int("prefix-threshold", 2000, "requests of the addresses of a /24 or /64 network over the alert time frame that raise an alert")
+	clientErrors := flag.Float64("client-error-ratio", 50, "percentage of error responses to a client over the alert time frame that raises an alert")
+	trustedProxies := flag.String("trusted-proxies", "", "comma separated addresses or networks of proxies and load balancers whose X-Forwarded-For tells the client address")
+	alertMode := flag.String("alert-mode", "threshold", "alert on the fixed threshold of hits, on deviations from baselines learned per host, or both : threshold, baseline, both")
+	deviations := flag.Float64("alert-deviations", 3, "standard deviations from the baseline of a host that raise an alert")
+	warmup := flag.Int("alert-warmup", 30, "number of display refreshes to learn baselines from before alerting")
+	store := flag.String("store", "", "directory to store reports and alerts in, and to query. Empty disables it")
+	storeRetention := flag.Int("store-retention", 168, "hours of reports and alerts kept in the store")
+	storeMaxMB := flag.Int64("store-max-mb", 1024, "maximum size of the store in megabytes, at least 16, oldest records are deleted past it")
+	record := flag.String("record", "", "directory to record the packets of analysed traffic in, as pcap or pcapng files. Empty disables it")
+	recordFormat := flag.String("record-format", "pcapng", "format of recording files : pcap or pcapng")
+	recordFileMB := flag.Int64("record-file-mb", 100, "size in megabytes past which a recording file is rotated")
+	recordPeriod := flag.Int("record-period", 60, "minutes after which a recording file is rotated. 0 disables it")
+	recordBudgetMB := flag.Int64("record-budget-mb", 1024, "total size of recording files in megabytes, oldest files are deleted past it")
+	recordOnAlert := flag.Bool("record-on-alert", false, "only record packets while an alert is active")
+	preAlert := flag.Int("record-pre-alert", 30, "seconds of packets before an alert that are recorded with it")
+	output := flag.String("output", "console", "where to display reports : console, or json for lines of JSON on the standard output")
 	flag.Parse()
 
+	if err = gonetmon.SetCaptureSource(*source, *file); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err = gonetmon.EnableDissectors(split(*protocols)); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	portList := split(*ports)
+	if *ports == "any" {
+		portList = nil
+	}
+	if err = gonetmon.SetPorts(portList); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	tlsPortList := split(*tlsPorts)
+	if *tlsPorts == "any" {
+		tlsPortList = nil
+	}
+	if err = gonetmon.SetTLSPorts(tlsPortList); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err = gonetmon.SetFlowExport(*collector, *exportFormat, *exportJSON,
+		time.Duration(*flowIdle)*time.Second, time.Duration(*flowActive)*time.Second); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err = gonetmon.SetPathDepth(*pathDepth); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err = gonetmon.SetClientAlert(*clientThreshold, *prefixThreshold, *clientErrors); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err = gonetmon.SetTrustedProxies(split(*trustedProxies)); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err = gonetmon.SetAlertMode(*alertMode, *deviations, *warmup); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err = gonetmon.SetStore(*store, time.Duration(*storeRetention)*time.Hour, *storeMaxMB*1024*1024); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) == "query" {
+		if err = query(flag.Args()[1:]); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if err = gonetmon.SetRecording(*record, *recordFormat, *recordFileMB*1024*1024,
+		time.Duration(*recordPeriod)*time.Minute, *recordBudgetMB*1024*1024); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err = gonetmon.SetRecordTrigger(*recordOnAlert, time.Duration(*preAlert)*time.Second); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err = gonetmon.SetOutput(*output); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err = gonetmon.SetRole(*role); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if err = gonetmon.SelectInterfaces(split(*interfaces), split(*networks), *any); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+
+	if flag.Arg(0) == "interfaces" {
+		if err = gonetmon.ListInterfaces(os.Stdout); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if *timeout > 0 {
 		log.Info("Started with timeout : ", *timeout)
 		err = gonetmon.SnifferTest(time.Duration(*timeout) * time.Second)
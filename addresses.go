@@ -0,0 +1,155 @@
+package gonetmon
+
+import (
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sirupsen/logrus"
+	"net"
+	"sync"
+)
+
+// Directions of a packet relative to the local host
+const (
+	directionInbound  = "inbound"  // From a remote peer to a local address
+	directionOutbound = "outbound" // From a local address to a remote peer
+	directionInternal = "internal" // Between two local addresses, e.g. on loopback
+	directionTransit  = "transit"  // Between two remote peers, e.g. seen in promiscuous mode or on a bridge
+)
+
+// addressedSource is implemented by capture sources that carry their own set of local addresses,
+// like synthetic sources, whose traffic doesn't belong to the machine's interfaces
+type addressedSource interface {
+	Addresses() []net.IP
+}
+
+// addressSet holds the set of local IPv4 and IPv6 addresses, safe for concurrent use
+type addressSet struct {
+	mu      sync.RWMutex
+	dynamic map[string]struct{} // Addresses of the machine's interfaces, renewed on refresh
+	static  map[string]struct{} // Addresses registered by capture sources, kept across refreshes
+}
+
+// localAddresses is the set of addresses considered local, shared by all capture goroutines
+var localAddresses = newAddressSet()
+
+// newAddressSet returns an empty set of addresses
+func newAddressSet() *addressSet {
+	return &addressSet{
+		dynamic: make(map[string]struct{}),
+		static:  make(map[string]struct{}),
+	}
+}
+
+// interfaceAddresses returns all addresses of all interfaces of the machine, whatever their state
+func interfaceAddresses() (map[string]struct{}, error) {
+	devices, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	addresses := make(map[string]struct{})
+	for i := range devices {
+		addrs, err := devices[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				addresses[ipnet.IP.String()] = struct{}{}
+			}
+		}
+	}
+
+	return addresses, nil
+}
+
+// refresh renews the set of the machine's addresses, and logs any change
+func (s *addressSet) refresh() {
+	addresses, err := interfaceAddresses()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Could not list local addresses.")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for a := range addresses {
+		if _, ok := s.dynamic[a]; !ok {
+			log.Info("New local address ", a)
+		}
+	}
+	for a := range s.dynamic {
+		if _, ok := addresses[a]; !ok {
+			log.Info("Local address removed ", a)
+		}
+	}
+
+	s.dynamic = addresses
+}
+
+// register adds addresses that are to be considered local, regardless of the machine's interfaces
+func (s *addressSet) register(ips []net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ip := range ips {
+		s.static[ip.String()] = struct{}{}
+	}
+}
+
+// contains tells whether the address is local
+func (s *addressSet) contains(ip string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.dynamic[ip]; ok {
+		return true
+	}
+	_, ok := s.static[ip]
+	return ok
+}
+
+// getPorts returns the transport layer source and destination ports of the packet, or 0 if there are none
+func getPorts(packet gopacket.Packet) (uint16, uint16) {
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		return uint16(tcp.SrcPort), uint16(tcp.DstPort)
+	}
+	if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+		return uint16(udp.SrcPort), uint16(udp.DstPort)
+	}
+	return 0, 0
+}
+
+// getEndpoints classifies the packet's direction relative to the local addresses, and returns it with the local and
+// remote IP addresses. When both or none of the endpoints are local, the remote peer is taken to be the one with the
+// lowest port, as servers usually listen on well known ports.
+func getEndpoints(packet gopacket.Packet, local *addressSet) (direction string, localIP string, remoteIP string) {
+	network := packet.NetworkLayer()
+	if network == nil {
+		return directionTransit, "", ""
+	}
+
+	srcEndpoint, dstEndpoint := network.NetworkFlow().Endpoints()
+	src, dst := srcEndpoint.String(), dstEndpoint.String()
+	srcLocal, dstLocal := local.contains(src), local.contains(dst)
+
+	switch {
+	case srcLocal && !dstLocal:
+		return directionOutbound, src, dst
+	case !srcLocal && dstLocal:
+		return directionInbound, dst, src
+	case srcLocal && dstLocal:
+		direction = directionInternal
+	default:
+		direction = directionTransit
+	}
+
+	srcPort, dstPort := getPorts(packet)
+	if srcPort != 0 && srcPort < dstPort {
+		return direction, dst, src
+	}
+	return direction, src, dst
+}
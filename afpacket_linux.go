@@ -0,0 +1,150 @@
+package gonetmon
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/bpf"
+	"sync"
+)
+
+// afpacketSource captures packets on a network interface through a memory mapped AF_PACKET socket, Linux only
+type afpacketSource struct {
+	name    string               // Interface name
+	conf    *captureConfig       // Capture parameters
+	tpacket *afpacket.TPacket    // AF_PACKET socket, set when opened
+	packets chan gopacket.Packet // Channel the packets are delivered on
+	done    chan struct{}        // Closed to stop reading
+	start   sync.Once            // Reading is started on first call to Packets
+	stop    sync.Once            // Protects done from being closed twice
+}
+
+// newAFPacketSource returns a source capturing on the network device with AF_PACKET
+func newAFPacketSource(device string, conf *captureConfig) CaptureSource {
+	return &afpacketSource{
+		name: device,
+		conf: conf,
+	}
+}
+
+// Name returns the interface name
+func (s *afpacketSource) Name() string {
+	return s.name
+}
+
+// Open opens the AF_PACKET socket on the interface, or on all interfaces for the any device
+func (s *afpacketSource) Open() error {
+	opts := []interface{}{afpacket.OptPollTimeout(defAFPacketPollTimeout)}
+
+	// Not binding the socket to an interface captures on all of them
+	if s.name != anyDevice {
+		opts = append(opts, afpacket.OptInterface(s.name))
+	}
+
+	tpacket, err := afpacket.NewTPacket(opts...)
+	if err != nil {
+		return err
+	}
+
+	s.tpacket = tpacket
+	s.packets = make(chan gopacket.Packet)
+	s.done = make(chan struct{})
+	return nil
+}
+
+// SetFilter compiles the BPF filter with libpcap and attaches it to the socket
+func (s *afpacketSource) SetFilter(filter string) error {
+	if s.tpacket == nil {
+		return errors.New("source is not opened")
+	}
+
+	instructions, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, int(s.conf.snapshotLen), filter)
+	if err != nil {
+		return err
+	}
+
+	raw := make([]bpf.RawInstruction, len(instructions))
+	for i, ins := range instructions {
+		raw[i] = bpf.RawInstruction{
+			Op: ins.Code,
+			Jt: ins.Jt,
+			Jf: ins.Jf,
+			K:  ins.K,
+		}
+	}
+
+	return s.tpacket.SetBPF(raw)
+}
+
+// read continuously reads packets from the socket until done, then closes the socket and the channel.
+// The socket is only closed here, so that it is never closed while a read is pending.
+func (s *afpacketSource) read() {
+	defer close(s.packets)
+	defer s.tpacket.Close()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		data, ci, err := s.tpacket.ReadPacketData()
+		if err == afpacket.ErrTimeout {
+			continue
+		}
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"interface": s.name,
+				"error":     err,
+			}).Error("Could not read packet from AF_PACKET socket.")
+			return
+		}
+
+		packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+		packet.Metadata().CaptureInfo = ci
+
+		select {
+		case <-s.done:
+			return
+		case s.packets <- packet:
+		}
+	}
+}
+
+// Packets starts reading from the socket and returns the channel packets are delivered on
+func (s *afpacketSource) Packets() <-chan gopacket.Packet {
+	s.start.Do(func() {
+		go s.read()
+	})
+	return s.packets
+}
+
+// Stats returns the socket's statistics since the last call
+func (s *afpacketSource) Stats() (*CaptureStats, error) {
+	if s.tpacket == nil {
+		return nil, errors.New("source is not opened")
+	}
+
+	_, stats, err := s.tpacket.SocketStats()
+	if err != nil {
+		return nil, err
+	}
+
+	return &CaptureStats{
+		Received: uint64(stats.Packets()),
+		Dropped:  uint64(stats.Drops()),
+	}, nil
+}
+
+// Close stops reading, the socket is then closed by the reading goroutine
+func (s *afpacketSource) Close() {
+	s.stop.Do(func() {
+		if s.done != nil {
+			close(s.done)
+		}
+	})
+}
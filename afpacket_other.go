@@ -0,0 +1,44 @@
+//go:build !linux
+// +build !linux
+
+package gonetmon
+
+import (
+	"errors"
+	"github.com/google/gopacket"
+)
+
+// errAFPacketUnsupported is returned when trying to use AF_PACKET capture outside of Linux
+var errAFPacketUnsupported = errors.New("afpacket capture is only supported on linux")
+
+// afpacketSource is a placeholder on platforms that don't support AF_PACKET sockets
+type afpacketSource struct {
+	name string
+}
+
+// newAFPacketSource returns a source that fails to open, since AF_PACKET is only available on Linux
+func newAFPacketSource(device string, conf *captureConfig) CaptureSource {
+	return &afpacketSource{name: device}
+}
+
+// Name returns the interface name
+func (s *afpacketSource) Name() string { return s.name }
+
+// Open always fails on this platform
+func (s *afpacketSource) Open() error { return errAFPacketUnsupported }
+
+// SetFilter always fails on this platform
+func (s *afpacketSource) SetFilter(filter string) error { return errAFPacketUnsupported }
+
+// Packets returns a closed channel
+func (s *afpacketSource) Packets() <-chan gopacket.Packet {
+	c := make(chan gopacket.Packet)
+	close(c)
+	return c
+}
+
+// Stats always fails on this platform
+func (s *afpacketSource) Stats() (*CaptureStats, error) { return nil, errAFPacketUnsupported }
+
+// Close does nothing
+func (s *afpacketSource) Close() {}
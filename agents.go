@@ -0,0 +1,290 @@
+package gonetmon
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Families of User-Agents
+const (
+	agentBrowser = "browser"
+	agentBot     = "bot"
+	agentLibrary = "library"
+	agentOther   = "other"
+	agentNone    = "none"
+)
+
+// otherKey counts the keys past the maximum number of keys of a client analytics table
+const otherKey = "(other)"
+
+// knownCrawlers are the product tokens of well known crawlers, matched case insensitively
+var knownCrawlers = []string{
+	"Googlebot", "bingbot", "Baiduspider", "YandexBot", "DuckDuckBot", "Slurp", "Applebot", "facebookexternalhit",
+	"Twitterbot", "LinkedInBot", "AhrefsBot", "SemrushBot", "MJ12bot", "DotBot", "PetalBot", "GPTBot", "CCBot",
+}
+
+// knownLibraries are the product tokens of HTTP client libraries and command line tools
+var knownLibraries = []string{
+	"curl", "Wget", "python-requests", "python-urllib", "aiohttp", "Go-http-client", "Java", "Apache-HttpClient",
+	"okhttp", "axios", "node-fetch", "undici", "libwww-perl", "PostmanRuntime", "HTTPie", "Ruby", "grpc-go",
+}
+
+// botMarkers are found in the User-Agents of crawlers that are not known by name
+var botMarkers = []string{"bot", "crawler", "spider", "scrape"}
+
+// browserTokens are the product tokens of browsers, most specific first since they mention each other
+var browserTokens = []string{"Edg", "OPR", "Firefox", "Chrome", "Safari"}
+
+// matchToken returns the first of the tokens found in the lower case User-Agent
+func matchToken(lower string, tokens []string) (string, bool) {
+	for _, t := range tokens {
+		if strings.Contains(lower, strings.ToLower(t)) {
+			return t, true
+		}
+	}
+	return "", false
+}
+
+// classifyAgent returns the family of the User-Agent, the name of its crawler, library or browser, and whether it
+// is a known crawler
+func classifyAgent(ua string) (family string, name string, crawler bool) {
+	if ua == "" {
+		return agentNone, agentNone, false
+	}
+	lower := strings.ToLower(ua)
+
+	if name, ok := matchToken(lower, knownCrawlers); ok {
+		return agentBot, name, true
+	}
+
+	// Libraries announce themselves with their product token first
+	for _, l := range knownLibraries {
+		if strings.HasPrefix(lower, strings.ToLower(l)) {
+			return agentLibrary, l, false
+		}
+	}
+
+	for _, m := range botMarkers {
+		if strings.Contains(lower, m) {
+			return agentBot, productName(ua), false
+		}
+	}
+
+	if strings.HasPrefix(ua, "Mozilla/") {
+		if name, ok := matchToken(lower, browserTokens); ok {
+			return agentBrowser, name, false
+		}
+		return agentBrowser, "Mozilla", false
+	}
+
+	return agentOther, productName(ua), false
+}
+
+// productName returns the first product of a User-Agent, without its version
+func productName(ua string) string {
+	name := ua
+	if idx := strings.IndexAny(name, "/ ;("); idx > 0 {
+		name = name[:idx]
+	}
+	if len(name) > defMaxAgentName {
+		name = name[:defMaxAgentName]
+	}
+	return name
+}
+
+// refererSource returns the host and path of the page that referred the request, without query nor fragment
+func refererSource(referer string) (string, bool) {
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+
+	source := normalizeHost(u.Host, strings.ToLower(u.Scheme)) + u.EscapedPath()
+	if len(source) > defMaxAgentName {
+		source = source[:defMaxAgentName]
+	}
+	return source, true
+}
+
+// trustedProxy tells whether the address belongs to a trusted proxy or load balancer
+func trustedProxy(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, n := range config.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddress returns the address of the client that sent the request : the peer that sent it, or behind trusted
+// proxies and load balancers, the address X-Forwarded-For tells they received it from. Each proxy appends the
+// address of its own peer, so addresses are read from the last one, and only while they were added by trusted proxies.
+func clientAddress(p *MetaPacket) string {
+	client := p.deviceIP
+	if p.role == roleServer {
+		client = p.remoteIP
+	}
+
+	forwarded := strings.Split(strings.Join(p.request.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && trustedProxy(client); i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(address) == nil {
+			break
+		}
+		client = address
+	}
+	return client
+}
+
+// clientAnalytics counts who is sending requests : User-Agent families and names, referers, client addresses and
+// known crawlers
+type clientAnalytics struct {
+	requests int
+	families map[string]int
+	agents   map[string]int
+	referers map[string]int
+	clients  map[string]int
+	crawlers map[string]int
+}
+
+// newClientAnalytics returns empty client analytics
+func newClientAnalytics() *clientAnalytics {
+	return &clientAnalytics{
+		families: make(map[string]int),
+		agents:   make(map[string]int),
+		referers: make(map[string]int),
+		clients:  make(map[string]int),
+		crawlers: make(map[string]int),
+	}
+}
+
+// countKey counts the key in the table, or in otherKey once the table holds the maximum number of keys
+func countKey(m map[string]int, key string) {
+	if _, ok := m[key]; !ok && len(m) >= defMaxClientKeys {
+		key = otherKey
+	}
+	m[key]++
+}
+
+// add counts the request
+func (c *clientAnalytics) add(p *MetaPacket) {
+	c.requests++
+
+	family, name, crawler := classifyAgent(p.request.UserAgent())
+	c.families[family]++
+	countKey(c.agents, name)
+	if crawler {
+		countKey(c.crawlers, name)
+	}
+
+	if source, ok := refererSource(p.request.Referer()); ok {
+		countKey(c.referers, source)
+	}
+	countKey(c.clients, clientAddress(p))
+}
+
+// rankedCount is an element of a table and its count
+type rankedCount struct {
+	name  string
+	count int
+}
+
+// topCounts returns the n elements of the table with the highest counts
+func topCounts(m map[string]int, n int) []rankedCount {
+	ranked := make([]rankedCount, 0, len(m))
+	for name, count := range m {
+		ranked = append(ranked, rankedCount{name: name, count: count})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].count != ranked[j].count {
+			return ranked[i].count > ranked[j].count
+		}
+		return ranked[i].name < ranked[j].name
+	})
+
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// buildRankedOutput returns a string representation of the elements and their count, in rank order
+func buildRankedOutput(ranked []rankedCount) string {
+	var output string
+	for _, r := range ranked {
+		output += fmt.Sprintf("%s(%d) ", r.name, r.count)
+	}
+	return output
+}
+
+// clientReport holds the top elements of client analytics
+type clientReport struct {
+	scope    string
+	requests int
+	families []rankedCount
+	agents   []rankedCount
+	referers []rankedCount
+	clients  []rankedCount
+	crawlers []rankedCount
+}
+
+// report returns the top elements of the client analytics, with scope telling what they cover
+func (c *clientAnalytics) report(scope string) *clientReport {
+	n := config.nbClients
+	return &clientReport{
+		scope:    scope,
+		requests: c.requests,
+		families: topCounts(c.families, len(c.families)),
+		agents:   topCounts(c.agents, n),
+		referers: topCounts(c.referers, n),
+		clients:  topCounts(c.clients, n),
+		crawlers: topCounts(c.crawlers, n),
+	}
+}
+
+// Render returns a string representation of the client analytics
+func (r *clientReport) Render() string {
+	output := fmt.Sprintf(reportAgents+"\n", r.scope, r.requests, buildRankedOutput(r.families))
+	output += fmt.Sprintf(reportAgentNames+"\n", buildRankedOutput(r.agents))
+	if len(r.referers) > 0 {
+		output += fmt.Sprintf(reportReferers+"\n", buildRankedOutput(r.referers))
+	}
+	output += fmt.Sprintf(reportClientIPs+"\n", buildRankedOutput(r.clients))
+	if len(r.crawlers) > 0 {
+		output += fmt.Sprintf(reportCrawlers+"\n", buildRankedOutput(r.crawlers))
+	}
+	return output
+}
+
+// SetTrustedProxies sets the proxies and load balancers, as addresses or networks in CIDR notation, whose
+// X-Forwarded-For header tells the address of clients. Without any, X-Forwarded-For is ignored.
+func SetTrustedProxies(proxies []string) error {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, p := range proxies {
+		p = strings.TrimSpace(p)
+		if ip := net.ParseIP(p); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy '%s', must be an address or a network in CIDR notation", p)
+		}
+		networks = append(networks, network)
+	}
+
+	config.trustedProxies = networks
+	return nil
+}
@@ -0,0 +1,46 @@
+package gonetmon
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientAddress(t *testing.T) {
+	saved := config.trustedProxies
+	defer func() { config.trustedProxies = saved }()
+	if err := SetTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		want      string
+	}{
+		{"direct client", "203.0.113.5", nil, "203.0.113.5"},
+		{"untrusted peer", "203.0.113.5", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"trusted proxy", "192.168.1.1", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"spoofed first address", "192.168.1.1", []string{"1.2.3.4, 198.51.100.7"}, "198.51.100.7"},
+		{"chain of trusted proxies", "10.0.0.1", []string{"198.51.100.7, 10.1.2.3"}, "198.51.100.7"},
+		{"several headers", "10.0.0.1", []string{"1.2.3.4", "198.51.100.7"}, "198.51.100.7"},
+		{"all trusted", "10.0.0.1", []string{"10.1.2.3"}, "10.1.2.3"},
+		{"invalid address", "10.0.0.1", []string{"198.51.100.7, unknown"}, "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		p := &MetaPacket{
+			role:     roleServer,
+			request:  &http.Request{Header: http.Header{"X-Forwarded-For": tt.forwarded}},
+			remoteIP: tt.peer,
+			deviceIP: "192.168.1.20",
+		}
+		if got := clientAddress(p); got != tt.want {
+			t.Errorf("%s : client %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	if err := SetTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("invalid network accepted")
+	}
+}
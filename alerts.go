@@ -0,0 +1,127 @@
+package gonetmon
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// watchdogAlert is the key of the alert of the watchdog on the total hits
+const watchdogAlert = "watchdog"
+
+// alerter is the path every alert and recovery takes to display, and it never blocks monitoring. At most
+// defAlertsPerWindow alerts are sent per report window, the others are held and summed up at the end of the window,
+// and messages display can't keep up with are dropped. Recording is triggered while any alert is active. It's shared
+// by the watchdog and monitoring routines.
+type alerter struct {
+	mutex       sync.Mutex
+	alertChan   chan<- alertMsg
+	triggerChan chan bool       // Tells recording whether alerts are active, nil if it's not triggered by alerts
+	active      map[string]bool // Maps the keys of active alerts to whether they were sent
+	sent        int             // Number of alerts sent in the current report window
+	held        int             // Number of alerts and recoveries held in the current report window
+	since       time.Time       // Start of the current report window
+	dropped     int             // Number of messages display could not keep up with, since last logged
+}
+
+// newAlerter returns an alerter sending to alertChan and triggerChan, with no active alert
+func newAlerter(alertChan chan<- alertMsg, triggerChan chan bool) *alerter {
+	return &alerter{
+		alertChan:   alertChan,
+		triggerChan: triggerChan,
+		active:      make(map[string]bool),
+		since:       time.Now(),
+	}
+}
+
+// send hands the message to display, or drops it if display can't keep up
+func (a *alerter) send(m alertMsg) {
+	select {
+	case a.alertChan <- m:
+	default:
+		a.dropped++
+	}
+}
+
+// trigger tells recording whether alerts are active. If it can't keep up, the oldest state is replaced so that the
+// latest one always gets through.
+func (a *alerter) trigger(alert bool) {
+	if a.triggerChan == nil {
+		return
+	}
+	for {
+		select {
+		case a.triggerChan <- alert:
+			return
+		default:
+		}
+		select {
+		case <-a.triggerChan:
+		default:
+		}
+	}
+}
+
+// notify raises or recovers the alert of the key. Alerts past the limit of the report window are held, and so are
+// the recoveries of alerts that were held : there are never more recoveries sent than alerts.
+func (a *alerter) notify(key string, m alertMsg) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	sent, active := a.active[key]
+	if m.recovery {
+		if !active {
+			return
+		}
+		delete(a.active, key)
+		if len(a.active) == 0 {
+			a.trigger(false)
+		}
+		if !sent {
+			a.held++
+			return
+		}
+		a.send(m)
+		return
+	}
+
+	if active {
+		return
+	}
+	if len(a.active) == 0 {
+		a.trigger(true)
+	}
+	sent = a.sent < defAlertsPerWindow
+	a.active[key] = sent
+	if !sent {
+		a.held++
+		return
+	}
+	a.sent++
+	a.send(m)
+}
+
+// endWindow sums up the alerts and recoveries held in the report window ending at t, and starts a new window.
+// It returns the number of active alerts.
+func (a *alerter) endWindow(t time.Time) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.held > 0 {
+		a.send(alertMsg{
+			recovery:  len(a.active) == 0,
+			body:      fmt.Sprintf(defAlertsHeldFormat, a.held, a.since.Format(defTimeLayout), len(a.active), t.Format(defTimeLayout)),
+			timestamp: t,
+		})
+	}
+	if a.dropped > 0 {
+		log.WithFields(logrus.Fields{
+			"dropped": a.dropped,
+		}).Error("Display could not keep up with alerts.")
+	}
+
+	a.sent, a.held, a.dropped = 0, 0, 0
+	a.since = t
+	return len(a.active)
+}
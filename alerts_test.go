@@ -0,0 +1,124 @@
+package gonetmon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// drain returns the messages waiting on the channel
+func drain(c chan alertMsg) []alertMsg {
+	var messages []alertMsg
+	for {
+		select {
+		case m := <-c:
+			messages = append(messages, m)
+		default:
+			return messages
+		}
+	}
+}
+
+func TestAlerterLimits(t *testing.T) {
+	c := make(chan alertMsg, defAlertBufSize)
+	a := newAlerter(c, nil)
+	now := time.Now()
+
+	// Alerts past the limit of the window are held, raising an active alert again does nothing
+	for i := 0; i < defAlertsPerWindow+5; i++ {
+		a.notify(fmt.Sprint("client ", i), alertMsg{body: "alert"})
+	}
+	a.notify("client 0", alertMsg{body: "alert"})
+	if sent := len(drain(c)); sent != defAlertsPerWindow {
+		t.Errorf("%d alerts sent, want %d", sent, defAlertsPerWindow)
+	}
+
+	// Recoveries of sent alerts are always sent, those of held alerts are held
+	a.notify("client 0", alertMsg{recovery: true, body: "recovery"})
+	a.notify(fmt.Sprint("client ", defAlertsPerWindow), alertMsg{recovery: true, body: "recovery"})
+	a.notify("unknown", alertMsg{recovery: true, body: "recovery"})
+	if messages := drain(c); len(messages) != 1 || !messages[0].recovery {
+		t.Errorf("recoveries sent %v, want one", messages)
+	}
+
+	// Held messages are summed up at the end of the window
+	since := a.since
+	if active := a.endWindow(now); active != defAlertsPerWindow+3 {
+		t.Errorf("%d active alerts, want %d", active, defAlertsPerWindow+3)
+	}
+	summary := drain(c)
+	want := fmt.Sprintf(defAlertsHeldFormat, 6, since.Format(defTimeLayout), defAlertsPerWindow+3, now.Format(defTimeLayout))
+	if len(summary) != 1 || summary[0].recovery || summary[0].body != want {
+		t.Errorf("summary %v, want the alert %q", summary, want)
+	}
+
+	// A new window sends alerts again, and nothing is summed up without held messages
+	a.notify("client new", alertMsg{body: "alert"})
+	a.endWindow(now.Add(time.Second))
+	if messages := drain(c); len(messages) != 1 {
+		t.Errorf("messages %v, want the alert only", messages)
+	}
+}
+
+func TestAlerterNeverBlocks(t *testing.T) {
+	c := make(chan alertMsg, 1)
+	a := newAlerter(c, nil)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			a.notify(fmt.Sprint("client ", i), alertMsg{body: "alert"})
+		}
+		a.endWindow(time.Now())
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("alerter blocked on a full channel")
+	}
+	if len(drain(c)) != 1 {
+		t.Errorf("want the first alert only")
+	}
+}
+
+func TestAlerterTrigger(t *testing.T) {
+	c := make(chan alertMsg, defAlertBufSize)
+	trigger := make(chan bool, 1)
+	a := newAlerter(c, trigger)
+
+	// Any alert triggers recording, not only the watchdog's, and it stops with the last recovery
+	a.notify("baseline www.example.com hits", alertMsg{body: "alert"})
+	if state := <-trigger; !state {
+		t.Error("want recording triggered by a baseline alert")
+	}
+	a.notify("client 192.0.2.1", alertMsg{body: "alert"})
+	a.notify("baseline www.example.com hits", alertMsg{recovery: true, body: "recovery"})
+	select {
+	case state := <-trigger:
+		t.Errorf("got trigger %v while a client alert is still active", state)
+	default:
+	}
+	a.notify("client 192.0.2.1", alertMsg{recovery: true, body: "recovery"})
+	if state := <-trigger; state {
+		t.Error("want recording stopped after the last recovery")
+	}
+
+	// Without a reader, sends don't block and the latest state wins
+	done := make(chan struct{})
+	go func() {
+		a.notify(watchdogAlert, alertMsg{body: "alert"})
+		a.notify(watchdogAlert, alertMsg{recovery: true, body: "recovery"})
+		a.notify(watchdogAlert, alertMsg{body: "alert"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("alerter blocked on a full trigger channel")
+	}
+	if state := <-trigger; !state {
+		t.Error("want the latest state, an active alert")
+	}
+}
@@ -1,9 +1,7 @@
 package gonetmon
 
 import (
-	"errors"
 	"github.com/google/gopacket"
-	"github.com/sirupsen/logrus"
 	"net/http"
 	"sort"
 	"strings"
@@ -21,8 +19,19 @@ const (
 type MetaPacket struct {
 	messageType string // Either request or response
 	device      string // Interface on which the packet was recorded
-	deviceIP    string // IP address of local network device interface
+	direction   string // Direction of the packet relative to the local host
+	deviceIP    string // Local IP address of the packet
 	remoteIP    string // IP address or remote peer
+	localPort   uint16 // Local TCP port
+	remotePort  uint16 // TCP port of remote peer
+	flow        string // Identifier of the connection the packet belongs to
+	role        string // Role of the local host in the exchange, client or server
+
+	// Time between the request and the response, when both were seen on a HTTP/2 stream
+	latency time.Duration
+
+	// Target of the tunnel the message requests to a proxy or establishes, if any
+	tunnel string
 
 	// Request information
 	request *http.Request
@@ -36,15 +45,19 @@ type MetaPacket struct {
 
 // NewMetaPacket returns a new struct initialised with values from the packetMsg
 func NewMetaPacket(data *packetMsg) *MetaPacket {
-	return &MetaPacket{
+	p := &MetaPacket{
 		messageType: "",
 		device:      data.device,
+		direction:   data.direction,
 		deviceIP:    data.deviceIP,
 		remoteIP:    data.remoteIP,
 		request:     nil,
 		response:    nil,
 		packet:      data.rawPacket,
 	}
+	p.localPort, p.remotePort = getLocalPorts(p)
+	p.flow = getFlowKey(p)
+	return p
 }
 
 // sectionStats holds all the available information about a section
@@ -53,6 +66,7 @@ type sectionStats struct {
 	nbHits  int    // Number of requests that were made for that section
 	// Associated statistics
 	nbMethods map[string]uint // Map request methods to the number of times they were encountered
+	responses *responseStats  // Statistics about the responses to requests for that section
 }
 
 // sections implements sort.Interface based on the hits of sectionStats
@@ -65,28 +79,62 @@ func (s sortedSections) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 // hostStats holds information about traffic with a host
 type hostStats struct {
 	host     string                   // Domain name
-	ips      []string                 // IP addresses that were encountered for that host (sort of a local DNS cache)
+	role     string                   // Role of the local host : client of a remote host, or server of a local virtual host
+	ips      []string                 // IP addresses that were encountered for that host (sort of a local DNS cache), or of its clients if local
 	hits     int                      // Number of successfully recognised packets associated with that host
+	clients  map[string]uint          // Map client IP addresses to the number of requests they made, if the host is local
+	ports    map[uint16]uint          // Map the TCP ports the host was served on to the number of requests
 	sections map[string]*sectionStats // Statistics about requested sections of that host
+	paths    *pathTree                // Requests counted at every level of their URL path
+	agents   *clientAnalytics         // Who sent the requests to that host
 	// Statistics about responses on that host
-	nbStatus map[int]uint // Map status codes to the number of times they were encountered
+	nbStatus  map[int]uint    // Map status codes to the number of times they were encountered
+	grpcCodes map[string]uint // Map gRPC status names to the number of calls that ended with it
+	responses *responseStats  // Content, size and cache signals of responses
+}
+
+// clientStats holds information about a remote client of local virtual hosts
+type clientStats struct {
+	ip    string          // IP address of the client
+	hits  int             // Number of requests made by the client
+	hosts map[string]uint // Map local virtual hosts to the number of requests the client made to them
 }
 
+// sortedClients implements sort.Interface based on the hits of clientStats
+type sortedClients []*clientStats
+
+func (c sortedClients) Len() int           { return len(c) }
+func (c sortedClients) Less(i, j int) bool { return c[i].hits > c[j].hits }
+func (c sortedClients) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
 // analysis holds accumulated data during a time frame between two display refreshes
 type analysis struct {
 	//packets []*MetaPacket			// The set of packets for this analysis
-	traffic map[string]int64 // maps device name and corresponding amount of bits
-	nbHosts int
-	hosts   map[string]*hostStats
+	traffic    map[string]int64 // maps device name and corresponding amount of bits
+	directions map[string]int   // maps packet direction to the number of packets
+	nbHosts    int
+	hosts      map[string]*hostStats
+	clients    map[string]*clientStats     // Remote clients of local virtual hosts
+	grpc       map[string]*grpcMethodStats // Statistics about calls of gRPC methods
+	tunnels    map[string]*tunnelStats     // Statistics about tunnels requested to proxies, per target
+	agents     *clientAnalytics            // Who sent the requests to all hosts
+	flows      *flowHosts                  // Hosts requested on each connection, carried over from one analysis to the next
+	sections   *flowHosts                  // Sections requested on each connection, carried over alike
+	endpoints  *flowHosts                  // Endpoints requested on each connection, carried over alike
+
+	endpointErrors map[string]*endpointErrors // Status classes of the responses of each endpoint of all hosts
 	//lastSeenHost *hostStats
 }
 
-// report holds the final result of an analysis, to be sent out to display()
+// report holds the final result of the analyses of all dissectors, to be sent out to display()
 type report struct {
-	topHost      *hostStats
-	sections     []*sectionStats
+	protocols    []protocolReport // Sections of the enabled dissectors, in configuration order
 	watchdogHits int
-	traffic      map[string]int64
+	alerts       int           // Number of alerts active at the end of the window : watchdog, clients and baselines
+	talkers      []talker      // Client addresses with the most requests over the alert time frame
+	networks     []talker      // Client networks with the most requests over the alert time frame
+	window       historySample // Traffic of the window the report covers, for history
+	hosts        []storedHost  // Traffic of every host over the window, for the store
 	timestamp    time.Time
 }
 
@@ -110,10 +158,15 @@ func (a *analysis) updateSectionStats(hostname string, sectionName string, req *
 	section.nbMethods[method]++
 }
 
-// updateResponseStats updates data for hostname with relevant data
-func (a *analysis) updateResponseStats(hostname string, res *http.Response) {
+// updateResponseStats updates data for hostname, and the requested section if it is known, with relevant data
+func (a *analysis) updateResponseStats(hostname string, sectionName string, role string, res *http.Response) {
 
-	host := a.hosts[hostname]
+	// The request may have been registered in a previous analysis
+	host, ok := a.hosts[hostname]
+	if !ok {
+		host = newHostStats(hostname, role)
+		a.hosts[hostname] = host
+	}
 	host.hits++
 	//a.lastSeenHost = host
 
@@ -123,6 +176,20 @@ func (a *analysis) updateResponseStats(hostname string, res *http.Response) {
 		host.nbStatus[status] = 0
 	}
 	host.nbStatus[status]++
+	if status == http.StatusOK && isGRPC(res.Header) {
+		host.grpcCodes[grpcStatus(res)]++
+	}
+	host.responses.add(res)
+
+	if sectionName == "" {
+		return
+	}
+	section, ok := host.sections[sectionName]
+	if !ok {
+		section = newSectionStats(sectionName)
+		host.sections[sectionName] = section
+	}
+	section.responses.add(res)
 }
 
 // newSectionStats returns an empty set of statistics about a section
@@ -131,29 +198,55 @@ func newSectionStats(section string) *sectionStats {
 		section:   section,
 		nbHits:    0,
 		nbMethods: make(map[string]uint),
+		responses: newResponseStats(),
 	}
 }
 
 // newHostStats returns an empty set of statistics about a host
-func newHostStats(host string) *hostStats {
+func newHostStats(host string, role string) *hostStats {
 	return &hostStats{
-		host:     host,
-		ips:      []string{},
-		hits:     0,
-		sections: make(map[string]*sectionStats),
-		nbStatus: make(map[int]uint),
+		host:      host,
+		role:      role,
+		ips:       []string{},
+		hits:      0,
+		clients:   make(map[string]uint),
+		ports:     make(map[uint16]uint),
+		sections:  make(map[string]*sectionStats),
+		paths:     newPathTree(config.packetFilter.pathDepth, defMaxPathNodes),
+		agents:    newClientAnalytics(),
+		nbStatus:  make(map[int]uint),
+		grpcCodes: make(map[string]uint),
+		responses: newResponseStats(),
 	}
 }
 
 // getHost returns the domain name from a http request, and attempts to do so for a http response.
 // There's no standard trace of the remote host in the Response header,
-// so the only way that's left is to see if we can match the remote address with a host's address we've already seen
-// before with a request
-func getHost(p *MetaPacket, a *analysis) (string, error) {
+// so we look for the host that was last requested on the same connection, and if we are the client, we can
+// see if we can match the remote address with a host's address we've already seen before with a request,
+// or with a name it was resolved for in DNS traffic. As a last resort, the address of the server is the host : the
+// remote address, or the local one if we are the server.
+func getHost(p *MetaPacket, a *analysis) string {
 
-	// If it's a request, it's in the header
+	// If it's a request, it's in the header, or in the target for proxies
 	if p.messageType == httpRequest {
-		return p.request.Host, nil
+		return normalizeHost(p.request.Host, requestScheme(p.request))
+	}
+
+	// HTTP/2 responses are tied to their request by their stream
+	if p.response.Request != nil && p.response.Request.Host != "" {
+		return normalizeHost(p.response.Request.Host, requestScheme(p.response.Request))
+	}
+
+	// The request was seen on the same connection
+	if host, ok := a.flows.get(p.flow); ok {
+		return host
+	}
+
+	// As a server, all virtual hosts share the local addresses, so there's nothing more to match on
+	if p.role == roleServer {
+		log.Info("HTTP response matches no known request, using the local address : ", p.deviceIP)
+		return p.deviceIP
 	}
 
 	// Verify if the ip corresponds to the last encountered host
@@ -167,26 +260,65 @@ func getHost(p *MetaPacket, a *analysis) (string, error) {
 	for host, stat := range a.hosts {
 		for _, ip := range stat.ips {
 			if strings.Compare(ip, p.remoteIP) == 0 {
-				return host, nil
+				return host
 			}
 		}
 	}
 
-	// If no previous host was found, we don't yet have a way to reliably return a host
-	return "nil", errors.New("error : http response remote IP matches no known host")
+	// The address may have been resolved for a name, even if we never saw a request for it
+	if name, ok := nameCache.lookup(p.remoteIP, p.packet.Metadata().Timestamp); ok {
+		return name
+	}
+
+	// If no previous host was found, we don't have a way to reliably return a name
+	log.Info("HTTP response remote IP matches no known host, using the address : ", p.remoteIP)
+	return p.remoteIP
 }
 
-// getSection extracts the section from a HTTP Request's URI
+// getSection extracts the section from a HTTP Request's URI : its first path segment, templated if it identifies
+// a resource. For gRPC, the section is the full method name.
 func getSection(req *http.Request) string {
-	uri := req.RequestURI
-	if idx := strings.IndexByte(uri[1:], '/'); idx >= 0 {
-		uri = uri[:idx+1]
+	uri := requestPath(req)
+	if isGRPC(req.Header) {
+		if idx := strings.IndexByte(uri, '?'); idx >= 0 {
+			uri = uri[:idx]
+		}
+		return uri
+	}
+
+	segments := pathSegments(uri)
+	if len(segments) == 0 {
+		return "/"
+	}
+	return "/" + segments[0]
+}
+
+// getResponseSection returns the section of the request a response answers, or an empty string if it is unknown
+func getResponseSection(p *MetaPacket, a *analysis) string {
+	// HTTP/2 responses are tied to their request by their stream
+	if p.response.Request != nil && p.response.Request.URL != nil {
+		return getSection(p.response.Request)
 	}
-	// Sometimes requests will hold values, skip them
-	if idx := strings.IndexByte(uri[1:], '?'); idx >= 0 {
-		uri = uri[:idx+1]
+
+	section, _ := a.sections.get(p.flow)
+	return section
+}
+
+// updateClientStats updates statistics about a remote client requesting a local virtual host
+func (a *analysis) updateClientStats(host string, clientIP string) {
+	client, ok := a.clients[clientIP]
+	if !ok {
+		client = &clientStats{
+			ip:    clientIP,
+			hits:  0,
+			hosts: make(map[string]uint),
+		}
+		a.clients[clientIP] = client
 	}
-	return uri
+	client.hits++
+	client.hosts[host]++
+
+	a.hosts[host].clients[clientIP]++
 }
 
 // registerHostElements adds new remote IP and section to a host if they were not present
@@ -234,29 +366,41 @@ func (a *analysis) updateTraffic(p *MetaPacket) {
 func (a *analysis) updateAnalysis(p *MetaPacket) {
 
 	a.updateTraffic(p)
+	a.directions[p.direction]++
+
+	p.role = getRole(p)
 
-	// If it is a response, we must have seen the corresponding host before, or we cannot work with it
+	// Tunnels are not requests to the proxy's host
+	if p.tunnel != "" {
+		a.updateTunnelStats(p)
+		return
+	}
+
+	// If it is a response, the host is the one of its request, or the address of the server
 	if p.messageType == httpResponse {
-		host, err := getHost(p, a)
-		if err != nil {
-			log.WithFields(logrus.Fields{
-				"remote IP": p.remoteIP,
-			}).Error(err)
-			return
+		host := getHost(p, a)
+		a.updateResponseStats(host, getResponseSection(p, a), p.role, p.response)
+		a.updateEndpointErrors(host, p)
+		if isGRPC(p.response.Header) {
+			a.updateGRPCStats(p)
 		}
-		a.updateResponseStats(host, p.response)
 	} else {
 
 		// Here, it is a request
-		host, _ := getHost(p, a)
+		host := getHost(p, a)
 		section := getSection(p.request)
 
+		// Remember the host for the response on the same connection
+		a.flows.set(p.flow, host)
+		a.sections.set(p.flow, section)
+		a.endpoints.set(p.flow, endpointPath(p.request))
+
 		hosts := a.hosts
 
 		// If host not registered, create new
 		if _, ok := a.hosts[host]; !ok {
 			// Register new host and section
-			hosts[host] = newHostStats(host)
+			hosts[host] = newHostStats(host, p.role)
 			hosts[host].ips = append(hosts[host].ips, p.remoteIP)
 			hosts[host].sections[section] = newSectionStats(section)
 		} else {
@@ -265,6 +409,15 @@ func (a *analysis) updateAnalysis(p *MetaPacket) {
 
 		// Update statistics
 		a.updateSectionStats(host, section, p.request)
+		hosts[host].paths.add(pathSegments(requestPath(p.request)))
+		hosts[host].ports[getServerPort(p)]++
+		hosts[host].agents.add(p)
+		a.agents.add(p)
+
+		// As a server, the remote peer is a client of our virtual host
+		if p.role == roleServer {
+			a.updateClientStats(host, p.remoteIP)
+		}
 	}
 }
 
@@ -275,27 +428,66 @@ func (a *analysis) AddPacket(p *MetaPacket) {
 	a.updateAnalysis(p)
 }
 
+// Add adds a decoded HTTP message, or the several HTTP/2 messages decoded from a packet, to the analysis.
+// Every HTTP message counts as a hit, tunnel data doesn't.
+func (a *analysis) Add(message interface{}) bool {
+	switch p := message.(type) {
+	case *tunnelMessage:
+		a.addTunnelData(p)
+		return false
+	case *MetaPacket:
+		a.AddPacket(p)
+		return true
+	case []*MetaPacket:
+		for _, m := range p {
+			a.AddPacket(m)
+		}
+		return len(p) > 0
+	default:
+		return false
+	}
+}
+
+// Renew returns a new analysis, keeping track of ongoing connections
+func (a *analysis) Renew() protocolAnalysis {
+	renewed := NewAnalysis()
+	renewed.flows = a.flows
+	renewed.sections = a.sections
+	renewed.endpoints = a.endpoints
+	return renewed
+}
+
 // NewAnalysis returns a new and empty analysis struct
 func NewAnalysis() *analysis {
 	return &analysis{
 		//packets: nil,
-		traffic: make(map[string]int64),
-		nbHosts: 0,
-		hosts:   make(map[string]*hostStats),
+		traffic:    make(map[string]int64),
+		directions: make(map[string]int),
+		nbHosts:    0,
+		hosts:      make(map[string]*hostStats),
+		clients:    make(map[string]*clientStats),
+		grpc:       make(map[string]*grpcMethodStats),
+		tunnels:    make(map[string]*tunnelStats),
+		agents:     newClientAnalytics(),
+		flows:      newFlowHosts(defMaxFlows),
+		sections:   newFlowHosts(defMaxFlows),
+		endpoints:  newFlowHosts(defMaxFlows),
+
+		endpointErrors: make(map[string]*endpointErrors),
 		//lastSeenHost: nil,
 	}
 }
 
-// NewReport build a new report, containing the host with the most hits
-func NewReport(a *analysis, watchdogHits int, t time.Time) *report {
+// Report builds the HTTP section of the report, containing the host with the most hits
+func (a *analysis) Report() protocolReport {
 
-	// If no hosts were registered, we have nothing to report
+	// If no hosts were registered, we have nothing to report but tunnels
 	if len(a.hosts) == 0 {
 		log.Info("No hosts in analysis to build report on.")
-		return &report{
-			topHost:   nil,
-			sections:  nil,
-			timestamp: t,
+		return &httpReport{
+			topHost:  nil,
+			sections: nil,
+			tunnels:  a.topTunnels(),
 		}
 	}
 
@@ -312,10 +504,9 @@ func NewReport(a *analysis, watchdogHits int, t time.Time) *report {
 	// This should not happen, as we avoid the case above, but for the sake of it
 	if topHost == nil {
 		log.Error("Could not find a topHost on a non-empty set of Hosts. THIS SHOULD NOT HAPPEN.")
-		return &report{
-			topHost:   nil,
-			sections:  nil,
-			timestamp: t,
+		return &httpReport{
+			topHost:  nil,
+			sections: nil,
 		}
 	}
 
@@ -328,13 +519,49 @@ func NewReport(a *analysis, watchdogHits int, t time.Time) *report {
 	}
 	sort.Sort(sortedSections(sections))
 
+	// Copy clients into a slice for sorting, and keep the top ones
+	clients := make([]*clientStats, 0, len(a.clients))
+	for _, stats := range a.clients {
+		clients = append(clients, stats)
+	}
+	sort.Sort(sortedClients(clients))
+	if len(clients) > config.nbClients {
+		clients = clients[:config.nbClients]
+	}
+
+	// Clients of all hosts are only worth showing when they differ from those of the top host
+	var allClients *clientReport
+	if len(a.hosts) > 1 {
+		allClients = a.agents.report("all hosts")
+	}
+
 	log.Info("Analysis terminated, building and returning report.")
 
+	return &httpReport{
+		topHost:    topHost,
+		sections:   sections,
+		traffic:    a.traffic,
+		directions: a.directions,
+		topClients: clients,
+		topMethods: a.topGRPCMethods(),
+		endpoints:  topHost.paths.top(config.packetFilter.pathDepth, config.packetFilter.nbSections),
+		tunnels:    a.topTunnels(),
+		hostAgents: topHost.agents.report(topHost.host),
+		errors:     a.topErrorEndpoints(),
+		allAgents:  allClients,
+	}
+}
+
+// NewReport builds a new report, with the sections of all analyses
+func NewReport(analyses []protocolAnalysis, watchdogHits int, t time.Time) *report {
+	protocols := make([]protocolReport, len(analyses))
+	for i, a := range analyses {
+		protocols[i] = a.Report()
+	}
+
 	return &report{
-		topHost:      topHost,
-		sections:     sections,
+		protocols:    protocols,
 		watchdogHits: watchdogHits,
-		traffic:      a.traffic,
 		timestamp:    t,
 	}
 }
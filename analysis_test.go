@@ -0,0 +1,44 @@
+package gonetmon
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResponseWithoutRequest(t *testing.T) {
+	const peer = "192.168.1.20"
+	role := config.role
+	defer func() { config.role = role }()
+
+	tests := []struct {
+		role string
+		host string
+	}{
+		{roleServer, testServer},
+		{roleClient, peer},
+	}
+
+	// The request of the response was never seen, e.g. because monitoring started in between
+	for _, tt := range tests {
+		config.role = tt.role
+		packet, err := NewSyntheticPacket(testServer, peer, 80, 40000, []byte("HTTP/1.1 200 OK\r\n\r\n"), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := NewAnalysis()
+		a.Add(&MetaPacket{
+			messageType: httpResponse,
+			direction:   directionOutbound,
+			remoteIP:    peer,
+			deviceIP:    testServer,
+			flow:        "unknown flow",
+			response:    &http.Response{StatusCode: http.StatusOK, Header: make(http.Header)},
+			packet:      packet,
+		})
+
+		if _, ok := a.hosts[tt.host]; !ok || len(a.hosts) != 1 {
+			t.Errorf("%s : hosts %v, want the response counted for %s", tt.role, a.hosts, tt.host)
+		}
+	}
+}
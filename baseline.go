@@ -0,0 +1,166 @@
+package gonetmon
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// Alert modes : fixed thresholds, learned baselines, or both
+const (
+	alertThreshold = "threshold"
+	alertBaseline  = "baseline"
+	alertBoth      = "both"
+)
+
+// Metrics followed for every host
+const (
+	metricHits   = "hits"
+	metricBytes  = "bytes"
+	metricErrors = "error rate"
+)
+
+// allHosts is the name of the series of the total traffic of all hosts
+const allHosts = "all hosts"
+
+// baselineSeries learns the usual value of a metric, as an exponentially weighted moving average and variance over
+// report windows
+type baselineSeries struct {
+	host     string
+	metric   string
+	mean     float64
+	variance float64
+	windows  int  // Number of windows learned
+	alert    bool // Current state of alert
+}
+
+// deviation returns the standard deviation of the series, at least one unit so that flat series don't alert on noise
+func (s *baselineSeries) deviation() float64 {
+	return math.Max(math.Sqrt(s.variance), 1)
+}
+
+// learn updates the baseline with the value of a window
+func (s *baselineSeries) learn(value float64) {
+	if s.windows == 0 {
+		s.mean = value
+	} else {
+		diff := value - s.mean
+		s.mean += defBaselineAlpha * diff
+		s.variance = (1 - defBaselineAlpha) * (s.variance + defBaselineAlpha*diff*diff)
+	}
+	s.windows++
+}
+
+// baselines holds the series of every host and metric. It's only accessed while monitoring.
+type baselines struct {
+	series map[string]*baselineSeries
+	alerts *alerter
+}
+
+// newBaselines returns empty baselines, sending their alerts on the alerter
+func newBaselines(alerts *alerter) *baselines {
+	return &baselines{
+		series: make(map[string]*baselineSeries),
+		alerts: alerts,
+	}
+}
+
+// get returns the series of the metric of the host, creating it if needed. Time t is the end of the window.
+func (b *baselines) get(host string, metric string, t time.Time) *baselineSeries {
+	key := host + " " + metric
+	s, ok := b.series[key]
+	if !ok {
+		// Don't grow indefinitely : start over when full, learning again, and recovering the alerts of the series
+		if len(b.series) >= defMaxBaselines {
+			for _, old := range b.series {
+				if old.alert {
+					old.alert = false
+					b.notify(old, 0, 0, t)
+				}
+			}
+			b.series = make(map[string]*baselineSeries)
+		}
+		s = &baselineSeries{host: host, metric: metric}
+		b.series[key] = s
+	}
+	return s
+}
+
+// verify compares the value of the window to the baseline once warmed up, raising or lowering the alert of the
+// series and sending a message if necessary, then learns the value
+func (b *baselines) verify(s *baselineSeries, value float64, t time.Time) {
+	defer s.learn(value)
+	if s.windows < config.alert.warmup {
+		return
+	}
+
+	deviations := math.Abs(value-s.mean) / s.deviation()
+	anomaly := deviations >= config.alert.deviations
+	if anomaly == s.alert {
+		return
+	}
+	s.alert = anomaly
+	b.notify(s, value, deviations, t)
+}
+
+// notify sends the alert or recovery message of the series, as told by its state of alert
+func (b *baselines) notify(s *baselineSeries, value float64, deviations float64, t time.Time) {
+	message := fmt.Sprintf(defBaselineRecoveryFormat, s.metric, s.host, t.Format(defTimeLayout))
+	if s.alert {
+		message = fmt.Sprintf(defBaselineAlertFormat, s.metric, s.host, value, s.mean, s.deviation(), deviations,
+			t.Format(defTimeLayout))
+	}
+
+	b.alerts.notify("baseline "+s.host+" "+s.metric, alertMsg{
+		recovery:  !s.alert,
+		body:      message,
+		timestamp: t,
+	})
+}
+
+// observe verifies and learns the hits, bytes and error rate of every host over the window of the analysis. Hosts
+// that were not seen count for no traffic.
+func (b *baselines) observe(a *analysis, t time.Time) {
+	var hits, bytes int
+	for host, stats := range a.hosts {
+		hits += stats.hits
+		bytes += int(stats.responses.bytes)
+		b.verify(b.get(host, metricHits, t), float64(stats.hits), t)
+		b.verify(b.get(host, metricBytes, t), float64(stats.responses.bytes), t)
+
+		// Error rates of a few responses are meaningless
+		if stats.responses.responses >= defBaselineMinResponses {
+			b.verify(b.get(host, metricErrors, t), stats.responses.errorRate(), t)
+		}
+	}
+	b.verify(b.get(allHosts, metricHits, t), float64(hits), t)
+	b.verify(b.get(allHosts, metricBytes, t), float64(bytes), t)
+
+	for _, s := range b.series {
+		if _, seen := a.hosts[s.host]; !seen && s.host != allHosts && s.metric != metricErrors {
+			b.verify(s, 0, t)
+		}
+	}
+}
+
+// SetAlertMode sets how alerts are raised : on the fixed threshold of hits, on deviations from baselines learned
+// per host, or both. Baselines alert when the traffic of a report window deviates from them by the given number of
+// standard deviations, once they learned from the given number of windows.
+func SetAlertMode(mode string, deviations float64, warmup int) error {
+	switch mode {
+	case alertThreshold, alertBaseline, alertBoth:
+	default:
+		return fmt.Errorf("invalid alert mode '%s', must be one of %s, %s or %s", mode, alertThreshold, alertBaseline, alertBoth)
+	}
+	if deviations <= 0 {
+		return fmt.Errorf("invalid number of standard deviations %.1f, must be positive", deviations)
+	}
+	if warmup < 1 {
+		return fmt.Errorf("invalid warm-up of %d windows, must be at least 1", warmup)
+	}
+
+	config.alert.mode = mode
+	config.alert.deviations = deviations
+	config.alert.warmup = warmup
+	return nil
+}
@@ -0,0 +1,44 @@
+package gonetmon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBaselineAlerts(t *testing.T) {
+	saved := config.alert
+	defer func() { config.alert = saved }()
+	config.alert.warmup = 5
+	config.alert.deviations = 3
+
+	c := make(chan alertMsg, defAlertBufSize)
+	alerts := newAlerter(c, nil)
+	b := newBaselines(alerts)
+	now := time.Now()
+
+	// A spike after a steady traffic raises an alert, counted as active at the end of the window
+	s := b.get(testHost, metricHits, now)
+	for i := 0; i < config.alert.warmup; i++ {
+		b.verify(s, 100, now)
+	}
+	b.verify(s, 1000, now)
+	if messages := drain(c); len(messages) != 1 || messages[0].recovery {
+		t.Fatalf("messages %v, want an alert", messages)
+	}
+	if active := alerts.endWindow(now); active != 1 {
+		t.Errorf("%d active alerts, want 1", active)
+	}
+
+	// Series are forgotten when too many are learned, and their alerts recover
+	for i := 0; len(b.series) < defMaxBaselines; i++ {
+		b.series[fmt.Sprint("host ", i)] = &baselineSeries{}
+	}
+	b.get("www.other.test", metricHits, now)
+	if messages := drain(c); len(messages) != 1 || !messages[0].recovery {
+		t.Errorf("messages %v, want a recovery", messages)
+	}
+	if active := alerts.endWindow(now); active != 0 {
+		t.Errorf("%d active alerts, want none", active)
+	}
+}
@@ -24,7 +24,7 @@ func CLI(syn *synchronisation) {
 		log.Info("Logging to both file and console.")
 
 		// This Goroutine is not waiting for a stop signal/message, so we take one off
-		for n := 1; n < int(syn.nbReceivers); n++ {
+		for n := 1; n < int(syn.receivers()); n++ {
 			syn.syncChan <- struct{}{}
 		}
 		break
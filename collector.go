@@ -2,49 +2,85 @@ package gonetmon
 
 import (
 	"errors"
-	"fmt"
 	"github.com/google/gopacket"
 	//_ "github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/sirupsen/logrus"
 	"net"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// devices is a couple of arrays to hold corresponding devices with their handles
+// devices holds the capture sources to listen on
 type devices struct {
-	devices []net.Interface
-	handles []*pcap.Handle
+	sources []CaptureSource          // Opened capture sources
+	stopped map[string]chan struct{} // Maps a source name to a channel that is closed when capture on it stops
+	watch   bool                     // Whether sources are network devices to be watched for changes during runtime
 }
 
-// InitialiseCapture opens device interfaces and associated handles to listen on, returns a map of these.
-// If the interfaces parameter is not nil, only open those specified.
+// newDevices returns an empty set of capture sources
+func newDevices(watch bool) *devices {
+	return &devices{
+		sources: []CaptureSource{},
+		stopped: make(map[string]chan struct{}),
+		watch:   watch,
+	}
+}
+
+// newCaptureSource returns a capture source for the network device, of the kind set in configuration
+func newCaptureSource(device net.Interface, conf *captureConfig) CaptureSource {
+	if conf.source == sourceAFPacket {
+		return newAFPacketSource(device.Name, conf)
+	}
+	return newLiveSource(device.Name, conf)
+}
+
+// InitialiseCapture opens the capture sources to listen on.
+// If a file source is configured, only that file is opened. If the any pseudo-device is selected, only that device
+// is opened. Otherwise, the devices selected by the interface selection rules are opened.
 func InitialiseCapture() (*devices, error) {
 
-	interfaceDevices := findDevices(config.requestedInterfaces)
-	if interfaceDevices == nil {
-		return nil, errors.New("could not find any devices")
+	if config.captureConf.source == sourceFile {
+		src := newFileSource(config.captureConf.file)
+		if err := src.Open(); err != nil {
+			log.WithFields(logrus.Fields{
+				"file":  config.captureConf.file,
+				"error": err,
+			}).Error("Could not open file for capture.")
+			return nil, err
+		}
+		devs := newDevices(false)
+		devs.sources = append(devs.sources, src)
+		return devs, nil
 	}
 
-	devs := &devices{
-		devices: []net.Interface{},
-		handles: []*pcap.Handle{},
+	// The any pseudo-device already covers all interfaces, including those that will appear later
+	if config.interfaces.any {
+		devs := newDevices(false)
+		src := newCaptureSource(net.Interface{Name: anyDevice}, &config.captureConf)
+		if err := openSource(src); err != nil {
+			return nil, err
+		}
+		devs.sources = append(devs.sources, src)
+		return devs, nil
+	}
+
+	devs := newDevices(config.captureConf.watchInterval > 0)
+
+	interfaceDevices := findDevices(&config.interfaces)
+	if interfaceDevices == nil {
+		return nil, errors.New("could not find any devices")
 	}
 
 	for _, d := range interfaceDevices {
 		// Try to open all devices for capture
-		if h, err := openDevice(d, &config.captureConf); err != nil {
-			log.WithFields(logrus.Fields{
-				"error": err,
-			}).Error("Could not open device for capture.")
-		} else {
-			devs.devices = append(devs.devices, d)
-			devs.handles = append(devs.handles, h)
+		src := newCaptureSource(d, &config.captureConf)
+		if err := openSource(src); err == nil {
+			devs.sources = append(devs.sources, src)
 		}
 	}
 
-	if len(devs.devices) == 0 {
+	if len(devs.sources) == 0 {
 		log.Error("Could not open any device interface.")
 		return nil, errors.New("could not open any device interface")
 	}
@@ -52,44 +88,29 @@ func InitialiseCapture() (*devices, error) {
 	return devs, nil
 }
 
-// selectDevices returns an array of requested interfaces among those available in the devices argument
-func selectDevices(requestedInterfaces []string, devices []net.Interface) ([]net.Interface, error) {
-	var tailoredList []net.Interface
-
-interfacesLoop:
-	for _, i := range requestedInterfaces {
-
-		for index, d := range devices {
-
-			if d.Name == i {
-				tailoredList = append(tailoredList, d)
-
-				// Remove the found element from array to avoid it on next iteration
-				// Won't affect current loop since Go uses a copy
-				devices[index] = devices[len(devices)-1]
-				devices = devices[:len(devices)-1]
-
-				log.Info("Found requested interface ", i)
-
-				continue interfacesLoop
-			}
-		}
-
-		// Here, the requested interface is not in the found set
-		log.Error("Could not find requested interface among activated interfaces : ", i)
+// upDevices returns the list of interfaces of the machine that have their state flag UP
+func upDevices() ([]net.Interface, error) {
+	devices, err := net.Interfaces()
+	if err != nil {
+		return nil, err
 	}
 
-	if len(tailoredList) == 0 {
-		return nil, fmt.Errorf("could not find any requested network devices among : %s", requestedInterfaces)
+	// Purge interfaces that don't have their state flag UP
+	cpy := devices[:0]
+	for _, d := range devices {
+		if d.Flags&net.FlagUp != 0 {
+			// Flag is up, Interface is activated, keep element
+			cpy = append(cpy, d)
+		}
 	}
 
-	return tailoredList, nil
+	return cpy, nil
 }
 
-// findDevices gathers the list of interfaces of the machine that have their state flage UP.
-// If the interfaces parameter is not nil, only list those specified if present.
-func findDevices(requestedInterfaces []string) []net.Interface {
-	devices, err := net.Interfaces()
+// findDevices gathers the list of interfaces of the machine that have their state flage UP,
+// and that are selected by the selection rules.
+func findDevices(selection *interfaceSelection) []net.Interface {
+	devices, err := upDevices()
 
 	if err != nil {
 		log.WithFields(logrus.Fields{
@@ -98,170 +119,202 @@ func findDevices(requestedInterfaces []string) []net.Interface {
 		return nil
 	}
 
-	if devices == nil || len(devices) == 0 {
+	if len(devices) == 0 {
 		log.Error("Could not find any network devices (but no error occurred).")
 		return nil
 	}
 
-	// Purge interfaces that don't have their state flag UP
-	cpy := devices[:0]
-	for _, d := range devices {
-		if d.Flags&(net.FlagUp) == 1 {
-			// Flag is up, Interface is activated, keep element
-			cpy = append(cpy, d)
-		}
-	}
-
-	// If we want a custom list of interfaces
-	if requestedInterfaces != nil {
-		devices, err = selectDevices(requestedInterfaces, devices)
-		if err != nil {
-			log.Error(err)
-			return nil
-		}
+	devices, err = selectDevices(selection, devices)
+	if err != nil {
+		log.Error(err)
+		return nil
 	}
 
 	return devices
 }
 
-// openDevice opens a live listener on the interface designated by the device parameter and returns a corresponding handle
-func openDevice(device net.Interface, config *captureConfig) (*pcap.Handle, error) {
-	handle, err := pcap.OpenLive(device.Name, config.snapshotLen, config.promiscuousMode, config.captureTimeout)
-	if err != nil {
+// openSource opens the capture source
+func openSource(src CaptureSource) error {
+	if err := src.Open(); err != nil {
 		log.WithFields(logrus.Fields{
-			"interface": device.Name,
-			"error":     err,
-		}).Error("Could not open device.")
+			"source": src.Name(),
+			"error":  err,
+		}).Error("Could not open source.")
 
-		return nil, err
+		return err
 	}
 
 	log.WithFields(logrus.Fields{
-		"interface": device.Name,
-	}).Info("Opened device interface.")
+		"source": src.Name(),
+	}).Info("Opened capture source.")
 
-	return handle, nil
+	return nil
 }
 
-// closeDevice closes listening on a device
-func closeDevice(h *pcap.Handle) {
-	h.Close()
+// closeSource stops capture on a source, and logs its statistics
+func closeSource(src CaptureSource) {
+	if stats, err := src.Stats(); err == nil {
+		log.WithFields(logrus.Fields{
+			"source":     src.Name(),
+			"received":   stats.Received,
+			"dropped":    stats.Dropped,
+			"if dropped": stats.IfDropped,
+		}).Info("Capture statistics.")
+	}
+	src.Close()
 }
 
-// closeDevices closes all devices given
+// closeDevices closes all sources given
 func closeDevices(devices *devices) {
-	for index, dev := range devices.devices {
-		log.Info("Closing device on interface ", dev.Name)
-		closeDevice(devices.handles[index])
+	for _, src := range devices.sources {
+		log.Info("Closing capture source ", src.Name())
+		closeSource(src)
 	}
 }
 
-// addFilter adds a BPF filter to the handle to filter sniffed traffic
-func addFilter(handle *pcap.Handle, filter string) error {
-	return handle.SetBPFFilter(filter)
-}
-
-// sniffApplicationLayer tells whether the packet contains the filter string in its application layer
-func sniffApplicationLayer(packet gopacket.Packet, filter string) bool {
-	var isApp = false
+// sniffApplicationLayer tells whether the packet's application layer holds the beginning of a HTTP message
+func sniffApplicationLayer(packet gopacket.Packet) bool {
 	applicationLayer := packet.ApplicationLayer()
-	if applicationLayer != nil {
-		payload := applicationLayer.Payload()
-		if strings.Contains(string(payload), filter) {
-			isApp = true
-		}
+	if applicationLayer == nil {
+		return false
 	}
 
-	return isApp
+	return isHTTP(applicationLayer.Payload())
 }
 
-// getRemoteIP extracts the IP address of the remote peer from packet
-func getRemoteIP(packet gopacket.Packet, deviceIP string) string {
-	src, dst := packet.NetworkLayer().NetworkFlow().Endpoints()
-
-	var rip string
-
-	// The deviceIP is among these two, so we return the other
-	if strings.Compare(deviceIP, src.String()) == 0 {
-		rip = dst.String()
-	} else {
-		rip = src.String()
-	}
-
-	log.Info("Remote peer address ", rip)
-
-	return rip
-}
-
-// getDeviceIP extracts the interface's local IP address
-func getDeviceIP(device *net.Interface) (string, error) {
-	add, err := device.Addrs()
-	if err != nil {
-		return "", err
-	}
-	// Don't keep the network mask
-	address := add[0].String()[:strings.IndexByte(add[0].String(), '/')]
-	return address, nil
+// dropped counts the captured packets that were not handed to the exporter or the recorder because they could not keep
+// up, to be accessed atomically
+var dropped struct {
+	flows   uint64
+	records uint64
 }
 
-// capturePacket continuously listens to a device interface managed by handle, and extracts relevant packets from traffic
-// to send it to packetChan
-func capturePackets(device net.Interface, handle *pcap.Handle, filter *filter, wg *sync.WaitGroup, packetChan chan<- packetMsg) {
+// capturePacket continuously listens to a capture source, and extracts relevant packets from traffic
+// to send it to packetChan. If flows are exported, all packets are sent to flowChan too, or dropped if it's full so that
+// export doesn't slow down analysis. If packets are recorded,
+// relevant packets are sent to recordChan, or dropped if it's full.
+// The stopped channel is closed when capture stops.
+func capturePackets(src CaptureSource, dissectors []Dissector, wg *sync.WaitGroup, packetChan chan<- packetMsg, flowChan chan<- packetMsg, recordChan chan<- packetMsg, stopped chan<- struct{}) {
 	defer wg.Done()
+	defer close(stopped)
 
-	log.Info("Capturing packets on ", device.Name)
+	log.Info("Capturing packets on ", src.Name())
 
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
+	// This will loop on a channel that will send packages, and will quit when the source is closed by another caller
+	for packet := range src.Packets() {
+		if flowChan != nil {
+			select {
+			case flowChan <- packetMsg{device: src.Name(), rawPacket: packet}:
+			default:
+				atomic.AddUint64(&dropped.flows, 1)
+			}
+		}
+
+		matched := matchObservers(dissectors, packet)
+		if d := matchDissector(dissectors, packet); d != nil {
+			matched = append(matched, d)
+		}
+		if len(matched) == 0 {
+			continue
+		}
 
-	// This will loop on a channel that will send packages, and will quit when the handle is closed by another caller
-	for packet := range packetSource.Packets() {
-		if sniffApplicationLayer(packet, filter.application) {
+		direction, localIP, remoteIP := getEndpoints(packet, localAddresses)
+		log.Debug("Remote peer address ", remoteIP)
 
-			ip, err := getDeviceIP(&device)
-			if err != nil {
-				log.WithFields(logrus.Fields{
-					"interface": device.Name,
-					"error":     err,
-				}).Error("Could not extract IP from local network interface")
+		if recordChan != nil {
+			select {
+			case recordChan <- packetMsg{device: src.Name(), rawPacket: packet}:
+			default:
+				atomic.AddUint64(&dropped.records, 1)
 			}
+		}
 
+		for _, d := range matched {
 			packetChan <- packetMsg{
-				dataType:  filter.dataType,
-				device:    device.Name,
-				deviceIP:  ip,
-				remoteIP:  getRemoteIP(packet, ip),
+				dataType:  d.Name(),
+				device:    src.Name(),
+				direction: direction,
+				deviceIP:  localIP,
+				remoteIP:  remoteIP,
 				rawPacket: packet,
 			}
 		}
 	}
 
-	log.Info("Stopping capture on ", device.Name)
+	log.Info("Stopping capture on ", src.Name())
 }
 
-// Collector listens on all network devices for relevant traffic and sends packets to packetChan
+// startCapture sets the network filter of the enabled dissectors on the source and launches a goroutine capturing on it.
+// If flows are exported, all traffic is captured. If the filter can't be set, the source is closed and false is returned.
+func (d *devices) startCapture(src CaptureSource, wg *sync.WaitGroup, packetChan chan<- packetMsg, flowChan chan<- packetMsg, recordChan chan<- packetMsg) bool {
+	dissectors := enabledDissectors()
+	filter := buildFilter(dissectors)
+	if flowChan != nil {
+		filter = ""
+	}
+	if err := src.SetFilter(filter); err != nil {
+		log.WithFields(logrus.Fields{
+			"source": src.Name(),
+			"error":  err,
+		}).Error("Could not set filter on source. Closing.")
+		closeSource(src)
+		return false
+	}
+
+	stopped := make(chan struct{})
+	d.stopped[src.Name()] = stopped
+
+	wg.Add(1)
+	go capturePackets(src, dissectors, wg, packetChan, flowChan, recordChan, stopped)
+	return true
+}
+
+// Collector listens on all capture sources for relevant traffic and sends packets to packetChan, and all traffic to
+// flowChan and relevant traffic to recordChan if they are not nil.
+// It periodically renews the set of local addresses, and if sources are network devices, looks for devices that
+// appeared or disappeared, adapts capture to them, and informs about it on deviceChan.
 // Behaviour and filters can be given as argument with parameters
-func Collector(devices *devices, packetChan chan packetMsg, syn *synchronisation) {
+func Collector(devices *devices, packetChan chan packetMsg, flowChan chan packetMsg, recordChan chan packetMsg, deviceChan chan<- deviceMsg, syn *synchronisation) {
 	defer syn.wg.Done()
 
 	collWG := sync.WaitGroup{}
 
-	for index, dev := range devices.devices {
-		collWG.Add(1)
-		h := devices.handles[index]
-		if err := addFilter(h, config.packetFilter.network); err != nil {
-			log.WithFields(logrus.Fields{
-				"interface": dev.Name,
-				"error":     err,
-			}).Error("Could not set filter on device. Closing.")
-			closeDevice(h)
+	// Local addresses are needed to tell the direction of packets, from the first one captured
+	localAddresses.refresh()
+
+	started := devices.sources[:0]
+	for _, src := range devices.sources {
+		if devices.startCapture(src, &collWG, packetChan, flowChan, recordChan) {
+			started = append(started, src)
 		}
-		go capturePackets(dev, h, &config.packetFilter, &collWG, packetChan)
+	}
+	devices.sources = started
+
+	// Periodically look for address and device changes, a nil channel never fires
+	var watchTick <-chan time.Time
+	if config.captureConf.watchInterval > 0 {
+		ticker := time.NewTicker(config.captureConf.watchInterval)
+		defer ticker.Stop()
+		watchTick = ticker.C
 	}
 
-	// Wait until sync to stop
-	<-syn.syncChan
+collectorLoop:
+	for {
+		select {
+
+		// Wait until sync to stop
+		case <-syn.syncChan:
+			break collectorLoop
+
+		case <-watchTick:
+			localAddresses.refresh()
+			if devices.watch {
+				devices.refresh(&collWG, packetChan, flowChan, recordChan, deviceChan)
+			}
+		}
+	}
 
-	// Inform goroutines to stop by closing their handles
+	// Inform goroutines to stop by closing their sources
 	closeDevices(devices)
 
 	// Wait for goroutines to stop
@@ -0,0 +1,199 @@
+package gonetmon
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"strconv"
+	"strings"
+)
+
+// maxLineLength is the maximum length of a HTTP request or status line we accept to look for
+const maxLineLength = 8192
+
+// httpMethods holds the request methods recognised in a HTTP/1.x request line
+var httpMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"DELETE":  true,
+	"CONNECT": true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PATCH":   true,
+}
+
+// firstLine returns the first line of the payload, without its line ending, or false if there is none
+func firstLine(payload []byte) ([]byte, bool) {
+	if len(payload) > maxLineLength {
+		payload = payload[:maxLineLength]
+	}
+
+	idx := bytes.IndexByte(payload, '\n')
+	if idx < 0 {
+		return nil, false
+	}
+
+	return bytes.TrimSuffix(payload[:idx], []byte("\r")), true
+}
+
+// isHTTPVersion tells whether the token is a HTTP/1.x version
+func isHTTPVersion(token []byte) bool {
+	return len(token) == len("HTTP/1.1") && bytes.HasPrefix(token, []byte("HTTP/1."))
+}
+
+// isHTTPRequest tells whether the payload starts with a HTTP/1.x request line, like "GET /index.html HTTP/1.1"
+func isHTTPRequest(payload []byte) bool {
+	line, ok := firstLine(payload)
+	if !ok {
+		return false
+	}
+
+	tokens := bytes.Split(line, []byte(" "))
+	if len(tokens) != 3 || len(tokens[1]) == 0 {
+		return false
+	}
+
+	return httpMethods[string(tokens[0])] && isHTTPVersion(tokens[2])
+}
+
+// responseStatus returns the status code of the HTTP/1.x status line the payload starts with, like "HTTP/1.1 200 OK"
+func responseStatus(payload []byte) (int, bool) {
+	line, ok := firstLine(payload)
+	if !ok {
+		return 0, false
+	}
+
+	tokens := bytes.SplitN(line, []byte(" "), 3)
+	if len(tokens) < 2 || !isHTTPVersion(tokens[0]) || len(tokens[1]) != 3 {
+		return 0, false
+	}
+
+	code, err := strconv.Atoi(string(tokens[1]))
+	if err != nil || code < 100 || code >= 600 {
+		return 0, false
+	}
+	return code, true
+}
+
+// isHTTPResponse tells whether the payload starts with a HTTP/1.x status line, like "HTTP/1.1 200 OK"
+func isHTTPResponse(payload []byte) bool {
+	_, ok := responseStatus(payload)
+	return ok
+}
+
+// requestTarget returns the target of the HTTP/1.x request line the payload starts with, like "/index.html"
+func requestTarget(payload []byte) string {
+	line, ok := firstLine(payload)
+	if !ok {
+		return ""
+	}
+
+	tokens := bytes.Split(line, []byte(" "))
+	if len(tokens) != 3 {
+		return ""
+	}
+	return string(tokens[1])
+}
+
+// headerValue returns the value of the first header of the given name in the head of a HTTP/1.x message
+func headerValue(payload []byte, name string) (string, bool) {
+	end := bytes.Index(payload, []byte("\r\n\r\n"))
+	if end < 0 {
+		end = len(payload)
+	}
+
+	for _, line := range strings.Split(string(payload[:end]), "\r\n")[1:] {
+		idx := strings.IndexByte(line, ':')
+		if idx >= 0 && strings.EqualFold(strings.TrimSpace(line[:idx]), name) {
+			return strings.TrimSpace(line[idx+1:]), true
+		}
+	}
+	return "", false
+}
+
+// upgradesTo tells whether the Upgrade header of the HTTP/1.x message holds the protocol
+func upgradesTo(payload []byte, protocol string) bool {
+	value, ok := headerValue(payload, "Upgrade")
+	if !ok {
+		return false
+	}
+
+	for _, token := range strings.Split(value, ",") {
+		// Protocols may have a version, like "websocket/13"
+		if idx := strings.IndexByte(token, '/'); idx >= 0 {
+			token = token[:idx]
+		}
+		if strings.EqualFold(strings.TrimSpace(token), protocol) {
+			return true
+		}
+	}
+	return false
+}
+
+// isHTTP tells whether the payload is the beginning of a HTTP/1.x message, whatever the port it was sent on
+func isHTTP(payload []byte) bool {
+	return isHTTPResponse(payload) || isHTTPRequest(payload)
+}
+
+// buildNetworkFilter returns the BPF filter for TCP traffic on the given ports, or on any port if ports is empty
+func buildNetworkFilter(ports []uint16) string {
+	if len(ports) == 0 {
+		return "tcp"
+	}
+
+	clauses := make([]string, len(ports))
+	for i, p := range ports {
+		clauses[i] = fmt.Sprintf("port %d", p)
+	}
+
+	return "tcp and (" + strings.Join(clauses, " or ") + ")"
+}
+
+// onPorts tells whether one of the segment's ports is in the list
+func onPorts(tcp *layers.TCP, ports []uint16) bool {
+	for _, p := range ports {
+		if uint16(tcp.SrcPort) == p || uint16(tcp.DstPort) == p {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePorts returns the list of port numbers
+func parsePorts(ports []string) ([]uint16, error) {
+	parsed := make([]uint16, 0, len(ports))
+	for _, p := range ports {
+		port, err := strconv.ParseUint(strings.TrimSpace(p), 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port '%s'", p)
+		}
+		parsed = append(parsed, uint16(port))
+	}
+	return parsed, nil
+}
+
+// SetPorts sets the TCP ports to capture HTTP traffic on. With no ports, HTTP is detected on any port,
+// at the cost of inspecting all TCP traffic.
+func SetPorts(ports []string) error {
+	parsed, err := parsePorts(ports)
+	if err != nil {
+		return err
+	}
+
+	config.packetFilter.ports = parsed
+	return nil
+}
+
+// SetTLSPorts sets the TCP ports to capture TLS traffic on. With no ports, TLS is detected on any port,
+// at the cost of inspecting all TCP traffic.
+func SetTLSPorts(ports []string) error {
+	parsed, err := parsePorts(ports)
+	if err != nil {
+		return err
+	}
+
+	config.packetFilter.tlsPorts = parsed
+	return nil
+}
@@ -1,28 +1,72 @@
 package gonetmon
 
 import (
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
 const (
-	clearConsole  = "\x1Bc"
-	topLine       = green + "[gonetmon]" + blue + " Refresh : %d seconds - Alert %d hits / %d seconds. - updated : %s" + stop
-	noReport      = "\t\t\t--- No report available : no traffic detected ---"
-	reportAlert   = "Alert watchdog :\t %s / %d hits over past %s"
-	reportTraffic = "HTTP traffic per interface :  %s"
-	reportTop     = "Top host : %s\t - %d hits\t"
-	reportResp    = "%s" // OK(%d), Redirect(%d), Server Error(%d), Client Error(%d)"
-	reportSection = "\t> %s\t-\t %d hits\t"
-	reportReqs    = "%s" //" POST, GET, PUT, PATCH, and DELETE"
+	clearConsole     = "\x1Bc"
+	topLine          = green + "[gonetmon]" + blue + " Refresh : %d seconds - Alert %d hits / %d seconds. - updated : %s" + stop
+	noReport         = "\t\t\t--- No report available : no traffic detected ---"
+	reportAlert      = "Alert watchdog :\t %s / %d hits over past %s"
+	reportActive     = " - %d alerts active"
+	reportTalkers    = "Top talkers :  %s- networks %s"
+	reportTrends     = "Trends over %s :"
+	reportTrend      = "\t> %-24s %s  now %s, avg %s"
+	reportTraffic    = "HTTP traffic per interface :  %s"
+	reportDirs       = "Packets per direction :  %s"
+	reportTop        = "Top host : %s (ports %s)\t - %d hits\t"
+	reportVhost      = "Top local virtual host : %s (ports %s)\t - %d hits\t"
+	reportClients    = "Top clients :  %s"
+	reportResp       = "%s- %s- errors %s"
+	reportSection    = "\t> %s\t-\t %d hits\t"
+	reportReqs       = "%s" //" POST, GET, PUT, PATCH, and DELETE"
+	reportContent    = "Content : %s- sizes %s- compressed %.1f%% %s- %d heavy uncompressed"
+	reportCache      = "Cache : cacheable %.1f%%, uncacheable %.1f%%, Age %.1f%%, ETag %.1f%%, 304 %.1f%% - X-Cache %d hits, %d misses"
+	reportStatus     = "Status : %s- errors %s"
+	reportEndpoints  = "Top endpoints :"
+	reportTunnels    = "Proxy tunnels :"
+	reportTunnel     = "\t> %s\t-\t %d requests, %d established, %d refused, %d bytes, avg duration %s"
+	reportEndpoint   = "\t> %s\t-\t %d hits"
+	reportErrors     = "Top erroring endpoints :"
+	reportErrorLine  = "\t> %s\t-\t %d errors / %d responses (%s)\t%s"
+	reportAgents     = "Clients of %s : %d requests\t%s"
+	reportAgentNames = "\t> User-Agents :  %s"
+	reportReferers   = "\t> Referers :  %s"
+	reportClientIPs  = "\t> Client IPs :  %s"
+	reportCrawlers   = "\t> Crawlers :  %s"
+	reportEvents     = "Device events :"
+	reportDNS        = "DNS : %d queries, %d answers - NXDOMAIN %.1f%% - SERVFAIL %.1f%% - resolver latency %s"
+	reportDNSName    = "\t> %s\t-\t %d queries"
+	reportGRPC       = "gRPC methods :"
+	reportGRPCCodes  = "gRPC status %s"
+	reportGRPCMethod = "\t> %s\t-\t %d calls, avg latency %s\t%s"
+	reportWS         = "WebSocket per endpoint :"
+	reportWSEndpoint = "\t> %s\t-\t %d connections, %d messages from clients, %d from servers, %d bytes\t"
+	reportWSCloses   = "- close codes %s"
+	reportKV         = "%s : %d commands, %d error replies"
+	reportKVCommand  = "\t> %s\t-\t %d calls, %d errors, avg latency %s"
+	reportKVPrefixes = "Top key prefixes :  %s"
+	reportTCP        = "TCP connection quality per remote host :"
+	reportTCPDevices = "TCP connection quality per interface :"
+	reportTCPSkipped = "\t  %d packets of connections not followed, whose opening and data were not seen"
+	reportTCPLine    = "\t> %s\t-\t %d connections, handshake RTT %s, %.1f%% retransmitted, %d out of order, %d zero windows, %d resets, avg duration %s"
+	reportTLS        = "HTTPS/TLS per server name :"
+	reportTLSName    = "\t> %s\t-\t %d connections, %d bytes\t"
+	reportTLSJA3     = "\t  JA3 %s\t-\t %d client hellos"
+	reportTLSShort   = "\t  %d truncated client hellos, not fingerprinted"
 
 	// ANSI Colours
-	red   = "\033[31;1;1m"
-	green = "\033[32m"
-	blue  = "\033[34m"
-	stop  = "\033[0m"
+	red    = "\033[31;1;1m"
+	green  = "\033[32m"
+	yellow = "\033[33m"
+	blue   = "\033[34m"
+	stop   = "\033[0m"
 )
 
 // buildAlertBarOutput builds the line with the current number of hits over past time frame of alert watching
@@ -33,19 +77,59 @@ func buildAlertBarOutput(r *report, p *configuration) string {
 		hits = red + hits + stop
 	}
 	output += fmt.Sprintf(reportAlert, hits, p.alert.threshold, p.alert.span)
+
+	// Alerts of clients and baselines count too, whatever the total hits
+	if r.alerts > 0 {
+		output += red + fmt.Sprintf(reportActive, r.alerts) + stop
+	}
 	return output
 }
 
 // buildTrafficOutput builds and returns a string containing the bit rate and total amount of bits per network device
-func buildTrafficOutput(r *report, p *configuration) string {
+func buildTrafficOutput(traffic map[string]int64, p *configuration) string {
 	var output string
-	for dev, bits := range r.traffic {
+	for dev, bits := range traffic {
 		speed := float64(bits) / p.displayRefresh.Seconds()
 		output += fmt.Sprintf("%s : %.2f bits/s (%d bits)   ", dev, speed, bits)
 	}
 	return output
 }
 
+// buildDirectionOutput returns a string with the number of packets in each direction, in a stable order
+func buildDirectionOutput(directions map[string]int) string {
+	var output string
+	for _, dir := range []string{directionInbound, directionOutbound, directionInternal, directionTransit} {
+		if nb, ok := directions[dir]; ok {
+			output += fmt.Sprintf("%s(%d) ", dir, nb)
+		}
+	}
+	return output
+}
+
+// buildPortOutput returns the sorted list of ports a host was served on
+func buildPortOutput(ports map[uint16]uint) string {
+	list := make([]int, 0, len(ports))
+	for p := range ports {
+		list = append(list, int(p))
+	}
+	sort.Ints(list)
+
+	output := make([]string, len(list))
+	for i, p := range list {
+		output[i] = strconv.Itoa(p)
+	}
+	return strings.Join(output, ", ")
+}
+
+// buildClientOutput returns a string representation of the clients and their number of requests
+func buildClientOutput(clients []*clientStats) string {
+	var output string
+	for _, c := range clients {
+		output += fmt.Sprintf("%s(%d) ", c.ip, c.hits)
+	}
+	return output
+}
+
 // buildRequestOutput returns a string representation of elements in given map
 func buildRequestOutput(methods map[string]uint) string {
 	var output string
@@ -55,11 +139,18 @@ func buildRequestOutput(methods map[string]uint) string {
 	return output
 }
 
-// buildResponseOutput returns a string representation of elements in given map
+// buildResponseOutput returns a string representation of the status codes and their count, in code order and
+// coloured by class
 func buildResponseOutput(status map[int]uint) string {
+	codes := make([]int, 0, len(status))
+	for code := range status {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+
 	var output string
-	for code, nb := range status {
-		output += fmt.Sprintf("%d(%d) ", code, nb)
+	for _, code := range codes {
+		output += colourise(fmt.Sprintf("%d(%d)", code, status[code]), statusColour(statusClass(code))) + " "
 	}
 	return output
 }
@@ -74,23 +165,34 @@ func min(a int, b int) int {
 }
 */
 
-// displayToConsole builds the final report with passed alerts, clears the terminal and prints the result
-func displayToConsole(r *report, alerts *[]string) {
+// displayToConsole builds the final report with passed alerts, device events and history, clears the terminal and prints the result
+func displayToConsole(r *report, h *history, alerts *[]string, events *[]string) {
 	var output string
 
 	output += fmt.Sprintf(topLine+"\n", int(config.displayRefresh.Seconds()), config.alert.threshold, int(config.alert.span.Seconds()), time.Now().Format("2006-01-02 15:04:05"))
 	output += buildAlertBarOutput(r, config) + "\n"
-	if r.topHost == nil {
+	if len(r.talkers) > 0 {
+		output += fmt.Sprintf(reportTalkers+"\n", buildTalkerOutput(r.talkers), buildTalkerOutput(r.networks))
+	}
+
+	// Each dissector renders its own section
+	var sections string
+	for _, p := range r.protocols {
+		if !p.Empty() {
+			sections += p.Render()
+		}
+	}
+	if sections == "" {
 		output += noReport + "\n"
 	} else {
-		output += fmt.Sprintf(reportTraffic+"\n", buildTrafficOutput(r, config))
-		output += fmt.Sprintf(reportTop, r.topHost.host, r.topHost.hits)
-		output += fmt.Sprintf(reportResp+"\n", buildResponseOutput(r.topHost.nbStatus))
-		//for _, section := range r.sections[:min(p.PacketFilter.NbSections, len(r.sections))] {
-		for _, section := range r.sections {
-			output += fmt.Sprintf(reportSection, section.section, section.nbHits)
-			output += fmt.Sprintf(reportReqs+"\n", buildRequestOutput(section.nbMethods))
-		}
+		output += sections
+	}
+	if h != nil {
+		output += buildHistoryOutput(h)
+	}
+	if len(*events) > 0 {
+		output += reportEvents + "\n"
+		output += strings.Join(*events, "")
 	}
 	output += strings.Join(*alerts, "")
 
@@ -98,12 +200,43 @@ func displayToConsole(r *report, alerts *[]string) {
 	fmt.Print(output)
 }
 
-// outputReport is a selector between outputs : for now, only console is supported
-func outputReport(r *report, alerts *[]string) {
+// displayToJSON prints the report window and the recent history as a line of JSON
+func displayToJSON(r *report, h *history) {
+	line, err := buildJSONOutput(r, h)
+	if err != nil {
+		log.Error("Could not encode report as JSON : ", err)
+		return
+	}
+	fmt.Println(line)
+}
+
+// eventJSON is the JSON representation of an alert or a device event
+type eventJSON struct {
+	Kind      string    `json:"kind"`
+	Body      string    `json:"body"`
+	Recovery  bool      `json:"recovery,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// printEventJSON prints an alert or a device event as it happens, as a line of JSON
+func printEventJSON(kind string, body string, recovery bool) {
+	line, err := json.Marshal(&eventJSON{Kind: kind, Body: body, Recovery: recovery, Timestamp: time.Now()})
+	if err != nil {
+		log.Error("Could not encode event as JSON : ", err)
+		return
+	}
+	fmt.Println(string(line))
+}
+
+// outputReport is a selector between outputs : console, or lines of JSON
+func outputReport(r *report, h *history, alerts *[]string, events *[]string) {
 
 	switch config.displayType {
 	case consoleOutput:
-		displayToConsole(r, alerts)
+		displayToConsole(r, h, alerts, events)
+
+	case jsonOutput:
+		displayToJSON(r, h)
 
 		// TODO
 		/*case fileOutput :
@@ -113,20 +246,35 @@ func outputReport(r *report, alerts *[]string) {
 
 }
 
+// SetOutput sets where reports are displayed : refreshed on the console, or as lines of JSON on the standard output
+func SetOutput(output string) error {
+	switch output {
+	case consoleOutput, jsonOutput:
+		config.displayType = output
+		return nil
+	default:
+		return fmt.Errorf("invalid output '%s', must be one of %s or %s", output, consoleOutput, jsonOutput)
+	}
+}
+
 // Display is in charge of rendering a report in to the format of the final output
-// For now, only console output is supported
-func Display(reportChan <-chan *report, alertChan <-chan alertMsg, syn *synchronisation) {
+// For now, only console output is supported. Reports and alerts are also written to the store, if any.
+func Display(reportChan <-chan *report, alertChan <-chan alertMsg, deviceChan <-chan deviceMsg, store *reportStore, syn *synchronisation) {
 	defer syn.wg.Done()
+	if store != nil {
+		defer store.close()
+	}
 
 	var alerts []string
+	var events []string
+	hist := newHistory(config.displayRefresh)
 
 	// Display empty monitoring console
 	if config.displayType == consoleOutput {
 		displayToConsole(&report{
-			topHost:   nil,
-			sections:  nil,
+			protocols: nil,
 			timestamp: time.Now(),
-		}, &alerts)
+		}, nil, &alerts, &events)
 	}
 
 displayLoop:
@@ -137,17 +285,48 @@ displayLoop:
 			break displayLoop
 
 		case alert := <-alertChan:
+			if store != nil {
+				store.writeAlert(alert)
+			}
+
+			if config.displayType == jsonOutput {
+				printEventJSON("alert", alert.body, alert.recovery)
+				continue
+			}
 
 			if !alert.recovery {
 				alert.body = red + alert.body + stop // Red text
 			}
+
+			// Only keep the most recent alerts
 			alerts = append(alerts, alert.body+"\n")
+			if len(alerts) > defMaxAlerts {
+				alerts = alerts[len(alerts)-defMaxAlerts:]
+			}
 
 			fmt.Println(alert.body)
 
+		case device := <-deviceChan:
+			if config.displayType == jsonOutput {
+				printEventJSON("device", device.body, false)
+				continue
+			}
+
+			// Only keep the most recent events
+			events = append(events, "\t"+device.body+"\n")
+			if len(events) > defMaxEvents {
+				events = events[len(events)-defMaxEvents:]
+			}
+
+			fmt.Println(device.body)
+
 		case report := <-reportChan:
 			// Interpret report and adapt to desired output
-			outputReport(report, &alerts)
+			hist.add(report.window)
+			if store != nil {
+				store.writeReport(report)
+			}
+			outputReport(report, hist, &alerts, &events)
 		}
 	}
 
@@ -0,0 +1,157 @@
+package gonetmon
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"sort"
+	"strings"
+)
+
+// Dissector recognises, decodes and analyses one application protocol.
+// Dissectors are held in the registry and enabled by configuration, several of them can run concurrently.
+type Dissector interface {
+	// Name returns the name of the dissector, used to enable it and to tag the packets it matched
+	Name() string
+
+	// Filter returns the BPF fragment selecting the traffic the dissector is interested in
+	Filter() string
+
+	// Match tells whether the captured packet is to be handled by the dissector
+	Match(packet gopacket.Packet) bool
+
+	// Decode transforms a matched packet into the dissector's typed message
+	Decode(data *packetMsg) (interface{}, error)
+
+	// NewAnalysis returns an empty analysis for the dissector's messages
+	NewAnalysis() protocolAnalysis
+}
+
+// sharedDissector is implemented by dissectors that add their messages to the analysis of another dissector when it
+// is enabled, so that versions of a protocol are reported together
+type sharedDissector interface {
+	Dissector
+
+	// SharesWith returns the name of the dissector whose analysis is shared
+	SharesWith() string
+}
+
+// observerDissector is implemented by dissectors that look at the packets of all protocols, like transport layer
+// statistics do. They are handed the packets they match in addition to the dissector handling them.
+type observerDissector interface {
+	Dissector
+
+	// Observer marks the dissector as an observer
+	Observer()
+}
+
+// protocolAnalysis accumulates the messages decoded by a dissector between two reports
+type protocolAnalysis interface {
+	// Add adds a decoded message to the analysis, and tells whether it counts as a hit for the watchdog
+	Add(message interface{}) bool
+
+	// Report builds the dissector's section of the report
+	Report() protocolReport
+
+	// Renew returns a new and empty analysis, carrying over state that must outlive a report
+	Renew() protocolAnalysis
+}
+
+// protocolReport is a dissector's section of a report
+type protocolReport interface {
+	// Empty tells whether there is nothing to report
+	Empty() bool
+
+	// Render returns the section as it is to be printed on console
+	Render() string
+}
+
+// registry maps the names of all available dissectors to their implementation
+var registry = map[string]Dissector{
+	dataHTTP:      newHTTPDissector(),
+	dataDNS:       &dnsDissector{},
+	dataTLS:       &tlsDissector{},
+	dataHTTP2:     newHTTP2Dissector(),
+	dataWebSocket: newWebSocketDissector(),
+	dataRedis:     newKVDissector(dataRedis, "Redis", redisPort, newRESPParsers),
+	dataMemcached: newKVDissector(dataMemcached, "memcached", memcachedPort, newMemcachedParsers),
+	dataTCP:       newTCPDissector(),
+}
+
+// enabledDissectors returns the dissectors enabled in configuration, in configuration order, except that dissectors
+// sharing an analysis come first : they claim part of the traffic of the dissector they share with, like HTTP/2
+// upgrades starting as HTTP/1 requests.
+func enabledDissectors() []Dissector {
+	enabled := make([]Dissector, 0, len(config.packetFilter.dissectors))
+	for _, name := range config.packetFilter.dissectors {
+		if d, ok := registry[name]; ok {
+			enabled = append(enabled, d)
+		}
+	}
+
+	sort.SliceStable(enabled, func(i, j int) bool {
+		_, iShared := enabled[i].(sharedDissector)
+		_, jShared := enabled[j].(sharedDissector)
+		return iShared && !jShared
+	})
+	return enabled
+}
+
+// dissectorEnabled tells whether the dissector of the name is enabled in configuration
+func dissectorEnabled(name string) bool {
+	for _, n := range config.packetFilter.dissectors {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// buildFilter returns the BPF filter capturing the traffic of all the given dissectors
+func buildFilter(dissectors []Dissector) string {
+	fragments := make([]string, len(dissectors))
+	for i, d := range dissectors {
+		fragments[i] = "(" + d.Filter() + ")"
+	}
+	return strings.Join(fragments, " or ")
+}
+
+// matchDissector returns the first of the dissectors that matches the packet, or nil if none does.
+// Observers are not considered.
+func matchDissector(dissectors []Dissector, packet gopacket.Packet) Dissector {
+	for _, d := range dissectors {
+		if _, observer := d.(observerDissector); observer {
+			continue
+		}
+		if d.Match(packet) {
+			return d
+		}
+	}
+	return nil
+}
+
+// matchObservers returns the observers among the dissectors that match the packet
+func matchObservers(dissectors []Dissector, packet gopacket.Packet) []Dissector {
+	var observers []Dissector
+	for _, d := range dissectors {
+		if _, observer := d.(observerDissector); observer && d.Match(packet) {
+			observers = append(observers, d)
+		}
+	}
+	return observers
+}
+
+// EnableDissectors sets the protocols to analyse, by name of their dissector
+func EnableDissectors(names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("at least one protocol must be enabled")
+	}
+
+	for _, name := range names {
+		if _, ok := registry[name]; !ok {
+			return fmt.Errorf("unknown protocol '%s'", name)
+		}
+	}
+
+	config.packetFilter.dissectors = names
+	return nil
+}
@@ -0,0 +1,336 @@
+package gonetmon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dataDNS = "dns"
+	dnsPort = 53
+)
+
+// dnsMessage is a decoded DNS query or answer, with some additional information about its capture
+type dnsMessage struct {
+	dns       *layers.DNS
+	device    string    // Interface on which the message was recorded
+	remoteIP  string    // IP address of the remote peer, usually the resolver
+	timestamp time.Time // Capture timestamp
+}
+
+// dnsDissector handles DNS traffic on UDP and TCP port 53
+type dnsDissector struct{}
+
+// Name returns the name of the dissector
+func (d *dnsDissector) Name() string {
+	return dataDNS
+}
+
+// Filter returns the BPF fragment for DNS traffic
+func (d *dnsDissector) Filter() string {
+	return fmt.Sprintf("udp port %d or tcp port %d", dnsPort, dnsPort)
+}
+
+// decodeDNS returns the DNS message carried by the packet.
+// Over TCP, messages are prefixed by their length, which gopacket doesn't handle, so we decode it ourselves.
+func decodeDNS(packet gopacket.Packet) (*layers.DNS, error) {
+	if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+		if tcp.SrcPort != dnsPort && tcp.DstPort != dnsPort {
+			return nil, errors.New("not a DNS port")
+		}
+
+		payload := tcp.LayerPayload()
+		if len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) > len(payload)-2 {
+			return nil, errors.New("incomplete DNS message over TCP")
+		}
+
+		dns := &layers.DNS{}
+		if err := dns.DecodeFromBytes(payload[2:], gopacket.NilDecodeFeedback); err != nil {
+			return nil, err
+		}
+		return dns, nil
+	}
+
+	if dns, ok := packet.Layer(layers.LayerTypeDNS).(*layers.DNS); ok {
+		return dns, nil
+	}
+
+	return nil, errors.New("no DNS layer in packet")
+}
+
+// Match tells whether the packet carries a DNS message
+func (d *dnsDissector) Match(packet gopacket.Packet) bool {
+	_, err := decodeDNS(packet)
+	return err == nil
+}
+
+// Decode transforms the packet into a dnsMessage
+func (d *dnsDissector) Decode(data *packetMsg) (interface{}, error) {
+	dns, err := decodeDNS(data.rawPacket)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dnsMessage{
+		dns:       dns,
+		device:    data.device,
+		remoteIP:  data.remoteIP,
+		timestamp: data.rawPacket.Metadata().Timestamp,
+	}, nil
+}
+
+// NewAnalysis returns an empty DNS analysis
+func (d *dnsDissector) NewAnalysis() protocolAnalysis {
+	return newDNSAnalysis()
+}
+
+// nameEntry is a hostname resolved for an IP address, valid until expiry
+type nameEntry struct {
+	name   string
+	expiry time.Time
+}
+
+// dnsCache maps IP addresses to the hostnames they were resolved for, learned from DNS answers.
+// It is safe for concurrent use.
+type dnsCache struct {
+	mu      sync.RWMutex
+	names   map[string]nameEntry
+	maxSize int
+}
+
+// nameCache is the cache of resolved hostnames, shared by dissectors
+var nameCache = newDNSCache(defDNSCacheSize)
+
+// newDNSCache returns an empty cache holding at most maxSize addresses
+func newDNSCache(maxSize int) *dnsCache {
+	return &dnsCache{
+		names:   make(map[string]nameEntry),
+		maxSize: maxSize,
+	}
+}
+
+// add registers that ip was resolved for name, for ttl
+func (c *dnsCache) add(ip string, name string, ttl time.Duration, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// When full, first drop expired entries, and start over if that's not enough
+	if _, ok := c.names[ip]; !ok && len(c.names) >= c.maxSize {
+		for k, e := range c.names {
+			if now.After(e.expiry) {
+				delete(c.names, k)
+			}
+		}
+		if len(c.names) >= c.maxSize {
+			c.names = make(map[string]nameEntry)
+		}
+	}
+
+	// Keep names a little longer than their TTL : clients often keep connections open past it
+	c.names[ip] = nameEntry{
+		name:   name,
+		expiry: now.Add(ttl + defDNSCacheGrace),
+	}
+}
+
+// lookup returns the name the ip was last resolved for, if still valid
+func (c *dnsCache) lookup(ip string, now time.Time) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	e, ok := c.names[ip]
+	if !ok || now.After(e.expiry) {
+		return "", false
+	}
+	return e.name, true
+}
+
+// nameStats holds the number of times a name was queried
+type nameStats struct {
+	name    string
+	queries int
+}
+
+// sortedNames implements sort.Interface based on the queries of nameStats
+type sortedNames []*nameStats
+
+func (n sortedNames) Len() int           { return len(n) }
+func (n sortedNames) Less(i, j int) bool { return n[i].queries > n[j].queries }
+func (n sortedNames) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+// dnsAnalysis holds accumulated DNS data between two reports
+type dnsAnalysis struct {
+	queries   map[string]*nameStats          // Statistics per queried name
+	nbQueries int                            // Number of queries
+	nbAnswers int                            // Number of answers
+	rcodes    map[layers.DNSResponseCode]int // Number of answers per response code
+	pending   map[string]time.Time           // Capture time of queries not yet answered, to measure resolver latency
+	latency   time.Duration                  // Sum of resolver latencies
+	nbLatency int                            // Number of answers latency was measured for
+	last      time.Time                      // Capture time of the most recent message
+}
+
+// newDNSAnalysis returns a new and empty DNS analysis
+func newDNSAnalysis() *dnsAnalysis {
+	return &dnsAnalysis{
+		queries: make(map[string]*nameStats),
+		rcodes:  make(map[layers.DNSResponseCode]int),
+		pending: make(map[string]time.Time),
+	}
+}
+
+// pendingKey identifies a query so that its answer can be matched to it
+func pendingKey(m *dnsMessage) string {
+	name := ""
+	if len(m.dns.Questions) > 0 {
+		name = strings.ToLower(string(m.dns.Questions[0].Name))
+	}
+	return fmt.Sprintf("%d|%s|%s", m.dns.ID, m.remoteIP, name)
+}
+
+// addQuery registers a query
+func (a *dnsAnalysis) addQuery(m *dnsMessage) {
+	a.nbQueries++
+
+	for _, q := range m.dns.Questions {
+		name := strings.ToLower(string(q.Name))
+		stats, ok := a.queries[name]
+		if !ok {
+			stats = &nameStats{name: name}
+			a.queries[name] = stats
+		}
+		stats.queries++
+	}
+
+	if len(a.pending) >= defMaxFlows {
+		a.evictPending()
+	}
+	if len(a.pending) < defMaxFlows {
+		a.pending[pendingKey(m)] = m.timestamp
+	}
+}
+
+// evictPending forgets the queries that were not answered in time, as they are lost
+func (a *dnsAnalysis) evictPending() {
+	for key, t := range a.pending {
+		if a.last.Sub(t) > defDNSQueryTimeout {
+			delete(a.pending, key)
+		}
+	}
+}
+
+// addAnswer registers an answer, measures latency, and feeds the name cache with resolved addresses
+func (a *dnsAnalysis) addAnswer(m *dnsMessage) {
+	a.nbAnswers++
+	a.rcodes[m.dns.ResponseCode]++
+
+	key := pendingKey(m)
+	if t, ok := a.pending[key]; ok {
+		a.latency += m.timestamp.Sub(t)
+		a.nbLatency++
+		delete(a.pending, key)
+	}
+
+	if len(m.dns.Questions) == 0 {
+		return
+	}
+
+	// Addresses are attributed to the queried name rather than to intermediate aliases
+	name := strings.ToLower(string(m.dns.Questions[0].Name))
+	for _, rr := range m.dns.Answers {
+		if rr.Type == layers.DNSTypeA || rr.Type == layers.DNSTypeAAAA {
+			nameCache.add(rr.IP.String(), name, time.Duration(rr.TTL)*time.Second, m.timestamp)
+		}
+	}
+}
+
+// Add adds a DNS message to the analysis. DNS messages don't count as hits.
+func (a *dnsAnalysis) Add(message interface{}) bool {
+	m, ok := message.(*dnsMessage)
+	if !ok {
+		return false
+	}
+
+	if m.timestamp.After(a.last) {
+		a.last = m.timestamp
+	}
+
+	if m.dns.QR {
+		a.addAnswer(m)
+	} else {
+		a.addQuery(m)
+	}
+
+	return false
+}
+
+// Renew returns a new analysis, keeping queries that were not yet answered nor timed out
+func (a *dnsAnalysis) Renew() protocolAnalysis {
+	a.evictPending()
+	renewed := newDNSAnalysis()
+	renewed.pending = a.pending
+	renewed.last = a.last
+	return renewed
+}
+
+// Report builds the DNS section of the report
+func (a *dnsAnalysis) Report() protocolReport {
+	names := make([]*nameStats, 0, len(a.queries))
+	for _, stats := range a.queries {
+		names = append(names, stats)
+	}
+	sort.Sort(sortedNames(names))
+	if len(names) > config.packetFilter.nbSections {
+		names = names[:config.packetFilter.nbSections]
+	}
+
+	r := &dnsReport{
+		topNames:  names,
+		nbQueries: a.nbQueries,
+		nbAnswers: a.nbAnswers,
+	}
+
+	if a.nbAnswers > 0 {
+		r.nxdomain = float64(a.rcodes[layers.DNSResponseCodeNXDomain]) / float64(a.nbAnswers)
+		r.servfail = float64(a.rcodes[layers.DNSResponseCodeServFail]) / float64(a.nbAnswers)
+	}
+	if a.nbLatency > 0 {
+		r.latency = a.latency / time.Duration(a.nbLatency)
+	}
+
+	return r
+}
+
+// dnsReport holds the final result of a DNS analysis
+type dnsReport struct {
+	topNames  []*nameStats  // Most queried names
+	nbQueries int           // Number of queries
+	nbAnswers int           // Number of answers
+	nxdomain  float64       // Ratio of answers that were NXDOMAIN
+	servfail  float64       // Ratio of answers that were SERVFAIL
+	latency   time.Duration // Average resolver latency
+}
+
+// Empty tells whether no DNS message was seen
+func (r *dnsReport) Empty() bool {
+	return r.nbQueries == 0 && r.nbAnswers == 0
+}
+
+// Render returns the DNS section of the console display
+func (r *dnsReport) Render() string {
+	var output string
+
+	output += fmt.Sprintf(reportDNS+"\n", r.nbQueries, r.nbAnswers, r.nxdomain*100, r.servfail*100, r.latency)
+	for _, n := range r.topNames {
+		output += fmt.Sprintf(reportDNSName+"\n", n.name, n.queries)
+	}
+
+	return output
+}
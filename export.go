@@ -0,0 +1,412 @@
+package gonetmon
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons for a flow to be exported, as IPFIX flowEndReason values
+const (
+	flowEndIdle     = 1 // No packet was seen for the idle timeout
+	flowEndActive   = 2 // The flow lasted for the active timeout
+	flowEndDetected = 3 // The connection was closed or reset
+	flowEndForced   = 4 // Monitoring stops
+	flowEndLack     = 5 // The flow table is full
+)
+
+// flowEndReasons maps the reasons for a flow to be exported to their name in JSON records
+var flowEndReasons = map[uint8]string{
+	flowEndIdle:     "idle",
+	flowEndActive:   "active",
+	flowEndDetected: "end",
+	flowEndForced:   "forced",
+	flowEndLack:     "lack of resources",
+}
+
+// tcpFlagNames are the names of the TCP flags, from the lowest bit of the flags byte
+const tcpFlagNames = "FSRPAUEC"
+
+// flowTuple identifies a unidirectional flow by its 5-tuple
+type flowTuple struct {
+	network  gopacket.Flow // Source and destination addresses
+	srcPort  uint16
+	dstPort  uint16
+	protocol uint8
+}
+
+// flowRecord holds the statistics of a unidirectional flow
+type flowRecord struct {
+	srcIP     net.IP
+	dstIP     net.IP
+	srcPort   uint16
+	dstPort   uint16 // For ICMP, the type and code
+	protocol  uint8
+	packets   uint64
+	bytes     uint64 // IP bytes, headers included
+	first     time.Time
+	last      time.Time
+	tcpFlags  uint8 // Union of the TCP flags seen
+	endReason uint8 // Reason for the flow to be exported
+}
+
+// flowPacket holds the flow information of a packet
+type flowPacket struct {
+	key    flowTuple
+	record flowRecord // Record of the flow, as if it was made of this packet only
+	ends   bool       // Whether the packet closes or resets a connection
+}
+
+// tcpFlagsByte returns the TCP flags of the segment as in its header
+func tcpFlagsByte(tcp *layers.TCP) uint8 {
+	var flags uint8
+	for i, set := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR} {
+		if set {
+			flags |= 1 << uint(i)
+		}
+	}
+	return flags
+}
+
+// newFlowPacket extracts the flow information of an IP packet, or returns false if the packet is not IP
+func newFlowPacket(packet gopacket.Packet) (*flowPacket, bool) {
+	network := packet.NetworkLayer()
+	if network == nil {
+		return nil, false
+	}
+
+	p := &flowPacket{}
+	switch ip := network.(type) {
+	case *layers.IPv4:
+		p.record.protocol = uint8(ip.Protocol)
+		p.record.bytes = uint64(ip.Length)
+	case *layers.IPv6:
+		p.record.protocol = uint8(ip.NextHeader)
+		p.record.bytes = uint64(ip.Length) + 40
+	default:
+		return nil, false
+	}
+
+	p.key.network = network.NetworkFlow()
+	p.key.protocol = p.record.protocol
+	src, dst := p.key.network.Endpoints()
+	p.record.srcIP = net.IP(src.Raw())
+	p.record.dstIP = net.IP(dst.Raw())
+
+	switch t := packet.TransportLayer().(type) {
+	case *layers.TCP:
+		p.record.srcPort, p.record.dstPort = uint16(t.SrcPort), uint16(t.DstPort)
+		p.record.tcpFlags = tcpFlagsByte(t)
+		p.ends = t.FIN || t.RST
+	case *layers.UDP:
+		p.record.srcPort, p.record.dstPort = uint16(t.SrcPort), uint16(t.DstPort)
+	}
+
+	// ICMP has no ports, by convention its type and code take the place of the destination port
+	if icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		p.record.dstPort = uint16(icmp.TypeCode)
+	} else if icmp, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+		p.record.dstPort = uint16(icmp.TypeCode)
+	}
+	p.key.srcPort, p.key.dstPort = p.record.srcPort, p.record.dstPort
+
+	p.record.packets = 1
+	p.record.first = packet.Metadata().Timestamp
+	p.record.last = p.record.first
+	return p, true
+}
+
+// flowTable holds the flows being observed. Its clock follows capture time, so that files are read as if live.
+type flowTable struct {
+	flows         map[flowTuple]*flowRecord
+	maxSize       int           // Maximum number of flows to observe at once
+	idleTimeout   time.Duration // Flows are exported when no packet was seen for that long
+	activeTimeout time.Duration // Long lasting flows are exported at this period
+	origin        time.Time     // Capture time of the first packet
+	latest        time.Time     // Capture time of the latest packet
+	arrival       time.Time     // Time the latest packet was observed at
+}
+
+// newFlowTable returns an empty flow table
+func newFlowTable(maxSize int, idleTimeout time.Duration, activeTimeout time.Duration) *flowTable {
+	return &flowTable{
+		flows:         make(map[flowTuple]*flowRecord),
+		maxSize:       maxSize,
+		idleTimeout:   idleTimeout,
+		activeTimeout: activeTimeout,
+	}
+}
+
+// clock returns the capture time it is, given the time it is now
+func (t *flowTable) clock(now time.Time) time.Time {
+	if t.latest.IsZero() {
+		return now
+	}
+	return t.latest.Add(now.Sub(t.arrival))
+}
+
+// add accounts the packet in its flow, and returns the flows that ended
+func (t *flowTable) add(packet gopacket.Packet, now time.Time) []*flowRecord {
+	p, ok := newFlowPacket(packet)
+	if !ok {
+		return nil
+	}
+
+	if t.origin.IsZero() {
+		t.origin = p.record.first
+	}
+	if p.record.first.After(t.latest) {
+		t.latest = p.record.first
+	}
+	t.arrival = now
+
+	var ended []*flowRecord
+	r, ok := t.flows[p.key]
+	if ok && p.record.first.Sub(r.first) >= t.activeTimeout {
+		r.endReason = flowEndActive
+		ended = append(ended, r)
+		ok = false
+	}
+
+	if !ok {
+		// Don't grow indefinitely : when full, export all flows and start over
+		if len(t.flows) >= t.maxSize {
+			ended = append(ended, t.flush(flowEndLack)...)
+		}
+		r = &p.record
+		t.flows[p.key] = r
+	} else {
+		r.packets++
+		r.bytes += p.record.bytes
+		r.last = p.record.last
+		r.tcpFlags |= p.record.tcpFlags
+	}
+
+	if p.ends {
+		r.endReason = flowEndDetected
+		ended = append(ended, r)
+		delete(t.flows, p.key)
+	}
+
+	return ended
+}
+
+// expire returns the flows that saw no packet for the idle timeout, or lasted for the active timeout
+func (t *flowTable) expire(now time.Time) []*flowRecord {
+	clock := t.clock(now)
+
+	var expired []*flowRecord
+	for key, r := range t.flows {
+		switch {
+		case clock.Sub(r.last) >= t.idleTimeout:
+			r.endReason = flowEndIdle
+		case clock.Sub(r.first) >= t.activeTimeout:
+			r.endReason = flowEndActive
+		default:
+			continue
+		}
+		expired = append(expired, r)
+		delete(t.flows, key)
+	}
+
+	return expired
+}
+
+// flush returns all flows, and empties the table
+func (t *flowTable) flush(reason uint8) []*flowRecord {
+	flushed := make([]*flowRecord, 0, len(t.flows))
+	for _, r := range t.flows {
+		r.endReason = reason
+		flushed = append(flushed, r)
+	}
+	t.flows = make(map[flowTuple]*flowRecord)
+	return flushed
+}
+
+// flowJSON is the JSON representation of a flow record
+type flowJSON struct {
+	Source          string    `json:"src"`
+	Destination     string    `json:"dst"`
+	SourcePort      uint16    `json:"src_port"`
+	DestinationPort uint16    `json:"dst_port"`
+	Protocol        string    `json:"protocol"`
+	Packets         uint64    `json:"packets"`
+	Bytes           uint64    `json:"bytes"`
+	First           time.Time `json:"first"`
+	Last            time.Time `json:"last"`
+	TCPFlags        string    `json:"tcp_flags,omitempty"`
+	EndReason       string    `json:"end_reason"`
+}
+
+// newFlowJSON returns the JSON representation of the record
+func newFlowJSON(r *flowRecord) *flowJSON {
+	var flags []byte
+	for i := range tcpFlagNames {
+		if r.tcpFlags&(1<<uint(i)) != 0 {
+			flags = append(flags, tcpFlagNames[i])
+		}
+	}
+
+	return &flowJSON{
+		Source:          r.srcIP.String(),
+		Destination:     r.dstIP.String(),
+		SourcePort:      r.srcPort,
+		DestinationPort: r.dstPort,
+		Protocol:        layers.IPProtocol(r.protocol).String(),
+		Packets:         r.packets,
+		Bytes:           r.bytes,
+		First:           r.first,
+		Last:            r.last,
+		TCPFlags:        string(flags),
+		EndReason:       flowEndReasons[r.endReason],
+	}
+}
+
+// flowExporter sends flow records to a collector and to a file of JSON lines
+type flowExporter struct {
+	conn     net.Conn      // Connection to the collector, or nil
+	format   string        // Format of the records sent to the collector
+	file     *os.File      // File of JSON lines, or nil
+	json     *json.Encoder // Encoder writing to file
+	sequence uint32        // Sequence number of the next message : records sent for IPFIX, messages sent for NetFlow v9
+	messages int           // Number of messages sent, to send templates again
+	records  int           // Number of records exported
+	errors   int           // Number of records that could not be exported
+}
+
+// newFlowExporter opens the destinations of flow records set in configuration
+func newFlowExporter(conf *exportConfig) (*flowExporter, error) {
+	e := &flowExporter{format: conf.format}
+
+	if conf.collector != "" {
+		conn, err := net.Dial("udp", conf.collector)
+		if err != nil {
+			return nil, err
+		}
+		e.conn = conn
+	}
+
+	if conf.jsonFile != "" {
+		file, err := os.OpenFile(conf.jsonFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			e.close()
+			return nil, err
+		}
+		e.file = file
+		e.json = json.NewEncoder(file)
+	}
+
+	return e, nil
+}
+
+// export sends the records to the destinations. Capture time now is the time of export.
+func (e *flowExporter) export(records []*flowRecord, now time.Time, origin time.Time) {
+	if len(records) == 0 {
+		return
+	}
+
+	if e.conn != nil {
+		for _, m := range e.encode(records, now, origin) {
+			if _, err := e.conn.Write(m.data); err != nil {
+				log.WithFields(logrus.Fields{
+					"collector": e.conn.RemoteAddr(),
+					"error":     err,
+				}).Error("Could not send flow records.")
+				e.errors += m.records
+			}
+		}
+	}
+
+	if e.json != nil {
+		for _, r := range records {
+			if err := e.json.Encode(newFlowJSON(r)); err != nil {
+				log.WithFields(logrus.Fields{
+					"file":  e.file.Name(),
+					"error": err,
+				}).Error("Could not write flow record.")
+				e.errors++
+			}
+		}
+	}
+
+	e.records += len(records)
+}
+
+// close closes the destinations
+func (e *flowExporter) close() {
+	if e.conn != nil {
+		_ = e.conn.Close()
+	}
+	if e.file != nil {
+		_ = e.file.Close()
+	}
+}
+
+// Exporter maintains a table of the flows of all captured traffic received on flowChan, and exports them when
+// they end, expire, or when monitoring stops
+func Exporter(exporter *flowExporter, flowChan <-chan packetMsg, syn *synchronisation) {
+	defer syn.wg.Done()
+
+	table := newFlowTable(defMaxFlows, config.export.idleTimeout, config.export.activeTimeout)
+
+	ticker := time.NewTicker(defFlowSweep)
+	defer ticker.Stop()
+
+exporterLoop:
+	for {
+		select {
+
+		case <-syn.syncChan:
+			break exporterLoop
+
+		case now := <-ticker.C:
+			exporter.export(table.expire(now), table.clock(now), table.origin)
+
+		case data := <-flowChan:
+			now := time.Now()
+			exporter.export(table.add(data.rawPacket, now), table.clock(now), table.origin)
+		}
+	}
+
+	now := time.Now()
+	exporter.export(table.flush(flowEndForced), table.clock(now), table.origin)
+	exporter.close()
+
+	log.WithFields(logrus.Fields{
+		"records": exporter.records,
+		"errors":  exporter.errors,
+		"dropped": atomic.LoadUint64(&dropped.flows),
+	}).Info("Exporter terminating")
+}
+
+// SetFlowExport enables the export of flow records of all captured traffic, to a collector given by its address and
+// UDP port, in ipfix or netflow9 format, and to a file of JSON lines. Either destination may be empty.
+// Flows are exported when no packet was seen for the idle timeout, and at least every active timeout.
+func SetFlowExport(collector string, format string, jsonFile string, idleTimeout time.Duration, activeTimeout time.Duration) error {
+	if format != exportIPFIX && format != exportNetFlow9 {
+		return fmt.Errorf("invalid flow export format '%s', must be one of %s or %s", format, exportIPFIX, exportNetFlow9)
+	}
+	if collector != "" {
+		if _, _, err := net.SplitHostPort(collector); err != nil {
+			return fmt.Errorf("invalid collector address '%s' : %s", collector, err)
+		}
+	}
+	if idleTimeout <= 0 || activeTimeout <= 0 {
+		return fmt.Errorf("flow timeouts must be positive")
+	}
+
+	config.export = exportConfig{
+		collector:     collector,
+		format:        format,
+		jsonFile:      jsonFile,
+		idleTimeout:   idleTimeout,
+		activeTimeout: activeTimeout,
+	}
+	return nil
+}
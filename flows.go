@@ -0,0 +1,105 @@
+package gonetmon
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+)
+
+// Roles the local host can play in a HTTP exchange
+const (
+	roleClient = "client" // We issue requests to remote web servers
+	roleServer = "server" // We serve requests of remote clients, on local virtual hosts
+	roleAuto   = "auto"   // Role is detected for each message, from the direction of the requests
+)
+
+// flowHosts remembers the host that was requested on each connection, so that responses, which don't carry the
+// host, can be attributed to it. It outlives analyses, since a response may come after a report was built.
+type flowHosts struct {
+	hosts   map[string]string // Maps a connection to the last host requested on it
+	maxSize int               // Maximum number of connections to remember
+}
+
+// newFlowHosts returns an empty table of connections to hosts
+func newFlowHosts(maxSize int) *flowHosts {
+	return &flowHosts{
+		hosts:   make(map[string]string),
+		maxSize: maxSize,
+	}
+}
+
+// set registers the host requested on the connection
+func (f *flowHosts) set(flow string, host string) {
+	// Don't grow indefinitely : start over when full, connections still active will register again
+	if _, ok := f.hosts[flow]; !ok && len(f.hosts) >= f.maxSize {
+		f.hosts = make(map[string]string)
+	}
+	f.hosts[flow] = host
+}
+
+// get returns the last host requested on the connection, if any
+func (f *flowHosts) get(flow string) (string, bool) {
+	host, ok := f.hosts[flow]
+	return host, ok
+}
+
+// localPorts returns the local and remote ports of the packet, given its local IP address
+func localPorts(packet gopacket.Packet, localIP string) (uint16, uint16) {
+	srcPort, dstPort := getPorts(packet)
+
+	src, _ := packet.NetworkLayer().NetworkFlow().Endpoints()
+	if src.String() == localIP {
+		return srcPort, dstPort
+	}
+	return dstPort, srcPort
+}
+
+// flowKey returns an identifier of a connection, that is the same in both directions
+func flowKey(localIP string, localPort uint16, remoteIP string, remotePort uint16) string {
+	return fmt.Sprintf("%s:%d-%s:%d", localIP, localPort, remoteIP, remotePort)
+}
+
+// getLocalPorts returns the local and remote ports of the packet
+func getLocalPorts(p *MetaPacket) (uint16, uint16) {
+	return localPorts(p.packet, p.deviceIP)
+}
+
+// getFlowKey returns an identifier of the connection the packet belongs to, that is the same in both directions
+func getFlowKey(p *MetaPacket) string {
+	return flowKey(p.deviceIP, p.localPort, p.remoteIP, p.remotePort)
+}
+
+// getServerPort returns the port the HTTP server is listening on
+func getServerPort(p *MetaPacket) uint16 {
+	if p.role == roleServer {
+		return p.localPort
+	}
+	return p.remotePort
+}
+
+// getRole returns the role the local host plays for this message, as configured or as detected from its direction :
+// receiving a request or sending a response means we are the server
+func getRole(p *MetaPacket) string {
+	if config.role != roleAuto {
+		return config.role
+	}
+
+	switch {
+	case p.messageType == httpRequest && p.direction == directionInbound:
+		return roleServer
+	case p.messageType == httpResponse && p.direction == directionOutbound:
+		return roleServer
+	default:
+		return roleClient
+	}
+}
+
+// SetRole sets the role the local host plays in HTTP exchanges : client, server, or auto to detect it per message
+func SetRole(role string) error {
+	switch role {
+	case roleClient, roleServer, roleAuto:
+		config.role = role
+		return nil
+	default:
+		return fmt.Errorf("invalid role '%s', must be one of %s, %s or %s", role, roleClient, roleServer, roleAuto)
+	}
+}
@@ -0,0 +1,184 @@
+package gonetmon
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// grpcStatusUnknown is reported for calls whose status was not seen, like calls reset before their trailers
+const grpcStatusUnknown = "UNKNOWN"
+
+// grpcCodes maps gRPC status codes to their name
+var grpcCodes = []string{
+	"OK",
+	"CANCELLED",
+	"UNKNOWN",
+	"INVALID_ARGUMENT",
+	"DEADLINE_EXCEEDED",
+	"NOT_FOUND",
+	"ALREADY_EXISTS",
+	"PERMISSION_DENIED",
+	"RESOURCE_EXHAUSTED",
+	"FAILED_PRECONDITION",
+	"ABORTED",
+	"OUT_OF_RANGE",
+	"UNIMPLEMENTED",
+	"INTERNAL",
+	"UNAVAILABLE",
+	"DATA_LOSS",
+	"UNAUTHENTICATED",
+}
+
+// grpcErrorClass maps the status names of failed gRPC calls to the status class they count in, client or server
+// errors, as they are answered with 200 OK
+var grpcErrorClass = map[string]int{
+	"CANCELLED":           4,
+	"UNKNOWN":             5,
+	"INVALID_ARGUMENT":    4,
+	"DEADLINE_EXCEEDED":   5,
+	"NOT_FOUND":           4,
+	"ALREADY_EXISTS":      4,
+	"PERMISSION_DENIED":   4,
+	"RESOURCE_EXHAUSTED":  4,
+	"FAILED_PRECONDITION": 4,
+	"ABORTED":             4,
+	"OUT_OF_RANGE":        4,
+	"UNIMPLEMENTED":       5,
+	"INTERNAL":            5,
+	"UNAVAILABLE":         5,
+	"DATA_LOSS":           5,
+	"UNAUTHENTICATED":     4,
+}
+
+// isGRPC tells whether the message's content type is gRPC
+func isGRPC(header http.Header) bool {
+	return strings.HasPrefix(header.Get("Content-Type"), "application/grpc")
+}
+
+// grpcStatus returns the name of the status of a gRPC call, found in the trailers of its response,
+// or in its headers for responses made only of trailers
+func grpcStatus(res *http.Response) string {
+	value := res.Trailer.Get("grpc-status")
+	if value == "" {
+		value = res.Header.Get("grpc-status")
+	}
+
+	code, err := strconv.Atoi(value)
+	if err != nil || code < 0 {
+		return grpcStatusUnknown
+	}
+	if code >= len(grpcCodes) {
+		return value
+	}
+	return grpcCodes[code]
+}
+
+// callClass returns the status class of a response. gRPC calls answered with 200 OK count in the class of their gRPC
+// status, so that failed calls count as errors.
+func callClass(res *http.Response) int {
+	if res.StatusCode != http.StatusOK || !isGRPC(res.Header) {
+		return statusClass(res.StatusCode)
+	}
+	status := grpcStatus(res)
+	if status == grpcCodes[0] {
+		return statusClass(res.StatusCode)
+	}
+	if class, ok := grpcErrorClass[status]; ok {
+		return class
+	}
+	return 5
+}
+
+// grpcMethodStats holds statistics about the calls of a gRPC method
+type grpcMethodStats struct {
+	method  string          // Full method name, like /package.Service/Method
+	calls   int             // Number of completed calls
+	codes   map[string]uint // Map status names to the number of calls that ended with it
+	latency time.Duration   // Total latency of the calls whose request was seen
+	timed   int             // Number of calls whose request was seen
+}
+
+// sortedGRPCMethods implements sort.Interface based on the calls of grpcMethodStats
+type sortedGRPCMethods []*grpcMethodStats
+
+func (m sortedGRPCMethods) Len() int           { return len(m) }
+func (m sortedGRPCMethods) Less(i, j int) bool { return m[i].calls > m[j].calls }
+func (m sortedGRPCMethods) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// average returns the average latency of the method's calls
+func (m *grpcMethodStats) average() time.Duration {
+	if m.timed == 0 {
+		return 0
+	}
+	return m.latency / time.Duration(m.timed)
+}
+
+// updateGRPCStats updates the statistics of the method a gRPC response answers
+func (a *analysis) updateGRPCStats(p *MetaPacket) {
+	// Without the request, the method is unknown
+	if p.response.Request == nil {
+		return
+	}
+	method := getSection(p.response.Request)
+
+	stats, ok := a.grpc[method]
+	if !ok {
+		stats = &grpcMethodStats{
+			method: method,
+			codes:  make(map[string]uint),
+		}
+		a.grpc[method] = stats
+	}
+
+	stats.calls++
+	stats.codes[grpcStatus(p.response)]++
+	if p.latency > 0 {
+		stats.latency += p.latency
+		stats.timed++
+	}
+}
+
+// topGRPCMethods returns the gRPC methods with the most calls
+func (a *analysis) topGRPCMethods() []*grpcMethodStats {
+	methods := make([]*grpcMethodStats, 0, len(a.grpc))
+	for _, stats := range a.grpc {
+		methods = append(methods, stats)
+	}
+	sort.Sort(sortedGRPCMethods(methods))
+
+	if len(methods) > config.packetFilter.nbSections {
+		methods = methods[:config.packetFilter.nbSections]
+	}
+	return methods
+}
+
+// buildGRPCCodeOutput returns a string representation of gRPC status names and their count, in name order
+func buildGRPCCodeOutput(codes map[string]uint) string {
+	names := make([]string, 0, len(codes))
+	for name := range codes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var output string
+	for _, name := range names {
+		output += fmt.Sprintf("%s(%d) ", name, codes[name])
+	}
+	return output
+}
+
+// buildGRPCOutput returns a string representation of the gRPC methods, their calls, status codes and latency
+func buildGRPCOutput(methods []*grpcMethodStats) string {
+	var output string
+
+	output += reportGRPC + "\n"
+	for _, m := range methods {
+		output += fmt.Sprintf(reportGRPCMethod+"\n", m.method, m.calls, m.average(), buildGRPCCodeOutput(m.codes))
+	}
+
+	return output
+}
@@ -0,0 +1,99 @@
+package gonetmon
+
+import (
+	"bytes"
+	"golang.org/x/net/http2/hpack"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGRPCResetCalls(t *testing.T) {
+	tests := []struct {
+		name   string
+		code   uint32 // Error code of the RST_STREAM frame
+		status string
+	}{
+		{"cancelled by the client", h2ErrorCancel, "CANCELLED"},
+		{"refused by the server", 0x7, "UNKNOWN"},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		request := h2Block(hpack.NewEncoder(&buf), &buf, ":method", "POST", ":path", "/pkg.Service/Get",
+			":authority", "grpc.test", "content-type", "application/grpc")
+
+		c := newH2Conn("client", false)
+		data := append([]byte(h2Preface), h2FrameBytes(h2FrameHeaders, h2FlagEndHeaders, 1, request)...)
+		data = append(data, h2FrameBytes(h2FrameRSTStream, 0, 1, u16(u16(nil, int(tt.code>>16)), int(tt.code)))...)
+		if err := c.consume(c.toServer, data, 0); err != nil {
+			t.Fatalf("%s : %v", tt.name, err)
+		}
+
+		if len(c.responses) != 1 {
+			t.Fatalf("%s : %d responses, want 1", tt.name, len(c.responses))
+		}
+		res := c.responses[0].response
+		if got := grpcStatus(res); got != tt.status {
+			t.Errorf("%s : status %s, want %s", tt.name, got, tt.status)
+		}
+		if class := callClass(res); class < 4 {
+			t.Errorf("%s : status class %dxx, want an error", tt.name, class)
+		}
+	}
+}
+
+func TestCallClass(t *testing.T) {
+	grpc := func(status int, grpcStatus string) *http.Response {
+		res := &http.Response{StatusCode: status, Header: make(http.Header), Trailer: make(http.Header)}
+		res.Header.Set("Content-Type", "application/grpc")
+		if grpcStatus != "" {
+			res.Trailer.Set("grpc-status", grpcStatus)
+		}
+		return res
+	}
+
+	tests := []struct {
+		name  string
+		res   *http.Response
+		class int
+	}{
+		{"HTTP", &http.Response{StatusCode: http.StatusNotFound, Header: make(http.Header)}, 4},
+		{"gRPC OK", grpc(http.StatusOK, "0"), 2},
+		{"gRPC NOT_FOUND", grpc(http.StatusOK, "5"), 4},
+		{"gRPC UNAVAILABLE", grpc(http.StatusOK, "14"), 5},
+		{"gRPC without status", grpc(http.StatusOK, ""), 5},
+		{"gRPC with an unknown status", grpc(http.StatusOK, "42"), 5},
+		{"gRPC behind a failing proxy", grpc(http.StatusBadGateway, ""), 5},
+	}
+
+	for _, tt := range tests {
+		if got := callClass(tt.res); got != tt.class {
+			t.Errorf("%s : status class %dxx, want %dxx", tt.name, got, tt.class)
+		}
+	}
+
+	// Failed calls count in the error rate
+	s := newResponseStats()
+	s.add(grpc(http.StatusOK, "0"))
+	s.add(grpc(http.StatusOK, "5"))
+	if rate := s.errorRate(); rate != 50 {
+		t.Errorf("error rate %.0f%%, want 50%%", rate)
+	}
+
+	// The HTTP status codes are the ones the server sent, the gRPC ones are counted by name
+	a := NewAnalysis()
+	a.updateResponseStats(testHost, "", roleClient, grpc(http.StatusOK, "0"))
+	a.updateResponseStats(testHost, "", roleClient, grpc(http.StatusOK, "1"))
+	host := a.hosts[testHost]
+	if len(host.nbStatus) != 1 || host.nbStatus[http.StatusOK] != 2 {
+		t.Errorf("HTTP status codes %v, want 2 calls answered with 200", host.nbStatus)
+	}
+	if host.grpcCodes["OK"] != 1 || host.grpcCodes["CANCELLED"] != 1 {
+		t.Errorf("gRPC status codes %v, want OK and CANCELLED", host.grpcCodes)
+	}
+	r := &httpReport{topHost: host, traffic: map[string]int64{}, directions: map[string]int{}}
+	if output := r.Render(); !strings.Contains(output, "gRPC status CANCELLED(1) OK(1)") {
+		t.Errorf("gRPC status codes not rendered : %s", output)
+	}
+}
@@ -0,0 +1,256 @@
+package gonetmon
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// sparkTicks are the characters of sparklines, from the lowest to the highest value
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+// historySample holds the traffic of a report window
+type historySample struct {
+	t            time.Time
+	hits         int              // Messages that counted as hits for the watchdog
+	bytes        int64            // Bytes of HTTP bodies announced by responses
+	errorRate    float64          // Share of HTTP error responses, in percent
+	watchdogHits int              // Hits of the watchdog over its time frame, at the end of the window
+	traffic      map[string]int64 // Maps devices to the HTTP traffic seen on them
+}
+
+// historyRing is a fixed size circular buffer of samples, overwriting the oldest ones when full
+type historyRing struct {
+	samples []historySample
+	next    int  // Position of the next sample to write
+	full    bool // Whether the oldest samples are being overwritten
+}
+
+// newHistoryRing returns an empty ring holding up to size samples
+func newHistoryRing(size int) *historyRing {
+	if size < 1 {
+		size = 1
+	}
+	return &historyRing{samples: make([]historySample, size)}
+}
+
+// push adds the sample to the ring
+func (r *historyRing) push(s historySample) {
+	r.samples[r.next] = s
+	r.next = (r.next + 1) % len(r.samples)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// ordered returns the samples of the ring, from the oldest to the most recent
+func (r *historyRing) ordered() []historySample {
+	if !r.full {
+		return r.samples[:r.next]
+	}
+	return append(append([]historySample{}, r.samples[r.next:]...), r.samples[:r.next]...)
+}
+
+// history keeps the recent samples at report resolution, and older ones downsampled. It's only accessed by display.
+type history struct {
+	recent  *historyRing
+	daily   *historyRing
+	pending []historySample // Samples of the current downsampling step
+}
+
+// newHistory returns an empty history for reports every refresh period
+func newHistory(refresh time.Duration) *history {
+	return &history{
+		recent: newHistoryRing(int(defHistoryRecent / refresh)),
+		daily:  newHistoryRing(int(defHistoryDaily / defHistoryStep)),
+	}
+}
+
+// downsample returns a sample summing up the samples : traffic adds up, rates average, and the watchdog's highest
+// number of hits is kept
+func downsample(samples []historySample) historySample {
+	s := historySample{t: samples[0].t, traffic: make(map[string]int64)}
+	for _, sample := range samples {
+		s.hits += sample.hits
+		s.bytes += sample.bytes
+		s.errorRate += sample.errorRate / float64(len(samples))
+		if sample.watchdogHits > s.watchdogHits {
+			s.watchdogHits = sample.watchdogHits
+		}
+		for dev, bits := range sample.traffic {
+			s.traffic[dev] += bits
+		}
+	}
+	return s
+}
+
+// add records the sample, and a downsampled one for each step of time
+func (h *history) add(s historySample) {
+	h.recent.push(s)
+
+	if len(h.pending) > 0 && s.t.Sub(h.pending[0].t) >= defHistoryStep {
+		h.daily.push(downsample(h.pending))
+		h.pending = h.pending[:0]
+	}
+	h.pending = append(h.pending, s)
+}
+
+// trendMetric is a value of samples that is followed over time
+type trendMetric struct {
+	name   string
+	format string
+	value  func(s historySample) float64
+}
+
+// trendMetrics returns the followed values : hits, bytes, error rate, watchdog hits, and the traffic of each device
+// seen in the samples
+func trendMetrics(samples []historySample) []trendMetric {
+	metrics := []trendMetric{
+		{"hits", "%.0f", func(s historySample) float64 { return float64(s.hits) }},
+		{"bytes", "%.0f", func(s historySample) float64 { return float64(s.bytes) }},
+		{"error rate", "%.1f%%", func(s historySample) float64 { return s.errorRate }},
+		{"watchdog hits", "%.0f", func(s historySample) float64 { return float64(s.watchdogHits) }},
+	}
+
+	devices := make(map[string]bool)
+	for _, s := range samples {
+		for dev := range s.traffic {
+			devices[dev] = true
+		}
+	}
+	names := make([]string, 0, len(devices))
+	for dev := range devices {
+		names = append(names, dev)
+	}
+	sort.Strings(names)
+
+	for _, dev := range names {
+		dev := dev
+		metrics = append(metrics, trendMetric{"traffic " + dev, "%.0f", func(s historySample) float64 { return float64(s.traffic[dev]) }})
+	}
+	return metrics
+}
+
+// series returns the values of the metric in the samples
+func (m trendMetric) series(samples []historySample) []float64 {
+	values := make([]float64, len(samples))
+	for i, s := range samples {
+		values[i] = m.value(s)
+	}
+	return values
+}
+
+// fit returns at most width values, averaging consecutive values if there are more
+func fit(values []float64, width int) []float64 {
+	if len(values) <= width {
+		return values
+	}
+
+	fitted := make([]float64, width)
+	for i := range fitted {
+		from, to := i*len(values)/width, (i+1)*len(values)/width
+		for _, v := range values[from:to] {
+			fitted[i] += v / float64(to-from)
+		}
+	}
+	return fitted
+}
+
+// buildSparkline returns a line of characters whose height follows the values, between their minimum and maximum
+func buildSparkline(values []float64) string {
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		low, high = math.Min(low, v), math.Max(high, v)
+	}
+
+	line := make([]rune, len(values))
+	for i, v := range values {
+		tick := 0
+		if high > low {
+			tick = int((v - low) / (high - low) * float64(len(sparkTicks)-1))
+		}
+		line[i] = sparkTicks[tick]
+	}
+	return string(line)
+}
+
+// average returns the average of the values
+func average(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// buildTrendOutput returns the sparklines of the followed metrics over the samples, with their last and average values
+func buildTrendOutput(title string, samples []historySample) string {
+	output := fmt.Sprintf(reportTrends+"\n", title)
+	for _, m := range trendMetrics(samples) {
+		values := m.series(samples)
+		output += fmt.Sprintf(reportTrend+"\n", m.name, buildSparkline(fit(values, defSparklineWidth)),
+			fmt.Sprintf(m.format, values[len(values)-1]), fmt.Sprintf(m.format, average(values)))
+	}
+	return output
+}
+
+// buildHistoryOutput returns the sparklines of the recent history, and of the downsampled history when there is some
+func buildHistoryOutput(h *history) string {
+	var output string
+	if recent := h.recent.ordered(); len(recent) > 1 {
+		output += buildTrendOutput("past "+recent[len(recent)-1].t.Sub(recent[0].t).String(), recent)
+	}
+	if daily := h.daily.ordered(); len(daily) > 1 {
+		output += buildTrendOutput(fmt.Sprintf("past %s, every %s", daily[len(daily)-1].t.Sub(daily[0].t), defHistoryStep), daily)
+	}
+	return output
+}
+
+// sparklines returns the sparklines of the followed metrics over the samples, by metric name
+func sparklines(samples []historySample) map[string]string {
+	lines := make(map[string]string)
+	if len(samples) == 0 {
+		return lines
+	}
+	for _, m := range trendMetrics(samples) {
+		lines[m.name] = buildSparkline(fit(m.series(samples), defSparklineWidth))
+	}
+	return lines
+}
+
+// reportJSON is the JSON representation of a report window and of the recent history
+type reportJSON struct {
+	Timestamp    time.Time            `json:"timestamp"`
+	Hits         int                  `json:"hits"`
+	Bytes        int64                `json:"bytes"`
+	ErrorRate    float64              `json:"error_rate"`
+	WatchdogHits int                  `json:"watchdog_hits"`
+	Alerts       int                  `json:"active_alerts"`
+	Traffic      map[string]int64     `json:"traffic"`
+	History      map[string][]float64 `json:"history"`
+	Sparklines   map[string]string    `json:"sparklines"`
+}
+
+// buildJSONOutput returns the window of the report and the recent history as a line of JSON
+func buildJSONOutput(r *report, h *history) (string, error) {
+	recent := h.recent.ordered()
+	series := make(map[string][]float64)
+	for _, m := range trendMetrics(recent) {
+		series[m.name] = m.series(recent)
+	}
+
+	line, err := json.Marshal(&reportJSON{
+		Timestamp:    r.timestamp,
+		Hits:         r.window.hits,
+		Bytes:        r.window.bytes,
+		ErrorRate:    r.window.errorRate,
+		WatchdogHits: r.watchdogHits,
+		Alerts:       r.alerts,
+		Traffic:      r.window.traffic,
+		History:      series,
+		Sparklines:   sparklines(recent),
+	})
+	return string(line), err
+}
@@ -0,0 +1,196 @@
+package gonetmon
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// httpDissector handles HTTP/1.x traffic, and the tunnels established through proxies with CONNECT
+type httpDissector struct {
+	tunnels map[string]*httpTunnel // Connections on which a tunnel was requested, only accessed while monitoring
+}
+
+// newHTTPDissector returns a dissector for HTTP/1.x traffic
+func newHTTPDissector() *httpDissector {
+	return &httpDissector{tunnels: make(map[string]*httpTunnel)}
+}
+
+// Name returns the name of the dissector
+func (d *httpDissector) Name() string {
+	return dataHTTP
+}
+
+// Filter returns the BPF fragment for TCP traffic on configured HTTP ports, or any TCP traffic
+func (d *httpDissector) Filter() string {
+	return buildNetworkFilter(config.packetFilter.ports)
+}
+
+// Match tells whether the packet holds the beginning of a HTTP message on a configured HTTP port, on a connection
+// that was not upgraded to another protocol, or data of a tunnel established through a proxy. Upgrade handshakes
+// are tracked on the way.
+func (d *httpDissector) Match(packet gopacket.Packet) bool {
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return false
+	}
+	// The capture filter may be wider than the HTTP ports, when other traffic is captured too
+	if len(config.packetFilter.ports) > 0 && !onPorts(tcp, config.packetFilter.ports) {
+		return false
+	}
+	key, sender, receiver := connEndpoints(packet)
+
+	if u, upgraded := upgrades.get(key); upgraded {
+		if u.protocol == protocolConnect {
+			return len(tcp.LayerPayload()) > 0 || tcp.FIN || tcp.RST
+		}
+
+		// Closing packets with a payload are left to the dissector of the protocol, and so are all of them if it is
+		// enabled
+		if len(tcp.LayerPayload()) == 0 && (tcp.FIN || tcp.RST) && !dissectorEnabled(u.protocol) {
+			upgrades.remove(key)
+		}
+		return false
+	}
+
+	if !sniffApplicationLayer(packet) {
+		return false
+	}
+
+	upgrades.track(key, sender, receiver, tcp.LayerPayload(), tcp.Seq)
+	return true
+}
+
+// Decode transforms the packet into a MetaPacket holding the HTTP request or response, or into a tunnelMessage
+// if it carries data of an established tunnel
+func (d *httpDissector) Decode(data *packetMsg) (interface{}, error) {
+	key, _, _ := connEndpoints(data.rawPacket)
+
+	if t, ok := d.tunnels[key]; ok && t.established {
+		m := &tunnelMessage{target: t.target}
+		if tcp, ok := data.rawPacket.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+			m.bytes = len(tcp.LayerPayload())
+			if tcp.FIN || tcp.RST {
+				m.closed = true
+				m.duration = data.rawPacket.Metadata().Timestamp.Sub(t.opened)
+				delete(d.tunnels, key)
+				upgrades.remove(key)
+			}
+		}
+		return m, nil
+	}
+
+	// The proxy switched to a tunnel whose establishment was missed, e.g. because its request could not be read :
+	// only the response establishing it is HTTP
+	if u, switched := upgrades.get(key); switched && u.protocol == protocolConnect {
+		if tcp, ok := data.rawPacket.Layer(layers.LayerTypeTCP).(*layers.TCP); ok && !isHTTPResponse(tcp.LayerPayload()) {
+			return d.untrackedTunnel(key, u, tcp), nil
+		}
+	}
+
+	p, err := DataToHTTP(data)
+	if err != nil {
+		return nil, err
+	}
+	d.trackTunnel(key, p)
+	return p, nil
+}
+
+// untrackedTunnel returns the tunnel data of a packet of a tunnel whose establishment was missed. Its data is counted,
+// but not its duration.
+func (d *httpDissector) untrackedTunnel(key string, u upgrade, tcp *layers.TCP) *tunnelMessage {
+	if tcp.FIN || tcp.RST {
+		delete(d.tunnels, key)
+		upgrades.remove(key)
+	}
+	return &tunnelMessage{target: normalizeHost(u.endpoint, ""), bytes: len(tcp.LayerPayload())}
+}
+
+// NewAnalysis returns an empty HTTP analysis
+func (d *httpDissector) NewAnalysis() protocolAnalysis {
+	return NewAnalysis()
+}
+
+// httpReport holds the final result of a HTTP analysis
+type httpReport struct {
+	topHost    *hostStats
+	sections   []*sectionStats
+	traffic    map[string]int64
+	directions map[string]int
+	topClients []*clientStats
+	topMethods []*grpcMethodStats
+	endpoints  []pathCount
+	tunnels    []*tunnelStats
+	hostAgents *clientReport     // Who sent the requests to the top host
+	allAgents  *clientReport     // Who sent the requests to all hosts, if there are several
+	errors     []*endpointErrors // Endpoints of all hosts with the most error responses
+}
+
+// Empty tells whether no host nor tunnel was seen
+func (r *httpReport) Empty() bool {
+	return r.topHost == nil && len(r.tunnels) == 0
+}
+
+// Render returns the HTTP section of the console display
+func (r *httpReport) Render() string {
+	var output string
+
+	if r.topHost != nil {
+		output += r.renderHost()
+	}
+	if len(r.tunnels) > 0 {
+		output += buildTunnelOutput(r.tunnels)
+	}
+
+	return output
+}
+
+// renderHost returns the part of the HTTP section about the top host
+func (r *httpReport) renderHost() string {
+	var output string
+
+	output += fmt.Sprintf(reportTraffic+"\n", buildTrafficOutput(r.traffic, config))
+	output += fmt.Sprintf(reportDirs+"\n", buildDirectionOutput(r.directions))
+	ports := buildPortOutput(r.topHost.ports)
+	if r.topHost.role == roleServer {
+		output += fmt.Sprintf(reportVhost, r.topHost.host, ports, r.topHost.hits)
+	} else {
+		output += fmt.Sprintf(reportTop, r.topHost.host, ports, r.topHost.hits)
+	}
+	output += fmt.Sprintf(reportResp+"\n", buildResponseOutput(r.topHost.nbStatus),
+		buildClassOutput(r.topHost.responses.classes), buildErrorRateOutput(r.topHost.responses.errorRate()))
+	if len(r.topHost.grpcCodes) > 0 {
+		output += fmt.Sprintf(reportGRPCCodes+"\n", buildGRPCCodeOutput(r.topHost.grpcCodes))
+	}
+	output += buildResponseStatsOutput(r.topHost.responses, "")
+	//for _, section := range r.sections[:min(p.PacketFilter.NbSections, len(r.sections))] {
+	for _, section := range r.sections {
+		output += fmt.Sprintf(reportSection, section.section, section.nbHits)
+		output += fmt.Sprintf(reportReqs+"\n", buildRequestOutput(section.nbMethods))
+		output += buildStatusOutput(section.responses, "\t  ")
+		output += buildResponseStatsOutput(section.responses, "\t  ")
+	}
+	if len(r.endpoints) > 0 {
+		output += reportEndpoints + "\n"
+		for _, e := range r.endpoints {
+			output += fmt.Sprintf(reportEndpoint+"\n", e.path, e.hits)
+		}
+	}
+	if len(r.errors) > 0 {
+		output += buildErrorEndpointsOutput(r.errors)
+	}
+	if len(r.topClients) > 0 {
+		output += fmt.Sprintf(reportClients+"\n", buildClientOutput(r.topClients))
+	}
+	if len(r.topMethods) > 0 {
+		output += buildGRPCOutput(r.topMethods)
+	}
+	if r.hostAgents != nil && r.hostAgents.requests > 0 {
+		output += r.hostAgents.Render()
+	}
+	if r.allAgents != nil {
+		output += r.allAgents.Render()
+	}
+
+	return output
+}
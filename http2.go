@@ -0,0 +1,656 @@
+package gonetmon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/http2/hpack"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const dataHTTP2 = "http2"
+
+// h2Preface is the connection preface a HTTP/2 client starts with, after an upgrade or with prior knowledge
+const h2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// HTTP/2 frame types, flags, settings and error codes we look into
+const (
+	h2FrameHeaderLen = 9
+
+	h2FrameData         = 0x0
+	h2FrameHeaders      = 0x1
+	h2FrameRSTStream    = 0x3
+	h2FrameSettings     = 0x4
+	h2FramePushPromise  = 0x5
+	h2FrameContinuation = 0x9
+
+	h2FlagEndStream  = 0x1
+	h2FlagAck        = 0x1
+	h2FlagEndHeaders = 0x4
+	h2FlagPadded     = 0x8
+	h2FlagPriority   = 0x20
+
+	h2SettingHeaderTableSize = 0x1
+	h2DefaultTableSize       = 4096
+
+	h2ErrorCancel = 0x8
+)
+
+var (
+	errH2Preface  = errors.New("invalid HTTP/2 connection preface")
+	errH2Frame    = errors.New("malformed HTTP/2 frame")
+	errH2TooLarge = errors.New("HTTP/2 header block too large")
+)
+
+// h2Frame is a HTTP/2 frame. The payload is only kept for frames other than DATA.
+type h2Frame struct {
+	length  int
+	typ     byte
+	flags   byte
+	stream  uint32
+	payload []byte
+}
+
+// h2Direction is one direction of a HTTP/2 connection : the reassembled TCP stream, and the frames read from it
+type h2Direction struct {
+	fromClient bool            // Whether the client sends on this direction
+	stream     *tcpReassembler // Bytes sent on this direction
+	preface    int             // Bytes of the client preface still expected
+	broken     bool            // Whether bytes were lost, making the header compression state unusable
+	decoder    *hpack.Decoder  // Header decompression state of this direction
+
+	header    []byte  // Header of the frame being read
+	frame     h2Frame // Frame being read
+	inFrame   bool    // Whether the frame header was read
+	remaining int     // Bytes of the frame payload still to be read
+
+	block          []byte // Header block being gathered over HEADERS or PUSH_PROMISE and CONTINUATION frames
+	blockStream    uint32 // Stream of the header block
+	blockEndStream bool   // Whether the stream ends with the header block
+	blockPush      bool   // Whether the header block is a push promise
+}
+
+// newH2Direction returns a direction of a HTTP/2 connection, before any byte was read
+func newH2Direction(fromClient bool) *h2Direction {
+	d := &h2Direction{
+		fromClient: fromClient,
+		stream:     newTCPReassembler(),
+		decoder:    hpack.NewDecoder(h2DefaultTableSize, nil),
+	}
+	if fromClient {
+		d.preface = len(h2Preface)
+	}
+	return d
+}
+
+// h2Stream holds the request and response exchanged on a HTTP/2 stream
+type h2Stream struct {
+	request   *http.Request
+	response  *http.Response
+	requested time.Time // When the request headers were seen
+	answered  time.Time // When the response was complete
+	done      bool      // Whether the response was handed to analysis
+}
+
+// h2Conn is a HTTP/2 connection
+type h2Conn struct {
+	client    string               // Address and port of the client
+	upgrading bool                 // Whether an upgrade from HTTP/1.1 was requested, and not yet answered
+	toServer  *h2Direction         // Direction from client to server
+	toClient  *h2Direction         // Direction from server to client
+	streams   map[uint32]*h2Stream // Open streams
+	now       time.Time            // Capture time of the packet being decoded
+	requests  []*http.Request      // Requests completed by the packet being decoded
+	responses []*h2Stream          // Streams whose response was completed by the packet being decoded
+}
+
+// newH2Conn returns a connection opened by the client, either upgrading from HTTP/1.1 or with prior knowledge
+func newH2Conn(client string, upgrading bool) *h2Conn {
+	return &h2Conn{
+		client:    client,
+		upgrading: upgrading,
+		toServer:  newH2Direction(true),
+		toClient:  newH2Direction(false),
+		streams:   make(map[uint32]*h2Stream),
+	}
+}
+
+// other returns the opposite direction of the connection
+func (c *h2Conn) other(d *h2Direction) *h2Direction {
+	if d == c.toServer {
+		return c.toClient
+	}
+	return c.toServer
+}
+
+// stream returns the stream of the given id, opening it if needed
+func (c *h2Conn) stream(id uint32) *h2Stream {
+	s, ok := c.streams[id]
+	if !ok {
+		// Don't grow indefinitely on streams that were never closed, or whose end was missed
+		if len(c.streams) >= defH2MaxStreams {
+			c.streams = make(map[uint32]*h2Stream)
+		}
+		s = &h2Stream{}
+		c.streams[id] = s
+	}
+	return s
+}
+
+// consume reads frames from the next bytes of the direction. Missing bytes, of segments truncated by capture,
+// can only be skipped inside DATA frames.
+func (c *h2Conn) consume(d *h2Direction, data []byte, missing int) error {
+	// Check and skip the client preface
+	if d.preface > 0 {
+		offset := len(h2Preface) - d.preface
+		n := d.preface
+		if len(data) < n {
+			if missing > 0 {
+				return errTCPGap
+			}
+			n = len(data)
+		}
+		if !bytes.Equal(data[:n], []byte(h2Preface[offset:offset+n])) {
+			return errH2Preface
+		}
+		d.preface -= n
+		data = data[n:]
+	}
+
+	for len(data) > 0 || missing > 0 {
+		if !d.inFrame {
+			if len(data) == 0 {
+				return errTCPGap
+			}
+			n := h2FrameHeaderLen - len(d.header)
+			if n > len(data) {
+				n = len(data)
+			}
+			d.header = append(d.header, data[:n]...)
+			data = data[n:]
+			if len(d.header) < h2FrameHeaderLen {
+				continue
+			}
+
+			d.frame = h2Frame{
+				length:  int(d.header[0])<<16 | int(d.header[1])<<8 | int(d.header[2]),
+				typ:     d.header[3],
+				flags:   d.header[4],
+				stream:  binary.BigEndian.Uint32(d.header[5:]) & 0x7fffffff,
+				payload: d.frame.payload[:0],
+			}
+			d.header = d.header[:0]
+			d.inFrame = true
+			d.remaining = d.frame.length
+
+			if d.frame.typ != h2FrameData && d.frame.length > defH2MaxHeaderBlock {
+				return errH2TooLarge
+			}
+		}
+
+		if d.remaining > 0 {
+			if len(data) > 0 {
+				n := d.remaining
+				if n > len(data) {
+					n = len(data)
+				}
+				if d.frame.typ != h2FrameData {
+					d.frame.payload = append(d.frame.payload, data[:n]...)
+				}
+				data = data[n:]
+				d.remaining -= n
+			} else if missing == 0 {
+				// The rest of the frame comes with the next segments
+				break
+			} else {
+				if d.frame.typ != h2FrameData {
+					return errTCPGap
+				}
+				n := d.remaining
+				if n > missing {
+					n = missing
+				}
+				missing -= n
+				d.remaining -= n
+			}
+		}
+
+		if d.remaining == 0 {
+			d.inFrame = false
+			if err := c.handleFrame(d, &d.frame); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// unpad returns the frame payload without its padding, and without the fixed size fields that precede the header block
+func unpad(f *h2Frame, fixed int) ([]byte, error) {
+	p := f.payload
+	padding := 0
+	if f.flags&h2FlagPadded != 0 {
+		if len(p) == 0 {
+			return nil, errH2Frame
+		}
+		padding = int(p[0])
+		p = p[1:]
+	}
+	if len(p) < fixed+padding {
+		return nil, errH2Frame
+	}
+	return p[fixed : len(p)-padding], nil
+}
+
+// handleFrame handles a complete frame of the direction
+func (c *h2Conn) handleFrame(d *h2Direction, f *h2Frame) error {
+	switch f.typ {
+	case h2FrameHeaders, h2FramePushPromise:
+		fixed := 0
+		if f.typ == h2FramePushPromise {
+			fixed = 4 // Promised stream
+		} else if f.flags&h2FlagPriority != 0 {
+			fixed = 5 // Stream dependency and weight
+		}
+		fragment, err := unpad(f, fixed)
+		if err != nil {
+			return err
+		}
+
+		d.block = append(d.block[:0], fragment...)
+		d.blockStream = f.stream
+		d.blockEndStream = f.typ == h2FrameHeaders && f.flags&h2FlagEndStream != 0
+		d.blockPush = f.typ == h2FramePushPromise
+		if f.flags&h2FlagEndHeaders != 0 {
+			return c.handleBlock(d)
+		}
+
+	case h2FrameContinuation:
+		if f.stream != d.blockStream {
+			return errH2Frame
+		}
+		if len(d.block)+len(f.payload) > defH2MaxHeaderBlock {
+			return errH2TooLarge
+		}
+		d.block = append(d.block, f.payload...)
+		if f.flags&h2FlagEndHeaders != 0 {
+			return c.handleBlock(d)
+		}
+
+	case h2FrameData:
+		if !d.fromClient && f.flags&h2FlagEndStream != 0 {
+			c.closeStream(f.stream)
+		}
+
+	case h2FrameRSTStream:
+		c.resetStream(f.stream, f.payload)
+
+	case h2FrameSettings:
+		if f.flags&h2FlagAck != 0 {
+			return nil
+		}
+		// The header table size a peer allows bounds the compression state of what is sent to it
+		for p := f.payload; len(p) >= 6; p = p[6:] {
+			if binary.BigEndian.Uint16(p) == h2SettingHeaderTableSize {
+				c.other(d).decoder.SetAllowedMaxDynamicTableSize(binary.BigEndian.Uint32(p[2:]))
+			}
+		}
+	}
+
+	return nil
+}
+
+// handleBlock decompresses a complete header block, which must be done for all of them to keep the compression state,
+// and registers the request or response it holds
+func (c *h2Conn) handleBlock(d *h2Direction) error {
+	fields, err := d.decoder.DecodeFull(d.block)
+	if err != nil {
+		return err
+	}
+
+	if d.blockPush {
+		return nil
+	}
+
+	s := c.stream(d.blockStream)
+	if d.fromClient {
+		// Headers after the request's are trailers
+		if s.request == nil {
+			s.request = newH2Request(fields)
+			s.requested = c.now
+			c.requests = append(c.requests, s.request)
+		}
+		return nil
+	}
+
+	if status, ok := h2Status(fields); ok {
+		// Informational responses precede the final one
+		if status >= 200 {
+			s.response = newH2Response(status, fields, s.request)
+		}
+	} else if s.response != nil {
+		s.response.Trailer = make(http.Header)
+		for _, f := range fields {
+			s.response.Trailer.Add(f.Name, f.Value)
+		}
+	}
+
+	// The status of gRPC calls comes in trailers, at the end of the stream
+	if s.response != nil && !isGRPC(s.response.Header) {
+		c.complete(s)
+	}
+
+	if d.blockEndStream {
+		c.closeStream(d.blockStream)
+	}
+	return nil
+}
+
+// complete hands the stream's response to analysis, once
+func (c *h2Conn) complete(s *h2Stream) {
+	if s.done {
+		return
+	}
+	s.done = true
+	s.answered = c.now
+	c.responses = append(c.responses, s)
+}
+
+// closeStream completes the response of a stream that ended or was reset, and stops tracking it
+func (c *h2Conn) closeStream(id uint32) {
+	if s, ok := c.streams[id]; ok && s.response != nil {
+		c.complete(s)
+	}
+	delete(c.streams, id)
+}
+
+// resetStream closes a stream reset by a peer. gRPC calls reset before their status count as cancelled, or as unknown
+// when reset for another reason than cancellation.
+func (c *h2Conn) resetStream(id uint32, payload []byte) {
+	s, ok := c.streams[id]
+	if ok && !s.done && s.request != nil && isGRPC(s.request.Header) {
+		code := "2" // UNKNOWN
+		if len(payload) >= 4 && binary.BigEndian.Uint32(payload) == h2ErrorCancel {
+			code = "1" // CANCELLED
+		}
+
+		switch {
+		case s.response == nil:
+			s.response = newH2Response(http.StatusOK, []hpack.HeaderField{
+				{Name: "content-type", Value: "application/grpc"},
+				{Name: "grpc-status", Value: code},
+			}, s.request)
+		case s.response.Trailer.Get("grpc-status") == "" && s.response.Header.Get("grpc-status") == "":
+			s.response.Trailer = make(http.Header)
+			s.response.Trailer.Set("grpc-status", code)
+		}
+	}
+	c.closeStream(id)
+}
+
+// h2Status returns the status code of a response header block, if it holds one
+func h2Status(fields []hpack.HeaderField) (int, bool) {
+	for _, f := range fields {
+		if f.Name == ":status" {
+			status, err := strconv.Atoi(f.Value)
+			return status, err == nil
+		}
+	}
+	return 0, false
+}
+
+// contentLength returns the length announced in the headers, or 0 if there is none
+func contentLength(header http.Header) int64 {
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return length
+}
+
+// newH2Request returns a request made of the header fields of a stream
+func newH2Request(fields []hpack.HeaderField) *http.Request {
+	req := &http.Request{
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header),
+	}
+
+	for _, f := range fields {
+		switch f.Name {
+		case ":method":
+			req.Method = f.Value
+		case ":authority":
+			req.Host = f.Value
+		case ":path":
+			req.RequestURI = f.Value
+		default:
+			if !f.IsPseudo() {
+				req.Header.Add(f.Name, f.Value)
+			}
+		}
+	}
+
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+
+	// As in HTTP/1, CONNECT requests target an authority rather than a path
+	if req.RequestURI == "" {
+		req.RequestURI = req.Host
+	}
+
+	req.URL = &url.URL{Path: req.RequestURI}
+	if u, err := url.ParseRequestURI(req.RequestURI); err == nil {
+		req.URL = u
+	}
+	req.ContentLength = contentLength(req.Header)
+
+	return req
+}
+
+// newH2Response returns a response made of the header fields of a stream, answering the request if it was seen
+func newH2Response(status int, fields []hpack.HeaderField, req *http.Request) *http.Response {
+	res := &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Header:     make(http.Header),
+		Request:    req,
+	}
+
+	for _, f := range fields {
+		if !f.IsPseudo() {
+			res.Header.Add(f.Name, f.Value)
+		}
+	}
+	res.ContentLength = contentLength(res.Header)
+
+	return res
+}
+
+// http2Dissector handles cleartext HTTP/2 traffic, either upgraded from HTTP/1.1 or with prior knowledge.
+// Connections are tracked from their start, since header compression depends on all previous messages.
+// Requests and responses are added to the HTTP analysis when it is enabled.
+type http2Dissector struct {
+	mutex sync.Mutex         // Connections are registered while capturing, and decoded while monitoring
+	conns map[string]*h2Conn // Tracked connections
+}
+
+// newHTTP2Dissector returns a HTTP/2 dissector tracking no connection
+func newHTTP2Dissector() *http2Dissector {
+	return &http2Dissector{
+		conns: make(map[string]*h2Conn),
+	}
+}
+
+// Name returns the name of the dissector
+func (d *http2Dissector) Name() string {
+	return dataHTTP2
+}
+
+// SharesWith returns the name of the HTTP/1 dissector, whose analysis HTTP/2 messages are added to
+func (d *http2Dissector) SharesWith() string {
+	return dataHTTP
+}
+
+// Filter returns the BPF fragment for TCP traffic on configured HTTP ports, or any TCP traffic
+func (d *http2Dissector) Filter() string {
+	return buildNetworkFilter(config.packetFilter.ports)
+}
+
+// Match tells whether the packet starts a HTTP/2 connection on a configured HTTP port, or belongs to one
+func (d *http2Dissector) Match(packet gopacket.Packet) bool {
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return false
+	}
+	if len(config.packetFilter.ports) > 0 && !onPorts(tcp, config.packetFilter.ports) {
+		return false
+	}
+	payload := tcp.LayerPayload()
+	key, sender, _ := connEndpoints(packet)
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, ok := d.conns[key]; ok {
+		return len(payload) > 0 || tcp.FIN || tcp.RST
+	}
+
+	var conn *h2Conn
+	switch {
+	case bytes.HasPrefix(payload, []byte(h2Preface)):
+		conn = newH2Conn(sender, false)
+	case isHTTPRequest(payload) && upgradesTo(payload, "h2c"):
+		conn = newH2Conn(sender, true)
+	default:
+		return false
+	}
+
+	// Don't grow indefinitely : start over when full, losing track of ongoing connections
+	if len(d.conns) >= defMaxFlows {
+		d.conns = make(map[string]*h2Conn)
+	}
+	d.conns[key] = conn
+	return true
+}
+
+// remove stops tracking the connection
+func (d *http2Dissector) remove(key string) {
+	d.mutex.Lock()
+	delete(d.conns, key)
+	d.mutex.Unlock()
+}
+
+// Decode reads the HTTP/2 frames of the packet, and returns the requests and responses whose headers it completes
+func (d *http2Dissector) Decode(data *packetMsg) (interface{}, error) {
+	tcp, ok := data.rawPacket.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return nil, errors.New("no TCP layer in packet")
+	}
+	payload := tcp.LayerPayload()
+	key, sender, _ := connEndpoints(data.rawPacket)
+
+	d.mutex.Lock()
+	conn, ok := d.conns[key]
+	d.mutex.Unlock()
+
+	// The connection may have been closed or forgotten
+	var messages []*MetaPacket
+	if !ok {
+		return messages, nil
+	}
+
+	if tcp.FIN || tcp.RST {
+		defer d.remove(key)
+	}
+	conn.now = data.rawPacket.Metadata().Timestamp
+
+	dir := conn.toClient
+	if sender == conn.client {
+		dir = conn.toServer
+	}
+	seq := tcp.Seq
+	segment := newTCPSegment(data.rawPacket, tcp)
+
+	// Upgrades start with a HTTP/1.1 request, and a response switching protocols followed by HTTP/2 frames
+	if conn.upgrading {
+		if !(isHTTPRequest(payload) && dir.fromClient) && !(isHTTPResponse(payload) && !dir.fromClient) {
+			return messages, nil
+		}
+
+		p, err := DataToHTTP(data)
+		if err != nil {
+			d.remove(key)
+			return nil, err
+		}
+		messages = append(messages, p)
+
+		if p.messageType == httpRequest {
+			// The response to the upgrade request comes on the first stream
+			conn.stream(1).request = p.request
+			return messages, nil
+		}
+
+		if p.response.StatusCode != http.StatusSwitchingProtocols {
+			d.remove(key)
+			return messages, nil
+		}
+		conn.upgrading = false
+
+		// Frames may follow the response in the same segment
+		end := len(payload)
+		if idx := bytes.Index(payload, []byte("\r\n\r\n")); idx >= 0 {
+			end = idx + 4
+		}
+		seq += uint32(end)
+		segment.data = payload[end:]
+		segment.length -= end
+	}
+
+	if !dir.broken {
+		err := dir.stream.reassemble(seq, segment, func(data []byte, missing int) error {
+			return conn.consume(dir, data, missing)
+		})
+		if err != nil {
+			// Header compression state is lost with the bytes, only the other direction can still be read
+			dir.broken = true
+			log.Info("HTTP/2 connection ", key, " can no longer be decoded : ", err)
+		}
+	}
+
+	for _, req := range conn.requests {
+		p := NewMetaPacket(data)
+		p.messageType = httpRequest
+		p.request = req
+		messages = append(messages, p)
+	}
+	for _, s := range conn.responses {
+		p := NewMetaPacket(data)
+		p.messageType = httpResponse
+		p.response = s.response
+		if s.request != nil {
+			p.latency = s.answered.Sub(s.requested)
+		}
+		messages = append(messages, p)
+	}
+	conn.requests = conn.requests[:0]
+	conn.responses = conn.responses[:0]
+
+	return messages, nil
+}
+
+// NewAnalysis returns an empty HTTP analysis, for when HTTP/2 is analysed on its own
+func (d *http2Dissector) NewAnalysis() protocolAnalysis {
+	return NewAnalysis()
+}
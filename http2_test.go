@@ -0,0 +1,108 @@
+package gonetmon
+
+import (
+	"bytes"
+	"golang.org/x/net/http2/hpack"
+	"testing"
+)
+
+// h2FrameBytes returns a frame with its header
+func h2FrameBytes(typ byte, flags byte, stream uint32, payload []byte) []byte {
+	l := len(payload)
+	frame := []byte{byte(l >> 16), byte(l >> 8), byte(l), typ, flags,
+		byte(stream >> 24), byte(stream >> 16), byte(stream >> 8), byte(stream)}
+	return append(frame, payload...)
+}
+
+// h2Block returns the header block of the fields, compressed by the encoder
+func h2Block(e *hpack.Encoder, buf *bytes.Buffer, fields ...string) []byte {
+	buf.Reset()
+	for i := 0; i+1 < len(fields); i += 2 {
+		_ = e.WriteField(hpack.HeaderField{Name: fields[i], Value: fields[i+1]})
+	}
+	return append([]byte{}, buf.Bytes()...)
+}
+
+// consumeSplit feeds the bytes to the direction in segments of the given size
+func consumeSplit(c *h2Conn, d *h2Direction, data []byte, size int) error {
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := c.consume(d, data[:n], 0); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func TestH2Requests(t *testing.T) {
+	var buf bytes.Buffer
+	e := hpack.NewEncoder(&buf)
+
+	first := h2Block(e, &buf, ":method", "GET", ":path", "/index.html", ":authority", "www.h2.test")
+	second := h2Block(e, &buf, ":method", "POST", ":path", "/api/items", ":authority", "www.h2.test", "content-length", "12")
+
+	// The second header block is padded, and split over HEADERS and CONTINUATION frames
+	padded := append(append([]byte{3}, second[:4]...), 0, 0, 0)
+	stream := []byte(h2Preface)
+	stream = append(stream, h2FrameBytes(h2FrameSettings, 0, 0, nil)...)
+	stream = append(stream, h2FrameBytes(h2FrameHeaders, h2FlagEndHeaders|h2FlagEndStream, 1, first)...)
+	stream = append(stream, h2FrameBytes(h2FrameHeaders, h2FlagPadded, 3, padded)...)
+	stream = append(stream, h2FrameBytes(h2FrameContinuation, h2FlagEndHeaders, 3, second[4:])...)
+	stream = append(stream, h2FrameBytes(h2FrameData, h2FlagEndStream, 3, []byte("hello, world"))...)
+
+	// Headers split across segments, down to a byte per segment, decode the same
+	for _, size := range []int{len(stream), 100, 10, 3, 1} {
+		c := newH2Conn("client", false)
+		if err := consumeSplit(c, c.toServer, stream, size); err != nil {
+			t.Fatalf("segments of %d bytes : %v", size, err)
+		}
+		if len(c.requests) != 2 {
+			t.Fatalf("segments of %d bytes : %d requests, want 2", size, len(c.requests))
+		}
+		if r := c.requests[0]; r.Method != "GET" || r.Host != "www.h2.test" || r.URL.Path != "/index.html" {
+			t.Errorf("segments of %d bytes : first request %s %s%s", size, r.Method, r.Host, r.URL.Path)
+		}
+		if r := c.requests[1]; r.Method != "POST" || r.URL.Path != "/api/items" || r.ContentLength != 12 {
+			t.Errorf("segments of %d bytes : second request %s %s, length %d", size, r.Method, r.URL.Path, r.ContentLength)
+		}
+	}
+}
+
+func TestH2Errors(t *testing.T) {
+	var buf bytes.Buffer
+	block := h2Block(hpack.NewEncoder(&buf), &buf, ":method", "GET", ":path", "/api/items/with/a/longer/path")
+
+	tests := []struct {
+		name    string
+		data    []byte
+		missing int
+		err     error
+	}{
+		{"wrong preface", []byte("GET / HTTP/1.1\r\n\r\n"), 0, errH2Preface},
+		{"oversized header frame", append([]byte(h2Preface), 0xff, 0xff, 0xff, h2FrameHeaders, 0, 0, 0, 0, 1), 0, errH2TooLarge},
+		{"padding longer than the frame", append([]byte(h2Preface), h2FrameBytes(h2FrameHeaders, h2FlagPadded, 1, []byte{10, 0})...), 0, errH2Frame},
+		{"continuation of another stream", append(append([]byte(h2Preface), h2FrameBytes(h2FrameHeaders, 0, 1, block)...),
+			h2FrameBytes(h2FrameContinuation, h2FlagEndHeaders, 3, nil)...), 0, errH2Frame},
+	}
+
+	for _, tt := range tests {
+		c := newH2Conn("client", false)
+		if err := c.consume(c.toServer, tt.data, tt.missing); err != tt.err {
+			t.Errorf("%s : error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// Bytes lost inside DATA frames are skipped, but not inside header frames
+	c := newH2Conn("client", false)
+	data := append([]byte(h2Preface), h2FrameBytes(h2FrameData, 0, 1, make([]byte, 100))[:20]...)
+	if err := c.consume(c.toServer, data, 89); err != nil {
+		t.Errorf("bytes missing in DATA : error %v", err)
+	}
+	if err := c.consume(c.toServer, h2FrameBytes(h2FrameHeaders, 0, 1, block)[:12], len(block)-3); err != errTCPGap {
+		t.Errorf("bytes missing in HEADERS : error %v, want %v", err, errTCPGap)
+	}
+}
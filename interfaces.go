@@ -0,0 +1,211 @@
+package gonetmon
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strings"
+	"text/tabwriter"
+)
+
+// anyDevice is the name of the pseudo-device that captures on all interfaces at once
+const anyDevice = "any"
+
+// interfaceSelection holds the rules to select the network interfaces to capture on
+type interfaceSelection struct {
+	include []string     // Glob patterns of interface names to capture on. If empty, all interfaces are included
+	exclude []string     // Glob patterns of interface names to never capture on
+	cidrs   []*net.IPNet // If not empty, only capture on interfaces that carry an address in one of these networks
+	any     bool         // Capture on the "any" pseudo-device instead of individual interfaces
+}
+
+// newInterfaceSelection parses patterns and networks into a selection.
+// Patterns are globs on interface names like "eth*", and are exclusions when prefixed with '!' like "!docker*".
+// Networks are in CIDR notation like "10.0.0.0/8" or "fd00::/8".
+func newInterfaceSelection(patterns []string, networks []string, any bool) (*interfaceSelection, error) {
+	selection := &interfaceSelection{any: any}
+
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		exclude := strings.HasPrefix(p, "!")
+		p = strings.TrimPrefix(p, "!")
+
+		// Validate the pattern before using it
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid interface pattern '%s' : %s", p, err)
+		}
+
+		if exclude {
+			selection.exclude = append(selection.exclude, p)
+		} else {
+			selection.include = append(selection.include, p)
+		}
+	}
+
+	for _, n := range networks {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network '%s' : %s", n, err)
+		}
+		selection.cidrs = append(selection.cidrs, network)
+	}
+
+	return selection, nil
+}
+
+// SelectInterfaces sets the rules to select the network interfaces to capture on.
+// Patterns are globs on interface names like "eth*", and are exclusions when prefixed with '!' like "!docker*".
+// If networks are given in CIDR notation, only interfaces carrying an address in one of them are captured on.
+// If any is true, capture happens on the "any" pseudo-device, and other rules are ignored.
+func SelectInterfaces(patterns []string, networks []string, any bool) error {
+	selection, err := newInterfaceSelection(patterns, networks, any)
+	if err != nil {
+		return err
+	}
+	config.interfaces = *selection
+	return nil
+}
+
+// matchesAny tells whether the name matches one of the glob patterns
+func matchesAny(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// carriesNetwork tells whether one of the device's addresses belongs to one of the networks
+func carriesNetwork(device *net.Interface, networks []*net.IPNet) bool {
+	addrs, err := device.Addrs()
+	if err != nil {
+		return false
+	}
+
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		for _, n := range networks {
+			if n.Contains(ipnet.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check tells whether the device is selected for capture, and if not, why
+func (s *interfaceSelection) check(device *net.Interface) (bool, string) {
+	if device.Flags&net.FlagUp == 0 {
+		return false, "down"
+	}
+
+	if s.any {
+		return false, "captured through the any device"
+	}
+
+	if len(s.include) > 0 && !matchesAny(device.Name, s.include) {
+		return false, "not included"
+	}
+
+	if matchesAny(device.Name, s.exclude) {
+		return false, "excluded"
+	}
+
+	if len(s.cidrs) > 0 && !carriesNetwork(device, s.cidrs) {
+		return false, "no address in selected networks"
+	}
+
+	return true, ""
+}
+
+// selects tells whether the device is selected for capture
+func (s *interfaceSelection) selects(device *net.Interface) bool {
+	ok, _ := s.check(device)
+	return ok
+}
+
+// selectDevices returns the devices that are selected by the selection rules
+func selectDevices(selection *interfaceSelection, devices []net.Interface) ([]net.Interface, error) {
+	var tailoredList []net.Interface
+
+	for i := range devices {
+		if selection.selects(&devices[i]) {
+			tailoredList = append(tailoredList, devices[i])
+			log.Info("Selected interface ", devices[i].Name)
+		}
+	}
+
+	// Inform about include patterns that did not match anything
+	for _, p := range selection.include {
+		found := false
+		for _, d := range tailoredList {
+			if ok, _ := path.Match(p, d.Name); ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			log.Error("Could not find any activated interface matching requested pattern : ", p)
+		}
+	}
+
+	if len(tailoredList) == 0 {
+		return nil, errors.New("could not find any network devices matching the interface selection")
+	}
+
+	return tailoredList, nil
+}
+
+// ListInterfaces writes the candidate network interfaces to w, with their flags, addresses,
+// and whether they would be captured on with the current configuration
+func ListInterfaces(w io.Writer) error {
+	devices, err := net.Interfaces()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "INTERFACE\tFLAGS\tADDRESSES\tCAPTURED")
+
+	if config.interfaces.any {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", anyDevice, "-", "-", "yes")
+	}
+
+	for i := range devices {
+		d := &devices[i]
+
+		var addresses []string
+		if addrs, err := d.Addrs(); err == nil {
+			for _, a := range addrs {
+				addresses = append(addresses, a.String())
+			}
+		}
+		if len(addresses) == 0 {
+			addresses = []string{"-"}
+		}
+
+		captured := "yes"
+		if ok, reason := config.interfaces.check(d); !ok {
+			captured = "no (" + reason + ")"
+		}
+
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Name, d.Flags.String(), strings.Join(addresses, ", "), captured)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,300 @@
+package gonetmon
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+// Information elements of the exported records, numbered alike in IPFIX and NetFlow v9
+const (
+	ieOctetDeltaCount          = 1
+	iePacketDeltaCount         = 2
+	ieProtocolIdentifier       = 4
+	ieTCPControlBits           = 6
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieLastSwitched             = 21 // NetFlow v9 only, in milliseconds of exporter uptime
+	ieFirstSwitched            = 22 // NetFlow v9 only, in milliseconds of exporter uptime
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowEndReason            = 136 // IPFIX only
+	ieFlowStartMilliseconds    = 152 // IPFIX only
+	ieFlowEndMilliseconds      = 153 // IPFIX only
+)
+
+// Set identifiers of templates, and identifiers of the templates of IPv4 and IPv6 records
+const (
+	ipfixTemplateSet    = 2
+	netflow9TemplateSet = 0
+	templateIPv4        = 256
+	templateIPv6        = 257
+)
+
+// flowField is an information element of a template, and its length
+type flowField struct {
+	id     uint16
+	length uint16
+}
+
+// flowTemplate describes the records of a data set
+type flowTemplate struct {
+	id     uint16
+	fields []flowField
+}
+
+// size returns the length of a record of the template
+func (t *flowTemplate) size() int {
+	var size int
+	for _, f := range t.fields {
+		size += int(f.length)
+	}
+	return size
+}
+
+// newFlowTemplate returns the template of records of a format, for addresses of the given length
+func newFlowTemplate(format string, id uint16, source uint16, destination uint16, addressLength uint16) *flowTemplate {
+	t := &flowTemplate{
+		id: id,
+		fields: []flowField{
+			{source, addressLength},
+			{destination, addressLength},
+			{ieSourceTransportPort, 2},
+			{ieDestinationTransportPort, 2},
+			{ieProtocolIdentifier, 1},
+			{ieTCPControlBits, 1},
+			{iePacketDeltaCount, 8},
+			{ieOctetDeltaCount, 8},
+		},
+	}
+
+	if format == exportIPFIX {
+		t.fields = append(t.fields, flowField{ieFlowStartMilliseconds, 8}, flowField{ieFlowEndMilliseconds, 8},
+			flowField{ieFlowEndReason, 1})
+	} else {
+		t.fields = append(t.fields, flowField{ieFirstSwitched, 4}, flowField{ieLastSwitched, 4})
+	}
+	return t
+}
+
+// flowTemplates maps the export formats to their templates for IPv4 and IPv6 records
+var flowTemplates = map[string][2]*flowTemplate{
+	exportIPFIX: {
+		newFlowTemplate(exportIPFIX, templateIPv4, ieSourceIPv4Address, ieDestinationIPv4Address, 4),
+		newFlowTemplate(exportIPFIX, templateIPv6, ieSourceIPv6Address, ieDestinationIPv6Address, 16),
+	},
+	exportNetFlow9: {
+		newFlowTemplate(exportNetFlow9, templateIPv4, ieSourceIPv4Address, ieDestinationIPv4Address, 4),
+		newFlowTemplate(exportNetFlow9, templateIPv6, ieSourceIPv6Address, ieDestinationIPv6Address, 16),
+	},
+}
+
+// appendUint16 appends v to b in network byte order
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendUint32 appends v to b in network byte order
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// appendUint64 appends v to b in network byte order
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+// uptime returns the milliseconds elapsed from origin to t, the exporter's uptime for NetFlow v9
+func uptime(t time.Time, origin time.Time) uint32 {
+	if t.Before(origin) {
+		return 0
+	}
+	return uint32(t.Sub(origin) / time.Millisecond)
+}
+
+// appendRecord appends the record encoded with the template
+func appendRecord(b []byte, t *flowTemplate, r *flowRecord, origin time.Time) []byte {
+	for _, f := range t.fields {
+		switch f.id {
+		case ieSourceIPv4Address:
+			b = append(b, r.srcIP.To4()...)
+		case ieDestinationIPv4Address:
+			b = append(b, r.dstIP.To4()...)
+		case ieSourceIPv6Address:
+			b = append(b, r.srcIP.To16()...)
+		case ieDestinationIPv6Address:
+			b = append(b, r.dstIP.To16()...)
+		case ieSourceTransportPort:
+			b = appendUint16(b, r.srcPort)
+		case ieDestinationTransportPort:
+			b = appendUint16(b, r.dstPort)
+		case ieProtocolIdentifier:
+			b = append(b, r.protocol)
+		case ieTCPControlBits:
+			b = append(b, r.tcpFlags)
+		case iePacketDeltaCount:
+			b = appendUint64(b, r.packets)
+		case ieOctetDeltaCount:
+			b = appendUint64(b, r.bytes)
+		case ieFlowStartMilliseconds:
+			b = appendUint64(b, uint64(r.first.UnixNano()/int64(time.Millisecond)))
+		case ieFlowEndMilliseconds:
+			b = appendUint64(b, uint64(r.last.UnixNano()/int64(time.Millisecond)))
+		case ieFlowEndReason:
+			b = append(b, r.endReason)
+		case ieFirstSwitched:
+			b = appendUint32(b, uptime(r.first, origin))
+		case ieLastSwitched:
+			b = appendUint32(b, uptime(r.last, origin))
+		}
+	}
+	return b
+}
+
+// flowMessage is an encoded IPFIX or NetFlow v9 message
+type flowMessage struct {
+	data    []byte
+	records int // Number of data records in the message
+}
+
+// flowMessageBuilder accumulates the sets of a message
+type flowMessageBuilder struct {
+	format  string
+	sets    []byte
+	set     int    // Offset of the header of the data set being filled, or -1
+	setID   uint16 // Template of the data set being filled
+	count   int    // Number of template and data records, for NetFlow v9
+	records int    // Number of data records
+}
+
+// headerLength returns the length of the message header of the format
+func headerLength(format string) int {
+	if format == exportIPFIX {
+		return 16
+	}
+	return 20
+}
+
+// newFlowMessageBuilder starts a message, with the templates if they are due
+func (e *flowExporter) newFlowMessageBuilder() *flowMessageBuilder {
+	m := &flowMessageBuilder{format: e.format, set: -1}
+	if e.messages%defExportTemplateRate != 0 {
+		return m
+	}
+
+	setID := uint16(ipfixTemplateSet)
+	if e.format == exportNetFlow9 {
+		setID = netflow9TemplateSet
+	}
+
+	templates := flowTemplates[e.format]
+	b := appendUint16(m.sets, setID)
+	b = appendUint16(b, 0)
+	for _, t := range templates {
+		b = appendUint16(b, t.id)
+		b = appendUint16(b, uint16(len(t.fields)))
+		for _, f := range t.fields {
+			b = appendUint16(b, f.id)
+			b = appendUint16(b, f.length)
+		}
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	m.sets = b
+	m.count = len(templates)
+	return m
+}
+
+// closeSet ends the data set being filled. NetFlow v9 sets are padded to 4 bytes.
+func (m *flowMessageBuilder) closeSet() {
+	if m.set < 0 {
+		return
+	}
+	if m.format == exportNetFlow9 {
+		for (len(m.sets)-m.set)%4 != 0 {
+			m.sets = append(m.sets, 0)
+		}
+	}
+	binary.BigEndian.PutUint16(m.sets[m.set+2:], uint16(len(m.sets)-m.set))
+	m.set = -1
+}
+
+// fits tells whether a record of the template can be added without exceeding the maximum message size
+func (m *flowMessageBuilder) fits(t *flowTemplate) bool {
+	size := headerLength(m.format) + len(m.sets) + t.size() + 3 // Padding
+	if m.set < 0 || m.setID != t.id {
+		size += 4
+	}
+	return size <= defExportMaxMessage
+}
+
+// add appends the record to the message, in a data set of its template
+func (m *flowMessageBuilder) add(t *flowTemplate, r *flowRecord, origin time.Time) {
+	if m.set >= 0 && m.setID != t.id {
+		m.closeSet()
+	}
+	if m.set < 0 {
+		m.set = len(m.sets)
+		m.setID = t.id
+		m.sets = appendUint16(m.sets, t.id)
+		m.sets = appendUint16(m.sets, 0)
+	}
+	m.sets = appendRecord(m.sets, t, r, origin)
+	m.count++
+	m.records++
+}
+
+// build returns the message with its header, and advances the exporter's sequence number
+func (e *flowExporter) build(m *flowMessageBuilder, now time.Time, origin time.Time) flowMessage {
+	m.closeSet()
+
+	var b []byte
+	if e.format == exportIPFIX {
+		b = appendUint16(b, 10)
+		b = appendUint16(b, uint16(16+len(m.sets)))
+		b = appendUint32(b, uint32(now.Unix()))
+		b = appendUint32(b, e.sequence)
+		b = appendUint32(b, 0) // Observation domain
+		e.sequence += uint32(m.records)
+	} else {
+		b = appendUint16(b, 9)
+		b = appendUint16(b, uint16(m.count))
+		b = appendUint32(b, uptime(now, origin))
+		b = appendUint32(b, uint32(now.Unix()))
+		b = appendUint32(b, e.sequence)
+		b = appendUint32(b, 0) // Source identifier
+		e.sequence++
+	}
+	e.messages++
+
+	return flowMessage{data: append(b, m.sets...), records: m.records}
+}
+
+// encode returns the messages carrying the records, in the exporter's format. Capture time now is the time of
+// export, and origin the time the exporter started observing flows.
+func (e *flowExporter) encode(records []*flowRecord, now time.Time, origin time.Time) []flowMessage {
+	templates := flowTemplates[e.format]
+
+	var messages []flowMessage
+	var m *flowMessageBuilder
+	for _, r := range records {
+		t := templates[0]
+		if r.srcIP.To4() == nil {
+			t = templates[1]
+		}
+
+		if m != nil && !m.fits(t) {
+			messages = append(messages, e.build(m, now, origin))
+			m = nil
+		}
+		if m == nil {
+			m = e.newFlowMessageBuilder()
+		}
+		m.add(t, r, origin)
+	}
+	if m != nil {
+		messages = append(messages, e.build(m, now, origin))
+	}
+
+	return messages
+}
@@ -0,0 +1,160 @@
+package gonetmon
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// decodedFlow is a data record read back from a message, as the values of its information elements
+type decodedFlow map[uint16][]byte
+
+// decodeFlowMessage reads the templates and data records of an IPFIX or NetFlow v9 message, as a collector would.
+// Templates are kept in the map for the next messages.
+func decodeFlowMessage(t *testing.T, format string, data []byte, templates map[uint16][]flowField) (uint32, []decodedFlow) {
+	header := headerLength(format)
+	if len(data) < header {
+		t.Fatalf("%s message of %d bytes, shorter than its header", format, len(data))
+	}
+
+	var sequence uint32
+	templateSet := uint16(ipfixTemplateSet)
+	if format == exportIPFIX {
+		if version, length := binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:]); version != 10 || int(length) != len(data) {
+			t.Fatalf("IPFIX header : version %d, length %d of %d bytes", version, length, len(data))
+		}
+		sequence = binary.BigEndian.Uint32(data[8:])
+	} else {
+		if version := binary.BigEndian.Uint16(data); version != 9 {
+			t.Fatalf("NetFlow v9 header : version %d", version)
+		}
+		sequence = binary.BigEndian.Uint32(data[12:])
+		templateSet = netflow9TemplateSet
+	}
+
+	var records []decodedFlow
+	var count int
+	for sets := data[header:]; len(sets) > 0; {
+		id, length := binary.BigEndian.Uint16(sets), int(binary.BigEndian.Uint16(sets[2:]))
+		if length < 4 || length > len(sets) {
+			t.Fatalf("%s set %d of length %d, with %d bytes left", format, id, length, len(sets))
+		}
+		body := sets[4:length]
+		sets = sets[length:]
+
+		if id == templateSet {
+			for len(body) >= 4 {
+				templateID, n := binary.BigEndian.Uint16(body), int(binary.BigEndian.Uint16(body[2:]))
+				body = body[4:]
+				fields := make([]flowField, n)
+				for i := range fields {
+					fields[i] = flowField{binary.BigEndian.Uint16(body), binary.BigEndian.Uint16(body[2:])}
+					body = body[4:]
+				}
+				templates[templateID] = fields
+				count++
+			}
+			continue
+		}
+
+		fields, ok := templates[id]
+		if !ok {
+			t.Fatalf("%s data set of unknown template %d", format, id)
+		}
+		size := (&flowTemplate{fields: fields}).size()
+		for len(body) >= size {
+			r := make(decodedFlow)
+			for _, f := range fields {
+				r[f.id] = body[:f.length]
+				body = body[f.length:]
+			}
+			records = append(records, r)
+			count++
+		}
+	}
+
+	if format == exportNetFlow9 && int(binary.BigEndian.Uint16(data[2:])) != count {
+		t.Errorf("NetFlow v9 header counts %d records, message holds %d", binary.BigEndian.Uint16(data[2:]), count)
+	}
+	return sequence, records
+}
+
+func TestFlowExportRoundTrip(t *testing.T) {
+	first := time.Date(2026, 10, 18, 14, 0, 0, 0, time.UTC)
+	var records []*flowRecord
+	for i := 0; i < 100; i++ {
+		src, dst := net.IPv4(10, 0, 0, byte(i)), net.IPv4(192, 168, 1, 10)
+		if i%3 == 0 {
+			src, dst = net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+		}
+		records = append(records, &flowRecord{
+			srcIP: src, dstIP: dst, srcPort: uint16(40000 + i), dstPort: 80, protocol: 6,
+			packets: uint64(i + 1), bytes: uint64(1000 * (i + 1)), first: first, last: first.Add(time.Second),
+			tcpFlags: 0x1b, endReason: flowEndDetected,
+		})
+	}
+
+	for _, format := range []string{exportIPFIX, exportNetFlow9} {
+		listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := newFlowExporter(&exportConfig{collector: listener.LocalAddr().String(), format: format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.export(records, first.Add(2*time.Second), first)
+		e.close()
+
+		// Records don't fit in a single message, and sequence numbers count records for IPFIX, messages for NetFlow v9
+		templates := make(map[uint16][]flowField)
+		var decoded []decodedFlow
+		buf := make([]byte, 65536)
+		for messages := 0; len(decoded) < len(records); messages++ {
+			_ = listener.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := listener.ReadFrom(buf)
+			if err != nil {
+				t.Fatalf("%s : %d of %d records received : %v", format, len(decoded), len(records), err)
+			}
+			if n > defExportMaxMessage {
+				t.Errorf("%s : message of %d bytes, over %d", format, n, defExportMaxMessage)
+			}
+
+			// Records keep slices of the message
+			sequence, flows := decodeFlowMessage(t, format, append([]byte{}, buf[:n]...), templates)
+			want := uint32(len(decoded))
+			if format == exportNetFlow9 {
+				want = uint32(messages)
+			}
+			if sequence != want {
+				t.Errorf("%s : message %d has sequence number %d, want %d", format, messages, sequence, want)
+			}
+			decoded = append(decoded, flows...)
+		}
+		_ = listener.Close()
+
+		for i, r := range decoded {
+			want := records[i]
+			src, ok := r[ieSourceIPv4Address]
+			if !ok {
+				src = r[ieSourceIPv6Address]
+			}
+			if !net.IP(src).Equal(want.srcIP) || binary.BigEndian.Uint16(r[ieSourceTransportPort]) != want.srcPort ||
+				binary.BigEndian.Uint64(r[iePacketDeltaCount]) != want.packets ||
+				binary.BigEndian.Uint64(r[ieOctetDeltaCount]) != want.bytes || r[ieTCPControlBits][0] != want.tcpFlags {
+				t.Errorf("%s : record %d decoded as %v, want %+v", format, i, r, want)
+			}
+
+			if format == exportIPFIX {
+				start := binary.BigEndian.Uint64(r[ieFlowStartMilliseconds])
+				if start != uint64(first.UnixNano()/int64(time.Millisecond)) || r[ieFlowEndReason][0] != flowEndDetected {
+					t.Errorf("IPFIX : record %d starts at %d, ends for reason %d", i, start, r[ieFlowEndReason][0])
+				}
+			} else if last := binary.BigEndian.Uint32(r[ieLastSwitched]); last != 1000 {
+				t.Errorf("NetFlow v9 : record %d last switched at %d ms of uptime, want 1000", i, last)
+			}
+		}
+	}
+}
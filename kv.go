@@ -0,0 +1,445 @@
+package gonetmon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sort"
+	"strings"
+	"time"
+)
+
+// kvKeySeparators are the characters that usually separate the prefix of a key from the rest of it, like in "user:1234"
+const kvKeySeparators = ":/."
+
+// errKVLine is returned when a line exceeds the maximum length, which means the stream is not read where lines start
+var errKVLine = errors.New("line too long")
+
+// lineReader splits one direction of a text protocol into CRLF terminated lines, and skips the blocks of data
+// that lines announce
+type lineReader struct {
+	line  []byte // Line being read
+	skip  int    // Bytes of the data block still to skip, including its CRLF
+	size  int    // Size of the data block, without its CRLF
+	keep  bool   // Whether the beginning of the data block is to be kept
+	block []byte // Kept beginning of the data block
+}
+
+// expect announces a block of data of the given size, coming after the current line
+func (r *lineReader) expect(size int, keep bool) {
+	r.skip = size + 2
+	r.size = size
+	r.keep = keep
+	r.block = r.block[:0]
+}
+
+// read hands the complete lines to onLine, and the end of data blocks to onBlock, with their beginning if it is kept.
+// Missing bytes, of segments truncated by capture, can only be skipped inside data blocks.
+func (r *lineReader) read(data []byte, missing int, onLine func(line []byte) error, onBlock func(block []byte) error) error {
+	for len(data) > 0 || missing > 0 {
+		if r.skip > 0 {
+			n := r.skip
+			if len(data) > 0 {
+				if n > len(data) {
+					n = len(data)
+				}
+				if r.keep && len(r.block) < defKVMaxKey {
+					r.block = append(r.block, data[:n]...)
+				}
+				data = data[n:]
+			} else {
+				if n > missing {
+					n = missing
+				}
+				missing -= n
+			}
+
+			r.skip -= n
+			if r.skip > 0 {
+				continue
+			}
+
+			var block []byte
+			if r.keep {
+				block = r.block
+				if len(block) > r.size {
+					block = block[:r.size]
+				}
+				if len(block) > defKVMaxKey {
+					block = block[:defKVMaxKey]
+				}
+			}
+			if err := onBlock(block); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(data) == 0 {
+			return errTCPGap
+		}
+
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			r.line = append(r.line, data...)
+			data = nil
+		} else {
+			r.line = append(r.line, data[:idx]...)
+			data = data[idx+1:]
+		}
+		if len(r.line) > maxLineLength {
+			return errKVLine
+		}
+		if idx < 0 {
+			continue
+		}
+
+		err := onLine(bytes.TrimSuffix(r.line, []byte("\r")))
+		r.line = r.line[:0]
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// kvCommand is a command sent to a key-value store
+type kvCommand struct {
+	name string // Name of the command, in upper case
+	key  string // First key of the command, if any
+}
+
+// kvReply is a reply of a key-value store, matched to the command it answers when possible
+type kvReply struct {
+	command string        // Name of the command answered, or empty if it is not known
+	err     bool          // Whether the reply is an error
+	latency time.Duration // Time between the command and its reply, if known
+}
+
+// kvPending is a command waiting for its reply
+type kvPending struct {
+	command string
+	sent    time.Time
+}
+
+// kvParser reads the commands or replies of one direction of a key-value store connection
+type kvParser interface {
+	// consume reads the next bytes of the direction, and registers complete commands or replies on the connection
+	consume(data []byte, missing int) error
+}
+
+// kvDirection is one direction of a key-value store connection
+type kvDirection struct {
+	stream *tcpReassembler // Bytes sent on this direction
+	parser kvParser        // Protocol parser of this direction
+	broken bool            // Whether bytes were lost where protocol elements were expected
+}
+
+// kvConn is a connection to a key-value store. Replies come in the order of the commands.
+type kvConn struct {
+	toServer *kvDirection // Direction from client to server
+	toClient *kvDirection // Direction from server to client
+	pending  []kvPending  // Commands waiting for their reply, in order
+	unpaired bool         // Whether replies can't be matched to commands anymore, like after subscribing to messages
+	now      time.Time    // Capture time of the packet being decoded
+	commands []kvCommand  // Commands completed by the packet being decoded
+	replies  []kvReply    // Replies completed by the packet being decoded
+}
+
+// command registers a command, and whether a reply is expected for it
+func (c *kvConn) command(name string, key string, replied bool) {
+	c.commands = append(c.commands, kvCommand{name: name, key: key})
+
+	if replied && !c.unpaired {
+		// Don't grow indefinitely if replies are missed
+		if len(c.pending) >= defKVMaxPending {
+			c.pending = c.pending[1:]
+		}
+		c.pending = append(c.pending, kvPending{command: name, sent: c.now})
+	}
+}
+
+// reply registers a reply, matching it to the oldest command waiting for one
+func (c *kvConn) reply(err bool) {
+	if c.unpaired || len(c.pending) == 0 {
+		c.replies = append(c.replies, kvReply{err: err})
+		return
+	}
+
+	p := c.pending[0]
+	c.pending = c.pending[1:]
+	c.replies = append(c.replies, kvReply{command: p.command, err: err, latency: c.now.Sub(p.sent)})
+}
+
+// unpair stops matching replies to commands, when the server starts sending messages that answer no command
+func (c *kvConn) unpair() {
+	c.unpaired = true
+	c.pending = nil
+}
+
+// kvMessage holds the commands and replies decoded from a packet
+type kvMessage struct {
+	commands []kvCommand
+	replies  []kvReply
+}
+
+// kvDissector handles a plaintext key-value store protocol, like Redis or memcached, served on a well known port
+type kvDissector struct {
+	name       string                               // Name of the protocol
+	title      string                               // Name of the protocol in reports
+	port       uint16                               // Port the servers listen on
+	newParsers func(c *kvConn) (kvParser, kvParser) // Returns the parsers of commands and replies of a connection
+	conns      map[string]*kvConn                   // Connections being decoded, only accessed while monitoring
+}
+
+// newKVDissector returns a dissector for the key-value store protocol
+func newKVDissector(name string, title string, port uint16, newParsers func(c *kvConn) (kvParser, kvParser)) *kvDissector {
+	return &kvDissector{
+		name:       name,
+		title:      title,
+		port:       port,
+		newParsers: newParsers,
+		conns:      make(map[string]*kvConn),
+	}
+}
+
+// Name returns the name of the dissector
+func (d *kvDissector) Name() string {
+	return d.name
+}
+
+// Filter returns the BPF fragment for TCP traffic on the server port
+func (d *kvDissector) Filter() string {
+	return buildNetworkFilter([]uint16{d.port})
+}
+
+// Match tells whether the packet is sent to or from the server port, and carries data or closes the connection
+func (d *kvDissector) Match(packet gopacket.Packet) bool {
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return false
+	}
+	if uint16(tcp.SrcPort) != d.port && uint16(tcp.DstPort) != d.port {
+		return false
+	}
+	return len(tcp.LayerPayload()) > 0 || tcp.FIN || tcp.RST
+}
+
+// Decode reads the commands and replies of the packet
+func (d *kvDissector) Decode(data *packetMsg) (interface{}, error) {
+	tcp, ok := data.rawPacket.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return nil, errors.New("no TCP layer in packet")
+	}
+	key, _, _ := connEndpoints(data.rawPacket)
+
+	conn, ok := d.conns[key]
+	if !ok {
+		// Don't grow indefinitely : start over when full, losing track of ongoing connections
+		if len(d.conns) >= defMaxFlows {
+			d.conns = make(map[string]*kvConn)
+		}
+		conn = &kvConn{}
+		toServer, toClient := d.newParsers(conn)
+		conn.toServer = &kvDirection{stream: newTCPReassembler(), parser: toServer}
+		conn.toClient = &kvDirection{stream: newTCPReassembler(), parser: toClient}
+		d.conns[key] = conn
+	}
+
+	if tcp.FIN || tcp.RST {
+		defer delete(d.conns, key)
+	}
+	conn.now = data.rawPacket.Metadata().Timestamp
+
+	dir := conn.toClient
+	if uint16(tcp.DstPort) == d.port {
+		dir = conn.toServer
+	}
+
+	if !dir.broken {
+		err := dir.stream.reassemble(tcp.Seq, newTCPSegment(data.rawPacket, tcp), dir.parser.consume)
+		if err != nil {
+			// Element boundaries are lost with the bytes, and replies can't be matched to commands anymore
+			dir.broken = true
+			conn.unpair()
+			log.Info(d.title, " connection ", key, " can no longer be decoded : ", err)
+		}
+	}
+
+	m := &kvMessage{commands: conn.commands, replies: conn.replies}
+	conn.commands = nil
+	conn.replies = nil
+	return m, nil
+}
+
+// NewAnalysis returns an empty analysis of the protocol
+func (d *kvDissector) NewAnalysis() protocolAnalysis {
+	return newKVAnalysis(d.title)
+}
+
+// kvCommandStats holds statistics about a command
+type kvCommandStats struct {
+	command string
+	calls   int           // Number of times the command was sent
+	errors  int           // Number of error replies to the command
+	latency time.Duration // Total latency of the replies matched to the command
+	timed   int           // Number of replies matched to the command
+}
+
+// average returns the average latency of the command
+func (s *kvCommandStats) average() time.Duration {
+	if s.timed == 0 {
+		return 0
+	}
+	return s.latency / time.Duration(s.timed)
+}
+
+// sortedKVCommands implements sort.Interface based on the calls of kvCommandStats
+type sortedKVCommands []*kvCommandStats
+
+func (c sortedKVCommands) Len() int           { return len(c) }
+func (c sortedKVCommands) Less(i, j int) bool { return c[i].calls > c[j].calls }
+func (c sortedKVCommands) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// kvAnalysis holds accumulated key-value store data between two reports
+type kvAnalysis struct {
+	name     string                     // Name of the protocol
+	calls    int                        // Number of commands
+	errors   int                        // Number of error replies
+	commands map[string]*kvCommandStats // Statistics per command
+	prefixes map[string]int             // Number of commands per key prefix
+}
+
+// newKVAnalysis returns a new and empty analysis of the protocol
+func newKVAnalysis(name string) *kvAnalysis {
+	return &kvAnalysis{
+		name:     name,
+		commands: make(map[string]*kvCommandStats),
+		prefixes: make(map[string]int),
+	}
+}
+
+// keyPrefix returns the prefix of a key, which plays the role of HTTP sections
+func keyPrefix(key string) string {
+	if idx := strings.IndexAny(key, kvKeySeparators); idx > 0 {
+		return key[:idx]
+	}
+	return key
+}
+
+// getCommand returns the statistics of the command, creating them if needed
+func (a *kvAnalysis) getCommand(name string) *kvCommandStats {
+	stats, ok := a.commands[name]
+	if !ok {
+		stats = &kvCommandStats{command: name}
+		a.commands[name] = stats
+	}
+	return stats
+}
+
+// Add adds the commands and replies of a packet to the analysis. Packets holding commands count as hits.
+func (a *kvAnalysis) Add(message interface{}) bool {
+	m, ok := message.(*kvMessage)
+	if !ok {
+		return false
+	}
+
+	for _, c := range m.commands {
+		a.calls++
+		a.getCommand(c.name).calls++
+		if c.key != "" {
+			a.prefixes[keyPrefix(c.key)]++
+		}
+	}
+
+	for _, r := range m.replies {
+		if r.err {
+			a.errors++
+		}
+		if r.command == "" {
+			continue
+		}
+
+		stats := a.getCommand(r.command)
+		if r.err {
+			stats.errors++
+		}
+		stats.latency += r.latency
+		stats.timed++
+	}
+
+	return len(m.commands) > 0
+}
+
+// Renew returns a new and empty analysis
+func (a *kvAnalysis) Renew() protocolAnalysis {
+	return newKVAnalysis(a.name)
+}
+
+// Report builds the section of the protocol in the report
+func (a *kvAnalysis) Report() protocolReport {
+	commands := make([]*kvCommandStats, 0, len(a.commands))
+	for _, stats := range a.commands {
+		commands = append(commands, stats)
+	}
+	sort.Sort(sortedKVCommands(commands))
+	if len(commands) > config.packetFilter.nbSections {
+		commands = commands[:config.packetFilter.nbSections]
+	}
+
+	prefixes := make([]string, 0, len(a.prefixes))
+	for p := range a.prefixes {
+		prefixes = append(prefixes, p)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return a.prefixes[prefixes[i]] > a.prefixes[prefixes[j]]
+	})
+	if len(prefixes) > config.packetFilter.nbSections {
+		prefixes = prefixes[:config.packetFilter.nbSections]
+	}
+
+	top := make(map[string]int, len(prefixes))
+	for _, p := range prefixes {
+		top[p] = a.prefixes[p]
+	}
+
+	return &kvReport{
+		name:        a.name,
+		calls:       a.calls,
+		errors:      a.errors,
+		topCommands: commands,
+		topPrefixes: top,
+	}
+}
+
+// kvReport holds the final result of a key-value store analysis
+type kvReport struct {
+	name        string            // Name of the protocol
+	calls       int               // Number of commands
+	errors      int               // Number of error replies
+	topCommands []*kvCommandStats // Commands with the most calls
+	topPrefixes map[string]int    // Key prefixes with the most commands
+}
+
+// Empty tells whether no command was seen
+func (r *kvReport) Empty() bool {
+	return r.calls == 0 && r.errors == 0
+}
+
+// Render returns the section of the protocol on the console display
+func (r *kvReport) Render() string {
+	var output string
+
+	output += fmt.Sprintf(reportKV+"\n", r.name, r.calls, r.errors)
+	for _, c := range r.topCommands {
+		output += fmt.Sprintf(reportKVCommand+"\n", c.command, c.calls, c.errors, c.average())
+	}
+	if len(r.topPrefixes) > 0 {
+		output += fmt.Sprintf(reportKVPrefixes+"\n", buildCountOutput(r.topPrefixes))
+	}
+
+	return output
+}
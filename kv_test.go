@@ -0,0 +1,127 @@
+package gonetmon
+
+import (
+	"testing"
+)
+
+// newTestKVConn returns a connection read by the parsers
+func newTestKVConn(newParsers func(c *kvConn) (kvParser, kvParser)) *kvConn {
+	c := &kvConn{}
+	toServer, toClient := newParsers(c)
+	c.toServer = &kvDirection{parser: toServer}
+	c.toClient = &kvDirection{parser: toClient}
+	return c
+}
+
+// consumeKV feeds the bytes to the parser in segments of the given size
+func consumeKV(p kvParser, data string, size int) error {
+	for len(data) > 0 {
+		n := size
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := p.consume([]byte(data[:n]), 0); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func TestKVParsers(t *testing.T) {
+	tests := []struct {
+		name       string
+		newParsers func(c *kvConn) (kvParser, kvParser)
+		sent       string // Bytes sent by the client
+		received   string // Bytes sent by the server
+		commands   []kvCommand
+		replies    []kvReply
+	}{
+		{"RESP", newRESPParsers,
+			"*3\r\n$3\r\nSET\r\n$9\r\nuser:1234\r\n$5\r\nhello\r\n*2\r\n$3\r\nget\r\n$9\r\nuser:1234\r\nPING\r\n*1\r\n$4\r\nINFO\r\n",
+			"+OK\r\n$5\r\nhello\r\n-ERR unknown\r\n*2\r\n$1\r\na\r\n*1\r\n:1\r\n",
+			[]kvCommand{{"SET", "user:1234"}, {"GET", "user:1234"}, {"PING", ""}, {"INFO", ""}},
+			[]kvReply{{command: "SET"}, {command: "GET"}, {command: "PING", err: true}, {command: "INFO"}}},
+		{"RESP3", newRESPParsers,
+			"*2\r\n$7\r\nHGETALL\r\n$6\r\nh:test\r\n",
+			"%1\r\n+field\r\n=9\r\ntxt:value\r\n",
+			[]kvCommand{{"HGETALL", "h:test"}},
+			[]kvReply{{command: "HGETALL"}}},
+		{"memcached", newMemcachedParsers,
+			"set user:1 0 0 5\r\nhello\r\nget user:1\r\ndelete user:2 noreply\r\nmg user:3 v\r\nstats\r\n",
+			"STORED\r\nVALUE user:1 0 5\r\nhello\r\nEND\r\nVA 2 v\r\nhi\r\nSTAT pid 1\r\nEND\r\n",
+			[]kvCommand{{"SET", "user:1"}, {"GET", "user:1"}, {"DELETE", "user:2"}, {"MG", "user:3"}, {"STATS", ""}},
+			[]kvReply{{command: "SET"}, {command: "GET"}, {command: "MG"}, {command: "STATS"}}},
+		{"memcached errors", newMemcachedParsers,
+			"incr counter 1\r\nbogus\r\n",
+			"CLIENT_ERROR invalid numeric delta argument\r\nERROR\r\n",
+			[]kvCommand{{"INCR", "counter"}, {"BOGUS", ""}},
+			[]kvReply{{command: "INCR", err: true}, {command: "BOGUS", err: true}}},
+	}
+
+	// Elements split across segments, down to a byte per segment, decode the same
+	for _, tt := range tests {
+		for _, size := range []int{len(tt.sent) + len(tt.received), 7, 1} {
+			c := newTestKVConn(tt.newParsers)
+			if err := consumeKV(c.toServer.parser, tt.sent, size); err != nil {
+				t.Fatalf("%s in segments of %d bytes : commands : %v", tt.name, size, err)
+			}
+			if err := consumeKV(c.toClient.parser, tt.received, size); err != nil {
+				t.Fatalf("%s in segments of %d bytes : replies : %v", tt.name, size, err)
+			}
+
+			if len(c.commands) != len(tt.commands) {
+				t.Fatalf("%s in segments of %d bytes : commands %v, want %v", tt.name, size, c.commands, tt.commands)
+			}
+			for i, cmd := range tt.commands {
+				if c.commands[i] != cmd {
+					t.Errorf("%s in segments of %d bytes : command %d is %v, want %v", tt.name, size, i, c.commands[i], cmd)
+				}
+			}
+
+			// Replies are matched to the commands expecting one
+			if len(c.replies) != len(tt.replies) {
+				t.Fatalf("%s in segments of %d bytes : replies %v, want %v", tt.name, size, c.replies, tt.replies)
+			}
+			for i, r := range tt.replies {
+				if c.replies[i] != r {
+					t.Errorf("%s in segments of %d bytes : reply %d is %+v, want %+v", tt.name, size, i, c.replies[i], r)
+				}
+			}
+		}
+	}
+}
+
+func TestKVErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		newParsers func(c *kvConn) (kvParser, kvParser)
+		server     bool // Whether the data is sent by the server
+		data       string
+		missing    int
+		err        error
+	}{
+		{"RESP oversized bulk string", newRESPParsers, false, "*2\r\n$3\r\nGET\r\n$9999999999\r\n", 0, errRESP},
+		{"RESP oversized array", newRESPParsers, true, "*9999999999\r\n", 0, errRESP},
+		{"RESP invalid length", newRESPParsers, true, "$abc\r\n", 0, errRESP},
+		{"RESP inline reply", newRESPParsers, true, "hello\r\n", 0, errRESP},
+		{"RESP bytes missing in bulk string", newRESPParsers, true, "$100\r\nabc", 99, nil},
+		{"RESP bytes missing in header", newRESPParsers, true, "+OK\r\n", 5, errTCPGap},
+		{"memcached oversized value", newMemcachedParsers, true, "VALUE k 0 9999999999\r\n", 0, errMemcached},
+		{"memcached negative size", newMemcachedParsers, false, "set k 0 0 -1\r\n", 0, errMemcached},
+		{"memcached missing size", newMemcachedParsers, false, "set k 0\r\n", 0, errMemcached},
+		{"memcached bare meta command", newMemcachedParsers, false, "mn\r\nmg\r\n", 0, nil},
+		{"memcached line too long", newMemcachedParsers, false, "get " + string(make([]byte, maxLineLength)), 0, errKVLine},
+	}
+
+	for _, tt := range tests {
+		c := newTestKVConn(tt.newParsers)
+		p := c.toServer.parser
+		if tt.server {
+			p = c.toClient.parser
+		}
+		if err := p.consume([]byte(tt.data), tt.missing); err != tt.err {
+			t.Errorf("%s : error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package gonetmon
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	dataMemcached = "memcached"
+	memcachedPort = 11211
+)
+
+// errMemcached is returned for lines that are not memcached text protocol
+var errMemcached = errors.New("invalid memcached line")
+
+// memcachedStorage maps the storage commands to the position of the size of the data block that follows them
+var memcachedStorage = map[string]int{
+	"set":     4,
+	"add":     4,
+	"replace": 4,
+	"append":  4,
+	"prepend": 4,
+	"cas":     4,
+	"ms":      2,
+}
+
+// memcachedKeyless are the commands that don't act on a key
+var memcachedKeyless = map[string]bool{
+	"stats":     true,
+	"version":   true,
+	"flush_all": true,
+	"verbosity": true,
+	"quit":      true,
+	"mn":        true,
+}
+
+// memcachedMeta are the meta commands, which may be sent in quiet mode
+var memcachedMeta = map[string]bool{
+	"mg": true,
+	"ms": true,
+	"md": true,
+	"ma": true,
+}
+
+// memcachedClient reads the commands of a memcached connection, in the text protocol
+type memcachedClient struct {
+	conn   *kvConn    // Connection the commands are registered on
+	reader lineReader // Lines and data blocks of the direction
+}
+
+// memcachedServer reads the replies of a memcached connection, in the text protocol
+type memcachedServer struct {
+	conn      *kvConn    // Connection the replies are registered on
+	reader    lineReader // Lines and data blocks of the direction
+	valueEnds bool       // Whether the data block being read ends the reply, as for meta commands
+}
+
+// newMemcachedParsers returns the parsers of commands and replies of a memcached connection
+func newMemcachedParsers(c *kvConn) (kvParser, kvParser) {
+	return &memcachedClient{conn: c}, &memcachedServer{conn: c}
+}
+
+// blockSize returns the size of a data block announced in a field
+func blockSize(fields []string, position int) (int, error) {
+	if position >= len(fields) {
+		return 0, errMemcached
+	}
+	size, err := strconv.Atoi(fields[position])
+	if err != nil || size < 0 || size > defKVMaxBlock {
+		return 0, errMemcached
+	}
+	return size, nil
+}
+
+// consume reads the next bytes of the direction
+func (p *memcachedClient) consume(data []byte, missing int) error {
+	return p.reader.read(data, missing, p.line, p.block)
+}
+
+// line reads a command
+func (p *memcachedClient) line(line []byte) error {
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return nil
+	}
+	name := strings.ToLower(fields[0])
+
+	if position, ok := memcachedStorage[name]; ok {
+		size, err := blockSize(fields, position)
+		if err != nil {
+			return err
+		}
+		p.reader.expect(size, false)
+	}
+
+	var key string
+	if len(fields) > 1 && !memcachedKeyless[name] {
+		key = fields[1]
+	}
+
+	replied := fields[len(fields)-1] != "noreply" && name != "quit"
+	p.conn.command(strings.ToUpper(name), key, replied)
+
+	// In quiet mode, only failures are replied to
+	if memcachedMeta[name] && len(fields) > 2 {
+		for _, flag := range fields[2:] {
+			if flag == "q" {
+				p.conn.unpair()
+			}
+		}
+	}
+	return nil
+}
+
+// block reads the end of the data block of a storage command
+func (p *memcachedClient) block(block []byte) error {
+	return nil
+}
+
+// consume reads the next bytes of the direction
+func (p *memcachedServer) consume(data []byte, missing int) error {
+	return p.reader.read(data, missing, p.line, p.block)
+}
+
+// line reads a reply, or a line of a reply spanning several lines
+func (p *memcachedServer) line(line []byte) error {
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return nil
+	}
+
+	switch fields[0] {
+	case "VALUE": // VALUE <key> <flags> <bytes> [<cas unique>], until END
+		size, err := blockSize(fields, 3)
+		if err != nil {
+			return err
+		}
+		p.reader.expect(size, false)
+
+	case "VA": // VA <size> <flags>*, the reply of a meta get
+		size, err := blockSize(fields, 1)
+		if err != nil {
+			return err
+		}
+		p.reader.expect(size, false)
+		p.valueEnds = true
+
+	case "STAT", "ITEM": // Statistics, until END
+
+	case "ERROR", "CLIENT_ERROR", "SERVER_ERROR":
+		p.conn.reply(true)
+
+	default: // END, STORED, NOT_STORED, EXISTS, NOT_FOUND, DELETED, TOUCHED, OK, VERSION, numbers, and meta codes
+		p.conn.reply(false)
+	}
+
+	return nil
+}
+
+// block reads the end of a value
+func (p *memcachedServer) block(block []byte) error {
+	if p.valueEnds {
+		p.valueEnds = false
+		p.conn.reply(false)
+	}
+	return nil
+}
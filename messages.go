@@ -7,9 +7,10 @@ import (
 
 // packetMsg holds information and metadata about a captured packet after a filter was applied
 type packetMsg struct {
-	dataType  string          // Kind of data, for now just http packet
+	dataType  string          // Kind of data, the name of the dissector that matched the packet
 	device    string          // Interface on which the traffic was recorded
-	deviceIP  string          // IP address of local network device interface
+	direction string          // Direction of the packet relative to the local host : inbound, outbound, internal or transit
+	deviceIP  string          // Local IP address of the packet
 	remoteIP  string          // IP address or remote peer
 	rawPacket gopacket.Packet // Actual packet payload
 }
@@ -20,3 +21,11 @@ type alertMsg struct {
 	body      string    // Message to display
 	timestamp time.Time // Date of alert or recovery
 }
+
+// deviceMsg holds information about a network device that appeared or disappeared during runtime
+type deviceMsg struct {
+	added     bool      // True if the device was added to capture, false if it was removed
+	device    string    // Name of the network device
+	body      string    // Message to display
+	timestamp time.Time // Date of the change
+}
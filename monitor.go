@@ -1,17 +1,18 @@
 package gonetmon
 
 import (
+	"github.com/google/gopacket"
 	"github.com/sirupsen/logrus"
 	"strings"
 	"time"
 )
 
 //Monitor is the link between packet capture, alerting, and display, that accumulates data, analyses it and builds report to display
-func Monitor(packetChan <-chan packetMsg, reportChan chan<- *report, alertChan chan<- alertMsg, syn *synchronisation) {
+func Monitor(packetChan <-chan packetMsg, reportChan chan<- *report, alertChan chan<- alertMsg, triggerChan chan bool, syn *synchronisation) {
 	defer syn.wg.Done()
 
 	// Start a new monitoring session
-	session := NewSession(alertChan, syn)
+	session := NewSession(alertChan, triggerChan, syn)
 
 	// Set up ticker to regularly send reports to display
 	tickerReport := time.NewTicker(config.displayRefresh)
@@ -31,28 +32,24 @@ monitorLoop:
 			reportChan <- session.BuildReport(session.watchdog.Hits(), tr)
 
 			// Renew session analysis
-			session.analysis = NewAnalysis()
+			session.renewAnalysis()
 
 		case data := <-packetChan:
 
-			// Handle http data type
-			if data.dataType == config.packetFilter.dataType {
-				// Transform data into a more convenient form
-				packet, err := DataToHTTP(&data)
-				if err != nil {
-					log.WithFields(logrus.Fields{
-						"interface":         data.device,
-						"capture timestamp": data.rawPacket.Metadata().Timestamp,
-						"payload":           strings.Replace(string(data.rawPacket.ApplicationLayer().Payload()), "\n", "{newline}", -1), // Flatten to a single line to avoid breaking log file
-					}).Error("Could not interpret package as http.")
-					continue
-				}
-
-				// Add packet to analysis
-				session.analysis.AddPacket(packet)
-
-				// Update watchdog
-				session.watchdog.AddHit(packet.packet.Metadata().Timestamp)
+			// Transform data into a more convenient form with its dissector, and add it to analysis
+			hit, err := session.dissect(&data)
+			if err != nil {
+				log.WithFields(logrus.Fields{
+					"interface":         data.device,
+					"capture timestamp": data.rawPacket.Metadata().Timestamp,
+					"payload":           flattenPayload(data.rawPacket),
+				}).Error("Could not interpret package as " + data.dataType + ".")
+				continue
+			}
+
+			// Update watchdog
+			if hit {
+				session.watchdog.AddHit(data.rawPacket.Metadata().Timestamp)
 			}
 		}
 
@@ -61,3 +58,12 @@ monitorLoop:
 	tickerReport.Stop()
 	log.Info("Monitor terminating")
 }
+
+// flattenPayload returns the application payload of the packet on a single line, to avoid breaking log file
+func flattenPayload(packet gopacket.Packet) string {
+	app := packet.ApplicationLayer()
+	if app == nil {
+		return ""
+	}
+	return strings.Replace(string(app.Payload()), "\n", "{newline}", -1)
+}
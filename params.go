@@ -1,6 +1,7 @@
 package gonetmon
 
 import (
+	"net"
 	"sync"
 	"time"
 )
@@ -9,35 +10,137 @@ const (
 	// dataTypes
 	dataHTTP = "http"
 
+	// capture sources
+	sourcePcap     = "pcap"     // Live capture with libpcap
+	sourceAFPacket = "afpacket" // Live capture with AF_PACKET sockets, Linux only
+	sourceFile     = "file"     // Read packets from a pcap file
+
+	// flow export formats
+	exportIPFIX    = "ipfix"    // IPFIX, RFC 7011
+	exportNetFlow9 = "netflow9" // NetFlow version 9, RFC 3954
+
+	// recording formats
+	recordPcap   = "pcap"
+	recordPcapNG = "pcapng"
+
 	// output
 	consoleOutput = "console"
+	jsonOutput    = "json" // Lines of JSON on the standard output
 	//fileOutput    = ""
 )
 
+// defPorts are the default TCP ports to capture HTTP traffic on
+var defPorts = []uint16{80, 3000, 8000, 8080}
+
+// defTLSPorts are the default TCP ports to capture TLS traffic on
+var defTLSPorts = []uint16{443}
+
+// defDissectors are the protocols analysed by default
+var defDissectors = []string{dataHTTP}
+
 // Default values for program parameters
 const (
 	// Capture default
-	defNetworkFilter           = "tcp and port 80"
-	defApplicationFilter       = "HTTP"
-	defApplicationType         = dataHTTP
-	defNbSection               = 3
-	defSnapshotLen       int32 = 1024
-	defPromiscuousMode         = false
-	defCaptureTimeout          = defDisplayRefresh
+	defNbSection                 = 3
+	defNbClients                 = 3
+	defPathDepth                 = 3
+	defMaxPathNodes              = 10000
+	defRole                      = roleAuto
+	defMaxFlows                  = 10000
+	defDNSCacheSize              = 10000
+	defDNSCacheGrace             = 5 * time.Minute
+	defDNSQueryTimeout           = 5 * time.Second // Queries not answered after that long are considered lost
+	defTCPReorderDelay           = 3 * time.Millisecond
+	defH2MaxStreams              = 1000      // Maximum number of open streams tracked on a HTTP/2 connection
+	defMaxPendingSegments        = 64        // Maximum number of out of order segments waiting in a reassembled TCP stream
+	defH2MaxHeaderBlock          = 64 * 1024 // Maximum size of a HTTP/2 header block
+	defKVMaxPending              = 1000      // Maximum number of commands waiting for their reply on a key-value store connection
+	defKVMaxKey                  = 256       // Maximum length of the command names and keys kept
+	defKVMaxBlock                = 512 << 20 // Maximum size of a data block, or number of elements of an aggregate
+	defMaxClientKeys             = 1000      // Maximum number of User-Agents, referers or client addresses counted
+	defMaxAgentName              = 64        // Maximum length of the User-Agent names and referers kept
+	defCompressMinSize           = 1024      // Size of compressible responses past which they should be compressed
+	defMaxEndpoints              = 10000     // Maximum number of endpoints whose error responses are counted
+	defErrorRateWarning          = 5.0       // Error rate, in percent, past which it is shown in red
+	defSnapshotLen         int32 = 1024
+	defPromiscuousMode           = false
+	defCaptureTimeout            = defDisplayRefresh
+	defCaptureSource             = sourcePcap
+	defCaptureFile               = ""
+	defAFPacketPollTimeout       = 500 * time.Millisecond
+	defWatchInterval             = 5 * time.Second
+
+	// Flow export defaults
+	defExportFormat       = exportIPFIX
+	defFlowIdleTimeout    = 15 * time.Second // Flows are exported when no packet was seen for that long
+	defFlowActiveTimeout  = 60 * time.Second // Long lasting flows are exported at this period
+	defFlowSweep          = time.Second      // Period to look for expired flows
+	defExportMaxMessage   = 1400             // Maximum size of an exported message, to avoid IP fragmentation
+	defExportTemplateRate = 20               // Templates are sent again every that many messages
+
+	// Recording defaults
+	defRecordDir         = "" // Packets are not recorded by default
+	defRecordFormat      = recordPcapNG
+	defRecordFileSize    = 100 * 1024 * 1024  // Size past which a recording file is rotated
+	defRecordPeriod      = time.Hour          // Period after which a recording file is rotated
+	defRecordBudget      = 1024 * 1024 * 1024 // Oldest recording files are deleted past that total size
+	defRecordPreAlert    = 30 * time.Second   // Packets before an alert that are recorded with it
+	defRecordMaxBuffered = 100000             // Maximum number of packets kept for the pre-alert period
 
 	// Display configuration
 	defDisplayRefresh = 10 * time.Second
 	defDisplayType    = consoleOutput // Default output destination
+	defMaxEvents      = 5             // Number of most recent device events to keep on display
+	defMaxAlerts      = 10            // Number of most recent alerts and recoveries to keep on display
+
+	// History defaults
+	defHistoryRecent  = time.Hour       // History kept at the resolution of reports
+	defHistoryDaily   = 24 * time.Hour  // History kept downsampled
+	defHistoryStep    = 5 * time.Minute // Resolution of the downsampled history
+	defSparklineWidth = 60              // Maximum number of characters of sparklines
+
+	// Store defaults
+	defStoreDir       = ""                 // Reports and alerts are not stored by default
+	defStoreRetention = 7 * 24 * time.Hour // Records older than that are deleted
+	defStoreMaxBytes  = 1024 * 1024 * 1024 // Oldest records are deleted past that size of the store
+	defStoreSegment   = time.Hour          // Period of records held in a single file of the store
+	defStoreMaxRecord = 16 * 1024 * 1024   // Maximum size of a stored record
+	defQueryTop       = 10                 // Number of hosts answered to top queries
+	defQueryLayout    = "2006-01-02 15:04" // Layout of times in queries and their answers
 
 	// Format strings for display
-	defAlertFormat    = "High traffic generated an alert - hits = %d, triggered at %s"
-	defRecoveryFormat = "Alert recovered at %s"
+	defAlertFormat            = "High traffic generated an alert - hits = %d, triggered at %s"
+	defRecoveryFormat         = "Alert recovered at %s"
+	defClientAlertFormat      = "Client %s generated an alert - %d requests, %.1f%% errors over past %s, mostly on %s, triggered at %s"
+	defClientRecoveryFormat   = "Client %s alert recovered at %s"
+	defAlertsHeldFormat       = "%d more alerts and recoveries not shown since %s, %d alerts active at %s"
+	defBaselineAlertFormat    = "Anomaly in %s of %s : %.1f, usually %.1f ± %.1f (%.1f deviations), triggered at %s"
+	defBaselineRecoveryFormat = "Anomaly in %s of %s recovered at %s"
+	defDeviceAddedFormat      = "New device %s opened for capture at %s"
+	defDeviceRemovedFormat    = "Device %s removed from capture at %s"
 
 	// watchdog defaults
 	defAlertSpan        = 120 * time.Second
 	defAlertThreshold   = 7000
 	defaultWatchdogTick = 500 * time.Millisecond
 	defaultBufSize      = 1000
+	defAlertsPerWindow  = 10  // Number of alerts sent per report window, the others are summed up at its end
+	defAlertBufSize     = 100 // Size of the channel alerts are sent to display on
+
+	// Client alert defaults, over the same time frame
+	defClientThreshold    = 600
+	defPrefixThreshold    = 2000
+	defClientErrorRatio   = 50.0 // Percentage of error responses to a client that raises an alert
+	defClientMinResponses = 20   // Number of responses to a client before its error ratio is considered
+	defMaxSources         = 10000
+
+	// Baseline alert defaults, learned over report windows
+	defAlertMode            = alertThreshold
+	defAlertDeviations      = 3.0
+	defAlertWarmup          = 30  // Number of windows to learn from before alerting
+	defBaselineAlpha        = 0.1 // Weight of the last window in baselines
+	defBaselineMinResponses = 20  // Number of responses in a window before the error rate is considered
+	defMaxBaselines         = 10000
 
 	// General
 	defLogFile    = "./log-gonetmon.log"
@@ -49,27 +152,73 @@ type captureConfig struct {
 	snapshotLen     int32         // Maximum size to read for each packet
 	promiscuousMode bool          // Whether to ut the interface in promiscuous mode
 	captureTimeout  time.Duration // Period to listen for traffic before sending out captured traffic
+	source          string        // Kind of capture source to open : pcap, afpacket or file
+	file            string        // Path to the pcap file to read from, if source is file
+	watchInterval   time.Duration // Period to look for network devices that appeared or disappeared. 0 disables it
+}
+
+// exportConfig holds configuration for exporting flow records of all captured traffic
+type exportConfig struct {
+	collector     string        // Address and UDP port of the collector to send records to. Empty disables it
+	format        string        // Format of the records sent to the collector : ipfix or netflow9
+	jsonFile      string        // Path of the file to append records to, as JSON lines. Empty disables it
+	idleTimeout   time.Duration // Flows are exported when no packet was seen for that long
+	activeTimeout time.Duration // Long lasting flows are exported at this period
+}
+
+// enabled tells whether flows are to be exported
+func (e *exportConfig) enabled() bool {
+	return e.collector != "" || e.jsonFile != ""
+}
+
+// recordConfig holds configuration for recording the packets of analysed traffic to files
+type recordConfig struct {
+	dir      string        // Directory of the recording files. Empty disables it
+	format   string        // Format of the recording files : pcap or pcapng
+	fileSize int64         // Recording files are rotated past that size
+	period   time.Duration // Recording files are rotated after that period. 0 disables it
+	budget   int64         // Oldest recording files are deleted past that total size
+	onAlert  bool          // Whether packets are only recorded while an alert is active
+	preAlert time.Duration // Packets of that period before an alert are recorded with it
+}
+
+// storeConfig holds configuration for storing reports and alerts on disk
+type storeConfig struct {
+	dir       string        // Directory of the store. Empty disables it
+	retention time.Duration // Records older than that are deleted
+	maxBytes  int64         // Oldest records are deleted past that size of the store
 }
 
 // filter holds different filters on different levels to apply and tag data
 type filter struct {
-	network     string // BPF filter to filter traffic at data layer
-	application string // String to look for in application Layer
-	dataType    string // Monitor filter in case further development adds other traffic analysis
-	nbSections  int    // Number of sections to retain for top sections display
+	dissectors []string // Names of the dissectors to enable, each contributing its BPF fragment to filter traffic
+	ports      []uint16 // TCP ports to capture HTTP traffic on. If empty, HTTP is detected on any port
+	tlsPorts   []uint16 // TCP ports to capture TLS traffic on. If empty, TLS is detected on any port
+	nbSections int      // Number of sections to retain for top sections display
+	pathDepth  int      // Number of URL path segments kept to display the top endpoints
 }
 
 // synchronisation is a placeholder for synchronisation tools across goroutines
 type synchronisation struct {
 	wg          sync.WaitGroup
 	syncChan    chan struct{}
+	mutex       sync.Mutex // Routines are added from the goroutines that start them
 	nbReceivers uint
 }
 
 // addRoutine increments the number of goroutines to be synced and waiting for a message on the channel
 func (s *synchronisation) addRoutine() {
+	s.mutex.Lock()
 	s.wg.Add(1)
 	s.nbReceivers++
+	s.mutex.Unlock()
+}
+
+// receivers returns the number of goroutines to be synced
+func (s *synchronisation) receivers() uint {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.nbReceivers
 }
 
 // alertVars analysis related parameters
@@ -78,20 +227,37 @@ type alertVars struct {
 	threshold       int           // Number of request over time frame (hits/span) that will trigger an alert
 	watchdogTick    time.Duration // Period (milliseconds, preferably) over which to check for alerts
 	watchdogBufSize uint          // Size of the channel used to receive hit notification. Make it arbitrarily high. TODO: There may be a better way to do this
+
+	clientThreshold    int     // Number of requests of a single client address over the time frame that will trigger an alert
+	prefixThreshold    int     // Number of requests of the addresses of a /24 or /64 network over the time frame that will trigger an alert
+	clientErrorRatio   float64 // Percentage of error responses to a client over the time frame that will trigger an alert
+	clientMinResponses int     // Number of responses to a client over the time frame before its error ratio is considered
+
+	mode       string  // Alerts on the fixed threshold, on deviations from learned baselines, or both
+	deviations float64 // Number of standard deviations from the baseline that will trigger an alert
+	warmup     int     // Number of report windows to learn baselines from before alerting
 }
 
 // configuration holds the application's parameters it runs on
 type configuration struct {
 
 	// Raw data parameters
-	packetFilter        filter
-	captureConf         captureConfig
-	requestedInterfaces []string // Array of interfaces to specifically listen on. If nil, listen on all devices.
+	packetFilter filter
+	captureConf  captureConfig
+	interfaces   interfaceSelection // Rules to select the interfaces to listen on. If empty, listen on all devices.
+	export       exportConfig       // Flow export, disabled by default
+	store        storeConfig        // Storage of reports and alerts, disabled by default
+	record       recordConfig       // Recording of packets, disabled by default
 
 	// Display related parameters
 	displayRefresh time.Duration // Period (seconds) to renew display print, thus also used for capture and reporting
 	displayType    string        // Type of display output
 
+	// Analysis related parameters
+	role           string       // Role of the local host in HTTP exchanges : client, server, or auto to detect it
+	nbClients      int          // Number of clients to retain for top clients display
+	trustedProxies []*net.IPNet // Proxies and load balancers whose X-Forwarded-For tells the address of clients
+
 	alert alertVars
 }
 
@@ -101,24 +267,57 @@ func LoadParams() *configuration {
 
 	return &configuration{
 		packetFilter: filter{
-			network:     defNetworkFilter,
-			application: defApplicationFilter,
-			dataType:    defApplicationType,
-			nbSections:  defNbSection,
+			dissectors: defDissectors,
+			ports:      defPorts,
+			tlsPorts:   defTLSPorts,
+			nbSections: defNbSection,
+			pathDepth:  defPathDepth,
 		},
 		captureConf: captureConfig{
 			snapshotLen:     defSnapshotLen,
 			promiscuousMode: defPromiscuousMode,
 			captureTimeout:  defCaptureTimeout,
+			source:          defCaptureSource,
+			file:            defCaptureFile,
+			watchInterval:   defWatchInterval,
+		},
+		interfaces:     interfaceSelection{},
+		displayRefresh: defDisplayRefresh,
+		displayType:    defDisplayType,
+		role:           defRole,
+		nbClients:      defNbClients,
+		export: exportConfig{
+			format:        defExportFormat,
+			idleTimeout:   defFlowIdleTimeout,
+			activeTimeout: defFlowActiveTimeout,
+		},
+		record: recordConfig{
+			dir:      defRecordDir,
+			format:   defRecordFormat,
+			fileSize: defRecordFileSize,
+			period:   defRecordPeriod,
+			budget:   defRecordBudget,
+			preAlert: defRecordPreAlert,
+		},
+		store: storeConfig{
+			dir:       defStoreDir,
+			retention: defStoreRetention,
+			maxBytes:  defStoreMaxBytes,
 		},
-		requestedInterfaces: nil,
-		displayRefresh:      defDisplayRefresh,
-		displayType:         defDisplayType,
 		alert: alertVars{
 			span:            defAlertSpan,
 			threshold:       defAlertThreshold,
 			watchdogTick:    defaultWatchdogTick,
 			watchdogBufSize: defaultBufSize,
+
+			clientThreshold:    defClientThreshold,
+			prefixThreshold:    defPrefixThreshold,
+			clientErrorRatio:   defClientErrorRatio,
+			clientMinResponses: defClientMinResponses,
+
+			mode:       defAlertMode,
+			deviations: defAlertDeviations,
+			warmup:     defAlertWarmup,
 		},
 	}
 }
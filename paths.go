@@ -0,0 +1,173 @@
+package gonetmon
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// pathID replaces the segments of URL paths that identify a resource, so that requests for the same endpoint add up
+const pathID = "{id}"
+
+// isHex tells whether the character is a hexadecimal digit
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// isUUID tells whether the segment is a UUID, like 123e4567-e89b-12d3-a456-426614174000
+func isUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		switch i {
+		case 8, 13, 18, 23:
+			if s[i] != '-' {
+				return false
+			}
+		default:
+			if !isHex(s[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isIdentifier tells whether the path segment identifies a resource : a number, a UUID, or a long hexadecimal
+// string like a hash, holding at least a digit
+func isIdentifier(s string) bool {
+	if isUUID(s) {
+		return true
+	}
+
+	digits := 0
+	for i := 0; i < len(s); i++ {
+		if !isHex(s[i]) {
+			return false
+		}
+		if s[i] >= '0' && s[i] <= '9' {
+			digits++
+		}
+	}
+	return digits == len(s) || (len(s) >= 16 && digits > 0)
+}
+
+// pathSegments returns the segments of the path of a request target, without query nor fragment, with those
+// identifying resources replaced by a template. An empty target has no segments.
+func pathSegments(uri string) []string {
+	if idx := strings.IndexAny(uri, "?#"); idx >= 0 {
+		uri = uri[:idx]
+	}
+
+	var segments []string
+	for _, s := range strings.Split(uri, "/") {
+		if s == "" {
+			continue
+		}
+		if isIdentifier(s) {
+			s = pathID
+		}
+		segments = append(segments, s)
+	}
+	return segments
+}
+
+// pathNode is a level of a path tree, counting the requests for paths starting with it
+type pathNode struct {
+	hits     int
+	children map[string]*pathNode
+}
+
+// pathTree counts requests at every level of their URL path, down to a maximum depth
+type pathTree struct {
+	root     *pathNode
+	nodes    int // Number of nodes in the tree
+	maxDepth int // Number of path segments kept
+	maxNodes int // Maximum number of nodes, past which new paths are counted on their deepest known level
+}
+
+// pathCount is the number of requests for an endpoint
+type pathCount struct {
+	path string
+	hits int
+}
+
+// newPathTree returns an empty path tree
+func newPathTree(maxDepth int, maxNodes int) *pathTree {
+	return &pathTree{
+		root:     &pathNode{children: make(map[string]*pathNode)},
+		maxDepth: maxDepth,
+		maxNodes: maxNodes,
+	}
+}
+
+// add counts a request for the path given by its segments, at every level
+func (t *pathTree) add(segments []string) {
+	node := t.root
+	node.hits++
+
+	for i, s := range segments {
+		if i >= t.maxDepth {
+			break
+		}
+
+		child, ok := node.children[s]
+		if !ok {
+			// Don't grow indefinitely : stop at the deepest known level
+			if t.nodes >= t.maxNodes {
+				break
+			}
+			child = &pathNode{children: make(map[string]*pathNode)}
+			node.children[s] = child
+			t.nodes++
+		}
+		child.hits++
+		node = child
+	}
+}
+
+// collect appends the endpoints under the node down to depth, with the requests that ended at each of them
+func (n *pathNode) collect(prefix string, depth int, endpoints []pathCount) []pathCount {
+	ending := n.hits
+	if depth > 0 {
+		for name, child := range n.children {
+			ending -= child.hits
+			endpoints = child.collect(prefix+"/"+name, depth-1, endpoints)
+		}
+	}
+
+	if ending > 0 {
+		if prefix == "" {
+			prefix = "/"
+		}
+		endpoints = append(endpoints, pathCount{path: prefix, hits: ending})
+	}
+	return endpoints
+}
+
+// top returns the n endpoints with the most requests, with paths cut at depth
+func (t *pathTree) top(depth int, n int) []pathCount {
+	endpoints := t.root.collect("", depth, nil)
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].hits != endpoints[j].hits {
+			return endpoints[i].hits > endpoints[j].hits
+		}
+		return endpoints[i].path < endpoints[j].path
+	})
+
+	if len(endpoints) > n {
+		endpoints = endpoints[:n]
+	}
+	return endpoints
+}
+
+// SetPathDepth sets the number of URL path segments kept to report the top endpoints of hosts
+func SetPathDepth(depth int) error {
+	if depth < 1 {
+		return fmt.Errorf("invalid path depth %d, must be at least 1", depth)
+	}
+
+	config.packetFilter.pathDepth = depth
+	return nil
+}
@@ -0,0 +1,75 @@
+package gonetmon
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPathSegments(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want []string
+	}{
+		{"", nil},
+		{"/", nil},
+		{"/index.html", []string{"index.html"}},
+		{"/users/123/orders", []string{"users", pathID, "orders"}},
+		{"//users//42/", []string{"users", pathID}},
+		{"/users/123?page=2#top", []string{"users", pathID}},
+		{"/items/123e4567-e89b-12d3-a456-426614174000", []string{"items", pathID}},
+		{"/items/123E4567-E89B-12D3-A456-426614174000/edit", []string{"items", pathID, "edit"}},
+		{"/blobs/9f86d081884c7d659a2feaa0c55ad015", []string{"blobs", pathID}},
+		{"/blobs/deadbeefdeadbeef", []string{"blobs", "deadbeefdeadbeef"}}, // Hexadecimal words without digits are names
+		{"/blobs/9f86d081", []string{"blobs", "9f86d081"}},                 // Short hexadecimal strings may be names
+		{"/v2/api", []string{"v2", "api"}},
+		{"/users/123e4567-e89b-12d3-a456-42661417400", []string{"users", "123e4567-e89b-12d3-a456-42661417400"}},
+	}
+
+	for _, tt := range tests {
+		if got := pathSegments(tt.uri); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pathSegments(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestPathTree(t *testing.T) {
+	tree := newPathTree(3, 100)
+	for uri, n := range map[string]int{
+		"/users/1/orders/7": 4, // Cut at the maximum depth
+		"/users/2/orders":   3,
+		"/users/3":          2,
+		"/":                 1,
+		"/static/app.js":    5,
+	} {
+		for i := 0; i < n; i++ {
+			tree.add(pathSegments(uri))
+		}
+	}
+
+	tests := []struct {
+		depth int
+		n     int
+		want  []pathCount
+	}{
+		{1, 10, []pathCount{{"/users", 9}, {"/static", 5}, {"/", 1}}},
+		{2, 10, []pathCount{{"/users/{id}", 9}, {"/static/app.js", 5}, {"/", 1}}},
+		{3, 2, []pathCount{{"/users/{id}/orders", 7}, {"/static/app.js", 5}}},
+		{3, 10, []pathCount{{"/users/{id}/orders", 7}, {"/static/app.js", 5}, {"/users/{id}", 2}, {"/", 1}}},
+	}
+
+	for _, tt := range tests {
+		if got := tree.top(tt.depth, tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("top(%d, %d) = %v, want %v", tt.depth, tt.n, got, tt.want)
+		}
+	}
+
+	// When full, new paths are counted on their deepest known level
+	full := newPathTree(3, 2)
+	for _, uri := range []string{"/a/b", "/a/c", "/d"} {
+		full.add(pathSegments(uri))
+	}
+	want := []pathCount{{"/", 1}, {"/a", 1}, {"/a/b", 1}}
+	if got := full.top(3, 10); !reflect.DeepEqual(got, want) {
+		t.Errorf("full tree : top(3, 10) = %v, want %v", got, want)
+	}
+}
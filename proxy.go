@@ -0,0 +1,184 @@
+package gonetmon
+
+import (
+	"fmt"
+	"golang.org/x/net/idna"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// protocolConnect is the protocol of the upgrade table for tunnels established through a proxy with CONNECT
+const protocolConnect = "connect"
+
+// normalizeHost returns the host in canonical form : in lower case, internationalised names in ASCII, and without
+// the default port of the scheme
+func normalizeHost(host string, scheme string) string {
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		name, port = h, p
+	}
+	name = strings.TrimSuffix(strings.Trim(name, "[]"), ".")
+
+	if ascii, err := idna.Lookup.ToASCII(name); err == nil {
+		name = ascii
+	}
+	name = strings.ToLower(name)
+
+	defaultPort := "80"
+	if scheme == "https" {
+		defaultPort = "443"
+	}
+	if port == "" || port == defaultPort {
+		if strings.Contains(name, ":") {
+			return "[" + name + "]"
+		}
+		return name
+	}
+	return net.JoinHostPort(name, port)
+}
+
+// requestScheme returns the scheme of the request, given in absolute-form targets sent to proxies, or http
+func requestScheme(req *http.Request) string {
+	if req.URL != nil && req.URL.Scheme != "" {
+		return strings.ToLower(req.URL.Scheme)
+	}
+	return "http"
+}
+
+// requestPath returns the path and query of the request target, also for absolute-form targets sent to proxies
+func requestPath(req *http.Request) string {
+	if req.URL != nil && req.URL.IsAbs() {
+		return req.URL.RequestURI()
+	}
+	return req.RequestURI
+}
+
+// httpTunnel is a connection on which a tunnel was requested to a proxy
+type httpTunnel struct {
+	target      string    // Host and port the tunnel was requested to
+	opened      time.Time // Capture time of the response establishing the tunnel
+	established bool      // Whether the proxy established the tunnel
+}
+
+// tunnelMessage holds the tunnel data of a packet
+type tunnelMessage struct {
+	target   string        // Host and port of the tunnel
+	bytes    int           // Bytes of tunnel data
+	closed   bool          // Whether the packet closes the tunnel
+	duration time.Duration // Duration of the tunnel, if it was closed
+}
+
+// trackTunnel registers CONNECT requests, and the responses establishing tunnels or refusing them. The message is
+// tagged with the tunnel's target when it is part of the establishment.
+func (d *httpDissector) trackTunnel(key string, p *MetaPacket) {
+	if p.messageType == httpRequest {
+		if p.request.Method != http.MethodConnect {
+			return
+		}
+
+		// Don't grow indefinitely : start over when full, losing track of tunnels being established, and of their
+		// upgrades so that tunnel data isn't taken for HTTP
+		if _, ok := d.tunnels[key]; !ok && len(d.tunnels) >= defMaxFlows {
+			for k := range d.tunnels {
+				upgrades.remove(k)
+			}
+			d.tunnels = make(map[string]*httpTunnel)
+		}
+		p.tunnel = normalizeHost(p.request.Host, "")
+		d.tunnels[key] = &httpTunnel{target: p.tunnel}
+		return
+	}
+
+	t, ok := d.tunnels[key]
+	if !ok || t.established {
+		return
+	}
+
+	p.tunnel = t.target
+	if p.response.StatusCode/100 == 2 {
+		t.established = true
+		t.opened = p.packet.Metadata().Timestamp
+	} else {
+		delete(d.tunnels, key)
+	}
+}
+
+// tunnelStats holds statistics about the tunnels requested to a target through proxies
+type tunnelStats struct {
+	target      string
+	requests    int           // Number of CONNECT requests
+	established int           // Number of tunnels established
+	refused     int           // Number of tunnels refused
+	bytes       int64         // Bytes carried by the tunnels, in both directions
+	closed      int           // Number of tunnels closed
+	duration    time.Duration // Sum of the durations of the tunnels closed
+}
+
+// averageDuration returns the average duration of the tunnels closed
+func (s *tunnelStats) averageDuration() time.Duration {
+	if s.closed == 0 {
+		return 0
+	}
+	return s.duration / time.Duration(s.closed)
+}
+
+// getTunnel returns the statistics of the tunnels to the target, creating them if needed
+func (a *analysis) getTunnel(target string) *tunnelStats {
+	stats, ok := a.tunnels[target]
+	if !ok {
+		stats = &tunnelStats{target: target}
+		a.tunnels[target] = stats
+	}
+	return stats
+}
+
+// updateTunnelStats updates the statistics of tunnels with a message of their establishment
+func (a *analysis) updateTunnelStats(p *MetaPacket) {
+	stats := a.getTunnel(p.tunnel)
+	switch {
+	case p.messageType == httpRequest:
+		stats.requests++
+	case p.response.StatusCode/100 == 2:
+		stats.established++
+	default:
+		stats.refused++
+	}
+}
+
+// addTunnelData updates the statistics of tunnels with data they carried
+func (a *analysis) addTunnelData(m *tunnelMessage) {
+	stats := a.getTunnel(m.target)
+	stats.bytes += int64(m.bytes)
+	if m.closed {
+		stats.closed++
+		stats.duration += m.duration
+	}
+}
+
+// topTunnels returns the tunnel targets with the most requests
+func (a *analysis) topTunnels() []*tunnelStats {
+	tunnels := make([]*tunnelStats, 0, len(a.tunnels))
+	for _, stats := range a.tunnels {
+		tunnels = append(tunnels, stats)
+	}
+	sort.Slice(tunnels, func(i, j int) bool {
+		return tunnels[i].requests > tunnels[j].requests
+	})
+
+	if len(tunnels) > config.packetFilter.nbSections {
+		tunnels = tunnels[:config.packetFilter.nbSections]
+	}
+	return tunnels
+}
+
+// buildTunnelOutput returns a string representation of the statistics of tunnels
+func buildTunnelOutput(tunnels []*tunnelStats) string {
+	output := reportTunnels + "\n"
+	for _, t := range tunnels {
+		output += fmt.Sprintf(reportTunnel+"\n", t.target, t.requests, t.established, t.refused, t.bytes, t.averageDuration())
+	}
+	return output
+}
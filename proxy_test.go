@@ -0,0 +1,93 @@
+package gonetmon
+
+import (
+	"github.com/google/gopacket/layers"
+	"testing"
+	"time"
+)
+
+func TestUntrackedTunnel(t *testing.T) {
+	const client = "192.168.1.20"
+	now := time.Now()
+	d := newHTTPDissector()
+
+	// The proxy established a tunnel whose CONNECT request was lost while monitoring, as when tunnels are reset
+	request, err := NewSyntheticPacket(client, testServer, 40000, 80, []byte("CONNECT www.example.com:443 HTTP/1.1\r\nHost: www.example.com:443\r\n\r\n"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := NewSyntheticPacket(testServer, client, 80, 40000, []byte("HTTP/1.1 200 Connection established\r\n\r\n"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := NewSyntheticPacket(client, testServer, 40000, 80, []byte{0x16, 0x03, 0x01, 0x00, 0x05, 'h', 'e', 'l', 'l', 'o'}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fin, err := NewSyntheticTCPPacket(client, testServer, &layers.TCP{SrcPort: 40000, DstPort: 80, Seq: 11, ACK: true, FIN: true}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*packetMsg{{rawPacket: request}, {rawPacket: response}} {
+		if !d.Match(p.rawPacket) {
+			t.Fatal("handshake not matched")
+		}
+	}
+	key, _, _ := connEndpoints(request)
+	defer upgrades.remove(key)
+
+	// The response establishing the tunnel is still HTTP
+	message, err := d.Decode(&packetMsg{rawPacket: response})
+	if p, ok := message.(*MetaPacket); err != nil || !ok || p.messageType != httpResponse {
+		t.Fatalf("got %T %v, error %v, want the HTTP response", message, message, err)
+	}
+
+	for _, tt := range []struct {
+		name   string
+		packet *packetMsg
+		bytes  int
+	}{
+		{"data", &packetMsg{rawPacket: data}, 10},
+		{"fin", &packetMsg{rawPacket: fin}, 0},
+	} {
+		if !d.Match(tt.packet.rawPacket) {
+			t.Fatalf("%s : tunnel packet not matched", tt.name)
+		}
+		message, err := d.Decode(tt.packet)
+		m, ok := message.(*tunnelMessage)
+		if err != nil || !ok {
+			t.Fatalf("%s : got %T, error %v, want tunnel data", tt.name, message, err)
+		}
+		if m.target != "www.example.com:443" || m.bytes != tt.bytes {
+			t.Errorf("%s : got tunnel to %s with %d bytes, want %d bytes", tt.name, m.target, m.bytes, tt.bytes)
+		}
+	}
+	if _, switched := upgrades.get(key); switched {
+		t.Error("tunnel not forgotten once closed")
+	}
+}
+
+func TestTunnelsReset(t *testing.T) {
+	d := newHTTPDissector()
+	upgrades.track("old", "a", "b", []byte("CONNECT old.example.com:443 HTTP/1.1\r\n\r\n"), 0)
+	upgrades.track("old", "b", "a", []byte("HTTP/1.1 200 OK\r\n\r\n"), 0)
+	defer upgrades.remove("old")
+	d.tunnels["old"] = &httpTunnel{target: "old.example.com:443"}
+	for i := 1; i < defMaxFlows; i++ {
+		d.tunnels[string(rune(i))] = &httpTunnel{}
+	}
+
+	request, err := NewSyntheticPacket("192.168.1.20", testServer, 40001, 80, []byte("CONNECT www.example.com:443 HTTP/1.1\r\nHost: www.example.com:443\r\n\r\n"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := DataToHTTP(&packetMsg{rawPacket: request})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.trackTunnel("new", p)
+
+	if _, switched := upgrades.get("old"); switched || len(d.tunnels) != 1 {
+		t.Errorf("%d tunnels tracked, old upgrade kept %v : tables reset apart", len(d.tunnels), switched)
+	}
+}
@@ -0,0 +1,128 @@
+package gonetmon
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sort"
+)
+
+// errTCPGap is returned when bytes of a TCP stream are lost
+var errTCPGap = errors.New("missing bytes in TCP stream")
+
+// tcpSegment is a TCP segment. Its length may exceed its data if it was truncated by capture.
+type tcpSegment struct {
+	data   []byte
+	length int
+}
+
+// newTCPSegment returns the segment carried by the packet
+func newTCPSegment(packet gopacket.Packet, tcp *layers.TCP) tcpSegment {
+	payload := tcp.LayerPayload()
+	return tcpSegment{data: payload, length: len(payload) + missingBytes(packet)}
+}
+
+// missingBytes returns the number of bytes of the packet that were not captured, because of the snapshot length
+func missingBytes(packet gopacket.Packet) int {
+	meta := packet.Metadata()
+	if meta.Length > meta.CaptureLength {
+		return meta.Length - meta.CaptureLength
+	}
+	return 0
+}
+
+// connEndpoints returns an identifier of the TCP connection of the packet that is the same in both directions,
+// and the addresses and ports of the packet's sender and receiver
+func connEndpoints(packet gopacket.Packet) (string, string, string) {
+	srcPort, dstPort := getPorts(packet)
+	src, dst := packet.NetworkLayer().NetworkFlow().Endpoints()
+
+	sender := fmt.Sprintf("%s:%d", src, srcPort)
+	receiver := fmt.Sprintf("%s:%d", dst, dstPort)
+
+	endpoints := []string{sender, receiver}
+	sort.Strings(endpoints)
+
+	return endpoints[0] + "-" + endpoints[1], sender, receiver
+}
+
+// tcpReassembler puts the segments of one direction of a TCP connection back in order, skipping retransmitted bytes.
+// Tracking starts at the first segment seen.
+type tcpReassembler struct {
+	started bool                  // Whether the first segment was seen
+	next    uint32                // Next expected sequence number
+	pending map[uint32]tcpSegment // Segments received ahead of next
+}
+
+// newTCPReassembler returns a reassembler that did not see any segment yet
+func newTCPReassembler() *tcpReassembler {
+	return &tcpReassembler{
+		pending: make(map[uint32]tcpSegment),
+	}
+}
+
+// reassemble puts the segment in order, and hands all the bytes that became contiguous to consume.
+// Bytes missing from truncated segments are handed as a count.
+func (r *tcpReassembler) reassemble(seq uint32, segment tcpSegment, consume func(data []byte, missing int) error) error {
+	if segment.length == 0 {
+		return nil
+	}
+
+	if !r.started {
+		r.started = true
+		r.next = seq
+	}
+
+	// Segments ahead wait for the missing ones
+	if int32(seq-r.next) > 0 {
+		if len(r.pending) >= defMaxPendingSegments {
+			return errTCPGap
+		}
+		r.pending[seq] = segment
+		return nil
+	}
+
+	if err := r.deliver(seq, segment, consume); err != nil {
+		return err
+	}
+
+	// Deliver the segments that were waiting for this one
+	for len(r.pending) > 0 {
+		found := false
+		for s, seg := range r.pending {
+			if int32(s-r.next) <= 0 {
+				delete(r.pending, s)
+				if err := r.deliver(s, seg, consume); err != nil {
+					return err
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+
+	return nil
+}
+
+// deliver hands the part of a segment starting at or before the next expected byte that was not yet read
+func (r *tcpReassembler) deliver(seq uint32, segment tcpSegment, consume func(data []byte, missing int) error) error {
+	skip := int(r.next - seq)
+	if skip >= segment.length {
+		return nil
+	}
+
+	data := segment.data
+	if skip < len(data) {
+		data = data[skip:]
+	} else {
+		data = nil
+	}
+	length := segment.length - skip
+
+	r.next += uint32(length)
+	return consume(data, length-len(data))
+}
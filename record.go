@@ -0,0 +1,331 @@
+package gonetmon
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Recording file names are made of the prefix, the time the file was opened at, its number, and the format
+const (
+	recordPrefix = "gonetmon-"
+	recordLayout = "20060102-150405.000"
+)
+
+// linkType returns the link type of the packet, from its first layer
+func linkType(packet gopacket.Packet) layers.LinkType {
+	if len(packet.Layers()) == 0 {
+		return layers.LinkTypeEthernet
+	}
+	switch packet.Layers()[0].LayerType() {
+	case layers.LayerTypeLinuxSLL:
+		return layers.LinkTypeLinuxSLL
+	case layers.LayerTypeLoopback:
+		return layers.LinkTypeNull
+	case layers.LayerTypeIPv4, layers.LayerTypeIPv6:
+		return layers.LinkTypeRaw
+	default:
+		return layers.LinkTypeEthernet
+	}
+}
+
+// countingWriter counts the bytes written to a file
+type countingWriter struct {
+	w     io.Writer
+	bytes int64
+}
+
+// Write writes to the file and counts the bytes
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.bytes += int64(n)
+	return n, err
+}
+
+// recordFile is an open recording file. pcap files hold packets of a single link type, pcapng files hold an
+// interface for each device.
+type recordFile struct {
+	path       string
+	file       *os.File
+	counter    *countingWriter
+	opened     time.Time
+	linkType   layers.LinkType
+	pcap       *pcapgo.Writer
+	ng         *pcapgo.NgWriter
+	interfaces map[string]int // Maps devices to their interface in the pcapng file
+}
+
+// recorder writes packets to rotating pcap or pcapng files, and deletes the oldest ones past its disk budget.
+// If it records on alerts, packets are buffered for the pre-alert period and only written while an alert is active.
+// It's only accessed by its routine.
+type recorder struct {
+	conf    *recordConfig
+	file    *recordFile
+	buffer  list.List // Recent packets, when recording on alerts
+	active  bool      // Whether packets are written
+	packets int
+	files   int
+	errors  int
+}
+
+// newRecorder returns a recorder writing to the configured directory, creating it if needed
+func newRecorder(conf *recordConfig) (*recorder, error) {
+	if err := os.MkdirAll(conf.dir, 0755); err != nil {
+		return nil, err
+	}
+	return &recorder{conf: conf, active: !conf.onAlert}, nil
+}
+
+// open opens a new recording file for the first packet to write to it
+func (r *recorder) open(data *packetMsg) error {
+	t := time.Now()
+	path := filepath.Join(r.conf.dir, fmt.Sprintf("%s%s-%04d.%s", recordPrefix, t.Format(recordLayout), r.files%10000, r.conf.format))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	f := &recordFile{
+		path:       path,
+		file:       file,
+		counter:    &countingWriter{w: file},
+		opened:     t,
+		linkType:   linkType(data.rawPacket),
+		interfaces: make(map[string]int),
+	}
+	if r.conf.format == recordPcapNG {
+		intf := pcapgo.DefaultNgInterface
+		intf.Name, intf.LinkType = data.device, f.linkType
+		f.ng, err = pcapgo.NewNgWriterInterface(f.counter, intf, pcapgo.DefaultNgWriterOptions)
+		f.interfaces[data.device] = 0
+	} else {
+		f.pcap = pcapgo.NewWriter(f.counter)
+		err = f.pcap.WriteFileHeader(uint32(config.captureConf.snapshotLen), f.linkType)
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	r.file = f
+	r.files++
+	r.retain()
+	return nil
+}
+
+// close flushes and closes the current recording file
+func (r *recorder) close() {
+	if r.file == nil {
+		return
+	}
+	if r.file.ng != nil {
+		if err := r.file.ng.Flush(); err != nil {
+			r.errors++
+		}
+	}
+	if err := r.file.file.Close(); err != nil {
+		r.errors++
+	}
+	r.file = nil
+}
+
+// rotate closes the current file if it's too large, too old, or can't hold the packet
+func (r *recorder) rotate(data *packetMsg) {
+	if r.file == nil {
+		return
+	}
+	if r.file.counter.bytes >= r.conf.fileSize || (r.conf.period > 0 && time.Since(r.file.opened) >= r.conf.period) ||
+		(r.file.pcap != nil && linkType(data.rawPacket) != r.file.linkType) {
+		r.close()
+	}
+}
+
+// retain deletes the oldest recording files while the recordings exceed the disk budget, except the current one
+func (r *recorder) retain() {
+	files, err := filepath.Glob(filepath.Join(r.conf.dir, recordPrefix+"*"))
+	if err != nil {
+		return
+	}
+
+	// Names start with the time they were opened at, so they are in chronological order
+	var sizes []int64
+	var total int64
+	var recordings []string
+	for _, name := range files {
+		info, err := os.Stat(name)
+		if err != nil || info.IsDir() || (!strings.HasSuffix(name, "."+recordPcap) && !strings.HasSuffix(name, "."+recordPcapNG)) {
+			continue
+		}
+		recordings = append(recordings, name)
+		sizes = append(sizes, info.Size())
+		total += info.Size()
+	}
+
+	for i, name := range recordings {
+		if total <= r.conf.budget || name == r.file.path {
+			break
+		}
+		if err := os.Remove(name); err != nil {
+			log.WithFields(logrus.Fields{
+				"file":  name,
+				"error": err,
+			}).Error("Could not delete recording.")
+			return
+		}
+		total -= sizes[i]
+	}
+}
+
+// write writes the packet to the current recording file, opening one if needed
+func (r *recorder) write(data *packetMsg) {
+	r.rotate(data)
+	if r.file == nil {
+		if err := r.open(data); err != nil {
+			r.errors++
+			log.WithFields(logrus.Fields{
+				"directory": r.conf.dir,
+				"error":     err,
+			}).Error("Could not open recording file.")
+			return
+		}
+	}
+
+	ci := data.rawPacket.Metadata().CaptureInfo
+	var err error
+	if r.file.ng != nil {
+		id, ok := r.file.interfaces[data.device]
+		if !ok {
+			intf := pcapgo.DefaultNgInterface
+			intf.Name, intf.LinkType = data.device, linkType(data.rawPacket)
+			if id, err = r.file.ng.AddInterface(intf); err == nil {
+				r.file.interfaces[data.device] = id
+			}
+		}
+		if err == nil {
+			ci.InterfaceIndex = id
+			err = r.file.ng.WritePacket(ci, data.rawPacket.Data())
+		}
+	} else {
+		err = r.file.pcap.WritePacket(ci, data.rawPacket.Data())
+	}
+
+	if err != nil {
+		r.errors++
+		return
+	}
+	r.packets++
+}
+
+// add writes the packet if recording is active, or keeps it for the pre-alert period
+func (r *recorder) add(data *packetMsg) {
+	if r.active {
+		r.write(data)
+		return
+	}
+
+	r.buffer.PushBack(data)
+	r.evict(data.rawPacket.Metadata().Timestamp)
+}
+
+// evict removes the buffered packets older than the pre-alert period, keeping at most defRecordMaxBuffered packets
+func (r *recorder) evict(now time.Time) {
+	for e := r.buffer.Front(); e != nil; e = r.buffer.Front() {
+		data := e.Value.(*packetMsg)
+
+		// Since packets are buffered in order, following ones are all still valid
+		if now.Sub(data.rawPacket.Metadata().Timestamp) <= r.conf.preAlert && r.buffer.Len() <= defRecordMaxBuffered {
+			break
+		}
+		r.buffer.Remove(e)
+	}
+}
+
+// trigger starts recording when an alert is raised, beginning with the buffered packets, and stops it on recovery
+func (r *recorder) trigger(alert bool) {
+	if !r.conf.onAlert || alert == r.active {
+		return
+	}
+	r.active = alert
+
+	if !alert {
+		r.close()
+		return
+	}
+	for e := r.buffer.Front(); e != nil; e = r.buffer.Front() {
+		r.write(e.Value.(*packetMsg))
+		r.buffer.Remove(e)
+	}
+}
+
+// Recorder writes the relevant packets received on recordChan to rotating files, always or only while an alert is
+// active, as told on triggerChan
+func Recorder(rec *recorder, recordChan <-chan packetMsg, triggerChan <-chan bool, syn *synchronisation) {
+	defer syn.wg.Done()
+
+recorderLoop:
+	for {
+		select {
+
+		case <-syn.syncChan:
+			break recorderLoop
+
+		case alert := <-triggerChan:
+			rec.trigger(alert)
+
+		case data := <-recordChan:
+			rec.add(&data)
+		}
+	}
+
+	rec.close()
+
+	log.WithFields(logrus.Fields{
+		"packets": rec.packets,
+		"files":   rec.files,
+		"errors":  rec.errors,
+		"dropped": atomic.LoadUint64(&dropped.records),
+	}).Info("Recorder terminating")
+}
+
+// SetRecording enables writing the packets of the analysed traffic to pcap or pcapng files in a directory. Files are
+// rotated when they reach the given size or have been open for the given period, 0 disabling rotation in time, and
+// the oldest ones are deleted when all recordings exceed the budget. An empty directory disables recording.
+func SetRecording(dir string, format string, fileSize int64, period time.Duration, budget int64) error {
+	if format != recordPcap && format != recordPcapNG {
+		return fmt.Errorf("invalid recording format '%s', must be one of %s or %s", format, recordPcap, recordPcapNG)
+	}
+	if fileSize <= 0 || budget < fileSize {
+		return fmt.Errorf("invalid recording file size %d and budget %d, must be positive and the budget at least the file size", fileSize, budget)
+	}
+	if period < 0 {
+		return fmt.Errorf("invalid recording period %s, must not be negative", period)
+	}
+
+	config.record.dir = dir
+	config.record.format = format
+	config.record.fileSize = fileSize
+	config.record.period = period
+	config.record.budget = budget
+	return nil
+}
+
+// SetRecordTrigger sets whether packets are only recorded while an alert is active, beginning with the packets of the
+// given period before the alert
+func SetRecordTrigger(onAlert bool, preAlert time.Duration) error {
+	if preAlert < 0 {
+		return fmt.Errorf("invalid pre-alert period %s, must not be negative", preAlert)
+	}
+
+	config.record.onAlert = onAlert
+	config.record.preAlert = preAlert
+	return nil
+}
@@ -0,0 +1,159 @@
+package gonetmon
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+const (
+	dataRedis = "redis"
+	redisPort = 6379
+)
+
+// errRESP is returned for data that is not RESP, which means the stream is not read where elements start
+var errRESP = errors.New("invalid RESP element")
+
+// redisSubscribers are the commands after which the server sends messages that answer no command
+var redisSubscribers = map[string]bool{
+	"SUBSCRIBE":  true,
+	"PSUBSCRIBE": true,
+	"SSUBSCRIBE": true,
+	"MONITOR":    true,
+}
+
+// redisKeyless are common commands whose first argument is not a key
+var redisKeyless = map[string]bool{
+	"AUTH":       true,
+	"CLIENT":     true,
+	"CLUSTER":    true,
+	"COMMAND":    true,
+	"CONFIG":     true,
+	"ECHO":       true,
+	"HELLO":      true,
+	"INFO":       true,
+	"PSUBSCRIBE": true,
+	"PUBLISH":    true,
+	"SCRIPT":     true,
+	"SELECT":     true,
+	"SSUBSCRIBE": true,
+	"SUBSCRIBE":  true,
+}
+
+// respParser reads the commands or replies of one direction of a Redis connection, in RESP2 or RESP3.
+// Clients send commands as arrays of bulk strings, or inline.
+type respParser struct {
+	conn       *kvConn    // Connection the commands or replies are registered on
+	fromClient bool       // Whether the client sends on this direction
+	reader     lineReader // Lines and bulk strings of the direction
+	depth      []int      // Elements still expected in each of the nested aggregates being read
+	kind       byte       // Type of the top level element being read
+	args       []string   // First arguments of the command being read
+}
+
+// newRESPParsers returns the parsers of commands and replies of a Redis connection
+func newRESPParsers(c *kvConn) (kvParser, kvParser) {
+	return &respParser{conn: c, fromClient: true}, &respParser{conn: c}
+}
+
+// consume reads the next bytes of the direction
+func (p *respParser) consume(data []byte, missing int) error {
+	return p.reader.read(data, missing, p.line, p.block)
+}
+
+// line reads an element header, or a simple element
+func (p *respParser) line(line []byte) error {
+	if len(line) == 0 {
+		return nil
+	}
+
+	if len(p.depth) == 0 {
+		p.kind = line[0]
+		p.args = p.args[:0]
+	}
+
+	switch line[0] {
+	case '*', '~', '>', '%': // Array, set, push and map
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n > defKVMaxBlock {
+			return errRESP
+		}
+		if line[0] == '%' {
+			n *= 2
+		}
+		if n <= 0 {
+			return p.done()
+		}
+		p.depth = append(p.depth, n)
+		return nil
+
+	case '$', '=', '!': // Bulk string, verbatim string and bulk error
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n > defKVMaxBlock {
+			return errRESP
+		}
+		if n < 0 {
+			return p.done()
+		}
+		// Only the command name and key are kept
+		p.reader.expect(n, p.fromClient && len(p.depth) == 1 && len(p.args) < 2)
+		return nil
+
+	case '+', '-', ':', ',', '#', '_', '(': // Simple string, error, integer, double, boolean, null and big number
+		return p.done()
+
+	default:
+		if !p.fromClient || len(p.depth) > 0 {
+			return errRESP
+		}
+
+		// Inline command
+		fields := strings.Fields(string(line))
+		if len(fields) > 2 {
+			fields = fields[:2]
+		}
+		p.args = append(p.args, fields...)
+		return p.done()
+	}
+}
+
+// block reads the end of a bulk string
+func (p *respParser) block(block []byte) error {
+	if block != nil {
+		p.args = append(p.args, string(block))
+	}
+	return p.done()
+}
+
+// done ends an element, and the aggregates it completes. Complete top level elements are registered.
+func (p *respParser) done() error {
+	for len(p.depth) > 0 {
+		last := len(p.depth) - 1
+		p.depth[last]--
+		if p.depth[last] > 0 {
+			return nil
+		}
+		p.depth = p.depth[:last]
+	}
+
+	if !p.fromClient {
+		p.conn.reply(p.kind == '-' || p.kind == '!')
+		return nil
+	}
+
+	if len(p.args) == 0 {
+		return nil
+	}
+
+	name := strings.ToUpper(p.args[0])
+	var key string
+	if len(p.args) > 1 && !redisKeyless[name] {
+		key = p.args[1]
+	}
+
+	p.conn.command(name, key, true)
+	if redisSubscribers[name] {
+		p.conn.unpair()
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package gonetmon
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Families of response content types
+const (
+	contentHTML       = "html"
+	contentJSON       = "json"
+	contentJavaScript = "javascript"
+	contentCSS        = "css"
+	contentXML        = "xml"
+	contentText       = "text"
+	contentImage      = "image"
+	contentFont       = "font"
+	contentMedia      = "media"
+	contentGRPC       = "grpc"
+	contentOther      = "other"
+	contentNone       = "none"
+)
+
+// compressible are the content families worth compressing
+var compressible = map[string]bool{
+	contentHTML:       true,
+	contentJSON:       true,
+	contentJavaScript: true,
+	contentCSS:        true,
+	contentXML:        true,
+	contentText:       true,
+}
+
+// sizeBuckets are the upper bounds of the buckets of the response size histogram, larger responses count in the last
+var sizeBuckets = []int64{1 << 10, 10 << 10, 100 << 10, 1 << 20}
+
+// sizeLabels name the buckets of the response size histogram
+var sizeLabels = []string{"<1KB", "<10KB", "<100KB", "<1MB", ">=1MB"}
+
+// contentFamily returns the family of the media type given in a Content-Type header
+func contentFamily(contentType string) string {
+	media := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	kind := strings.Split(media, "/")[0]
+
+	switch {
+	case media == "":
+		return contentNone
+	case media == "text/html" || media == "application/xhtml+xml":
+		return contentHTML
+	case strings.HasPrefix(media, "application/grpc"):
+		return contentGRPC
+	case strings.HasSuffix(media, "json"):
+		return contentJSON
+	case strings.Contains(media, "javascript") || strings.Contains(media, "ecmascript"):
+		return contentJavaScript
+	case media == "text/css":
+		return contentCSS
+	case strings.HasSuffix(media, "xml"):
+		return contentXML
+	case kind == "text":
+		return contentText
+	case kind == "image":
+		return contentImage
+	case kind == "font" || strings.Contains(media, "font"):
+		return contentFont
+	case kind == "video" || kind == "audio":
+		return contentMedia
+	default:
+		return contentOther
+	}
+}
+
+// sizeBucket returns the index of the histogram bucket of the size
+func sizeBucket(size int64) int {
+	for i, bound := range sizeBuckets {
+		if size < bound {
+			return i
+		}
+	}
+	return len(sizeBuckets)
+}
+
+// cacheability tells whether the Cache-Control and Expires headers allow shared caches to store the response. The
+// second value is false when the headers don't say, leaving caches to their heuristics.
+func cacheability(header http.Header) (cacheable bool, explicit bool) {
+	directives := make(map[string]string)
+	for _, d := range strings.Split(strings.ToLower(header.Get("Cache-Control")), ",") {
+		name, value := strings.TrimSpace(d), ""
+		if idx := strings.IndexByte(name, '='); idx >= 0 {
+			name, value = name[:idx], strings.Trim(name[idx+1:], "\"")
+		}
+		if name != "" {
+			directives[name] = value
+		}
+	}
+
+	for _, d := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[d]; ok {
+			return false, true
+		}
+	}
+	for _, d := range []string{"s-maxage", "max-age"} {
+		if value, ok := directives[d]; ok {
+			age, err := strconv.Atoi(value)
+			return err == nil && age > 0, true
+		}
+	}
+	if _, ok := directives["public"]; ok {
+		return true, true
+	}
+	if header.Get("Expires") != "" {
+		return true, true
+	}
+	return false, false
+}
+
+// responseStats holds statistics about the responses of a host or a section
+type responseStats struct {
+	responses    int
+	classes      []int          // Number of responses in each status class
+	contentTypes map[string]int // Map content families to the number of responses
+	sizes        []int          // Number of responses in each bucket of sizes, when announced
+	bodies       int            // Number of responses announcing a body, or not announcing their size
+	bytes        int64          // Sum of the announced sizes
+	encodings    map[string]int // Map content codings to the number of responses compressed with them
+	uncompressed int            // Number of responses of compressible content sent uncompressed, heavier than the minimum
+	cacheable    int            // Number of responses that shared caches may store
+	uncacheable  int            // Number of responses that shared caches must not store
+	aged         int            // Number of responses with an Age header, served from a cache
+	etags        int            // Number of responses with an ETag
+	notModified  int            // Number of 304 Not Modified responses
+	cacheHits    int            // Number of responses a CDN marked as hits in X-Cache
+	cacheMisses  int            // Number of responses a CDN marked as misses in X-Cache
+}
+
+// newResponseStats returns an empty set of statistics about responses
+func newResponseStats() *responseStats {
+	return &responseStats{
+		classes:      make([]int, len(statusClasses)),
+		contentTypes: make(map[string]int),
+		sizes:        make([]int, len(sizeLabels)),
+		encodings:    make(map[string]int),
+	}
+}
+
+// add updates the statistics with the response
+func (s *responseStats) add(res *http.Response) {
+	s.responses++
+	s.classes[callClass(res)]++
+
+	family := contentFamily(res.Header.Get("Content-Type"))
+	if res.StatusCode != http.StatusNotModified && res.ContentLength != 0 {
+		s.contentTypes[family]++
+		s.bodies++
+	}
+
+	if res.ContentLength >= 0 {
+		s.sizes[sizeBucket(res.ContentLength)]++
+		s.bytes += res.ContentLength
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding")))
+	switch {
+	case encoding != "" && encoding != "identity":
+		s.encodings[encoding]++
+	case compressible[family] && res.ContentLength >= defCompressMinSize:
+		s.uncompressed++
+	}
+
+	if cacheable, explicit := cacheability(res.Header); explicit && cacheable {
+		s.cacheable++
+	} else if explicit {
+		s.uncacheable++
+	}
+	if res.Header.Get("Age") != "" {
+		s.aged++
+	}
+	if res.Header.Get("ETag") != "" {
+		s.etags++
+	}
+	if res.StatusCode == http.StatusNotModified {
+		s.notModified++
+	}
+
+	xCache := strings.ToUpper(res.Header.Get("X-Cache"))
+	switch {
+	case strings.Contains(xCache, "HIT"):
+		s.cacheHits++
+	case strings.Contains(xCache, "MISS"):
+		s.cacheMisses++
+	}
+}
+
+// percent returns the share of n in the responses
+func (s *responseStats) percent(n int) float64 {
+	if s.responses == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(s.responses)
+}
+
+// compressedPercent returns the share of compressed responses among those with a body
+func (s *responseStats) compressedPercent() float64 {
+	if s.bodies == 0 {
+		return 0
+	}
+	compressed := 0
+	for _, n := range s.encodings {
+		compressed += n
+	}
+	return 100 * float64(compressed) / float64(s.bodies)
+}
+
+// buildSizeOutput returns a string representation of the size histogram, in size order
+func buildSizeOutput(sizes []int) string {
+	var output string
+	for i, n := range sizes {
+		if n > 0 {
+			output += fmt.Sprintf("%s(%d) ", sizeLabels[i], n)
+		}
+	}
+	return output
+}
+
+// buildResponseStatsOutput returns a string representation of the statistics about responses, each line starting
+// with the indent
+func buildResponseStatsOutput(s *responseStats, indent string) string {
+	if s == nil || s.responses == 0 {
+		return ""
+	}
+
+	output := indent + fmt.Sprintf(reportContent+"\n", buildRankedOutput(topCounts(s.contentTypes, len(s.contentTypes))),
+		buildSizeOutput(s.sizes), s.compressedPercent(), buildCountOutput(s.encodings), s.uncompressed)
+
+	// Responses without any cache signal, like those of APIs, leave nothing to tell
+	if s.cacheable+s.uncacheable+s.aged+s.etags+s.notModified+s.cacheHits+s.cacheMisses == 0 {
+		return output
+	}
+	output += indent + fmt.Sprintf(reportCache+"\n", s.percent(s.cacheable), s.percent(s.uncacheable),
+		s.percent(s.aged), s.percent(s.etags), s.percent(s.notModified), s.cacheHits, s.cacheMisses)
+	return output
+}
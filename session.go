@@ -3,29 +3,163 @@ package gonetmon
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
 	"time"
 )
 
-// session is a placeholder for current analysis and watchdog reference
+// session is a placeholder for current analyses and watchdog reference
 type session struct {
-	analysis *analysis // Current ongoing analysis
-	watchdog *watchdog // Surveil traffic behaviour and raise alert if need
+	dissectors map[string]Dissector // Enabled dissectors, by name
+	analyses   []protocolAnalysis   // Current ongoing analyses, one per dissector or group of dissectors sharing one
+	index      map[string]int       // Maps a dissector's name to the position of its analysis
+	watchdog   *watchdog            // Surveil traffic behaviour and raise alert if need
+	sources    *sourceWatch         // Surveil the behaviour of single clients and raise alerts if need
+	baselines  *baselines           // Learn the usual traffic of hosts and raise alerts on anomalies
+	alerts     *alerter             // Path of all alerts to display
+	hits       int                  // Hits of the current analyses
 }
 
-// NewSession initialises a new monitoring session and launches a watchdog goroutine
-func NewSession(alertChan chan<- alertMsg, syn *synchronisation) *session {
-	return &session{
-		analysis: NewAnalysis(),
-		watchdog: NewWatchdog(alertChan, syn),
+// NewSession initialises a new monitoring session for the enabled dissectors and launches a watchdog goroutine
+func NewSession(alertChan chan<- alertMsg, triggerChan chan bool, syn *synchronisation) *session {
+	dissectors := enabledDissectors()
+	alerts := newAlerter(alertChan, triggerChan)
+
+	s := &session{
+		dissectors: make(map[string]Dissector, len(dissectors)),
+		analyses:   make([]protocolAnalysis, 0, len(dissectors)),
+		index:      make(map[string]int, len(dissectors)),
+		watchdog:   NewWatchdog(alerts, syn),
+		sources:    newSourceWatch(alerts),
+		baselines:  newBaselines(alerts),
+		alerts:     alerts,
 	}
+
+	for _, d := range dissectors {
+		s.dissectors[d.Name()] = d
+	}
+
+	// Dissectors that share an analysis come first in the list, so create the others' analyses beforehand
+	for _, d := range dissectors {
+		if _, shared := d.(sharedDissector); !shared {
+			s.index[d.Name()] = len(s.analyses)
+			s.analyses = append(s.analyses, d.NewAnalysis())
+		}
+	}
+
+	for _, d := range dissectors {
+		shared, ok := d.(sharedDissector)
+		if !ok {
+			continue
+		}
+		if i, enabled := s.index[shared.SharesWith()]; enabled {
+			s.index[d.Name()] = i
+		} else {
+			s.index[d.Name()] = len(s.analyses)
+			s.analyses = append(s.analyses, d.NewAnalysis())
+		}
+	}
+
+	return s
+}
+
+// renewAnalysis starts new analyses, keeping track of state that must outlive a report
+func (s *session) renewAnalysis() {
+	for i, a := range s.analyses {
+		s.analyses[i] = a.Renew()
+	}
+	s.hits = 0
+}
+
+// dissect decodes the packet with the dissector it was tagged with, and adds it to the corresponding analysis.
+// Returns whether the message counts as a hit.
+func (s *session) dissect(data *packetMsg) (bool, error) {
+	i, ok := s.index[data.dataType]
+	if !ok {
+		return false, fmt.Errorf("no enabled dissector for %s", data.dataType)
+	}
+
+	message, err := s.dissectors[data.dataType].Decode(data)
+	if err != nil {
+		return false, err
+	}
+
+	hit := s.analyses[i].Add(message)
+	s.sources.observe(message)
+	if hit {
+		s.hits++
+	}
+	return hit, nil
 }
 
-// BuildReport calls for a final analysis and returns the resulting report
+// BuildReport calls for a final analysis and returns the resulting report, with the top talkers
 func (s *session) BuildReport(watchdogHits int, t time.Time) *report {
-	return NewReport(s.analysis, watchdogHits, t)
+	r := NewReport(s.analyses, watchdogHits, t)
+
+	// The window of the analyses is over, compare it to what it usually is
+	if config.alert.mode != alertThreshold {
+		for _, a := range s.analyses {
+			if h, ok := a.(*analysis); ok {
+				s.baselines.observe(h, t)
+			}
+		}
+	}
+
+	s.sources.evict(t)
+	r.alerts = s.alerts.endWindow(t)
+	r.talkers, r.networks = s.sources.talkers()
+	r.window = s.window(watchdogHits, t)
+	if config.store.dir != "" {
+		r.hosts = s.hostSummaries()
+	}
+	return r
+}
+
+// hostSummaries returns the traffic of every host of the current analyses, for the store
+func (s *session) hostSummaries() []storedHost {
+	var hosts []storedHost
+	for _, a := range s.analyses {
+		if h, ok := a.(*analysis); ok {
+			for _, stats := range h.hosts {
+				hosts = append(hosts, newStoredHost(stats))
+			}
+		}
+	}
+	return hosts
+}
+
+// window returns the sample of traffic of the current analyses, for history
+func (s *session) window(watchdogHits int, t time.Time) historySample {
+	sample := historySample{
+		t:            t,
+		hits:         s.hits,
+		watchdogHits: watchdogHits,
+		traffic:      make(map[string]int64),
+	}
+
+	var responses, errors int
+	for _, a := range s.analyses {
+		h, ok := a.(*analysis)
+		if !ok {
+			continue
+		}
+		for dev, bits := range h.traffic {
+			sample.traffic[dev] += bits
+		}
+		for _, host := range h.hosts {
+			sample.bytes += host.responses.bytes
+			responses += host.responses.responses
+			errors += host.responses.errors()
+		}
+	}
+	if responses > 0 {
+		sample.errorRate = 100 * float64(errors) / float64(responses)
+	}
+
+	return sample
 }
 
 // readRequest is a wrapper around http.ReadRequest
@@ -65,9 +199,13 @@ func readResponse(b *bufio.Reader) (*http.Response, error) {
 // Returns nil wth an error if data does not contain a valid http payload
 func DataToHTTP(data *packetMsg) (*MetaPacket, error) {
 
+	application := data.rawPacket.ApplicationLayer()
+	if application == nil {
+		return nil, errors.New("no application layer in packet")
+	}
 	packet := NewMetaPacket(data)
 
-	appPayload := string(data.rawPacket.ApplicationLayer().Payload())
+	appPayload := string(application.Payload())
 	// In order to use the /net/http functions to interpret http packets,
 	// we have to present *bufio.Reader containing the payload
 	b := []byte(appPayload)
@@ -1,8 +1,11 @@
 package gonetmon
 
 import (
+	"errors"
+	"github.com/sirupsen/logrus"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,9 +35,119 @@ func Sniff(testWait *sync.WaitGroup, result chan<- error) error {
 		return err
 	}
 
+	return monitor(devices, result)
+}
+
+// SniffSources runs monitoring on the given capture sources instead of the network devices.
+// Combined with NewSyntheticSource, it allows to run the whole pipeline on fabricated traffic.
+func SniffSources(sources []CaptureSource, testWait *sync.WaitGroup, result chan<- error) error {
+	if testWait != nil {
+		defer testWait.Done()
+	}
+
+	devices := newDevices(false)
+
+	for _, src := range sources {
+		if err := openSource(src); err == nil {
+			devices.sources = append(devices.sources, src)
+		}
+
+		// Sources may bring their own local addresses
+		if a, ok := src.(addressedSource); ok {
+			localAddresses.register(a.Addresses())
+		}
+	}
+
+	if len(devices.sources) == 0 {
+		err := errors.New("could not open any capture source")
+		log.Error(err)
+		if result != nil {
+			result <- err
+		}
+		return err
+	}
+
+	return monitor(devices, result)
+}
+
+// monitor sets up and runs the different routines on the opened capture sources, until shutdown
+func monitor(devices *devices, result chan<- error) error {
+
 	// Past this point, log to file
 	log2File()
 
+	// Flows of all traffic are exported by their own routine, a nil channel disables it
+	var exporter *flowExporter
+	var flowChan chan packetMsg
+	if config.export.enabled() {
+		var err error
+		if exporter, err = newFlowExporter(&config.export); err != nil {
+			log.WithFields(logrus.Fields{
+				"collector": config.export.collector,
+				"file":      config.export.jsonFile,
+				"error":     err,
+			}).Error("Could not open flow export.")
+			closeDevices(devices)
+			if result != nil {
+				result <- err
+			}
+			return err
+		}
+		flowChan = make(chan packetMsg, 1000)
+		atomic.StoreUint64(&dropped.flows, 0)
+	}
+
+	// Reports and alerts are stored by display, a nil store disables it
+	var store *reportStore
+	if config.store.dir != "" {
+		var err error
+		if store, err = newReportStore(&config.store); err != nil {
+			log.WithFields(logrus.Fields{
+				"directory": config.store.dir,
+				"error":     err,
+			}).Error("Could not open store.")
+			if exporter != nil {
+				exporter.close()
+			}
+			closeDevices(devices)
+			if result != nil {
+				result <- err
+			}
+			return err
+		}
+	}
+
+	// Relevant packets are recorded by their own routine, a nil channel disables it. Without a trigger channel, they
+	// are recorded continuously.
+	var rec *recorder
+	var recordChan chan packetMsg
+	var triggerChan chan bool
+	if config.record.dir != "" {
+		var err error
+		if rec, err = newRecorder(&config.record); err != nil {
+			log.WithFields(logrus.Fields{
+				"directory": config.record.dir,
+				"error":     err,
+			}).Error("Could not open recording.")
+			if exporter != nil {
+				exporter.close()
+			}
+			if store != nil {
+				store.close()
+			}
+			closeDevices(devices)
+			if result != nil {
+				result <- err
+			}
+			return err
+		}
+		recordChan = make(chan packetMsg, 1000)
+		atomic.StoreUint64(&dropped.records, 0)
+		if config.record.onAlert {
+			triggerChan = make(chan bool, 10)
+		}
+	}
+
 	// IPCs
 	syn := &synchronisation{
 		wg:          sync.WaitGroup{},
@@ -45,19 +158,32 @@ func Sniff(testWait *sync.WaitGroup, result chan<- error) error {
 
 	packetChan := make(chan packetMsg, 1000)
 	reportChan := make(chan *report, 1)
-	alertChan := make(chan alertMsg, 1)
+	alertChan := make(chan alertMsg, defAlertBufSize)
+	deviceChan := make(chan deviceMsg, 10)
 
 	// Run Sniffer/Collector
 	syn.addRoutine()
-	go Collector(devices, packetChan, syn)
+	go Collector(devices, packetChan, flowChan, recordChan, deviceChan, syn)
+
+	// Run flow export
+	if exporter != nil {
+		syn.addRoutine()
+		go Exporter(exporter, flowChan, syn)
+	}
+
+	// Run recording
+	if rec != nil {
+		syn.addRoutine()
+		go Recorder(rec, recordChan, triggerChan, syn)
+	}
 
 	// Run monitoring
 	syn.addRoutine()
-	go Monitor(packetChan, reportChan, alertChan, syn)
+	go Monitor(packetChan, reportChan, alertChan, triggerChan, syn)
 
 	// Run display to print result
 	syn.addRoutine()
-	go Display(reportChan, alertChan, syn)
+	go Display(reportChan, alertChan, deviceChan, store, syn)
 
 	// Run CLI
 	syn.addRoutine()
@@ -79,11 +205,23 @@ func Sniff(testWait *sync.WaitGroup, result chan<- error) error {
 
 // SnifferTest is a wrapper function for Sniffer use with a timeout
 func SnifferTest(duration time.Duration) error {
+	return runWithTimeout(Sniff, duration)
+}
+
+// SourcesTest is a wrapper function for SniffSources use with a timeout
+func SourcesTest(sources []CaptureSource, duration time.Duration) error {
+	return runWithTimeout(func(testWait *sync.WaitGroup, result chan<- error) error {
+		return SniffSources(sources, testWait, result)
+	}, duration)
+}
+
+// runWithTimeout runs the sniffing function and interrupts it after timeout
+func runWithTimeout(sniff func(*sync.WaitGroup, chan<- error) error, duration time.Duration) error {
 
 	testWait := sync.WaitGroup{}
 	testWait.Add(1)
 	result := make(chan error)
-	go Sniff(&testWait, result)
+	go sniff(&testWait, result)
 
 	// Send interrupt signal after timeout
 	p, _ := os.FindProcess(os.Getpid())
@@ -0,0 +1,115 @@
+package gonetmon
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	testServer = "192.168.1.10"
+	testHost   = "www.local.test"
+)
+
+// testExchanges are the requests sent to the local web server, and the status of their response
+var testExchanges = []struct {
+	client string
+	uri    string
+	status string
+	count  int
+}{
+	{"203.0.113.5", "/index.html", "200 OK", 10},
+	{"203.0.113.6", "/images/logo.png", "304 Not Modified", 4},
+	{"198.51.100.7", "/missing", "404 Not Found", 3},
+	{"198.51.100.8", "/api/orders", "503 Service Unavailable", 2},
+}
+
+// fabricateExchanges returns the packets of the test exchanges, each request followed by its response
+func fabricateExchanges(t *testing.T) []gopacket.Packet {
+	var packets []gopacket.Packet
+	port := uint16(40000)
+	now := time.Now()
+	for _, e := range testExchanges {
+		for i := 0; i < e.count; i++ {
+			port++
+			request := fmt.Sprintf("GET %s HTTP/1.1\r\nHost: %s\r\n\r\n", e.uri, testHost)
+			response := fmt.Sprintf("HTTP/1.1 %s\r\nContent-Length: 0\r\n\r\n", e.status)
+
+			req, err := NewSyntheticPacket(e.client, testServer, port, 80, []byte(request), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := NewSyntheticPacket(testServer, e.client, 80, port, []byte(response), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packets = append(packets, req, res)
+		}
+	}
+	return packets
+}
+
+// TestSourcesPipeline runs the whole pipeline on fabricated packets, and checks the reports it stored
+func TestSourcesPipeline(t *testing.T) {
+	saved := *config
+	defer func() { *config = saved }()
+
+	dir, err := ioutil.TempDir("", "gonetmon-pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer os.Remove(defLogFile)
+
+	config.displayRefresh = 500 * time.Millisecond
+	config.displayType = jsonOutput
+	if err := EnableDissectors([]string{dataHTTP}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetStore(dir, defStoreRetention, defStoreMaxBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := NewSyntheticSource("synthetic", []string{testServer}, fabricateExchanges(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := SourcesTest([]CaptureSource{source}, 2*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reports of all windows add up to the fabricated traffic
+	var hits int
+	status := make(map[string]int)
+	hosts := make(map[string]bool)
+	err = readRecords(dir, start.Add(-time.Minute), time.Now().Add(time.Minute), func(r *storedRecord) {
+		for _, h := range r.Hosts {
+			hosts[h.Host] = true
+			hits += h.Hits
+			for class, n := range h.Status {
+				status[class] += n
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hosts) != 1 || !hosts[testHost] {
+		t.Errorf("hosts = %v, want only %s", hosts, testHost)
+	}
+	// Requests and responses are both hits of the host
+	if hits != 38 {
+		t.Errorf("hits = %d, want 38", hits)
+	}
+	want := map[string]int{"2xx": 10, "3xx": 4, "4xx": 3, "5xx": 2}
+	for class, n := range want {
+		if status[class] != n {
+			t.Errorf("status %s = %d, want %d", class, status[class], n)
+		}
+	}
+}
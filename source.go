@@ -0,0 +1,351 @@
+package gonetmon
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CaptureStats holds packet counters reported by a capture source
+type CaptureStats struct {
+	Received  uint64 // Number of packets received by the source
+	Dropped   uint64 // Number of packets dropped by the source, e.g. because the kernel buffer was full
+	IfDropped uint64 // Number of packets dropped by the network interface, if known
+}
+
+// CaptureSource is anything packets can be captured from : a live pcap handle, a pcap file, an afpacket socket,
+// or an in-memory set of fabricated packets. The Collector only works through this interface.
+//
+// A source is used in this order : Open, SetFilter, Packets, and Close whenever capture must stop.
+type CaptureSource interface {
+	// Name returns the name of the source, i.e. the network interface name or the file path
+	Name() string
+
+	// Open prepares the source for capture
+	Open() error
+
+	// SetFilter applies a BPF filter to the source
+	SetFilter(filter string) error
+
+	// Packets returns the channel captured packets are delivered on.
+	// It is closed when the source is closed or has no more packets to deliver.
+	Packets() <-chan gopacket.Packet
+
+	// Stats returns capture statistics of the source
+	Stats() (*CaptureStats, error)
+
+	// Close stops capture and releases the source
+	Close()
+}
+
+// pcapSource captures packets through a libpcap handle, either live on a network interface or from a pcap file
+type pcapSource struct {
+	name    string                 // Interface name or file path
+	live    bool                   // Whether to capture live on an interface, or read from a file
+	conf    *captureConfig         // Capture parameters for live capture
+	handle  *pcap.Handle           // libpcap handle, set when opened
+	packets <-chan gopacket.Packet // Channel fed by gopacket's PacketSource
+}
+
+// newLiveSource returns a source capturing live on the network device
+func newLiveSource(device string, conf *captureConfig) *pcapSource {
+	return &pcapSource{
+		name: device,
+		live: true,
+		conf: conf,
+	}
+}
+
+// SetCaptureSource sets the kind of source to capture from : pcap or afpacket on network devices, or file to read
+// packets from the given pcap file, which is then required
+func SetCaptureSource(kind string, file string) error {
+	switch kind {
+	case sourcePcap, sourceAFPacket:
+		if file != "" {
+			return fmt.Errorf("a pcap file can only be given with the %s source", sourceFile)
+		}
+	case sourceFile:
+		if file == "" {
+			return fmt.Errorf("the %s source requires a pcap file", sourceFile)
+		}
+	default:
+		return fmt.Errorf("invalid capture source '%s', must be one of %s, %s or %s", kind, sourcePcap, sourceAFPacket, sourceFile)
+	}
+
+	config.captureConf.source = kind
+	config.captureConf.file = file
+	return nil
+}
+
+// newFileSource returns a source reading packets from a pcap file
+func newFileSource(file string) *pcapSource {
+	return &pcapSource{
+		name: file,
+		live: false,
+	}
+}
+
+// Name returns the name of the interface or file
+func (s *pcapSource) Name() string {
+	return s.name
+}
+
+// Open opens the libpcap handle
+func (s *pcapSource) Open() error {
+	var handle *pcap.Handle
+	var err error
+
+	if s.live {
+		handle, err = pcap.OpenLive(s.name, s.conf.snapshotLen, s.conf.promiscuousMode, s.conf.captureTimeout)
+	} else {
+		handle, err = pcap.OpenOffline(s.name)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	s.handle = handle
+	return nil
+}
+
+// SetFilter applies a BPF filter on the handle
+func (s *pcapSource) SetFilter(filter string) error {
+	if s.handle == nil {
+		return errors.New("source is not opened")
+	}
+	return s.handle.SetBPFFilter(filter)
+}
+
+// Packets returns the channel of packets read from the handle.
+// The channel is closed when the handle is closed, or when the end of the file is reached.
+func (s *pcapSource) Packets() <-chan gopacket.Packet {
+	if s.packets == nil {
+		s.packets = gopacket.NewPacketSource(s.handle, s.handle.LinkType()).Packets()
+	}
+	return s.packets
+}
+
+// Stats returns libpcap's statistics for the handle. Not available on files.
+func (s *pcapSource) Stats() (*CaptureStats, error) {
+	if s.handle == nil {
+		return nil, errors.New("source is not opened")
+	}
+
+	stats, err := s.handle.Stats()
+	if err != nil {
+		return nil, err
+	}
+
+	return &CaptureStats{
+		Received:  uint64(stats.PacketsReceived),
+		Dropped:   uint64(stats.PacketsDropped),
+		IfDropped: uint64(stats.PacketsIfDropped),
+	}, nil
+}
+
+// Close closes the handle
+func (s *pcapSource) Close() {
+	if s.handle != nil {
+		s.handle.Close()
+	}
+}
+
+// syntheticSource delivers a given set of packets from memory, allowing to run the whole pipeline
+// on fabricated traffic, without any network device nor elevated privileges
+type syntheticSource struct {
+	name     string               // Name of the source
+	local    []net.IP             // Addresses to be considered local for the fabricated traffic
+	input    []gopacket.Packet    // Packets to deliver
+	filter   *pcap.BPF            // Compiled BPF filter, if any
+	packets  chan gopacket.Packet // Channel the packets are delivered on
+	done     chan struct{}        // Closed to stop delivery
+	start    sync.Once            // Delivery is started on first call to Packets
+	stop     sync.Once            // Protects done from being closed twice
+	received uint64               // Number of packets delivered, to be accessed atomically
+}
+
+// NewSyntheticSource returns a capture source that will deliver the given packets in order, and then close.
+// Use NewSyntheticPacket to fabricate them. The local IP addresses are those of the fabricated local host,
+// used to tell the direction of the packets.
+func NewSyntheticSource(name string, localIPs []string, packets []gopacket.Packet) (CaptureSource, error) {
+	local := make([]net.IP, 0, len(localIPs))
+	for _, a := range localIPs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local IP address %s", a)
+		}
+		local = append(local, ip)
+	}
+
+	return &syntheticSource{
+		name:  name,
+		local: local,
+		input: packets,
+	}, nil
+}
+
+// Name returns the name of the source
+func (s *syntheticSource) Name() string {
+	return s.name
+}
+
+// Addresses returns the addresses of the fabricated local host
+func (s *syntheticSource) Addresses() []net.IP {
+	return s.local
+}
+
+// Open prepares the channels for delivery
+func (s *syntheticSource) Open() error {
+	s.packets = make(chan gopacket.Packet)
+	s.done = make(chan struct{})
+	return nil
+}
+
+// SetFilter compiles the BPF filter, which is then applied to the packets on delivery
+func (s *syntheticSource) SetFilter(filter string) error {
+	bpf, err := pcap.NewBPF(layers.LinkTypeEthernet, int(config.captureConf.snapshotLen), filter)
+	if err != nil {
+		return err
+	}
+	s.filter = bpf
+	return nil
+}
+
+// deliver sends all packets that match the filter on the channel, until done, and closes it
+func (s *syntheticSource) deliver() {
+	defer close(s.packets)
+
+	for _, p := range s.input {
+		if s.filter != nil && !s.filter.Matches(p.Metadata().CaptureInfo, p.Data()) {
+			continue
+		}
+
+		select {
+		case <-s.done:
+			return
+		case s.packets <- p:
+			atomic.AddUint64(&s.received, 1)
+		}
+	}
+}
+
+// Packets starts delivering the packets and returns the channel they are sent on
+func (s *syntheticSource) Packets() <-chan gopacket.Packet {
+	s.start.Do(func() {
+		go s.deliver()
+	})
+	return s.packets
+}
+
+// Stats returns the number of packets delivered so far
+func (s *syntheticSource) Stats() (*CaptureStats, error) {
+	return &CaptureStats{
+		Received: atomic.LoadUint64(&s.received),
+	}, nil
+}
+
+// Close stops delivery
+func (s *syntheticSource) Close() {
+	s.stop.Do(func() {
+		close(s.done)
+	})
+}
+
+// checksummedLayer is a transport layer whose checksum depends on the network layer
+type checksummedLayer interface {
+	gopacket.SerializableLayer
+	SetNetworkLayerForChecksum(l gopacket.NetworkLayer) error
+}
+
+// NewSyntheticPacket fabricates an Ethernet/IP/TCP packet carrying the payload, as if it had been captured at timestamp t.
+// Both IPv4 and IPv6 addresses are accepted, as long as they are of the same family.
+func NewSyntheticPacket(srcIP, dstIP string, srcPort, dstPort uint16, payload []byte, t time.Time) (gopacket.Packet, error) {
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(srcPort),
+		DstPort: layers.TCPPort(dstPort),
+		Seq:     1,
+		Ack:     1,
+		PSH:     true,
+		ACK:     true,
+		Window:  65535,
+	}
+	return newSyntheticPacket(srcIP, dstIP, layers.IPProtocolTCP, tcp, payload, t)
+}
+
+// NewSyntheticTCPPacket fabricates an Ethernet/IP packet around the given TCP segment, for when sequence numbers,
+// flags or window matter, as if it had been captured at timestamp t.
+func NewSyntheticTCPPacket(srcIP, dstIP string, tcp *layers.TCP, payload []byte, t time.Time) (gopacket.Packet, error) {
+	return newSyntheticPacket(srcIP, dstIP, layers.IPProtocolTCP, tcp, payload, t)
+}
+
+// NewSyntheticUDPPacket fabricates an Ethernet/IP/UDP packet carrying the payload, as if it had been captured at timestamp t.
+// Both IPv4 and IPv6 addresses are accepted, as long as they are of the same family.
+func NewSyntheticUDPPacket(srcIP, dstIP string, srcPort, dstPort uint16, payload []byte, t time.Time) (gopacket.Packet, error) {
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(srcPort),
+		DstPort: layers.UDPPort(dstPort),
+	}
+	return newSyntheticPacket(srcIP, dstIP, layers.IPProtocolUDP, udp, payload, t)
+}
+
+// newSyntheticPacket serialises the Ethernet and IP layers around the transport layer and payload, and decodes the result
+func newSyntheticPacket(srcIP, dstIP string, protocol layers.IPProtocol, transport checksummedLayer, payload []byte, t time.Time) (gopacket.Packet, error) {
+	src := net.ParseIP(srcIP)
+	dst := net.ParseIP(dstIP)
+	if src == nil || dst == nil {
+		return nil, fmt.Errorf("invalid IP address in %s -> %s", srcIP, dstIP)
+	}
+
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 0x01},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 0x02},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+
+	var network gopacket.SerializableLayer
+	if src.To4() != nil && dst.To4() != nil {
+		ip := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Protocol: protocol,
+			SrcIP:    src.To4(),
+			DstIP:    dst.To4(),
+		}
+		_ = transport.SetNetworkLayerForChecksum(ip)
+		network = ip
+	} else if src.To4() == nil && dst.To4() == nil {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: protocol,
+			SrcIP:      src,
+			DstIP:      dst,
+		}
+		_ = transport.SetNetworkLayerForChecksum(ip)
+		network = ip
+	} else {
+		return nil, fmt.Errorf("mixed IP address families in %s -> %s", srcIP, dstIP)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, network, transport, gopacket.Payload(payload)); err != nil {
+		return nil, err
+	}
+
+	packet := gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default)
+	meta := packet.Metadata()
+	meta.Timestamp = t
+	meta.CaptureLength = len(buf.Bytes())
+	meta.Length = len(buf.Bytes())
+
+	return packet, nil
+}
@@ -0,0 +1,294 @@
+package gonetmon
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// sourceEvent is a request from a client, or a response to it, inside the alert time frame
+type sourceEvent struct {
+	t       time.Time
+	request bool   // Whether it is a request, or a response
+	failed  bool   // Whether the response is a client or server error
+	section string // Section requested
+}
+
+// sourceWindow holds the requests and responses of a client address or network prefix over the alert time frame
+type sourceWindow struct {
+	key       string    // Client address or network prefix
+	prefix    bool      // Whether the key is a network prefix
+	events    list.List // Requests and responses, in the order they were seen
+	requests  int
+	responses int
+	errors    int
+	alert     bool // Current state of alert
+}
+
+// push adds the event to the window
+func (w *sourceWindow) push(e sourceEvent) {
+	w.events.PushBack(e)
+	w.count(e, 1)
+}
+
+// count adds delta to the counters the event is part of
+func (w *sourceWindow) count(e sourceEvent, delta int) {
+	switch {
+	case e.request:
+		w.requests += delta
+	case e.failed:
+		w.responses += delta
+		w.errors += delta
+	default:
+		w.responses += delta
+	}
+}
+
+// evict removes the events older than the alert time frame
+func (w *sourceWindow) evict(now time.Time) {
+	for e := w.events.Front(); e != nil; e = w.events.Front() {
+		event := e.Value.(sourceEvent)
+
+		// Since events are stored in order, following ones are all still valid
+		if now.Sub(event.t) <= config.alert.span {
+			break
+		}
+		w.events.Remove(e)
+		w.count(event, -1)
+	}
+}
+
+// errorRatio returns the share of error responses, in percent
+func (w *sourceWindow) errorRatio() float64 {
+	if w.responses == 0 {
+		return 0
+	}
+	return 100 * float64(w.errors) / float64(w.responses)
+}
+
+// abusive tells whether the client sent too many requests over the time frame, or too many of them failed
+func (w *sourceWindow) abusive() bool {
+	threshold := config.alert.clientThreshold
+	if w.prefix {
+		threshold = config.alert.prefixThreshold
+	}
+	if w.requests >= threshold {
+		return true
+	}
+	return w.responses >= config.alert.clientMinResponses && w.errorRatio() >= config.alert.clientErrorRatio
+}
+
+// topSection returns the section the client requested the most over the time frame
+func (w *sourceWindow) topSection() string {
+	sections := make(map[string]int)
+	var top string
+	for e := w.events.Front(); e != nil; e = e.Next() {
+		event := e.Value.(sourceEvent)
+		if !event.request {
+			continue
+		}
+		sections[event.section]++
+		if sections[event.section] > sections[top] {
+			top = event.section
+		}
+	}
+	return top
+}
+
+// clientPrefix returns the network of the address : its /24 for IPv4, its /64 for IPv6
+func clientPrefix(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return address
+	}
+
+	network := net.IPNet{IP: ip.Mask(net.CIDRMask(64, 128)), Mask: net.CIDRMask(64, 128)}
+	if v4 := ip.To4(); v4 != nil {
+		network = net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}
+	}
+	return network.String()
+}
+
+// sourceWatch extends the watchdog to the behaviour of single clients and their networks, raising alerts when one
+// exceeds the rate of requests or the ratio of errors it's allowed. It's only accessed while monitoring.
+type sourceWatch struct {
+	windows map[string]*sourceWindow // Windows of client addresses and network prefixes
+	clients *flowHosts               // Client that sent the last request on each connection, to attribute responses
+	alerts  *alerter
+}
+
+// newSourceWatch returns an empty watch over clients, sending its alerts on the alerter
+func newSourceWatch(alerts *alerter) *sourceWatch {
+	return &sourceWatch{
+		windows: make(map[string]*sourceWindow),
+		clients: newFlowHosts(defMaxFlows),
+		alerts:  alerts,
+	}
+}
+
+// observe records the HTTP messages of a decoded message, ignoring other protocols and tunnels
+func (s *sourceWatch) observe(message interface{}) {
+	switch m := message.(type) {
+	case *MetaPacket:
+		s.add(m)
+	case []*MetaPacket:
+		for _, p := range m {
+			s.add(p)
+		}
+	}
+}
+
+// add records the request of a client, or the response to it. Clients are only followed when the local host serves
+// them : requests it sends are all its own.
+func (s *sourceWatch) add(p *MetaPacket) {
+	if p.tunnel != "" || p.role != roleServer {
+		return
+	}
+
+	event := sourceEvent{t: p.packet.Metadata().Timestamp}
+	var client string
+	if p.messageType == httpRequest {
+		client = clientAddress(p)
+		s.clients.set(p.flow, client)
+		event.request = true
+		event.section = getSection(p.request)
+	} else {
+		var ok bool
+		if client, ok = s.clients.get(p.flow); !ok {
+			return
+		}
+		event.failed = callClass(p.response) >= 4
+	}
+
+	s.record(client, false, event)
+	s.record(clientPrefix(client), true, event)
+}
+
+// record adds the event to the window of the client address or network prefix, and verifies it
+func (s *sourceWatch) record(key string, prefix bool, event sourceEvent) {
+	w, ok := s.windows[key]
+	if !ok {
+		// Don't grow indefinitely : start over when full, losing the history of clients, whose alerts recover
+		if len(s.windows) >= defMaxSources {
+			for _, old := range s.windows {
+				if old.alert {
+					old.alert = false
+					s.notify(old, event.t)
+				}
+			}
+			s.windows = make(map[string]*sourceWindow)
+		}
+		w = &sourceWindow{key: key, prefix: prefix}
+		s.windows[key] = w
+	}
+
+	w.evict(event.t)
+	w.push(event)
+	s.verify(w, event.t)
+}
+
+// verify raises or lowers the alert of the window, sending a message if necessary
+func (s *sourceWatch) verify(w *sourceWindow, now time.Time) {
+	abusive := w.abusive()
+	if abusive == w.alert {
+		return
+	}
+	w.alert = abusive
+	s.notify(w, now)
+}
+
+// notify sends the alert or recovery message of the window, as told by its state of alert
+func (s *sourceWatch) notify(w *sourceWindow, now time.Time) {
+	message := fmt.Sprintf(defClientRecoveryFormat, w.key, now.Format(defTimeLayout))
+	if w.alert {
+		message = fmt.Sprintf(defClientAlertFormat, w.key, w.requests, w.errorRatio(), config.alert.span,
+			w.topSection(), now.Format(defTimeLayout))
+	}
+
+	s.alerts.notify("client "+w.key, alertMsg{
+		recovery:  !w.alert,
+		body:      message,
+		timestamp: now,
+	})
+}
+
+// evict removes the events older than the time frame from all windows, recovering alerts, and forgets idle clients
+func (s *sourceWatch) evict(now time.Time) {
+	for key, w := range s.windows {
+		w.evict(now)
+		s.verify(w, now)
+		if w.events.Len() == 0 {
+			delete(s.windows, key)
+		}
+	}
+}
+
+// talker is a client address or network prefix, with its requests and error ratio over the time frame
+type talker struct {
+	key        string
+	requests   int
+	errorRatio float64
+}
+
+// talkers returns the client addresses and network prefixes with the most requests over the time frame
+func (s *sourceWatch) talkers() (addresses []talker, prefixes []talker) {
+	for _, w := range s.windows {
+		if w.requests == 0 {
+			continue
+		}
+		t := talker{key: w.key, requests: w.requests, errorRatio: w.errorRatio()}
+		if w.prefix {
+			prefixes = append(prefixes, t)
+		} else {
+			addresses = append(addresses, t)
+		}
+	}
+
+	for _, ranked := range [][]talker{addresses, prefixes} {
+		sort.Slice(ranked, func(i, j int) bool {
+			if ranked[i].requests != ranked[j].requests {
+				return ranked[i].requests > ranked[j].requests
+			}
+			return ranked[i].key < ranked[j].key
+		})
+	}
+	if len(addresses) > config.nbClients {
+		addresses = addresses[:config.nbClients]
+	}
+	if len(prefixes) > config.nbClients {
+		prefixes = prefixes[:config.nbClients]
+	}
+	return addresses, prefixes
+}
+
+// buildTalkerOutput returns a string representation of the talkers, with their error ratio if they had errors
+func buildTalkerOutput(talkers []talker) string {
+	var output string
+	for _, t := range talkers {
+		if t.errorRatio > 0 {
+			output += fmt.Sprintf("%s(%d, %s errors) ", t.key, t.requests, buildErrorRateOutput(t.errorRatio))
+		} else {
+			output += fmt.Sprintf("%s(%d) ", t.key, t.requests)
+		}
+	}
+	return output
+}
+
+// SetClientAlert sets the number of requests over the alert time frame past which a single client address, or all
+// the addresses of its network prefix, raise an alert, and the ratio of error responses, in percent, that raises
+// an alert for a client
+func SetClientAlert(threshold int, prefixThreshold int, errorRatio float64) error {
+	if threshold < 1 || prefixThreshold < 1 {
+		return fmt.Errorf("invalid client alert thresholds %d and %d, must be at least 1", threshold, prefixThreshold)
+	}
+	if errorRatio <= 0 || errorRatio > 100 {
+		return fmt.Errorf("invalid client error ratio %.1f, must be a percentage above 0", errorRatio)
+	}
+
+	config.alert.clientThreshold = threshold
+	config.alert.prefixThreshold = prefixThreshold
+	config.alert.clientErrorRatio = errorRatio
+	return nil
+}
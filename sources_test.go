@@ -0,0 +1,73 @@
+package gonetmon
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// clientRequest returns a request of the client to the local host, in the role
+func clientRequest(t *testing.T, client string, role string, now time.Time) *MetaPacket {
+	packet, err := NewSyntheticPacket(client, testServer, 40000, 80, []byte("GET / HTTP/1.1\r\n\r\n"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &MetaPacket{
+		messageType: httpRequest,
+		remoteIP:    client,
+		deviceIP:    testServer,
+		flow:        client,
+		role:        role,
+		request:     &http.Request{Method: "GET", Host: testHost, RequestURI: "/", Header: make(http.Header)},
+		packet:      packet,
+	}
+}
+
+func TestSourceWatchRole(t *testing.T) {
+	s := newSourceWatch(newAlerter(make(chan alertMsg, defAlertBufSize), nil))
+	now := time.Now()
+
+	// Requests the local host sends as a client are all its own
+	s.add(clientRequest(t, "203.0.113.5", roleClient, now))
+	if len(s.windows) != 0 {
+		t.Errorf("windows %v for a request sent by the local host", s.windows)
+	}
+
+	s.add(clientRequest(t, "203.0.113.5", roleServer, now))
+	if len(s.windows) != 2 {
+		t.Errorf("%d windows for a request served, want the client and its network", len(s.windows))
+	}
+}
+
+func TestSourceWatchRecoversForgottenClients(t *testing.T) {
+	saved := config.alert
+	defer func() { config.alert = saved }()
+	config.alert.clientThreshold = 1
+	config.alert.prefixThreshold = 1
+
+	c := make(chan alertMsg, defAlertBufSize)
+	s := newSourceWatch(newAlerter(c, nil))
+	now := time.Now()
+
+	s.add(clientRequest(t, "203.0.113.5", roleServer, now))
+	if messages := drain(c); len(messages) != 2 {
+		t.Fatalf("messages %v, want the alerts of the client and its network", messages)
+	}
+
+	// Clients are forgotten when too many are followed, and their alerts recover
+	for i := 0; len(s.windows) < defMaxSources; i++ {
+		s.windows[fmt.Sprint("client ", i)] = &sourceWindow{key: fmt.Sprint("client ", i)}
+	}
+	s.add(clientRequest(t, "198.51.100.7", roleServer, now))
+
+	var recoveries int
+	for _, m := range drain(c) {
+		if m.recovery {
+			recoveries++
+		}
+	}
+	if recoveries != 2 {
+		t.Errorf("%d recoveries, want the client's and its network's", recoveries)
+	}
+}
@@ -0,0 +1,172 @@
+package gonetmon
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// statusClasses name the classes of status codes, by their first digit
+var statusClasses = []string{"", "1xx", "2xx", "3xx", "4xx", "5xx"}
+
+// statusClass returns the class of the status code, its first digit, or 0 if it is out of range
+func statusClass(code int) int {
+	class := code / 100
+	if class < 1 || class >= len(statusClasses) {
+		return 0
+	}
+	return class
+}
+
+// statusColour returns the console colour of a status class : errors stand out
+func statusColour(class int) string {
+	switch class {
+	case 2:
+		return green
+	case 3:
+		return blue
+	case 4:
+		return yellow
+	case 5:
+		return red
+	default:
+		return ""
+	}
+}
+
+// colourise returns the text in the colour, if any
+func colourise(text string, colour string) string {
+	if colour == "" {
+		return text
+	}
+	return colour + text + stop
+}
+
+// errors returns the number of client and server error responses
+func (s *responseStats) errors() int {
+	return s.classes[4] + s.classes[5]
+}
+
+// errorRate returns the share of client and server error responses, in percent
+func (s *responseStats) errorRate() float64 {
+	return s.percent(s.errors())
+}
+
+// buildErrorRateOutput returns the error rate, in red past the warning rate
+func buildErrorRateOutput(rate float64) string {
+	output := fmt.Sprintf("%.1f%%", rate)
+	if rate >= defErrorRateWarning {
+		output = colourise(output, red)
+	}
+	return output
+}
+
+// buildClassOutput returns a string representation of the number of responses in each status class, in class order
+func buildClassOutput(classes []int) string {
+	var output string
+	for class, n := range classes {
+		if class > 0 && n > 0 {
+			output += colourise(fmt.Sprintf("%s(%d)", statusClasses[class], n), statusColour(class)) + " "
+		}
+	}
+	return output
+}
+
+// buildStatusOutput returns the status classes and the error rate of the responses, each line starting with the indent
+func buildStatusOutput(s *responseStats, indent string) string {
+	if s == nil || s.responses == 0 {
+		return ""
+	}
+	return indent + fmt.Sprintf(reportStatus+"\n", buildClassOutput(s.classes), buildErrorRateOutput(s.errorRate()))
+}
+
+// endpointPath returns the path of the request's endpoint, templated and cut at the configured depth as for the
+// top endpoints. For gRPC, it is the full method name.
+func endpointPath(req *http.Request) string {
+	if isGRPC(req.Header) {
+		return getSection(req)
+	}
+
+	segments := pathSegments(requestPath(req))
+	if len(segments) > config.packetFilter.pathDepth {
+		segments = segments[:config.packetFilter.pathDepth]
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// endpointErrors counts the error responses of an endpoint of a host
+type endpointErrors struct {
+	endpoint  string // Host and path of the endpoint
+	responses int
+	classes   []int // Number of responses in each status class
+}
+
+// errors returns the number of client and server error responses of the endpoint
+func (e *endpointErrors) errors() int {
+	return e.classes[4] + e.classes[5]
+}
+
+// errorRate returns the share of client and server error responses of the endpoint, in percent
+func (e *endpointErrors) errorRate() float64 {
+	if e.responses == 0 {
+		return 0
+	}
+	return 100 * float64(e.errors()) / float64(e.responses)
+}
+
+// updateEndpointErrors counts the response for the endpoint of its request, if the endpoint is known
+func (a *analysis) updateEndpointErrors(host string, p *MetaPacket) {
+	// HTTP/2 responses are tied to their request by their stream
+	path, ok := a.endpoints.get(p.flow)
+	if p.response.Request != nil && p.response.Request.URL != nil {
+		path, ok = endpointPath(p.response.Request), true
+	}
+	if !ok {
+		return
+	}
+
+	key := host + path
+	e, ok := a.endpointErrors[key]
+	if !ok {
+		// Don't grow indefinitely : start over when full
+		if len(a.endpointErrors) >= defMaxEndpoints {
+			a.endpointErrors = make(map[string]*endpointErrors)
+		}
+		e = &endpointErrors{endpoint: key, classes: make([]int, len(statusClasses))}
+		a.endpointErrors[key] = e
+	}
+	e.responses++
+	e.classes[callClass(p.response)]++
+}
+
+// topErrorEndpoints returns the endpoints with the most error responses
+func (a *analysis) topErrorEndpoints() []*endpointErrors {
+	endpoints := make([]*endpointErrors, 0, len(a.endpointErrors))
+	for _, e := range a.endpointErrors {
+		if e.errors() > 0 {
+			endpoints = append(endpoints, e)
+		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].errors() != endpoints[j].errors() {
+			return endpoints[i].errors() > endpoints[j].errors()
+		}
+		return endpoints[i].endpoint < endpoints[j].endpoint
+	})
+
+	if len(endpoints) > config.packetFilter.nbSections {
+		endpoints = endpoints[:config.packetFilter.nbSections]
+	}
+	return endpoints
+}
+
+// buildErrorEndpointsOutput returns the table of the endpoints with the most error responses
+func buildErrorEndpointsOutput(endpoints []*endpointErrors) string {
+	output := reportErrors + "\n"
+	for _, e := range endpoints {
+		output += fmt.Sprintf(reportErrorLine+"\n", e.endpoint, e.errors(), e.responses,
+			buildErrorRateOutput(e.errorRate()), buildClassOutput(e.classes))
+	}
+	return output
+}
@@ -0,0 +1,495 @@
+package gonetmon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Kinds of stored records
+const (
+	recordReport = "report"
+	recordAlert  = "alert"
+)
+
+// Questions the store can answer
+const (
+	queryTopHosts = "top-hosts"
+	queryStatus   = "status"
+	queryTraffic  = "traffic"
+	queryAlerts   = "alerts"
+)
+
+// Segment file names are made of the prefix, the UTC time the segment starts at, and the suffix
+const (
+	segmentPrefix = "gonetmon-"
+	segmentLayout = "20060102-15"
+	segmentSuffix = ".jsonl"
+)
+
+// storedHost is the JSON representation of the traffic of a host during a report window
+type storedHost struct {
+	Host   string         `json:"host"`
+	Hits   int            `json:"hits"`
+	Bytes  int64          `json:"bytes"`
+	Status map[string]int `json:"status,omitempty"` // Maps status classes to the number of responses
+}
+
+// storedRecord is the JSON representation of a stored report or alert
+type storedRecord struct {
+	Kind         string       `json:"kind"`
+	Timestamp    time.Time    `json:"timestamp"`
+	Hits         int          `json:"hits,omitempty"`
+	Bytes        int64        `json:"bytes,omitempty"`
+	ErrorRate    float64      `json:"error_rate,omitempty"`
+	WatchdogHits int          `json:"watchdog_hits,omitempty"`
+	Hosts        []storedHost `json:"hosts,omitempty"`
+	Alert        string       `json:"alert,omitempty"`
+	Recovery     bool         `json:"recovery,omitempty"`
+}
+
+// newStoredHost returns the representation of the traffic of a host, to be stored
+func newStoredHost(stats *hostStats) storedHost {
+	h := storedHost{
+		Host:   stats.host,
+		Hits:   stats.hits,
+		Bytes:  stats.responses.bytes,
+		Status: make(map[string]int),
+	}
+	for class, n := range stats.responses.classes {
+		if class > 0 && n > 0 {
+			h.Status[statusClasses[class]] = n
+		}
+	}
+	return h
+}
+
+// segmentName returns the name of the file of the segment starting at t
+func segmentName(t time.Time) string {
+	return segmentPrefix + t.UTC().Format(segmentLayout) + segmentSuffix
+}
+
+// segmentStart returns the time the segment of the file starts at, and whether the file is a segment
+func segmentStart(name string) (time.Time, bool) {
+	if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(segmentLayout, strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix))
+	return t, err == nil
+}
+
+// segment is a file of the store
+type segment struct {
+	path  string
+	start time.Time
+	size  int64
+}
+
+// listSegments returns the segments of the store directory, from the oldest to the most recent
+func listSegments(dir string) ([]segment, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, f := range files {
+		if start, ok := segmentStart(f.Name()); ok && !f.IsDir() {
+			segments = append(segments, segment{path: filepath.Join(dir, f.Name()), start: start, size: f.Size()})
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].start.Before(segments[j].start)
+	})
+	return segments, nil
+}
+
+// reportStore appends reports and alerts to segment files of a directory, one per period, and deletes the oldest
+// segments past the retention limits. The size of the store is checked before every write. It's only accessed by
+// display.
+type reportStore struct {
+	conf  *storeConfig
+	file  *os.File
+	start time.Time // Time the open segment starts at
+	size  int64     // Size of all segments, the open one included
+}
+
+// newReportStore opens the store in the configured directory, creating it if needed
+func newReportStore(conf *storeConfig) (*reportStore, error) {
+	if err := os.MkdirAll(conf.dir, 0755); err != nil {
+		return nil, err
+	}
+	return &reportStore{conf: conf}, nil
+}
+
+// rotate opens the segment of the record's time if it's not the open one, and applies retention
+func (s *reportStore) rotate(t time.Time) error {
+	start := t.UTC().Truncate(defStoreSegment)
+	if s.file != nil && start.Equal(s.start) {
+		return nil
+	}
+	s.close()
+
+	file, err := os.OpenFile(filepath.Join(s.conf.dir, segmentName(start)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.file, s.start = file, start
+
+	s.retain(t, 0)
+	return nil
+}
+
+// retain deletes the segments older than the retention period, then the oldest ones while the store can't take n more
+// bytes, and updates the size of the store
+func (s *reportStore) retain(now time.Time, n int64) {
+	segments, err := listSegments(s.conf.dir)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"directory": s.conf.dir,
+			"error":     err,
+		}).Error("Could not list the segments of the store.")
+		return
+	}
+
+	var size int64
+	for _, seg := range segments {
+		size += seg.size
+	}
+
+	for _, seg := range segments {
+		if seg.start.Equal(s.start) {
+			break
+		}
+		if now.Sub(seg.start.Add(defStoreSegment)) < s.conf.retention && size+n <= s.conf.maxBytes {
+			break
+		}
+
+		if err := os.Remove(seg.path); err != nil {
+			log.WithFields(logrus.Fields{
+				"segment": seg.path,
+				"error":   err,
+			}).Error("Could not delete segment of the store.")
+			break
+		}
+		size -= seg.size
+	}
+	s.size = size
+}
+
+// reserve makes room for n more bytes in the store, deleting the oldest segments, and as a last resort the records
+// of the open segment
+func (s *reportStore) reserve(n int64, now time.Time) error {
+	if s.size+n <= s.conf.maxBytes {
+		return nil
+	}
+	s.retain(now, n)
+	if s.size+n <= s.conf.maxBytes {
+		return nil
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := s.file.Truncate(0); err != nil {
+		return err
+	}
+	s.size -= info.Size()
+	log.WithFields(logrus.Fields{
+		"segment": s.file.Name(),
+		"bytes":   info.Size(),
+	}).Info("Store is full, deleted the records of the open segment.")
+	return nil
+}
+
+// write appends the record to its segment, once there is room for it
+func (s *reportStore) write(record *storedRecord) {
+	var line bytes.Buffer
+	err := json.NewEncoder(&line).Encode(record)
+	if err == nil {
+		err = s.rotate(record.Timestamp)
+	}
+	if err == nil {
+		err = s.reserve(int64(line.Len()), record.Timestamp)
+	}
+	if err == nil {
+		var n int
+		n, err = s.file.Write(line.Bytes())
+		s.size += int64(n)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"directory": s.conf.dir,
+			"kind":      record.Kind,
+			"error":     err,
+		}).Error("Could not store record.")
+	}
+}
+
+// writeReport stores the window of the report and the traffic of its hosts
+func (s *reportStore) writeReport(r *report) {
+	s.write(&storedRecord{
+		Kind:         recordReport,
+		Timestamp:    r.timestamp,
+		Hits:         r.window.hits,
+		Bytes:        r.window.bytes,
+		ErrorRate:    r.window.errorRate,
+		WatchdogHits: r.watchdogHits,
+		Hosts:        r.hosts,
+	})
+}
+
+// writeAlert stores the alert or recovery
+func (s *reportStore) writeAlert(alert alertMsg) {
+	t := alert.timestamp
+	if t.IsZero() {
+		t = time.Now()
+	}
+	s.write(&storedRecord{
+		Kind:      recordAlert,
+		Timestamp: t,
+		Alert:     alert.body,
+		Recovery:  alert.recovery,
+	})
+}
+
+// close closes the open segment
+func (s *reportStore) close() {
+	if s.file != nil {
+		_ = s.file.Close()
+		s.file = nil
+	}
+}
+
+// readRecords calls fn with the records of the store between from and to, in the order they were stored
+func readRecords(dir string, from time.Time, to time.Time, fn func(r *storedRecord)) error {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, seg := range segments {
+		if !seg.start.Before(to) || !seg.start.Add(defStoreSegment).After(from) {
+			continue
+		}
+		if err := readSegment(seg.path, from, to, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSegment calls fn with the records of the segment between from and to. Lines that can't be decoded, like a
+// last line cut short, are skipped.
+func readSegment(path string, from time.Time, to time.Time, fn func(r *storedRecord)) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), defStoreMaxRecord)
+	for scanner.Scan() {
+		var r storedRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		if !r.Timestamp.Before(from) && r.Timestamp.Before(to) {
+			fn(&r)
+		}
+	}
+	return scanner.Err()
+}
+
+// errorRates returns the share of client and server errors of the status classes, in percent
+func errorRates(status map[string]int) (float64, float64) {
+	var total int
+	for _, n := range status {
+		total += n
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return 100 * float64(status["4xx"]) / float64(total), 100 * float64(status["5xx"]) / float64(total)
+}
+
+// queryTop writes the hosts with the most hits
+func queryTop(w *tabwriter.Writer, dir string, from time.Time, to time.Time) error {
+	hosts := make(map[string]*storedHost)
+	err := readRecords(dir, from, to, func(r *storedRecord) {
+		for _, h := range r.Hosts {
+			total, ok := hosts[h.Host]
+			if !ok {
+				total = &storedHost{Host: h.Host, Status: make(map[string]int)}
+				hosts[h.Host] = total
+			}
+			total.Hits += h.Hits
+			total.Bytes += h.Bytes
+			for class, n := range h.Status {
+				total.Status[class] += n
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	ranked := make([]*storedHost, 0, len(hosts))
+	for _, h := range hosts {
+		ranked = append(ranked, h)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Hits != ranked[j].Hits {
+			return ranked[i].Hits > ranked[j].Hits
+		}
+		return ranked[i].Host < ranked[j].Host
+	})
+	if len(ranked) > defQueryTop {
+		ranked = ranked[:defQueryTop]
+	}
+
+	_, _ = fmt.Fprintln(w, "HOST\tHITS\tBYTES\t4XX\t5XX")
+	for _, h := range ranked {
+		clientErrors, serverErrors := errorRates(h.Status)
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%.1f%%\t%.1f%%\n", h.Host, h.Hits, h.Bytes, clientErrors, serverErrors)
+	}
+	return nil
+}
+
+// queryStatusRates writes the status classes of the responses of the host, or of all hosts, in every report
+func queryStatusRates(w *tabwriter.Writer, dir string, host string, from time.Time, to time.Time) error {
+	total := make(map[string]int)
+	_, _ = fmt.Fprintln(w, "TIME\tRESPONSES\t4XX\t5XX")
+	err := readRecords(dir, from, to, func(r *storedRecord) {
+		status := make(map[string]int)
+		for _, h := range r.Hosts {
+			if host != "" && h.Host != host {
+				continue
+			}
+			for class, n := range h.Status {
+				status[class] += n
+				total[class] += n
+			}
+		}
+
+		var responses int
+		for _, n := range status {
+			responses += n
+		}
+		if responses > 0 {
+			clientErrors, serverErrors := errorRates(status)
+			_, _ = fmt.Fprintf(w, "%s\t%d\t%.1f%%\t%.1f%%\n", r.Timestamp.Local().Format(defQueryLayout), responses, clientErrors, serverErrors)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	var responses int
+	for _, n := range total {
+		responses += n
+	}
+	clientErrors, serverErrors := errorRates(total)
+	_, _ = fmt.Fprintf(w, "TOTAL\t%d\t%.1f%%\t%.1f%%\n", responses, clientErrors, serverErrors)
+	return nil
+}
+
+// queryTrafficTrend writes the hits and bytes of the host, or of all hosts, in every report, and their sparkline
+func queryTrafficTrend(w *tabwriter.Writer, dir string, host string, from time.Time, to time.Time) error {
+	var hits []float64
+	_, _ = fmt.Fprintln(w, "TIME\tHITS\tBYTES\tWATCHDOG HITS")
+	err := readRecords(dir, from, to, func(r *storedRecord) {
+		if r.Kind != recordReport {
+			return
+		}
+
+		var n int
+		var bytes int64
+		for _, h := range r.Hosts {
+			if host == "" || h.Host == host {
+				n += h.Hits
+				bytes += h.Bytes
+			}
+		}
+		hits = append(hits, float64(n))
+		_, _ = fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", r.Timestamp.Local().Format(defQueryLayout), n, bytes, r.WatchdogHits)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The sparkline goes below the table, not to widen its columns
+	if err := w.Flush(); err != nil || len(hits) < 2 {
+		return err
+	}
+	_, _ = fmt.Fprintf(w, "\nhits %s\n", buildSparkline(fit(hits, defSparklineWidth)))
+	return nil
+}
+
+// queryAlertList writes the alerts and recoveries
+func queryAlertList(w *tabwriter.Writer, dir string, from time.Time, to time.Time) error {
+	_, _ = fmt.Fprintln(w, "TIME\tALERT")
+	return readRecords(dir, from, to, func(r *storedRecord) {
+		if r.Kind == recordAlert {
+			_, _ = fmt.Fprintf(w, "%s\t%s\n", r.Timestamp.Local().Format(defQueryLayout), r.Alert)
+		}
+	})
+}
+
+// Query answers a question from the reports and alerts stored between from and to, and writes the answer to w :
+// top-hosts for the hosts with the most hits, status for the error rates of a host or all hosts, traffic for the hits
+// of a host or all hosts over time, and alerts for the alerts that were raised
+func Query(w io.Writer, question string, host string, from time.Time, to time.Time) error {
+	if config.store.dir == "" {
+		return fmt.Errorf("no store directory to query")
+	}
+	if !from.Before(to) {
+		return fmt.Errorf("invalid time range from %s to %s", from.Format(defQueryLayout), to.Format(defQueryLayout))
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	var err error
+	switch question {
+	case queryTopHosts:
+		err = queryTop(tw, config.store.dir, from, to)
+	case queryStatus:
+		err = queryStatusRates(tw, config.store.dir, host, from, to)
+	case queryTraffic:
+		err = queryTrafficTrend(tw, config.store.dir, host, from, to)
+	case queryAlerts:
+		err = queryAlertList(tw, config.store.dir, from, to)
+	default:
+		return fmt.Errorf("invalid question '%s', must be one of %s, %s, %s or %s", question, queryTopHosts, queryStatus, queryTraffic, queryAlerts)
+	}
+	if err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// SetStore sets the directory to store reports and alerts in, and the retention limits of the store : the period
+// records are kept for, and the maximum size of the store. An empty directory disables it.
+func SetStore(dir string, retention time.Duration, maxBytes int64) error {
+	if dir != "" && (retention < defStoreSegment || maxBytes < defStoreMaxRecord) {
+		return fmt.Errorf("invalid store retention of %s and %d bytes, must be at least %s and %d bytes", retention, maxBytes, defStoreSegment, defStoreMaxRecord)
+	}
+
+	config.store = storeConfig{
+		dir:       dir,
+		retention: retention,
+		maxBytes:  maxBytes,
+	}
+	return nil
+}
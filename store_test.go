@@ -0,0 +1,74 @@
+package gonetmon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// storeSize returns the total size of the segments of the store
+func storeSize(t *testing.T, dir string) int64 {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			t.Fatal(err)
+		}
+		size += info.Size()
+	}
+	return size
+}
+
+func TestStoreMaxBytes(t *testing.T) {
+	const maxBytes = 4096
+	dir := t.TempDir()
+	s, err := newReportStore(&storeConfig{dir: dir, retention: 24 * time.Hour, maxBytes: maxBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	start := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+	hosts := []storedHost{{Host: strings.Repeat("h", 300)}}
+	for i := 0; i < 200; i++ {
+		s.write(&storedRecord{Kind: recordReport, Timestamp: start.Add(time.Duration(i) * time.Minute), Hosts: hosts})
+		if size := storeSize(t, dir); size > maxBytes || size != s.size {
+			t.Fatalf("record %d : store of %d bytes, counted %d, limit %d", i, size, s.size, maxBytes)
+		}
+	}
+
+	// A single segment larger than the limit is emptied to make room
+	s.close()
+	s, err = newReportStore(&storeConfig{dir: dir, retention: 24 * time.Hour, maxBytes: maxBytes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := start.Add(10 * time.Hour)
+	for i := 0; i < 20; i++ {
+		s.write(&storedRecord{Kind: recordReport, Timestamp: later.Add(time.Duration(i) * time.Second), Hosts: hosts})
+		if size := storeSize(t, dir); size > maxBytes {
+			t.Fatalf("record %d : store of %d bytes past the limit of %d", i, size, maxBytes)
+		}
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("got segments %v, error %v, expected only the open one", segments, err)
+	}
+}
+
+func TestSetStoreLimits(t *testing.T) {
+	store := config.store
+	defer func() { config.store = store }()
+	if err := SetStore(t.TempDir(), defStoreSegment, defStoreMaxRecord-1); err == nil {
+		t.Error("expected an error for a store smaller than a record")
+	}
+	if err := SetStore(t.TempDir(), defStoreSegment, defStoreMaxRecord); err != nil {
+		t.Error(err)
+	}
+}
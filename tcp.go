@@ -0,0 +1,444 @@
+package gonetmon
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sort"
+	"time"
+)
+
+const dataTCP = "tcp"
+
+// tcpHole is a range of sequence numbers that was skipped on a direction of a connection, because segments were lost
+// before reaching the capture point, or arrive out of order
+type tcpHole struct {
+	start uint32
+	end   uint32
+	seen  time.Time // Capture time of the segment that revealed the hole
+}
+
+// tcpSender tracks the sequence numbers and window sent on one direction of a connection
+type tcpSender struct {
+	started    bool      // Whether a sequence number was seen
+	next       uint32    // Sequence number following the highest byte sent
+	holes      []tcpHole // Skipped ranges of sequence numbers, not filled yet
+	zeroWindow bool      // Whether the sender's receive window is closed
+}
+
+// seqAfter tells whether sequence number a comes after b, with wraparound
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+// track registers a segment carrying data or a FIN, and tells whether it is a retransmission or arrives out of order.
+// Segments filling a hole within the reordering delay are out of order, later ones are retransmissions of lost segments.
+func (s *tcpSender) track(seq uint32, length uint32, t time.Time, reorderDelay time.Duration) (retransmission bool, outOfOrder bool) {
+	end := seq + length
+	if !s.started {
+		s.started = true
+		s.next = end
+		return false, false
+	}
+
+	if !seqAfter(s.next, seq) {
+		if seqAfter(seq, s.next) {
+			// Don't grow indefinitely : forget the oldest hole
+			if len(s.holes) >= defMaxPendingSegments {
+				s.holes = s.holes[1:]
+			}
+			s.holes = append(s.holes, tcpHole{start: s.next, end: seq, seen: t})
+		}
+		s.next = end
+		return false, false
+	}
+
+	// The segment starts before the highest byte sent
+	if seqAfter(end, s.next) {
+		s.next = end
+	}
+	for i, h := range s.holes {
+		if !seqAfter(h.start, seq) && seqAfter(h.end, seq) {
+			s.holes = append(s.holes[:i], s.holes[i+1:]...)
+			if t.Sub(h.seen) < reorderDelay {
+				return false, true
+			}
+			return true, false
+		}
+	}
+	return true, false
+}
+
+// window registers the receive window advertised by the sender, and tells whether it just closed
+func (s *tcpSender) window(size uint16) bool {
+	if size > 0 {
+		s.zeroWindow = false
+		return false
+	}
+	closed := !s.zeroWindow
+	s.zeroWindow = true
+	return closed
+}
+
+// tcpConn is the state of a connection between a local and a remote endpoint
+type tcpConn struct {
+	host        string        // Remote host, by name when it was resolved
+	device      string        // Interface the connection was first seen on
+	first       time.Time     // Capture time of the first packet seen
+	syn         time.Time     // Capture time of the first SYN
+	synAck      time.Time     // Capture time of the first SYN-ACK
+	localOpened bool          // Whether the local endpoint opened the connection
+	measured    bool          // Whether the round-trip time of the handshake was measured
+	rtt         time.Duration // Round-trip time between the capture point and the remote endpoint
+	finLocal    bool          // Whether the local endpoint closed its direction
+	finRemote   bool          // Whether the remote endpoint closed its direction
+	local       tcpSender     // Direction from the local endpoint
+	remote      tcpSender     // Direction from the remote endpoint
+}
+
+// tcpEvent holds what a packet tells about the quality of its connection
+type tcpEvent struct {
+	host           string        // Remote host
+	device         string        // Interface of the connection
+	opened         bool          // Whether the connection was first seen
+	rtt            time.Duration // Round-trip time of the handshake, if it was measured on this packet
+	segments       int           // Number of segments carrying data, a SYN or a FIN
+	retransmission bool          // Whether the segment is a retransmission
+	outOfOrder     bool          // Whether the segment arrived out of order
+	zeroWindow     bool          // Whether the sender closed its receive window
+	reset          bool          // Whether the connection was reset
+	closed         bool          // Whether the connection ended
+	duration       time.Duration // Duration of the connection since it was first seen, if it ended
+	unfollowed     bool          // Whether the packet belongs to a connection that is not followed
+}
+
+// tcpDissector follows TCP connections of the captured traffic, whichever protocol they carry, to measure their quality
+type tcpDissector struct {
+	conns map[string]*tcpConn // Connections being followed, only accessed while monitoring
+}
+
+// newTCPDissector returns a dissector following TCP connections
+func newTCPDissector() *tcpDissector {
+	return &tcpDissector{conns: make(map[string]*tcpConn)}
+}
+
+// Name returns the name of the dissector
+func (d *tcpDissector) Name() string {
+	return dataTCP
+}
+
+// Observer marks the dissector as an observer, as it looks at the packets of all protocols carried over TCP
+func (d *tcpDissector) Observer() {}
+
+// Filter returns the BPF fragment for all TCP traffic, whichever port it is on
+func (d *tcpDissector) Filter() string {
+	return "tcp"
+}
+
+// Match tells whether the packet is a TCP segment
+func (d *tcpDissector) Match(packet gopacket.Packet) bool {
+	return packet.Layer(layers.LayerTypeTCP) != nil
+}
+
+// Decode updates the state of the packet's connection, and returns what it tells about the connection's quality.
+// Connections are followed from their SYN, or from their first segment carrying data, so that packets closing
+// a connection that was already forgotten don't count as new connections.
+func (d *tcpDissector) Decode(data *packetMsg) (interface{}, error) {
+	tcp, ok := data.rawPacket.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return nil, errors.New("no TCP layer in packet")
+	}
+	key, _, _ := connEndpoints(data.rawPacket)
+	now := data.rawPacket.Metadata().Timestamp
+	length := uint32(len(tcp.LayerPayload()))
+
+	src, _ := data.rawPacket.NetworkLayer().NetworkFlow().Endpoints()
+	fromLocal := src.String() == data.deviceIP
+
+	conn, ok := d.conns[key]
+	if !ok {
+		if !tcp.SYN && length == 0 {
+			return &tcpEvent{unfollowed: true}, nil
+		}
+
+		// Don't grow indefinitely : start over when full, losing track of ongoing connections
+		if len(d.conns) >= defMaxFlows {
+			d.conns = make(map[string]*tcpConn)
+		}
+
+		host := data.remoteIP
+		if name, resolved := nameCache.lookup(data.remoteIP, now); resolved {
+			host = name
+		}
+		conn = &tcpConn{host: host, device: data.device, first: now}
+		d.conns[key] = conn
+	}
+
+	event := &tcpEvent{host: conn.host, device: conn.device, opened: !ok}
+
+	sender := &conn.remote
+	if fromLocal {
+		sender = &conn.local
+	}
+
+	// Segments are reordered within a round-trip time, or a few milliseconds before it is known
+	reorderDelay := conn.rtt
+	if reorderDelay == 0 {
+		reorderDelay = defTCPReorderDelay
+	}
+
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		event.segments = 1
+		if conn.syn.IsZero() {
+			conn.syn = now
+			conn.localOpened = fromLocal
+		} else {
+			event.retransmission = true
+		}
+		sender.started = true
+		sender.next = tcp.Seq + 1
+
+	case tcp.SYN && tcp.ACK:
+		event.segments = 1
+		if conn.synAck.IsZero() {
+			conn.synAck = now
+			// Opening the connection, we see the time it takes the remote endpoint to answer
+			if conn.localOpened && !conn.syn.IsZero() {
+				conn.rtt = now.Sub(conn.syn)
+				conn.measured = true
+				event.rtt = conn.rtt
+			}
+		} else {
+			event.retransmission = true
+		}
+		sender.started = true
+		sender.next = tcp.Seq + 1
+
+	default:
+		// Accepting the connection, we see the time it takes the remote endpoint to acknowledge our SYN-ACK
+		if !conn.measured && !conn.localOpened && !fromLocal && !conn.synAck.IsZero() {
+			conn.rtt = now.Sub(conn.synAck)
+			conn.measured = true
+			event.rtt = conn.rtt
+		}
+
+		if length > 0 || tcp.FIN {
+			if tcp.FIN {
+				length++
+			}
+			event.segments = 1
+			event.retransmission, event.outOfOrder = sender.track(tcp.Seq, length, now, reorderDelay)
+		}
+	}
+
+	if !tcp.RST {
+		event.zeroWindow = sender.window(tcp.Window)
+	}
+
+	if tcp.FIN {
+		if fromLocal {
+			conn.finLocal = true
+		} else {
+			conn.finRemote = true
+		}
+	}
+
+	if tcp.RST || (conn.finLocal && conn.finRemote) {
+		event.reset = tcp.RST
+		event.closed = true
+		event.duration = now.Sub(conn.first)
+		delete(d.conns, key)
+	}
+
+	return event, nil
+}
+
+// NewAnalysis returns an empty analysis of connection quality
+func (d *tcpDissector) NewAnalysis() protocolAnalysis {
+	return newTCPAnalysis()
+}
+
+// tcpQuality holds statistics about the quality of the connections with a remote host, or on an interface
+type tcpQuality struct {
+	name            string        // Remote host or interface
+	connections     int           // Number of connections seen
+	segments        int           // Number of segments carrying data, a SYN or a FIN
+	retransmissions int           // Number of retransmitted segments
+	outOfOrder      int           // Number of segments that arrived out of order
+	zeroWindows     int           // Number of times a receive window closed
+	resets          int           // Number of connections reset
+	rtt             time.Duration // Sum of handshake round-trip times
+	timed           int           // Number of handshakes measured
+	closed          int           // Number of connections that ended
+	duration        time.Duration // Sum of durations of the connections that ended
+}
+
+// add adds the event to the statistics
+func (q *tcpQuality) add(e *tcpEvent) {
+	if e.opened {
+		q.connections++
+	}
+	if e.rtt > 0 {
+		q.rtt += e.rtt
+		q.timed++
+	}
+	q.segments += e.segments
+	if e.retransmission {
+		q.retransmissions++
+	}
+	if e.outOfOrder {
+		q.outOfOrder++
+	}
+	if e.zeroWindow {
+		q.zeroWindows++
+	}
+	if e.reset {
+		q.resets++
+	}
+	if e.closed {
+		q.closed++
+		q.duration += e.duration
+	}
+}
+
+// averageRTT returns the average round-trip time of handshakes
+func (q *tcpQuality) averageRTT() time.Duration {
+	if q.timed == 0 {
+		return 0
+	}
+	return q.rtt / time.Duration(q.timed)
+}
+
+// averageDuration returns the average duration of the connections that ended
+func (q *tcpQuality) averageDuration() time.Duration {
+	if q.closed == 0 {
+		return 0
+	}
+	return q.duration / time.Duration(q.closed)
+}
+
+// retransmissionRate returns the share of segments that were retransmitted
+func (q *tcpQuality) retransmissionRate() float64 {
+	if q.segments == 0 {
+		return 0
+	}
+	return float64(q.retransmissions) / float64(q.segments)
+}
+
+// sortedTCPQualities implements sort.Interface based on the connections of tcpQuality
+type sortedTCPQualities []*tcpQuality
+
+func (q sortedTCPQualities) Len() int           { return len(q) }
+func (q sortedTCPQualities) Less(i, j int) bool { return q[i].connections > q[j].connections }
+func (q sortedTCPQualities) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+
+// tcpAnalysis holds accumulated connection quality data between two reports
+type tcpAnalysis struct {
+	hosts      map[string]*tcpQuality // Statistics per remote host
+	devices    map[string]*tcpQuality // Statistics per interface
+	unfollowed int                    // Number of packets of connections that are not followed
+}
+
+// newTCPAnalysis returns a new and empty analysis of connection quality
+func newTCPAnalysis() *tcpAnalysis {
+	return &tcpAnalysis{
+		hosts:   make(map[string]*tcpQuality),
+		devices: make(map[string]*tcpQuality),
+	}
+}
+
+// getQuality returns the statistics of name in the map, creating them if needed
+func getQuality(qualities map[string]*tcpQuality, name string) *tcpQuality {
+	q, ok := qualities[name]
+	if !ok {
+		q = &tcpQuality{name: name}
+		qualities[name] = q
+	}
+	return q
+}
+
+// Add adds what a packet tells about its connection to the analysis. Packets are not hits.
+func (a *tcpAnalysis) Add(message interface{}) bool {
+	e, ok := message.(*tcpEvent)
+	if !ok {
+		return false
+	}
+	if e.unfollowed {
+		a.unfollowed++
+		return false
+	}
+
+	getQuality(a.hosts, e.host).add(e)
+	getQuality(a.devices, e.device).add(e)
+	return false
+}
+
+// Renew returns a new and empty analysis
+func (a *tcpAnalysis) Renew() protocolAnalysis {
+	return newTCPAnalysis()
+}
+
+// Report builds the connection quality section of the report, with the remote hosts with the most connections
+func (a *tcpAnalysis) Report() protocolReport {
+	hosts := make([]*tcpQuality, 0, len(a.hosts))
+	for _, q := range a.hosts {
+		hosts = append(hosts, q)
+	}
+	sort.Sort(sortedTCPQualities(hosts))
+	if len(hosts) > config.packetFilter.nbSections {
+		hosts = hosts[:config.packetFilter.nbSections]
+	}
+
+	devices := make([]*tcpQuality, 0, len(a.devices))
+	for _, q := range a.devices {
+		devices = append(devices, q)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].name < devices[j].name
+	})
+
+	return &tcpReport{
+		topHosts:   hosts,
+		devices:    devices,
+		unfollowed: a.unfollowed,
+	}
+}
+
+// tcpReport holds the final result of a connection quality analysis
+type tcpReport struct {
+	topHosts   []*tcpQuality // Remote hosts with the most connections
+	devices    []*tcpQuality // Interfaces, by name
+	unfollowed int           // Number of packets of connections that are not followed
+}
+
+// Empty tells whether no connection was seen
+func (r *tcpReport) Empty() bool {
+	return len(r.devices) == 0 && r.unfollowed == 0
+}
+
+// buildTCPQualityOutput returns a string representation of connection quality statistics
+func buildTCPQualityOutput(qualities []*tcpQuality) string {
+	var output string
+	for _, q := range qualities {
+		output += fmt.Sprintf(reportTCPLine+"\n", q.name, q.connections, q.averageRTT(), q.retransmissionRate()*100,
+			q.outOfOrder, q.zeroWindows, q.resets, q.averageDuration())
+	}
+	return output
+}
+
+// Render returns the connection quality section on the console display
+func (r *tcpReport) Render() string {
+	var output string
+
+	output += reportTCP + "\n"
+	output += buildTCPQualityOutput(r.topHosts)
+	output += reportTCPDevices + "\n"
+	output += buildTCPQualityOutput(r.devices)
+	if r.unfollowed > 0 {
+		output += fmt.Sprintf(reportTCPSkipped+"\n", r.unfollowed)
+	}
+
+	return output
+}
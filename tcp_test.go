@@ -0,0 +1,50 @@
+package gonetmon
+
+import (
+	"github.com/google/gopacket/layers"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTCPFollowsAllPorts(t *testing.T) {
+	d := newTCPDissector()
+	if filter := d.Filter(); filter != "tcp" {
+		t.Errorf("filter %q, want all TCP traffic", filter)
+	}
+
+	const client = "192.168.1.20"
+	now := time.Now()
+	syn, err := NewSyntheticTCPPacket(client, testServer, &layers.TCP{SrcPort: 40000, DstPort: 5432, Seq: 1, SYN: true}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ack, err := NewSyntheticTCPPacket(client, testServer, &layers.TCP{SrcPort: 40001, DstPort: 5432, Seq: 1, ACK: true}, nil, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := d.NewAnalysis()
+	for _, p := range []*packetMsg{
+		{device: "eth0", deviceIP: testServer, remoteIP: client, rawPacket: syn},
+		{device: "eth0", deviceIP: testServer, remoteIP: client, rawPacket: ack},
+	} {
+		if !d.Match(p.rawPacket) {
+			t.Fatal("TCP packet not matched")
+		}
+		message, err := d.Decode(p)
+		if err != nil || message == nil {
+			t.Fatalf("got %v, error %v, want an event", message, err)
+		}
+		a.Add(message)
+	}
+
+	// A connection opened on a port that is not a HTTP port is followed, an acknowledgement out of the blue is not
+	r := a.Report().(*tcpReport)
+	if len(r.topHosts) != 1 || r.topHosts[0].connections != 1 || r.unfollowed != 1 {
+		t.Fatalf("hosts %+v, %d unfollowed packets, want 1 connection and 1 unfollowed packet", r.topHosts, r.unfollowed)
+	}
+	if output := r.Render(); !strings.Contains(output, "1 packets of connections not followed") {
+		t.Errorf("unfollowed packets not rendered : %s", output)
+	}
+}
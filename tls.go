@@ -0,0 +1,537 @@
+package gonetmon
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dataTLS = "tls"
+
+// TLS record and handshake types, and extensions we look into
+const (
+	tlsRecordHandshake    = 22
+	tlsHandshakeClient    = 1
+	tlsHandshakeServer    = 2
+	tlsExtServerName      = 0
+	tlsExtGroups          = 10
+	tlsExtPointFormats    = 11
+	tlsExtALPN            = 16
+	tlsExtVersions        = 43
+	tlsRecordHeaderLen    = 5
+	tlsHandshakeHeaderLen = 4
+)
+
+// Kinds of TLS messages
+const (
+	tlsClientHello = "client hello"
+	tlsServerHello = "server hello"
+	tlsData        = "data"
+)
+
+// errTLSShort is returned when a TLS message is truncated
+var errTLSShort = errors.New("truncated TLS message")
+
+// tlsHello holds the metadata of a ClientHello or ServerHello
+type tlsHello struct {
+	version     uint16   // Highest version offered by the client, or version selected by the server
+	legacy      uint16   // Version of the hello message itself, kept at TLS 1.2 by TLS 1.3 clients
+	truncated   bool     // Whether the record was cut short, so that extensions may be missing
+	ciphers     []uint16 // Cipher suites offered by the client, or the one selected by the server
+	extensions  []uint16 // Extension types, in order
+	groups      []uint16 // Supported groups (elliptic curves)
+	pointFormat []uint8  // Elliptic curve point formats
+	serverName  string   // Server Name Indication
+	alpn        []string // Application protocols offered by the client, or the one selected by the server
+}
+
+// tlsMessage is a decoded TLS packet, either a handshake hello or any other record data
+type tlsMessage struct {
+	kind      string    // Client hello, server hello, or data
+	hello     *tlsHello // Hello metadata, if a hello
+	bytes     int       // Size of the TLS payload
+	flow      string    // Identifier of the connection
+	serverIP  string    // IP address of the server
+	timestamp time.Time // Capture timestamp
+}
+
+// tlsReader reads big endian values from a byte slice, recording whether it ran short
+type tlsReader struct {
+	data []byte
+	err  error
+}
+
+// next returns the next n bytes
+func (r *tlsReader) next(n int) []byte {
+	if r.err != nil || n > len(r.data) {
+		r.err = errTLSShort
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+// u8 returns the next byte
+func (r *tlsReader) u8() uint8 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// u16 returns the next 2 bytes as an integer
+func (r *tlsReader) u16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+// u24 returns the next 3 bytes as an integer
+func (r *tlsReader) u24() int {
+	b := r.next(3)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+// isGREASE tells whether the value is one of the reserved GREASE values, which are to be ignored in fingerprints
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// isTLSRecord tells whether the payload starts with a TLS record header
+func isTLSRecord(payload []byte) bool {
+	return len(payload) >= tlsRecordHeaderLen &&
+		payload[0] >= 20 && payload[0] <= 24 && // change cipher spec, alert, handshake, application data, heartbeat
+		payload[1] == 3 && payload[2] <= 4
+}
+
+// parseExtensions reads the hello's extensions, one at a time : if the hello is truncated, those that are complete
+// are read up to the first incomplete one
+func parseExtensions(r *tlsReader, hello *tlsHello, client bool) {
+	if len(r.data) == 0 {
+		return
+	}
+
+	size := int(r.u16())
+	if size > len(r.data) {
+		size = len(r.data)
+	}
+	ext := &tlsReader{data: r.next(size)}
+	for ext.err == nil && len(ext.data) > 0 {
+		typ := ext.u16()
+		body := &tlsReader{data: ext.next(int(ext.u16()))}
+		if ext.err != nil {
+			break
+		}
+		hello.extensions = append(hello.extensions, typ)
+
+		switch typ {
+		case tlsExtServerName:
+			list := &tlsReader{data: body.next(int(body.u16()))}
+			for list.err == nil && len(list.data) > 0 {
+				nameType := list.u8()
+				name := list.next(int(list.u16()))
+				if nameType == 0 && name != nil {
+					hello.serverName = strings.ToLower(string(name))
+				}
+			}
+
+		case tlsExtALPN:
+			list := &tlsReader{data: body.next(int(body.u16()))}
+			for list.err == nil && len(list.data) > 0 {
+				if proto := list.next(int(list.u8())); proto != nil {
+					hello.alpn = append(hello.alpn, string(proto))
+				}
+			}
+
+		case tlsExtGroups:
+			list := &tlsReader{data: body.next(int(body.u16()))}
+			for list.err == nil && len(list.data) > 0 {
+				hello.groups = append(hello.groups, list.u16())
+			}
+
+		case tlsExtPointFormats:
+			hello.pointFormat = append(hello.pointFormat, body.next(int(body.u8()))...)
+
+		case tlsExtVersions:
+			// The client lists the versions it supports, the server tells the one it selected
+			if client {
+				list := &tlsReader{data: body.next(int(body.u8()))}
+				for list.err == nil && len(list.data) > 0 {
+					if v := list.u16(); !isGREASE(v) && v > hello.version {
+						hello.version = v
+					}
+				}
+			} else {
+				hello.version = body.u16()
+			}
+		}
+	}
+}
+
+// parseHello parses a ClientHello or ServerHello from a TCP payload starting with a handshake record
+func parseHello(payload []byte) (*tlsHello, bool, error) {
+	r := &tlsReader{data: payload}
+
+	if r.u8() != tlsRecordHandshake {
+		return nil, false, errors.New("not a TLS handshake record")
+	}
+	r.next(2) // Record version
+	record := &tlsReader{data: r.next(int(r.u16()))}
+	truncated := r.err != nil
+	if truncated {
+		// Hellos may span several segments or be cut by the snapshot length, the complete extensions are still read
+		record = &tlsReader{data: payload[tlsRecordHeaderLen:]}
+	}
+
+	handshake := record.u8()
+	if handshake != tlsHandshakeClient && handshake != tlsHandshakeServer {
+		return nil, false, errors.New("not a TLS hello")
+	}
+	client := handshake == tlsHandshakeClient
+	record.u24() // Handshake length
+
+	hello := &tlsHello{version: record.u16(), truncated: truncated}
+	hello.legacy = hello.version
+	record.next(32)               // Random
+	record.next(int(record.u8())) // Session ID
+
+	if client {
+		ciphers := &tlsReader{data: record.next(int(record.u16()))}
+		for ciphers.err == nil && len(ciphers.data) > 0 {
+			hello.ciphers = append(hello.ciphers, ciphers.u16())
+		}
+		record.next(int(record.u8())) // Compression methods
+	} else {
+		hello.ciphers = []uint16{record.u16()}
+		record.u8() // Compression method
+	}
+
+	if record.err != nil {
+		return nil, client, record.err
+	}
+
+	parseExtensions(record, hello, client)
+	return hello, client, nil
+}
+
+// joinValues joins the non GREASE values with dashes, as in JA3
+func joinValues(values []uint16) string {
+	s := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			s = append(s, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(s, "-")
+}
+
+// fingerprint returns the JA3 fingerprint of a ClientHello : the MD5 hash of its version, ciphers, extensions,
+// groups and point formats. The version is the one of the hello message itself, not the one negotiated in extensions.
+func fingerprint(hello *tlsHello) string {
+	formats := make([]string, len(hello.pointFormat))
+	for i, f := range hello.pointFormat {
+		formats[i] = strconv.Itoa(int(f))
+	}
+
+	ja3 := fmt.Sprintf("%d,%s,%s,%s,%s", hello.legacy, joinValues(hello.ciphers), joinValues(hello.extensions),
+		joinValues(hello.groups), strings.Join(formats, "-"))
+
+	sum := md5.Sum([]byte(ja3))
+	return hex.EncodeToString(sum[:])
+}
+
+// tlsVersionName returns a readable name of the TLS version
+func tlsVersionName(v uint16) string {
+	switch v {
+	case 0x0300:
+		return "SSL3.0"
+	case 0x0301:
+		return "TLS1.0"
+	case 0x0302:
+		return "TLS1.1"
+	case 0x0303:
+		return "TLS1.2"
+	case 0x0304:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("0x%04x", v)
+	}
+}
+
+// tlsDissector handles TLS traffic, looking into handshakes and counting bytes of encrypted traffic
+type tlsDissector struct{}
+
+// Name returns the name of the dissector
+func (d *tlsDissector) Name() string {
+	return dataTLS
+}
+
+// Filter returns the BPF fragment for TCP traffic on configured TLS ports, or any TCP traffic
+func (d *tlsDissector) Filter() string {
+	return buildNetworkFilter(config.packetFilter.tlsPorts)
+}
+
+// Match tells whether the packet carries TLS data : any payload on a TLS port, or a TLS record on any port.
+// On any port, segments that don't start with a record are missed.
+func (d *tlsDissector) Match(packet gopacket.Packet) bool {
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok || len(tcp.LayerPayload()) == 0 {
+		return false
+	}
+
+	if len(config.packetFilter.tlsPorts) > 0 && onPorts(tcp, config.packetFilter.tlsPorts) {
+		return true
+	}
+	return isTLSRecord(tcp.LayerPayload())
+}
+
+// Decode transforms the packet into a tlsMessage, parsing hellos
+func (d *tlsDissector) Decode(data *packetMsg) (interface{}, error) {
+	tcp, ok := data.rawPacket.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return nil, errors.New("no TCP layer in packet")
+	}
+	payload := tcp.LayerPayload()
+
+	localPort, remotePort := localPorts(data.rawPacket, data.deviceIP)
+	m := &tlsMessage{
+		kind:      tlsData,
+		bytes:     len(payload),
+		flow:      flowKey(data.deviceIP, localPort, data.remoteIP, remotePort),
+		serverIP:  data.remoteIP,
+		timestamp: data.rawPacket.Metadata().Timestamp,
+	}
+
+	if len(payload) > tlsRecordHeaderLen+tlsHandshakeHeaderLen && payload[0] == tlsRecordHandshake {
+		hello, client, err := parseHello(payload)
+		if err == nil {
+			m.hello = hello
+			if client {
+				m.kind = tlsClientHello
+			} else {
+				m.kind = tlsServerHello
+			}
+
+			// We are the server if we receive a ClientHello or send a ServerHello
+			if (client && data.direction == directionInbound) || (!client && data.direction == directionOutbound) {
+				m.serverIP = data.deviceIP
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// NewAnalysis returns an empty TLS analysis
+func (d *tlsDissector) NewAnalysis() protocolAnalysis {
+	return newTLSAnalysis(newFlowHosts(defMaxFlows))
+}
+
+// tlsNameStats holds statistics about TLS connections to a server name
+type tlsNameStats struct {
+	name        string
+	connections int            // Number of ClientHellos
+	bytes       int64          // Bytes of TLS payload exchanged
+	versions    map[string]int // Negotiated versions
+	alpn        map[string]int // Negotiated application protocols
+	ciphers     map[string]int // Negotiated cipher suites
+}
+
+// sortedTLSNames implements sort.Interface based on the connections, then bytes, of tlsNameStats
+type sortedTLSNames []*tlsNameStats
+
+func (n sortedTLSNames) Len() int { return len(n) }
+func (n sortedTLSNames) Less(i, j int) bool {
+	if n[i].connections != n[j].connections {
+		return n[i].connections > n[j].connections
+	}
+	return n[i].bytes > n[j].bytes
+}
+func (n sortedTLSNames) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+
+// tlsAnalysis holds accumulated TLS data between two reports
+type tlsAnalysis struct {
+	names        map[string]*tlsNameStats // Statistics per server name
+	fingerprints map[string]int           // Number of ClientHellos per JA3 fingerprint
+	truncated    int                      // Number of ClientHellos cut short, that are not fingerprinted
+	flows        *flowHosts               // Server name of each connection, carried over from one analysis to the next
+}
+
+// newTLSAnalysis returns a new and empty TLS analysis
+func newTLSAnalysis(flows *flowHosts) *tlsAnalysis {
+	return &tlsAnalysis{
+		names:        make(map[string]*tlsNameStats),
+		fingerprints: make(map[string]int),
+		flows:        flows,
+	}
+}
+
+// getName returns the statistics of the name, creating them if needed
+func (a *tlsAnalysis) getName(name string) *tlsNameStats {
+	stats, ok := a.names[name]
+	if !ok {
+		stats = &tlsNameStats{
+			name:     name,
+			versions: make(map[string]int),
+			alpn:     make(map[string]int),
+			ciphers:  make(map[string]int),
+		}
+		a.names[name] = stats
+	}
+	return stats
+}
+
+// serverName returns the name of the server of a connection : from the ClientHello if we saw it,
+// or else from the DNS cache, or else its address
+func (a *tlsAnalysis) serverName(m *tlsMessage) string {
+	if name, ok := a.flows.get(m.flow); ok {
+		return name
+	}
+	if name, ok := nameCache.lookup(m.serverIP, m.timestamp); ok {
+		return name
+	}
+	return m.serverIP
+}
+
+// Add adds a TLS message to the analysis. TLS messages don't count as hits.
+func (a *tlsAnalysis) Add(message interface{}) bool {
+	m, ok := message.(*tlsMessage)
+	if !ok {
+		return false
+	}
+
+	if m.kind == tlsClientHello {
+		name := m.hello.serverName
+		if name == "" {
+			name = a.serverName(m)
+		}
+		a.flows.set(m.flow, name)
+
+		stats := a.getName(name)
+		stats.connections++
+		// The fingerprint of a partial list of extensions would not be the client's
+		if m.hello.truncated {
+			a.truncated++
+		} else {
+			a.fingerprints[fingerprint(m.hello)]++
+		}
+	}
+
+	stats := a.getName(a.serverName(m))
+	stats.bytes += int64(m.bytes)
+
+	if m.kind == tlsServerHello {
+		stats.versions[tlsVersionName(m.hello.version)]++
+		if len(m.hello.ciphers) > 0 {
+			stats.ciphers[tls.CipherSuiteName(m.hello.ciphers[0])]++
+		}
+		for _, p := range m.hello.alpn {
+			stats.alpn[p]++
+		}
+	}
+
+	return false
+}
+
+// Renew returns a new analysis, keeping track of ongoing connections
+func (a *tlsAnalysis) Renew() protocolAnalysis {
+	return newTLSAnalysis(a.flows)
+}
+
+// Report builds the TLS section of the report
+func (a *tlsAnalysis) Report() protocolReport {
+	names := make([]*tlsNameStats, 0, len(a.names))
+	for _, stats := range a.names {
+		names = append(names, stats)
+	}
+	sort.Sort(sortedTLSNames(names))
+	if len(names) > config.packetFilter.nbSections {
+		names = names[:config.packetFilter.nbSections]
+	}
+
+	var fingerprints []string
+	for f := range a.fingerprints {
+		fingerprints = append(fingerprints, f)
+	}
+	sort.Slice(fingerprints, func(i, j int) bool {
+		return a.fingerprints[fingerprints[i]] > a.fingerprints[fingerprints[j]]
+	})
+	if len(fingerprints) > config.packetFilter.nbSections {
+		fingerprints = fingerprints[:config.packetFilter.nbSections]
+	}
+
+	counts := make([]int, len(fingerprints))
+	for i, f := range fingerprints {
+		counts[i] = a.fingerprints[f]
+	}
+
+	return &tlsReport{
+		topNames:     names,
+		fingerprints: fingerprints,
+		counts:       counts,
+		truncated:    a.truncated,
+	}
+}
+
+// tlsReport holds the final result of a TLS analysis
+type tlsReport struct {
+	topNames     []*tlsNameStats // Server names with the most connections
+	fingerprints []string        // Most seen JA3 fingerprints
+	counts       []int           // Number of ClientHellos for each fingerprint
+	truncated    int             // Number of ClientHellos cut short, that are not fingerprinted
+}
+
+// Empty tells whether no TLS traffic was seen
+func (r *tlsReport) Empty() bool {
+	return len(r.topNames) == 0
+}
+
+// buildCountOutput returns a string representation of the map's elements and their count, in key order
+func buildCountOutput(m map[string]int) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var output string
+	for _, k := range keys {
+		output += fmt.Sprintf("%s(%d) ", k, m[k])
+	}
+	return output
+}
+
+// Render returns the TLS section of the console display
+func (r *tlsReport) Render() string {
+	var output string
+
+	output += reportTLS + "\n"
+	for _, n := range r.topNames {
+		output += fmt.Sprintf(reportTLSName, n.name, n.connections, n.bytes)
+		output += fmt.Sprintf("%s%s%s\n", buildCountOutput(n.versions), buildCountOutput(n.alpn), buildCountOutput(n.ciphers))
+	}
+	for i, f := range r.fingerprints {
+		output += fmt.Sprintf(reportTLSJA3+"\n", f, r.counts[i])
+	}
+	if r.truncated > 0 {
+		output += fmt.Sprintf(reportTLSShort+"\n", r.truncated)
+	}
+
+	return output
+}
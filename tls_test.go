@@ -0,0 +1,113 @@
+package gonetmon
+
+import (
+	"strings"
+	"testing"
+)
+
+// u16 appends v to b in big endian
+func u16(b []byte, v int) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// clientHello returns a handshake record holding a TLS 1.3 ClientHello : its legacy version is TLS 1.2, and its
+// supported_versions extension offers TLS 1.3 and TLS 1.2, followed by the other extensions
+func clientHello(other ...byte) []byte {
+	versions := u16(u16(nil, 43), 5)
+	versions = append(versions, 4)
+	versions = u16(u16(versions, 0x0304), 0x0303)
+	groups := u16(u16(u16(u16(nil, 10), 4), 2), 29)
+
+	body := u16(nil, 0x0303)
+	body = append(body, make([]byte, 32)...) // Random
+	body = append(body, 0)                   // Session ID
+	body = u16(u16(u16(body, 4), 0x1301), 0x1302)
+	body = append(body, 1, 0) // Compression methods
+	extensions := append(append(versions, groups...), other...)
+	body = append(u16(body, len(extensions)), extensions...)
+
+	handshake := append([]byte{tlsHandshakeClient, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+	return append(u16([]byte{tlsRecordHandshake, 3, 1}, len(handshake)), handshake...)
+}
+
+func TestParseClientHello(t *testing.T) {
+	record := clientHello()
+
+	tests := []struct {
+		name      string
+		payload   []byte
+		truncated bool
+	}{
+		{"complete", record, false},
+		{"cut by the snapshot length", record[:len(record)-4], true},
+	}
+
+	for _, tt := range tests {
+		hello, client, err := parseHello(tt.payload)
+		if err != nil || !client {
+			t.Fatalf("%s : parseHello() = %v, %v", tt.name, client, err)
+		}
+		if hello.truncated != tt.truncated {
+			t.Errorf("%s : truncated = %v, want %v", tt.name, hello.truncated, tt.truncated)
+		}
+		if hello.legacy != 0x0303 {
+			t.Errorf("%s : legacy version = %#x, want 0x303", tt.name, hello.legacy)
+		}
+	}
+
+	// The negotiated version is the highest supported one, but JA3 uses the legacy version
+	hello, _, _ := parseHello(record)
+	if hello.version != 0x0304 {
+		t.Errorf("version = %#x, want 0x304", hello.version)
+	}
+	want := fingerprint(&tlsHello{legacy: 0x0303, ciphers: []uint16{0x1301, 0x1302}, extensions: []uint16{43, 10}, groups: []uint16{29}})
+	if got := fingerprint(hello); got != want {
+		t.Errorf("fingerprint = %s, want %s", got, want)
+	}
+}
+
+func TestTruncatedHelloExtensions(t *testing.T) {
+	name := []byte("www.example.com")
+	sni := u16(u16(u16(nil, tlsExtServerName), len(name)+5), len(name)+3)
+	sni = append(u16(append(sni, 0), len(name)), name...)
+	alpn := u16(u16(u16(nil, tlsExtALPN), 7), 5)
+	alpn = append(append(alpn, 2), "h2"...)
+	alpn = append(alpn, 1, 'x')
+	keyShare := append(u16(u16(nil, 51), 1200), make([]byte, 1200)...)
+
+	// Browsers send hellos longer than the default snapshot length, with large key shares
+	record := clientHello(append(append(sni, alpn...), keyShare...)...)
+	hello, _, err := parseHello(record[:1024])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hello.truncated || hello.serverName != "www.example.com" || len(hello.alpn) != 2 || hello.alpn[0] != "h2" {
+		t.Errorf("truncated %v, server name %q, ALPN %v", hello.truncated, hello.serverName, hello.alpn)
+	}
+	if got := joinValues(hello.extensions); got != "43-10-0-16" {
+		t.Errorf("extensions %s, want those before the incomplete key share", got)
+	}
+}
+
+func TestServerHelloCipher(t *testing.T) {
+	a := newTLSAnalysis(newFlowHosts(defMaxFlows))
+	a.Add(&tlsMessage{kind: tlsServerHello, hello: &tlsHello{version: 0x0304, ciphers: []uint16{0x1301}}, flow: "flow", serverIP: testServer})
+	r := a.Report().(*tlsReport)
+	if output := r.Render(); !strings.Contains(output, "TLS_AES_128_GCM_SHA256(1)") {
+		t.Errorf("cipher suite not rendered : %s", output)
+	}
+}
+
+func TestTruncatedHelloNotFingerprinted(t *testing.T) {
+	record := clientHello()
+	hello, _, err := parseHello(record[:len(record)-4])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := newTLSAnalysis(newFlowHosts(defMaxFlows))
+	a.Add(&tlsMessage{kind: tlsClientHello, hello: hello, flow: "flow"})
+	if len(a.fingerprints) != 0 || a.truncated != 1 {
+		t.Errorf("fingerprints = %v, truncated = %d, want none and 1", a.fingerprints, a.truncated)
+	}
+}
@@ -0,0 +1,133 @@
+package gonetmon
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// upgrade is a connection on which a switch from HTTP/1.1 to another protocol was requested
+type upgrade struct {
+	protocol string // Protocol requested, or switched to, in lower case and without version, or connect for tunnels
+	client   string // Address and port of the client
+	endpoint string // Host and target the upgrade was requested for, or the server's address and port
+	switched bool   // Whether the server switched protocols
+	early    []byte // Data of the new protocol following the response switching protocols, in the same segment
+	earlySeq uint32 // TCP sequence number of the early data
+}
+
+// upgradeTable tracks connections upgraded from HTTP/1.1, which don't carry HTTP/1 messages anymore.
+// It is filled while capturing, from the handshakes of HTTP/1 messages.
+type upgradeTable struct {
+	mutex   sync.Mutex         // Capture goroutines of all sources share the table
+	conns   map[string]upgrade // Maps connections to their upgrade
+	maxSize int                // Maximum number of connections to remember
+}
+
+// upgrades is the table of upgraded connections, shared by dissectors
+var upgrades = newUpgradeTable(defMaxFlows)
+
+// newUpgradeTable returns an empty table of upgraded connections
+func newUpgradeTable(maxSize int) *upgradeTable {
+	return &upgradeTable{
+		conns:   make(map[string]upgrade),
+		maxSize: maxSize,
+	}
+}
+
+// upgradeProtocol returns the first protocol of the Upgrade header of the HTTP/1.x message, in lower case and
+// without version, or false if there is none
+func upgradeProtocol(payload []byte) (string, bool) {
+	value, ok := headerValue(payload, "Upgrade")
+	if !ok {
+		return "", false
+	}
+
+	protocol := strings.Split(value, ",")[0]
+	if idx := strings.IndexByte(protocol, '/'); idx >= 0 {
+		protocol = protocol[:idx]
+	}
+	return strings.ToLower(strings.TrimSpace(protocol)), true
+}
+
+// track registers upgrade and CONNECT requests, and the responses switching protocols or establishing tunnels,
+// from a HTTP/1.x message on the connection, starting at the TCP sequence number seq
+func (t *upgradeTable) track(key string, sender string, receiver string, payload []byte, seq uint32) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if isHTTPRequest(payload) {
+		protocol, ok := upgradeProtocol(payload)
+		host, _ := headerValue(payload, "Host")
+		endpoint := host + requestTarget(payload)
+
+		// Proxies switch to a tunnel to the target of CONNECT requests
+		if bytes.HasPrefix(payload, []byte(http.MethodConnect+" ")) {
+			protocol, ok = protocolConnect, true
+			endpoint = requestTarget(payload)
+		}
+		if !ok {
+			return
+		}
+
+		// Don't grow indefinitely : start over when full, connections still active will register again
+		if _, ok := t.conns[key]; !ok && len(t.conns) >= t.maxSize {
+			t.conns = make(map[string]upgrade)
+		}
+		t.conns[key] = upgrade{
+			protocol: protocol,
+			client:   sender,
+			endpoint: endpoint,
+		}
+		return
+	}
+
+	status, ok := responseStatus(payload)
+	if !ok {
+		return
+	}
+
+	u, requested := t.conns[key]
+	tunnel := requested && u.protocol == protocolConnect && status/100 == 2
+	if status != 101 && !tunnel {
+		// The upgrade was refused, the connection goes on with HTTP/1
+		if requested && !u.switched {
+			delete(t.conns, key)
+		}
+		return
+	}
+
+	// Without the request, we only know the server
+	if !requested {
+		if len(t.conns) >= t.maxSize {
+			t.conns = make(map[string]upgrade)
+		}
+		u = upgrade{client: receiver, endpoint: sender}
+	}
+	if protocol, ok := upgradeProtocol(payload); ok {
+		u.protocol = protocol
+	}
+	if idx := bytes.Index(payload, []byte("\r\n\r\n")); idx >= 0 && idx+4 < len(payload) {
+		u.early = append([]byte(nil), payload[idx+4:]...)
+		u.earlySeq = seq + uint32(idx+4)
+	}
+	u.switched = true
+	t.conns[key] = u
+}
+
+// get returns the upgrade of the connection, if it switched protocols
+func (t *upgradeTable) get(key string) (upgrade, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	u, ok := t.conns[key]
+	return u, ok && u.switched
+}
+
+// remove forgets about the connection, when it is closed
+func (t *upgradeTable) remove(key string) {
+	t.mutex.Lock()
+	delete(t.conns, key)
+	t.mutex.Unlock()
+}
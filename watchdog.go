@@ -3,6 +3,7 @@ package gonetmon
 import (
 	"container/list"
 	"fmt"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,19 +24,22 @@ type watchdog struct {
 	// Cache to store timely identified hits and time window to keep them
 	cache hitCache
 
-	// Channel to send alerts to
-	alertChan chan<- alertMsg
+	// Path to send alerts on
+	alerts *alerter
 
 	// Current state of alert
 	alert bool
 
+	// Number of elements in the cache, to be accessed atomically as monitoring reads it
+	hits int64
+
 	// Synchronisation
 	syn *synchronisation
 }
 
 // Hits returns the current number of elements in the cache
 func (w *watchdog) Hits() int {
-	return w.cache.list.Len()
+	return int(atomic.LoadInt64(&w.hits))
 }
 
 // buildAlertMsg builds an alert message appropriately to the current situation of recovery
@@ -60,15 +64,25 @@ func (w *watchdog) AddHit(t time.Time) {
 	w.cache.push <- t
 }
 
+// notify sends the alert or recovery message
+func (w *watchdog) notify(recovery bool) {
+	w.alerts.notify(watchdogAlert, buildAlertMsg(w, recovery, time.Now()))
+}
+
 // Verify checks the cache, raising or lowering the alert and sending a message if necessary
 func (w *watchdog) verify() {
 
+	// Hits are only compared to baselines
+	if config.alert.mode == alertBaseline {
+		return
+	}
+
 	// If the cache is empty, no need to go further
 	if w.cache.list.Len() <= 0 {
 		// If we were previously in alert, deescalate and send recovery message
 		if w.alert {
 			w.alert = false
-			w.alertChan <- buildAlertMsg(w, true, time.Now())
+			w.notify(true)
 		}
 		return
 	}
@@ -78,13 +92,13 @@ func (w *watchdog) verify() {
 		// New Alert
 		if !w.alert {
 			w.alert = true
-			w.alertChan <- buildAlertMsg(w, false, time.Now())
+			w.notify(false)
 		}
 	} else {
 		// Recovery
 		if w.alert {
 			w.alert = false
-			w.alertChan <- buildAlertMsg(w, true, time.Now())
+			w.notify(true)
 		}
 	}
 }
@@ -102,6 +116,7 @@ func (w *watchdog) evict(now time.Time) {
 		// If the element is older than allowed window
 		if now.Sub(e.Value.(time.Time)) > config.alert.span {
 			w.cache.list.Remove(e)
+			atomic.StoreInt64(&w.hits, int64(w.cache.list.Len()))
 		} else {
 			// Since we store timed values incrementally, following values are all still valid
 			break
@@ -133,13 +148,14 @@ watchdogLoop:
 		// Push request
 		case p := <-dog.cache.push:
 			dog.cache.list.PushBack(p)
+			atomic.StoreInt64(&dog.hits, int64(dog.cache.list.Len()))
 			dog.verify()
 		}
 	}
 }
 
 // NewWatchdog returns a watchdog struct and launches a goroutine that will observe its cache to detect alert triggering
-func NewWatchdog(c chan<- alertMsg, syn *synchronisation) *watchdog {
+func NewWatchdog(alerts *alerter, syn *synchronisation) *watchdog {
 
 	dog := &watchdog{
 		cache: hitCache{
@@ -147,9 +163,9 @@ func NewWatchdog(c chan<- alertMsg, syn *synchronisation) *watchdog {
 			bufSize: config.alert.watchdogBufSize,
 			list:    list.List{},
 		},
-		alertChan: c,
-		alert:     false,
-		syn:       syn,
+		alerts: alerts,
+		alert:  false,
+		syn:    syn,
 	}
 
 	// Routine that continuously verifies the cache and will inform about alert status
@@ -0,0 +1,99 @@
+package gonetmon
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"net"
+	"sync"
+	"time"
+)
+
+// buildDeviceMsg builds a message informing that a device was added to or removed from capture
+func buildDeviceMsg(device string, added bool, t time.Time) deviceMsg {
+	var message string
+
+	if added {
+		message = fmt.Sprintf(defDeviceAddedFormat, device, t.Format(defTimeLayout))
+	} else {
+		message = fmt.Sprintf(defDeviceRemovedFormat, device, t.Format(defTimeLayout))
+	}
+
+	return deviceMsg{
+		added:     added,
+		device:    device,
+		body:      message,
+		timestamp: t,
+	}
+}
+
+// notifyDevice logs the device change and sends it to display, without blocking if display can't keep up
+func notifyDevice(deviceChan chan<- deviceMsg, device string, added bool) {
+	msg := buildDeviceMsg(device, added, time.Now())
+
+	log.WithFields(logrus.Fields{
+		"interface": device,
+		"added":     added,
+	}).Info(msg.body)
+
+	select {
+	case deviceChan <- msg:
+	default:
+		log.Warn("Device notification channel is full, dropping message.")
+	}
+}
+
+// refresh compares the sources currently captured on with the network devices that are UP.
+// Sources whose device disappeared or whose capture stopped are closed, and new devices are opened and captured on.
+func (d *devices) refresh(wg *sync.WaitGroup, packetChan chan<- packetMsg, flowChan chan<- packetMsg, recordChan chan<- packetMsg, deviceChan chan<- deviceMsg) {
+	current, err := upDevices()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("Error in refreshing network devices.")
+		return
+	}
+
+	up := make(map[string]net.Interface, len(current))
+	for i := range current {
+		if config.interfaces.selects(&current[i]) {
+			up[current[i].Name] = current[i]
+		}
+	}
+
+	// Close sources whose device is gone, or on which capture has stopped on its own
+	kept := d.sources[:0]
+	for _, src := range d.sources {
+		_, present := up[src.Name()]
+
+		stopped := false
+		select {
+		case <-d.stopped[src.Name()]:
+			stopped = true
+		default:
+		}
+
+		if present && !stopped {
+			kept = append(kept, src)
+			delete(up, src.Name())
+			continue
+		}
+
+		closeSource(src)
+		delete(d.stopped, src.Name())
+		notifyDevice(deviceChan, src.Name(), false)
+	}
+	d.sources = kept
+
+	// What remains are new devices
+	for _, dev := range up {
+		src := newCaptureSource(dev, &config.captureConf)
+		if err := openSource(src); err != nil {
+			continue
+		}
+
+		if d.startCapture(src, wg, packetChan, flowChan, recordChan) {
+			d.sources = append(d.sources, src)
+			notifyDevice(deviceChan, src.Name(), true)
+		}
+	}
+}
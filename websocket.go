@@ -0,0 +1,444 @@
+package gonetmon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"sort"
+	"strconv"
+)
+
+const dataWebSocket = "websocket"
+
+// WebSocket opcodes
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// wsOpcodes maps the WebSocket opcodes to their name
+var wsOpcodes = map[byte]string{
+	wsContinuation: "continuation",
+	wsText:         "text",
+	wsBinary:       "binary",
+	wsClose:        "close",
+	wsPing:         "ping",
+	wsPong:         "pong",
+}
+
+// errWSFrame is returned for frames with an unknown opcode or an invalid length, which means the stream is not read
+// where frames start
+var errWSFrame = errors.New("invalid WebSocket frame")
+
+// wsFrame holds the metadata of a WebSocket frame
+type wsFrame struct {
+	fromClient bool   // Whether the client sent the frame
+	opcode     byte   // Kind of frame
+	fin        bool   // Whether the frame is the last of a message
+	length     uint64 // Length of the payload
+	closeCode  int    // Status code of a close frame, or -1 if there is none
+}
+
+// wsDirection is one direction of a WebSocket connection : the reassembled TCP stream, and the frames read from it
+type wsDirection struct {
+	fromClient bool            // Whether the client sends on this direction
+	stream     *tcpReassembler // Bytes sent on this direction
+	broken     bool            // Whether bytes were lost where frame headers were expected
+
+	header    []byte  // Header of the frame being read
+	frame     wsFrame // Frame being read
+	inFrame   bool    // Whether the frame header was read
+	mask      []byte  // Masking key of the frame, if masked
+	remaining uint64  // Bytes of the frame payload still to be read
+	code      []byte  // Status code of a close frame, as it is read
+}
+
+// wsConn is a WebSocket connection
+type wsConn struct {
+	endpoint string       // Host and target of the handshake, or server address
+	client   string       // Address and port of the client
+	toServer *wsDirection // Direction from client to server
+	toClient *wsDirection // Direction from server to client
+	opened   bool         // Whether the connection was counted
+	frames   []wsFrame    // Frames completed by the packet being decoded
+}
+
+// newWSConn returns a WebSocket connection from an upgrade
+func newWSConn(u upgrade) *wsConn {
+	return &wsConn{
+		endpoint: u.endpoint,
+		client:   u.client,
+		toServer: &wsDirection{fromClient: true, stream: newTCPReassembler()},
+		toClient: &wsDirection{fromClient: false, stream: newTCPReassembler()},
+	}
+}
+
+// read puts the segment back in its place in the stream of the direction, and decodes the frames it completes
+func (c *wsConn) read(key string, dir *wsDirection, seq uint32, segment tcpSegment) {
+	if dir.broken {
+		return
+	}
+	err := dir.stream.reassemble(seq, segment, func(data []byte, missing int) error {
+		return c.consume(dir, data, missing)
+	})
+	if err != nil {
+		// Frame boundaries are lost with the bytes
+		dir.broken = true
+		log.Info("WebSocket connection ", key, " can no longer be decoded : ", err)
+	}
+}
+
+// wsHeaderLength returns the length of the frame header, as far as it can be told from its first bytes
+func wsHeaderLength(header []byte) int {
+	if len(header) < 2 {
+		return 2
+	}
+
+	length := 2
+	switch header[1] & 0x7f {
+	case 126:
+		length += 2
+	case 127:
+		length += 8
+	}
+	if header[1]&0x80 != 0 {
+		length += 4
+	}
+	return length
+}
+
+// parseHeader reads the complete header of the frame of the direction
+func (d *wsDirection) parseHeader() error {
+	h := d.header
+	d.frame = wsFrame{
+		fromClient: d.fromClient,
+		opcode:     h[0] & 0x0f,
+		fin:        h[0]&0x80 != 0,
+		closeCode:  -1,
+	}
+	if _, ok := wsOpcodes[d.frame.opcode]; !ok {
+		return errWSFrame
+	}
+
+	switch h[1] & 0x7f {
+	case 126:
+		d.frame.length = uint64(binary.BigEndian.Uint16(h[2:]))
+	case 127:
+		d.frame.length = binary.BigEndian.Uint64(h[2:])
+	default:
+		d.frame.length = uint64(h[1] & 0x7f)
+	}
+
+	// The most significant bit of 64-bit lengths must be 0, and control frames are short and never fragmented
+	if d.frame.length>>63 != 0 || (d.frame.opcode >= wsClose && (d.frame.length > 125 || !d.frame.fin)) {
+		return errWSFrame
+	}
+
+	d.mask = d.mask[:0]
+	if h[1]&0x80 != 0 {
+		d.mask = append(d.mask, h[len(h)-4:]...)
+	}
+
+	d.inFrame = true
+	d.remaining = d.frame.length
+	d.code = d.code[:0]
+	return nil
+}
+
+// consume reads frames from the next bytes of the direction. Missing bytes, of segments truncated by capture,
+// can only be skipped inside payloads.
+func (c *wsConn) consume(d *wsDirection, data []byte, missing int) error {
+	for len(data) > 0 || missing > 0 {
+		if !d.inFrame {
+			if len(data) == 0 {
+				return errTCPGap
+			}
+			for len(data) > 0 && len(d.header) < wsHeaderLength(d.header) {
+				d.header = append(d.header, data[0])
+				data = data[1:]
+			}
+			if len(d.header) < wsHeaderLength(d.header) {
+				continue
+			}
+
+			err := d.parseHeader()
+			d.header = d.header[:0]
+			if err != nil {
+				return err
+			}
+		}
+
+		if d.remaining > 0 {
+			if len(data) > 0 {
+				n := d.remaining
+				if n > uint64(len(data)) {
+					n = uint64(len(data))
+				}
+
+				// The status code starts the payload of close frames
+				for i := uint64(0); i < n && d.frame.opcode == wsClose && len(d.code) < 2; i++ {
+					b := data[i]
+					if len(d.mask) > 0 {
+						b ^= d.mask[len(d.code)%4]
+					}
+					d.code = append(d.code, b)
+				}
+
+				data = data[n:]
+				d.remaining -= n
+			} else {
+				n := d.remaining
+				if n > uint64(missing) {
+					n = uint64(missing)
+				}
+				missing -= int(n)
+				d.remaining -= n
+			}
+		}
+
+		if d.remaining == 0 {
+			d.inFrame = false
+			if len(d.code) == 2 {
+				d.frame.closeCode = int(binary.BigEndian.Uint16(d.code))
+			}
+			c.frames = append(c.frames, d.frame)
+		}
+	}
+
+	return nil
+}
+
+// wsMessage holds the WebSocket frames decoded from a packet
+type wsMessage struct {
+	endpoint string    // Endpoint of the connection
+	opened   bool      // Whether it is the first packet seen on the connection
+	frames   []wsFrame // Frames completed by the packet
+}
+
+// websocketDissector handles WebSocket traffic, on connections that switched protocols from HTTP/1.1
+type websocketDissector struct {
+	conns map[string]*wsConn // Connections being decoded, only accessed while monitoring
+}
+
+// newWebSocketDissector returns a WebSocket dissector decoding no connection
+func newWebSocketDissector() *websocketDissector {
+	return &websocketDissector{
+		conns: make(map[string]*wsConn),
+	}
+}
+
+// Name returns the name of the dissector
+func (d *websocketDissector) Name() string {
+	return dataWebSocket
+}
+
+// Filter returns the BPF fragment for TCP traffic on configured HTTP ports, or any TCP traffic
+func (d *websocketDissector) Filter() string {
+	return buildNetworkFilter(config.packetFilter.ports)
+}
+
+// Match tells whether the packet belongs to a connection upgraded to WebSocket. The upgrade is only forgotten once
+// the closing packet is decoded, after the frames queued before it.
+func (d *websocketDissector) Match(packet gopacket.Packet) bool {
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return false
+	}
+	key, _, _ := connEndpoints(packet)
+
+	u, ok := upgrades.get(key)
+	if !ok || u.protocol != dataWebSocket {
+		return false
+	}
+	return len(tcp.LayerPayload()) > 0 || tcp.FIN || tcp.RST
+}
+
+// Decode reads the WebSocket frames of the packet
+func (d *websocketDissector) Decode(data *packetMsg) (interface{}, error) {
+	tcp, ok := data.rawPacket.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return nil, errors.New("no TCP layer in packet")
+	}
+	key, sender, _ := connEndpoints(data.rawPacket)
+
+	conn, ok := d.conns[key]
+	if !ok {
+		// The connection may have been closed or forgotten
+		u, upgraded := upgrades.get(key)
+		if !upgraded {
+			return &wsMessage{}, nil
+		}
+
+		// Don't grow indefinitely : start over when full, losing track of ongoing connections
+		if len(d.conns) >= defMaxFlows {
+			d.conns = make(map[string]*wsConn)
+		}
+		conn = newWSConn(u)
+		d.conns[key] = conn
+
+		// Frames may follow the response switching protocols in the same segment
+		if len(u.early) > 0 {
+			conn.read(key, conn.toClient, u.earlySeq, tcpSegment{data: u.early, length: len(u.early)})
+		}
+	}
+
+	if tcp.FIN || tcp.RST {
+		defer func() {
+			delete(d.conns, key)
+			upgrades.remove(key)
+		}()
+	}
+
+	m := &wsMessage{endpoint: conn.endpoint, opened: !conn.opened}
+	conn.opened = true
+
+	dir := conn.toClient
+	if sender == conn.client {
+		dir = conn.toServer
+	}
+	conn.read(key, dir, tcp.Seq, newTCPSegment(data.rawPacket, tcp))
+
+	m.frames = conn.frames
+	conn.frames = nil
+	return m, nil
+}
+
+// NewAnalysis returns an empty WebSocket analysis
+func (d *websocketDissector) NewAnalysis() protocolAnalysis {
+	return newWSAnalysis()
+}
+
+// wsEndpointStats holds statistics about the WebSocket connections to an endpoint
+type wsEndpointStats struct {
+	endpoint       string
+	connections    int            // Number of connections seen
+	clientMessages int            // Number of messages sent by clients
+	serverMessages int            // Number of messages sent by servers
+	bytes          uint64         // Bytes of frame payloads
+	opcodes        map[string]int // Number of frames per opcode
+	closes         map[string]int // Number of close frames per status code
+}
+
+// messages returns the number of messages exchanged with the endpoint
+func (s *wsEndpointStats) messages() int {
+	return s.clientMessages + s.serverMessages
+}
+
+// sortedWSEndpoints implements sort.Interface based on the messages, then bytes, of wsEndpointStats
+type sortedWSEndpoints []*wsEndpointStats
+
+func (e sortedWSEndpoints) Len() int { return len(e) }
+func (e sortedWSEndpoints) Less(i, j int) bool {
+	if e[i].messages() != e[j].messages() {
+		return e[i].messages() > e[j].messages()
+	}
+	return e[i].bytes > e[j].bytes
+}
+func (e sortedWSEndpoints) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+// wsAnalysis holds accumulated WebSocket data between two reports
+type wsAnalysis struct {
+	endpoints map[string]*wsEndpointStats
+}
+
+// newWSAnalysis returns a new and empty WebSocket analysis
+func newWSAnalysis() *wsAnalysis {
+	return &wsAnalysis{
+		endpoints: make(map[string]*wsEndpointStats),
+	}
+}
+
+// Add adds the frames of a packet to the analysis. WebSocket frames don't count as hits.
+func (a *wsAnalysis) Add(message interface{}) bool {
+	m, ok := message.(*wsMessage)
+	if !ok || (!m.opened && len(m.frames) == 0) {
+		return false
+	}
+
+	stats, ok := a.endpoints[m.endpoint]
+	if !ok {
+		stats = &wsEndpointStats{
+			endpoint: m.endpoint,
+			opcodes:  make(map[string]int),
+			closes:   make(map[string]int),
+		}
+		a.endpoints[m.endpoint] = stats
+	}
+
+	if m.opened {
+		stats.connections++
+	}
+
+	for _, f := range m.frames {
+		stats.opcodes[wsOpcodes[f.opcode]]++
+		stats.bytes += f.length
+
+		// Control frames are never fragmented, data messages end with their final frame
+		if f.fin && f.opcode < wsClose {
+			if f.fromClient {
+				stats.clientMessages++
+			} else {
+				stats.serverMessages++
+			}
+		}
+
+		if f.opcode == wsClose && f.closeCode >= 0 {
+			stats.closes[strconv.Itoa(f.closeCode)]++
+		}
+	}
+
+	return false
+}
+
+// Renew returns a new and empty analysis
+func (a *wsAnalysis) Renew() protocolAnalysis {
+	return newWSAnalysis()
+}
+
+// Report builds the WebSocket section of the report
+func (a *wsAnalysis) Report() protocolReport {
+	endpoints := make([]*wsEndpointStats, 0, len(a.endpoints))
+	for _, stats := range a.endpoints {
+		endpoints = append(endpoints, stats)
+	}
+	sort.Sort(sortedWSEndpoints(endpoints))
+
+	if len(endpoints) > config.packetFilter.nbSections {
+		endpoints = endpoints[:config.packetFilter.nbSections]
+	}
+
+	return &wsReport{topEndpoints: endpoints}
+}
+
+// wsReport holds the final result of a WebSocket analysis
+type wsReport struct {
+	topEndpoints []*wsEndpointStats // Endpoints with the most messages
+}
+
+// Empty tells whether no WebSocket traffic was seen
+func (r *wsReport) Empty() bool {
+	return len(r.topEndpoints) == 0
+}
+
+// Render returns the WebSocket section of the console display
+func (r *wsReport) Render() string {
+	var output string
+
+	output += reportWS + "\n"
+	for _, e := range r.topEndpoints {
+		output += fmt.Sprintf(reportWSEndpoint, e.endpoint, e.connections, e.clientMessages, e.serverMessages, e.bytes)
+		output += buildCountOutput(e.opcodes)
+		if len(e.closes) > 0 {
+			output += fmt.Sprintf(reportWSCloses, buildCountOutput(e.closes))
+		}
+		output += "\n"
+	}
+
+	return output
+}
@@ -0,0 +1,187 @@
+package gonetmon
+
+import (
+	"bytes"
+	"github.com/google/gopacket/layers"
+	"testing"
+	"time"
+)
+
+// wsFrameBytes returns a frame with its header, masking the payload with the key if there is one
+func wsFrameBytes(opcode byte, fin bool, key []byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	var maskBit byte
+	if len(key) == 4 {
+		maskBit = 0x80
+	}
+
+	frame := []byte{first}
+	l := len(payload)
+	switch {
+	case l < 126:
+		frame = append(frame, maskBit|byte(l))
+	case l <= 0xffff:
+		frame = u16(append(frame, maskBit|126), l)
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, byte(l>>24), byte(l>>16), byte(l>>8), byte(l))
+	}
+
+	if maskBit == 0 {
+		return append(frame, payload...)
+	}
+	frame = append(frame, key...)
+	for i, b := range payload {
+		frame = append(frame, b^key[i%4])
+	}
+	return frame
+}
+
+func TestWSFrames(t *testing.T) {
+	key := []byte{0x37, 0xfa, 0x21, 0x3d}
+
+	tests := []struct {
+		name      string
+		data      []byte
+		opcode    byte
+		length    uint64
+		closeCode int
+	}{
+		{"7-bit length", wsFrameBytes(wsText, true, nil, []byte("hello")), wsText, 5, -1},
+		{"16-bit length", wsFrameBytes(wsBinary, true, nil, make([]byte, 300)), wsBinary, 300, -1},
+		{"64-bit length", wsFrameBytes(wsBinary, true, nil, make([]byte, 70000)), wsBinary, 70000, -1},
+		{"masked 16-bit length", wsFrameBytes(wsText, true, key, bytes.Repeat([]byte("a"), 200)), wsText, 200, -1},
+		{"close code", wsFrameBytes(wsClose, true, nil, []byte{0x03, 0xe8, 'b', 'y', 'e'}), wsClose, 5, 1000},
+		{"masked close code", wsFrameBytes(wsClose, true, key, []byte{0x03, 0xe9}), wsClose, 2, 1001},
+		{"empty close", wsFrameBytes(wsClose, true, key, nil), wsClose, 0, -1},
+	}
+
+	// Headers split across segments, down to a byte per segment, decode the same
+	for _, tt := range tests {
+		for _, size := range []int{len(tt.data), 3, 1} {
+			c := newWSConn(upgrade{endpoint: "ws.test/chat", client: "client"})
+			for data := tt.data; len(data) > 0; {
+				n := size
+				if n > len(data) {
+					n = len(data)
+				}
+				if err := c.consume(c.toServer, data[:n], 0); err != nil {
+					t.Fatalf("%s in segments of %d bytes : %v", tt.name, size, err)
+				}
+				data = data[n:]
+			}
+
+			if len(c.frames) != 1 {
+				t.Fatalf("%s in segments of %d bytes : %d frames, want 1", tt.name, size, len(c.frames))
+			}
+			f := c.frames[0]
+			if f.opcode != tt.opcode || f.length != tt.length || f.closeCode != tt.closeCode || !f.fromClient || !f.fin {
+				t.Errorf("%s in segments of %d bytes : frame %+v, want opcode %d, length %d, close code %d",
+					tt.name, size, f, tt.opcode, tt.length, tt.closeCode)
+			}
+		}
+	}
+}
+
+func TestWSErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		missing int
+		err     error
+	}{
+		{"unknown opcode", []byte{0x83, 0}, 0, errWSFrame},
+		{"oversized 64-bit length", []byte{0x82, 127, 0x80, 0, 0, 0, 0, 0, 0, 0}, 0, errWSFrame},
+		{"long control frame", wsFrameBytes(wsPing, true, nil, make([]byte, 126)), 0, errWSFrame},
+		{"fragmented control frame", wsFrameBytes(wsPong, false, nil, nil), 0, errWSFrame},
+		{"bytes missing in payload", wsFrameBytes(wsBinary, true, nil, make([]byte, 300))[:100], 204, nil},
+		{"bytes missing in header", nil, 10, errTCPGap},
+	}
+
+	for _, tt := range tests {
+		c := newWSConn(upgrade{endpoint: "ws.test/chat", client: "client"})
+		if err := c.consume(c.toClient, tt.data, tt.missing); err != tt.err {
+			t.Errorf("%s : error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestWSFramesQueuedBeforeDecode(t *testing.T) {
+	const client = "192.168.1.20"
+	dissectors := config.packetFilter.dissectors
+	config.packetFilter.dissectors = []string{dataHTTP, dataWebSocket}
+	defer func() { config.packetFilter.dissectors = dissectors }()
+	enabled := []Dissector{newHTTPDissector(), newWebSocketDissector()}
+
+	key := []byte{0x37, 0xfa, 0x21, 0x3d}
+	request := []byte("GET /chat HTTP/1.1\r\nHost: " + testHost + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	response := append([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"),
+		wsFrameBytes(wsText, true, nil, []byte("welcome"))...)
+	clientFrame := wsFrameBytes(wsText, true, key, []byte("hello"))
+	serverFrame := wsFrameBytes(wsBinary, true, nil, make([]byte, 300))
+
+	segments := []struct {
+		fromClient bool
+		seq        uint32
+		payload    []byte
+		fin        bool
+	}{
+		{true, 1, request, false},
+		{false, 1, response, false},
+		{true, 1 + uint32(len(request)), clientFrame, false},
+		{false, 1 + uint32(len(response)), serverFrame, false},
+		{true, 1 + uint32(len(request)+len(clientFrame)), nil, true},
+	}
+
+	// All packets are captured and queued before monitoring decodes the first one, as for short connections
+	var queue []*packetMsg
+	var matched []Dissector
+	for _, s := range segments {
+		src, dst, srcPort, dstPort := client, testServer, layers.TCPPort(40000), layers.TCPPort(80)
+		if !s.fromClient {
+			src, dst, srcPort, dstPort = dst, src, dstPort, srcPort
+		}
+		packet, err := NewSyntheticTCPPacket(src, dst, &layers.TCP{SrcPort: srcPort, DstPort: dstPort, Seq: s.seq, ACK: true, PSH: !s.fin, FIN: s.fin}, s.payload, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		d := matchDissector(enabled, packet)
+		if d == nil {
+			t.Fatalf("segment %d not matched", len(queue))
+		}
+		queue = append(queue, &packetMsg{dataType: d.Name(), rawPacket: packet})
+		matched = append(matched, d)
+	}
+	conn, _, _ := connEndpoints(queue[0].rawPacket)
+	defer upgrades.remove(conn)
+
+	var frames []wsFrame
+	for i, p := range queue {
+		message, err := matched[i].Decode(p)
+		if err != nil {
+			t.Fatalf("segment %d : %v", i, err)
+		}
+		if m, ok := message.(*wsMessage); ok {
+			frames = append(frames, m.frames...)
+		}
+	}
+
+	want := []wsFrame{
+		{fromClient: false, opcode: wsText, fin: true, length: 7, closeCode: -1},
+		{fromClient: true, opcode: wsText, fin: true, length: 5, closeCode: -1},
+		{fromClient: false, opcode: wsBinary, fin: true, length: 300, closeCode: -1},
+	}
+	if len(frames) != len(want) {
+		t.Fatalf("got frames %+v, want %+v", frames, want)
+	}
+	for i := range want {
+		if frames[i] != want[i] {
+			t.Errorf("frame %d : got %+v, want %+v", i, frames[i], want[i])
+		}
+	}
+	if _, ok := upgrades.get(conn); ok {
+		t.Error("upgrade not forgotten once the connection closed")
+	}
+}